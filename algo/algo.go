@@ -0,0 +1,553 @@
+// Package algo works large parent orders as smaller child orders. Supports TWAP and VWAP over a window within
+// market hours, and iceberg orders with a displayed volume.
+package algo
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("algo")
+
+// Message type for progress, sent on the feed topic
+const AlgoMsgType = "algo_progress"
+
+// Strategies
+const (
+	TWAP    = "TWAP"
+	VWAP    = "VWAP"
+	Iceberg = "ICEBERG"
+)
+
+// States
+const (
+	StateRunning   = "RUNNING"
+	StateDone      = "DONE"      // All volume filled
+	StateExpired   = "EXPIRED"   // The window ended before all was filled
+	StateCancelled = "CANCELLED" //
+	StateFailed    = "FAILED"    // An order could not be placed
+)
+
+type ParentOrder struct {
+	Strategy      string  `json:"strategy"`
+	Accno         int64   `json:"accno"`
+	Identifier    string  `json:"identifier"`
+	MarketId      int64   `json:"market_id"`
+	Side          string  `json:"side"`
+	Volume        int64   `json:"volume"`
+	Price         float64 `json:"price"`                    // Limit price of all children
+	Start         int64   `json:"start,omitempty"`          // Millis. Default now. Clamped to market hours
+	End           int64   `json:"end,omitempty"`            // Millis. Default close
+	Slices        int     `json:"slices,omitempty"`         // TWAP and VWAP. Default one per 5 minutes
+	DisplayVolume int64   `json:"display_volume,omitempty"` // ICEBERG
+}
+
+func (po *ParentOrder) validate() error {
+	if po.Side != "BUY" && po.Side != "SELL" {
+		return fmt.Errorf("Side must be BUY or SELL, not '%s'", po.Side)
+	}
+	if po.Volume <= 0 || po.Price <= 0 || po.Identifier == "" || po.MarketId == 0 || po.Accno == 0 {
+		return fmt.Errorf("Need accno, identifier, market_id, price and volume")
+	}
+	switch po.Strategy {
+	case TWAP, VWAP:
+	case Iceberg:
+		if po.DisplayVolume <= 0 || po.DisplayVolume > po.Volume {
+			return fmt.Errorf("Iceberg needs a display volume between 1 and %d", po.Volume)
+		}
+	default:
+		return fmt.Errorf("Unknown strategy '%s'", po.Strategy)
+	}
+	return nil
+}
+
+// A child order sent to the market
+type Child struct {
+	OrderId int64 `json:"order_id"`
+	Volume  int64 `json:"volume"`
+	Filled  int64 `json:"filled"`
+	Active  bool  `json:"active"`
+	Created int64 `json:"created"`
+
+	deleting bool // Deleted by us, so the DELETED message is expected
+}
+
+// A running, or finished, algo
+type Algo struct {
+	Id       string      `json:"id"`
+	Parent   ParentOrder `json:"parent"`
+	State    string      `json:"state"`
+	Schedule Schedule    `json:"schedule,omitempty"`
+	Children []*Child    `json:"children"`
+	Filled   int64       `json:"filled"`
+	Due      int64       `json:"due"` // Volume that should be worked by now
+	Message  string      `json:"message,omitempty"`
+	Created  int64       `json:"created"`
+	Updated  int64       `json:"updated"`
+
+	stepping    bool // A step is placing or changing orders. Only one runs at a time.
+	again       bool // Another step was asked for while stepping
+	notifyAgain bool
+}
+
+func (a *Algo) active() *Child {
+	for _, c := range a.Children {
+		if c.Active {
+			return c
+		}
+	}
+	return nil
+}
+
+func (a *Algo) done() bool {
+	return a.State != StateRunning
+}
+
+func (a *Algo) copy() Algo {
+	res := *a
+	res.Children = nil
+	for _, c := range a.Children {
+		child := *c
+		res.Children = append(res.Children, &child)
+	}
+	return res
+}
+
+// A fill, or a delete when volume is 0, of an order we did not know, while children were being placed
+type orderEvent struct {
+	accno, orderId, volume int64
+}
+
+// Engine running the algos. Feed it merged messages from the FeedState, with Bind, or by calling OnMessage.
+// Call Tick periodically, or use Start.
+type AlgoEngine struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	algos   map[string]*Algo
+	cli     *api.ApiClient
+	clock   func() int64
+	publish feed.FeedClient
+	quit    chan bool
+
+	// The feed can report a fill before CreateOrder returns the order id, so events of unknown orders are kept
+	// while a child is being placed, and replayed when the id is known.
+	placing int
+	early   []orderEvent
+}
+
+func NewAlgoEngine(cli *api.ApiClient) *AlgoEngine {
+	ae := &AlgoEngine{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		algos:                   make(map[string]*Algo),
+		cli:                     cli,
+		clock:                   func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+		publish:                 func(*feedmodel.FeedMsg) {},
+	}
+	ae.init()
+	return ae
+}
+
+// Listen to the messages of the FeedState, and publish progress on its topic
+func (ae *AlgoEngine) Bind(fs *feed.FeedState) *AlgoEngine {
+	ae.SetPublisher(fs.Publish)
+	fs.AddListener(ae.OnMessage)
+	return ae
+}
+
+func (ae *AlgoEngine) SetPublisher(publish feed.FeedClient) *AlgoEngine {
+	ae.Lock()
+	defer ae.Unlock()
+	ae.publish = publish
+	return ae
+}
+
+// Override the clock. Mainly for tests and backtests.
+func (ae *AlgoEngine) SetClock(clock func() int64) *AlgoEngine {
+	ae.Lock()
+	defer ae.Unlock()
+	ae.clock = clock
+	return ae
+}
+
+// Call Tick every interval, until Stop
+func (ae *AlgoEngine) Start(interval time.Duration) *AlgoEngine {
+	ae.Lock()
+	defer ae.Unlock()
+	if ae.quit == nil {
+		ae.quit = make(chan bool)
+		go func(quit chan bool) {
+			for {
+				select {
+				case <-quit:
+					return
+				case <-time.After(interval):
+					ae.Tick()
+				}
+			}
+		}(ae.quit)
+	}
+	return ae
+}
+
+func (ae *AlgoEngine) Stop() {
+	ae.Lock()
+	defer ae.Unlock()
+	if ae.quit != nil {
+		close(ae.quit)
+		ae.quit = nil
+	}
+}
+
+// Create and start an algo. The first child is placed right away if something is due.
+func (ae *AlgoEngine) Create(parent ParentOrder) (res Algo, err error) {
+	if err = parent.validate(); err != nil {
+		return
+	}
+	ae.Lock()
+	now := ae.clock()
+	ae.Unlock()
+	if parent.Start < now {
+		parent.Start = now
+	}
+	algo := &Algo{Parent: parent, State: StateRunning, Created: now, Updated: now}
+	if parent.Strategy != Iceberg {
+		start, end, err := marketWindow(parent.Start, parent.End)
+		if err != nil {
+			return res, err
+		}
+		algo.Parent.Start, algo.Parent.End = start, end
+		if parent.Strategy == TWAP {
+			algo.Schedule = TWAPSchedule(start, end, parent.Volume, parent.Slices)
+		} else {
+			graphs, err := ae.cli.TradableDay(fmt.Sprintf("%d:%s", parent.MarketId, parent.Identifier))
+			if err != nil {
+				return res, fmt.Errorf("Unable to get volume profile: %v", err)
+			}
+			algo.Schedule = VWAPSchedule(start, end, parent.Volume, parent.Slices, graphs)
+		}
+	}
+
+	ae.Lock()
+	algo.Id = fmt.Sprintf("%d", rand.Uint32())
+	ae.algos[algo.Id] = algo
+	ae.Unlock()
+
+	ae.step(algo, true)
+	ae.Lock()
+	defer ae.Unlock()
+	return algo.copy(), nil
+}
+
+// Cancel an algo, and delete the active child
+func (ae *AlgoEngine) Cancel(id string) error {
+	ae.Lock()
+	algo, ok := ae.algos[id]
+	if !ok || algo.done() {
+		ae.Unlock()
+		return fmt.Errorf("Algo %s not found, or already done", id)
+	}
+	algo.State, algo.Message = StateCancelled, "Cancelled by user"
+	ae.Unlock()
+	ae.step(algo, true)
+	return nil
+}
+
+func (ae *AlgoEngine) Algos() (res []Algo) {
+	ae.Lock()
+	defer ae.Unlock()
+	for _, a := range ae.algos {
+		res = append(res, a.copy())
+	}
+	sort.Sort(byCreated(res))
+	return
+}
+
+type byCreated []Algo
+
+func (bc byCreated) Len() int           { return len(bc) }
+func (bc byCreated) Swap(i, j int)      { bc[i], bc[j] = bc[j], bc[i] }
+func (bc byCreated) Less(i, j int) bool { return bc[i].Created < bc[j].Created }
+
+// Work all running algos. Places, grows or deletes children as needed.
+func (ae *AlgoEngine) Tick() {
+	ae.Lock()
+	running := []*Algo{}
+	for _, a := range ae.algos {
+		if !a.done() {
+			running = append(running, a)
+		}
+	}
+	ae.Unlock()
+	for _, a := range running {
+		ae.step(a, false)
+	}
+}
+
+// Handle privtrade and order messages. Implements feed.FeedClient.
+func (ae *AlgoEngine) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	var accno, orderId, volume int64
+	switch msg.Type {
+	case "privtrade":
+		var trade feedmodel.FeedPrivateTradeData
+		if err := msg.DecodeData(&trade); err != nil {
+			return
+		}
+		accno, orderId, volume = trade.Accno, trade.OrderId, int64(trade.Volume)
+	case "order":
+		var order feedmodel.FeedOrderData
+		if err := msg.DecodeData(&order); err != nil || order.OrderState != "DELETED" {
+			return
+		}
+		accno, orderId = order.Accno, order.OrderId
+	default:
+		return
+	}
+
+	ae.Lock()
+	changed := ae.applyLocked(accno, orderId, volume)
+	if changed == nil && ae.placing > 0 {
+		ae.early = append(ae.early, orderEvent{accno: accno, orderId: orderId, volume: volume})
+	}
+	ae.Unlock()
+	if changed != nil {
+		ae.step(changed, true) // Iceberg places the next slice right away
+	}
+}
+
+// Apply a fill, or a delete when volume is 0, to the active child with the order id. Returns its algo, if any.
+// Caller must hold the lock.
+func (ae *AlgoEngine) applyLocked(accno, orderId, volume int64) (changed *Algo) {
+	for _, a := range ae.algos {
+		if a.Parent.Accno != accno {
+			continue
+		}
+		for _, c := range a.Children {
+			if c.OrderId == orderId && c.Active {
+				if volume > 0 {
+					c.Filled += volume
+					a.Filled += volume
+				}
+				if volume == 0 && !c.deleting && a.State == StateRunning {
+					// Deleted outside of the algo, by the user or the exchange. Placing it again could fight the user.
+					a.State = StateFailed
+					a.Message = fmt.Sprintf("Child order %d was deleted outside of the algo", c.OrderId)
+				}
+				if volume == 0 || c.Filled >= c.Volume {
+					c.Active = false
+				}
+				a.Updated = ae.clock()
+				changed = a
+			}
+		}
+	}
+	return
+}
+
+// Apply the events that arrived for an order before its id was known. Returns true if any did.
+// Caller must hold the lock.
+func (ae *AlgoEngine) replayLocked(accno, orderId int64) (applied bool) {
+	early := ae.early
+	ae.early = nil
+	for _, ev := range early {
+		if ev.accno != accno || ev.orderId != orderId {
+			ae.early = append(ae.early, ev)
+		} else if ae.applyLocked(ev.accno, ev.orderId, ev.volume) != nil {
+			applied = true
+		}
+	}
+	return
+}
+
+// Bring one algo in line with what is due. Publishes progress if anything changed, or if notify is set.
+// The ticker, the feed and the commands can all step the same algo, so if a step is running, it runs once more
+// when done, instead of both placing a child.
+func (ae *AlgoEngine) step(a *Algo, notify bool) {
+	ae.Lock()
+	if a.stepping {
+		a.again, a.notifyAgain = true, a.notifyAgain || notify
+		ae.Unlock()
+		return
+	}
+	a.stepping = true
+	ae.Unlock()
+	for {
+		ae.stepOnce(a, notify)
+		ae.Lock()
+		if !a.again {
+			a.stepping = false
+			ae.Unlock()
+			return
+		}
+		notify = a.notifyAgain
+		a.again, a.notifyAgain = false, false
+		ae.Unlock()
+	}
+}
+
+func (ae *AlgoEngine) stepOnce(a *Algo, notify bool) {
+	ae.Lock()
+	now := ae.clock()
+	p := a.Parent
+	child := a.active()
+	if a.State == StateRunning {
+		if a.Filled >= p.Volume {
+			a.State, notify = StateDone, true
+		} else if p.End > 0 && now >= p.End {
+			a.State, notify = StateExpired, true
+			a.Message = fmt.Sprintf("Window ended with %d of %d filled", a.Filled, p.Volume)
+		}
+	}
+
+	var want int64 // Open volume we want in the market
+	if a.State == StateRunning {
+		if p.Strategy == Iceberg {
+			a.Due = p.Volume
+			want = p.DisplayVolume
+			if rest := p.Volume - a.Filled; rest < want {
+				want = rest
+			}
+		} else {
+			a.Due = a.Schedule.DueAt(now)
+			want = a.Due - a.Filled
+		}
+	}
+	var open int64
+	if child != nil {
+		open = child.Volume - child.Filled
+		child.deleting = want <= 0
+	}
+	ae.Unlock()
+
+	var err error
+	switch {
+	case child != nil && want <= 0:
+		_, err = ae.cli.DeleteOrder(p.Accno, child.OrderId)
+		ae.Lock()
+		if err == nil {
+			child.Active = false
+		}
+		child.deleting = false
+		ae.Unlock()
+	case child != nil && p.Strategy != Iceberg && want > open:
+		// Behind schedule. Grow the child instead of placing another one.
+		volume := child.Filled + want
+		if _, err = ae.cli.UpdateOrder(p.Accno, child.OrderId, p.Price, volume); err == nil {
+			ae.Lock()
+			child.Volume = volume
+			ae.Unlock()
+		}
+	case child == nil && want > 0:
+		ae.Lock()
+		ae.placing++
+		ae.Unlock()
+		reply, err2 := ae.cli.CreateOrder(&api.AccountOrder{Accno: p.Accno, Identifier: p.Identifier, MarketId: p.MarketId,
+			Price: p.Price, Volume: want, Side: api.OrderSide(p.Side), OrderType: api.LIMIT, Reference: "algo:" + a.Id})
+		ae.Lock()
+		ae.placing--
+		if err = err2; err == nil {
+			a.Children = append(a.Children, &Child{OrderId: reply.OrderId, Volume: want, Active: true, Created: now})
+			if ae.replayLocked(p.Accno, reply.OrderId) {
+				a.again = true // Filled while we placed it, so step once more, like the feed would have
+			}
+		} else {
+			a.State = StateFailed
+		}
+		if ae.placing == 0 {
+			ae.early = nil // The rest are of orders that are not ours
+		}
+		ae.Unlock()
+	default:
+		if !notify {
+			return
+		}
+	}
+
+	ae.Lock()
+	if err != nil {
+		a.Message = err.Error()
+		logger.Warn("Algo failed", "id", a.Id, "err", err)
+	}
+	a.Updated = now
+	current := a.copy()
+	publish := ae.publish
+	ae.Unlock()
+	if msg, err := feedmodel.NewFeedMsgFromObject(AlgoMsgType, &current); err == nil {
+		publish(msg)
+	}
+}
+
+// ---------- Transport commands
+
+func parseParent(params api.Params) (po ParentOrder, err error) {
+	po = ParentOrder{Strategy: params["strategy"], Identifier: params["identifier"], Side: params["side"]}
+	for _, f := range []struct {
+		key string
+		dst interface{}
+	}{
+		{"accno", &po.Accno}, {"market_id", &po.MarketId}, {"volume", &po.Volume}, {"price", &po.Price},
+		{"start", &po.Start}, {"end", &po.End}, {"slices", &po.Slices}, {"display_volume", &po.DisplayVolume},
+	} {
+		if v := params[f.key]; v != "" {
+			if _, err = fmt.Sscan(v, f.dst); err != nil {
+				return po, fmt.Errorf("Bad %s '%s': %v", f.key, v, err)
+			}
+		}
+	}
+	return
+}
+
+func (ae *AlgoEngine) init() {
+	ae.AddCommand(string(api.AlgoCreateCmd)).Description("Work a parent order with an execution algo").
+		AddFullArgument("strategy", "Algo", []string{TWAP, VWAP, Iceberg}, false).
+		AddArgument("accno").AddArgument("identifier").AddArgument("market_id").AddArgument("volume").
+		AddFullArgument("side", "Buy or Sell", []string{"BUY", "SELL"}, false).
+		AddFullArgument("price", "Limit price for all child orders", []string{}, false).
+		AddFullArgument("start", "Start in millis. Default now", []string{}, true).
+		AddFullArgument("end", "End in millis. Default market close", []string{}, true).
+		AddFullArgument("slices", "Number of slices for TWAP and VWAP. Default one per 5 minutes", []string{}, true).
+		AddFullArgument("display_volume", "Displayed volume for ICEBERG", []string{}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			po, err := parseParent(params)
+			if err != nil {
+				return nil, err
+			}
+			algo, err := ae.Create(po)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(algo)
+		})
+
+	ae.AddCommand(string(api.AlgoListCmd)).Description("Progress of the algos").
+		AddFullArgument("id", "Only this algo", []string{}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			res := []Algo{}
+			for _, a := range ae.Algos() {
+				if params["id"] == "" || params["id"] == a.Id {
+					res = append(res, a)
+				}
+			}
+			return json.Marshal(res)
+		})
+
+	ae.AddCommand(string(api.AlgoCancelCmd)).Description("Cancel an algo, and delete its active child order").
+		AddArgument("id").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if err := ae.Cancel(params["id"]); err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]string{"id": params["id"], "state": StateCancelled})
+		})
+}
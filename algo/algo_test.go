@@ -0,0 +1,222 @@
+package algo_test
+
+import (
+	"github.com/Forau/yanngo/algo"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/swagger"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type fakeBroker struct {
+	api.RequestCommandTransport
+	calls  []string
+	orders int64
+
+	entered, gate chan bool // If set, CreateOrder signals entered, and waits for the gate
+}
+
+func newFakeBroker(intraday []swagger.IntradayGraph) *fakeBroker {
+	fb := &fakeBroker{RequestCommandTransport: make(api.RequestCommandTransport)}
+	fb.AddCommand(string(api.CreateOrderCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		if fb.gate != nil {
+			fb.entered <- true
+			<-fb.gate
+		}
+		fb.orders++
+		fb.calls = append(fb.calls, fmt.Sprintf("create %s %s", p["volume"], p["reference"][:5]))
+		return json.Marshal(map[string]interface{}{"order_id": fb.orders})
+	})
+	fb.AddCommand(string(api.UpdateOrderCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		fb.calls = append(fb.calls, fmt.Sprintf("update %s %s", p["order_id"], p["volume"]))
+		return json.Marshal(map[string]interface{}{})
+	})
+	fb.AddCommand(string(api.DeleteOrderCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		fb.calls = append(fb.calls, fmt.Sprintf("delete %s", p["order_id"]))
+		return json.Marshal(map[string]interface{}{})
+	})
+	fb.AddCommand(string(api.TradableIntradayCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		return json.Marshal(intraday)
+	})
+	return fb
+}
+
+func deleted(orderId int64) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject("order", &feedmodel.FeedOrderData{Accno: 1, OrderId: orderId, OrderState: "DELETED"})
+	return msg
+}
+
+func fill(orderId int64, volume float64) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject("privtrade", &feedmodel.FeedPrivateTradeData{Accno: 1, OrderId: orderId, Volume: volume})
+	return msg
+}
+
+func openOf(date string) int64 {
+	ot, _ := omxtime.NewOmxTimeDate(date)
+	return ot.OmxOpen
+}
+
+func TestTWAP(t *testing.T) {
+	open := openOf("2026-10-19")
+	now := open - omxtime.MinuteX10 // Before open, so the window starts at open
+	fb := newFakeBroker(nil)
+	ae := algo.NewAlgoEngine(api.NewApiClient(fb)).SetClock(func() int64 { return now })
+
+	a, err := ae.Create(algo.ParentOrder{Strategy: algo.TWAP, Accno: 1, Identifier: "101", MarketId: 11, Side: "BUY",
+		Volume: 1000, Price: 100, End: open + 4*omxtime.MinuteX15, Slices: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Parent.Start != open || len(a.Schedule) != 4 || a.Schedule[1].Time != open+omxtime.MinuteX15 || a.Schedule[3].Volume != 250 {
+		t.Fatalf("Unexpected schedule: %+v", a)
+	}
+	if len(fb.calls) != 0 {
+		t.Errorf("Expected nothing before open: %+v", fb.calls)
+	}
+
+	now = open
+	ae.Tick()
+	ae.OnMessage(fill(1, 100))
+	now = open + omxtime.MinuteX15
+	ae.Tick() // Behind with 150. Grow the child to 500
+	ae.OnMessage(fill(1, 400))
+	ae.Tick() // In line, nothing to do
+	now = open + 4*omxtime.MinuteX15
+	ae.Tick()
+
+	t.Logf("Calls: %+v", fb.calls)
+	if fmt.Sprint(fb.calls) != "[create 250 algo: update 1 500]" {
+		t.Errorf("Unexpected calls: %+v", fb.calls)
+	}
+	res := ae.Algos()
+	if len(res) != 1 || res[0].State != algo.StateExpired || res[0].Filled != 500 || res[0].Children[0].Active {
+		t.Errorf("Unexpected algo: %+v", res)
+	}
+}
+
+func TestVWAPSchedule(t *testing.T) {
+	open, prevOpen := openOf("2026-10-19"), openOf("2026-10-16")
+	fb := newFakeBroker([]swagger.IntradayGraph{{MarketId: 11, Identifier: "101", Ticks: []swagger.IntradayTick{
+		{Timestamp: prevOpen + omxtime.MinuteX5, Volume: 100},
+		{Timestamp: prevOpen + omxtime.MinuteX15, Volume: 200},
+		{Timestamp: prevOpen + omxtime.MinuteX15 + omxtime.MinuteX1, Volume: 100},
+		{Timestamp: prevOpen + omxtime.MinuteX10*5, Volume: 1000}, // Outside window
+	}}})
+	ae := algo.NewAlgoEngine(api.NewApiClient(fb)).SetClock(func() int64 { return open })
+
+	resp := ae.Preform(&api.Request{Command: api.AlgoCreateCmd, Args: api.Params{"strategy": algo.VWAP, "accno": "1",
+		"identifier": "101", "market_id": "11", "side": "SELL", "volume": "400", "price": "99.5",
+		"end": fmt.Sprint(open + 3*omxtime.MinuteX10), "slices": "3"}})
+	if resp.IsError() {
+		t.Fatal(resp.String())
+	}
+	var a algo.Algo
+	resp.Unmarshal(&a)
+	vols := []int64{}
+	for _, s := range a.Schedule {
+		vols = append(vols, s.Volume)
+	}
+	if fmt.Sprint(vols) != "[100 300 0]" || a.Due != 100 || fmt.Sprint(fb.calls) != "[create 100 algo:]" {
+		t.Errorf("Unexpected VWAP: %v, %+v, %+v", vols, a, fb.calls)
+	}
+}
+
+func TestIcebergAndCancel(t *testing.T) {
+	fb := newFakeBroker(nil)
+	ae := algo.NewAlgoEngine(api.NewApiClient(fb))
+	var progress []algo.Algo
+	ae.SetPublisher(func(msg *feedmodel.FeedMsg) {
+		var a algo.Algo
+		msg.DecodeData(&a)
+		progress = append(progress, a)
+	})
+
+	a, err := ae.Create(algo.ParentOrder{Strategy: algo.Iceberg, Accno: 1, Identifier: "101", MarketId: 11, Side: "BUY",
+		Volume: 250, Price: 100, DisplayVolume: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ae.OnMessage(fill(1, 100))
+	ae.OnMessage(fill(2, 60))
+	if resp := ae.Preform(&api.Request{Command: api.AlgoCancelCmd, Args: api.Params{"id": a.Id}}); resp.IsError() {
+		t.Fatal(resp.String())
+	}
+
+	t.Logf("Calls: %+v", fb.calls)
+	if fmt.Sprint(fb.calls) != "[create 100 algo: create 100 algo: delete 2]" {
+		t.Errorf("Unexpected calls: %+v", fb.calls)
+	}
+	last := progress[len(progress)-1]
+	if last.State != algo.StateCancelled || last.Filled != 160 {
+		t.Errorf("Unexpected progress: %+v", last)
+	}
+	if err = ae.Cancel(a.Id); err == nil {
+		t.Error("Expected error when cancelling twice")
+	}
+}
+
+func TestConcurrentStepsAndExternalDelete(t *testing.T) {
+	fb := newFakeBroker(nil)
+	ae := algo.NewAlgoEngine(api.NewApiClient(fb))
+	a, err := ae.Create(algo.ParentOrder{Strategy: algo.Iceberg, Accno: 1, Identifier: "101", MarketId: 11, Side: "BUY",
+		Volume: 250, Price: 100, DisplayVolume: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fill places the next slice. A tick while that is in flight must not place one more.
+	fb.entered, fb.gate = make(chan bool), make(chan bool)
+	done := make(chan bool)
+	go func() {
+		ae.OnMessage(fill(1, 100))
+		done <- true
+	}()
+	<-fb.entered
+	ae.Tick()
+	fb.gate <- true
+	<-done
+	fb.gate = nil
+	if fmt.Sprint(fb.calls) != "[create 100 algo: create 100 algo:]" {
+		t.Errorf("Expected one child per slice: %+v", fb.calls)
+	}
+
+	// The user deletes the child. The algo fails, instead of placing it again.
+	ae.OnMessage(deleted(2))
+	ae.Tick()
+	algos := ae.Algos()
+	if len(fb.calls) != 2 || len(algos) != 1 || algos[0].Id != a.Id || algos[0].State != algo.StateFailed {
+		t.Errorf("Expected the algo to fail after the external delete: %+v, %+v", fb.calls, algos)
+	}
+}
+
+// The paper broker publishes the fills of marketable children before CreateOrder returns
+func TestIcebergOnPaperBroker(t *testing.T) {
+	broker := paper.NewPaperBroker(1, "SEK", 100000)
+	ae := algo.NewAlgoEngine(api.NewApiClient(paper.NewPaperTransport(broker, nil)))
+	broker.SetPublisher(ae.OnMessage)
+	quote, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11,
+		Bid: 99, Bid_volume: 1000, Ask: 100, Ask_volume: 1000})
+	broker.OnMessage(quote)
+
+	a, err := ae.Create(algo.ParentOrder{Strategy: algo.Iceberg, Accno: 1, Identifier: "101", MarketId: 11, Side: "BUY",
+		Volume: 300, Price: 100, DisplayVolume: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.State != algo.StateDone || a.Filled != 300 || len(a.Children) != 3 {
+		t.Errorf("Expected all three slices filled: %+v", a)
+	}
+	for _, c := range a.Children {
+		if c.Active || c.Filled != 100 {
+			t.Errorf("Expected the child filled, and not active: %+v", *c)
+		}
+	}
+	if trades := broker.Trades(); len(trades) != 3 {
+		t.Errorf("Expected three trades: %+v", trades)
+	}
+}
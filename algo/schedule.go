@@ -0,0 +1,110 @@
+package algo
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/swagger"
+)
+
+// Default slice length for TWAP and VWAP, when number of slices is not given
+const DefaultSliceMillis = omxtime.MinuteX5
+
+// A part of the parent order that is due at Time
+type Slice struct {
+	Time   int64 `json:"time"`
+	Volume int64 `json:"volume"`
+}
+
+type Schedule []Slice
+
+// Cumulative volume that should be worked at the given time
+func (s Schedule) DueAt(millis int64) (due int64) {
+	for _, slice := range s {
+		if slice.Time <= millis {
+			due += slice.Volume
+		}
+	}
+	return
+}
+
+// Clamp the window to the market hours of the day it starts. End 0 means close.
+func marketWindow(start, end int64) (int64, int64, error) {
+	ot := omxtime.NewOmxTimeMillis(start)
+	if ot.OmxOpen < 0 {
+		return 0, 0, fmt.Errorf("%s is not a trading day", ot.Date)
+	}
+	if start < ot.OmxOpen {
+		start = ot.OmxOpen
+	}
+	if end <= 0 || end > ot.OmxClose {
+		end = ot.OmxClose
+	}
+	if start >= end {
+		return 0, 0, fmt.Errorf("Window %s - %s is outside market hours", omxtime.MillisToString(start), omxtime.MillisToString(end))
+	}
+	return start, end, nil
+}
+
+func numSlices(start, end int64, slices int) int {
+	if slices <= 0 {
+		slices = int((end - start) / DefaultSliceMillis)
+	}
+	if slices < 1 {
+		slices = 1
+	}
+	return slices
+}
+
+// Spread volume over the slices by weight. Rounds on the cumulative volume, so the sum is always volume.
+func distribute(start, end, volume int64, weights []float64) (res Schedule) {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	step := (end - start) / int64(len(weights))
+	var cumWeight float64
+	var cumVolume int64
+	for idx, w := range weights {
+		cumWeight += w
+		target := int64(float64(volume)*cumWeight/total + 0.5)
+		if idx == len(weights)-1 {
+			target = volume
+		}
+		res = append(res, Slice{Time: start + int64(idx)*step, Volume: target - cumVolume})
+		cumVolume = target
+	}
+	return
+}
+
+// Equal slices over the window
+func TWAPSchedule(start, end, volume int64, slices int) Schedule {
+	weights := make([]float64, numSlices(start, end, slices))
+	for idx := range weights {
+		weights[idx] = 1
+	}
+	return distribute(start, end, volume, weights)
+}
+
+// Slices weighted by the volume in the intraday graphs, at the same time of day. The graphs can be from any day.
+// Falls back to TWAP if there is no volume in the window.
+func VWAPSchedule(start, end, volume int64, slices int, graphs []swagger.IntradayGraph) Schedule {
+	n := numSlices(start, end, slices)
+	day := omxtime.NewOmxTimeMillis(start)
+	from, step := start-day.OmxOpen, (end-start)/int64(n)
+
+	weights := make([]float64, n)
+	var total float64
+	for _, graph := range graphs {
+		for _, tick := range graph.Ticks {
+			offset := tick.Timestamp - omxtime.NewOmxTimeMillis(tick.Timestamp).OmxOpen
+			if idx := (offset - from) / step; offset >= from && idx < int64(n) {
+				weights[idx] += float64(tick.Volume)
+				total += float64(tick.Volume)
+			}
+		}
+	}
+	if total == 0 {
+		return TWAPSchedule(start, end, volume, n)
+	}
+	return distribute(start, end, volume, weights)
+}
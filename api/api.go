@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"github.com/Forau/yanngo/nnutils"
 	"github.com/Forau/yanngo/swagger"
+	"github.com/Forau/yanngo/trace"
 
 	"fmt"
 	"strings"
@@ -39,6 +40,14 @@ func (rb *RequestBuilder) S(key, val string) *RequestBuilder {
 func (rb *RequestBuilder) I(key string, val int64) *RequestBuilder {
 	return rb.S(key, fmt.Sprintf("%d", val))
 }
+
+// Same as I, but not set if zero
+func (rb *RequestBuilder) OptI(key string, val int64) *RequestBuilder {
+	if val == 0 {
+		return rb
+	}
+	return rb.I(key, val)
+}
 func (rb *RequestBuilder) IA(key string, val []int64) *RequestBuilder {
 	valArr := []string{}
 	for _, v := range val {
@@ -65,7 +74,9 @@ func (rb *RequestBuilder) V(key string, val interface{}) *RequestBuilder {
 }
 
 type ApiClient struct {
-	ph TransportHandler
+	ph    TransportHandler
+	trace trace.SpanContext
+	login string
 }
 
 func NewApiClient(ph TransportHandler) *ApiClient {
@@ -73,10 +84,21 @@ func NewApiClient(ph TransportHandler) *ApiClient {
 }
 
 func (ac *ApiClient) build(command RequestCommand) *RequestBuilder {
-	return &RequestBuilder{
-		req: &Request{Command: command, Args: Params{}},
+	rb := &RequestBuilder{
+		req: &Request{Command: command, Args: Params{}, TraceId: ac.trace.TraceId, SpanId: ac.trace.SpanId},
 		ph:  ac.ph,
 	}
+	return rb.S("login", ac.login)
+}
+
+// A copy of the client, that sends its requests as part of the trace sc
+func (ac *ApiClient) Trace(sc trace.SpanContext) *ApiClient {
+	return &ApiClient{ph: ac.ph, trace: sc, login: ac.login}
+}
+
+// A copy of the client, that sends its requests to one of the logins of a daemon with several. Empty for the default.
+func (ac *ApiClient) Login(login string) *ApiClient {
+	return &ApiClient{ph: ac.ph, trace: ac.trace, login: login}
 }
 
 func (ac *ApiClient) GetTransport() TransportHandler {
@@ -140,7 +162,8 @@ func (ao AccountOrder) Apply(b *RequestBuilder) (ret *RequestBuilder) {
 		I("volume", ao.Volume).
 		S("side", string(ao.Side)).
 		S("currency", "SEK").
-		S("order_type", string(ao.OrderType))
+		S("order_type", string(ao.OrderType)).
+		S("reference", ao.Reference)
 
 	if ao.OrderType == STOP_LIMIT || ao.OrderType == STOP_TRAILING || ao.OrderType == OCO {
 		ret = ret.S("activation_condition", string(ao.ActivationCondition)).
@@ -187,8 +210,11 @@ func (ac *ApiClient) ActivateOrder(accno, id int64) (res swagger.OrderReply, err
 	err = ac.build(ActivateOrderCmd).I("accno", accno).I("order_id", id).Exec(&res)
 	return
 }
-func (ac *ApiClient) UpdateOrder(accno, id int64) (res swagger.OrderReply, err error) {
-	err = ac.build(UpdateOrderCmd).I("accno", accno).I("order_id", id).Exec(&res)
+
+// Volume is the new total volume of the order
+func (ac *ApiClient) UpdateOrder(accno, id int64, price float64, volume int64) (res swagger.OrderReply, err error) {
+	err = ac.build(UpdateOrderCmd).I("accno", accno).I("order_id", id).
+		Price("price", price).I("volume", volume).S("currency", "SEK").Exec(&res)
 	return
 }
 func (ac *ApiClient) DeleteOrder(accno, id int64) (res swagger.OrderReply, err error) {
@@ -216,26 +242,28 @@ func (ac *ApiClient) InstrumentSearch(query string) (res []swagger.Instrument, e
 	return
 }
 
-// The advanced instrument search will page, and return the results in a chan. Ignoring error for now
-func (ac *ApiClient) InstrumentSearchStream(query, types string, fuzzy bool) (ret chan swagger.Instrument) {
+// The advanced instrument search will page, and return the results in a chan.
+// The error chan gets one value, nil if all pages were fetched, when the result chan is closed.
+func (ac *ApiClient) InstrumentSearchStream(query, types string, fuzzy bool) (ret chan swagger.Instrument, errc chan error) {
 	ret = make(chan swagger.Instrument, 1)
-	//  err = make(chan error,1)
+	errc = make(chan error, 1)
 
 	go func(size, page int64) {
 		defer close(ret)
-		//    defer close(err)
+		defer close(errc)
 
 		for {
 			var r []swagger.Instrument
 			if e := ac.build(InstrumentSearchCmd).S("query", query).S("instrument_group_type", types).
 				I("limit", size).I("offset", page).V("fuzzy", fuzzy).Exec(&r); e != nil {
-				fmt.Printf("UNCAUGHT ERROR: %+v\n", e)
+				errc <- e
 				return
 			} else {
 				for _, instr := range r {
 					ret <- instr
 				}
 				if l := int64(len(r)); l < size {
+					errc <- nil
 					return
 				}
 				page += size
@@ -243,11 +271,11 @@ func (ac *ApiClient) InstrumentSearchStream(query, types string, fuzzy bool) (re
 
 		}
 	}(100, 0)
-	return ret
+	return
 }
 
 func (ac *ApiClient) Instruments(ids ...int64) (res []swagger.Instrument, err error) {
-	err = ac.build(InstrumentsCmd).IA("ids", ids).Exec(&res)
+	err = ac.build(InstrumentsCmd).IA("instruments", ids).Exec(&res)
 	return
 }
 
@@ -257,48 +285,54 @@ func (ac *ApiClient) InstrumentLeverages(id int64, instrument_type, instrument_g
 	return
 }
 
-/*
-func (ac *ApiClient) InstrumentLeverageFilters(pathMap{id int64})(res swagger.,err error) {
-  err = ac.build(InstrumentLeverageFiltersCmd). &)
-  return
+// The filters that can be used in InstrumentLeverages. Empty strings and zero issuer are not filtered on.
+func (ac *ApiClient) InstrumentLeverageFilters(id int64, expiration_date string, issuer_id int64,
+	market_view, instrument_type, instrument_group_type, currency string) (res swagger.LeverageFilter, err error) {
+	err = ac.build(InstrumentLeverageFiltersCmd).I("instrument", id).S("expiration_date", expiration_date).
+		OptI("issuer_id", issuer_id).S("market_view", market_view).S("instrument_type", instrument_type).
+		S("instrument_group_type", instrument_group_type).S("currency", currency).Exec(&res)
+	return
 }
-func (ac *ApiClient) InstrumentOptionPairs(pathMap{id int64})(res swagger.,err error) {
-  err = ac.build(InstrumentOptionPairsCmd). &)
-  return
+
+// Calls and puts of the underlying instrument, paired on strike price. Expiration date as 2006-01-02.
+func (ac *ApiClient) InstrumentOptionPairs(id int64, expiration_date, currency string) (res []swagger.OptionPair, err error) {
+	err = ac.build(InstrumentOptionPairsCmd).I("instrument", id).S("expiration_date", expiration_date).
+		S("currency", currency).Exec(&res)
+	return
 }
-func (ac *ApiClient) InstrumentOptionPairFilters(pathMap{id int64})(res swagger.,err error) {
-  err = ac.build(InstrumentOptionPairFiltersCmd). &)
-  return
+
+func (ac *ApiClient) InstrumentOptionPairFilters(id int64, expiration_date, currency string) (res swagger.OptionPairFilter, err error) {
+	err = ac.build(InstrumentOptionPairFiltersCmd).I("instrument", id).S("expiration_date", expiration_date).
+		S("currency", currency).Exec(&res)
+	return
 }
-*/
+
 // The lookup_type is isin_code_currency_market_id or market_id_identifier
 func (ac *ApiClient) InstrumentLookup(typ, instrument string) (res []swagger.Instrument, err error) {
 	err = ac.build(InstrumentLookupCmd).S("lookup", instrument).S("type", typ).Exec(&res)
 	return
 }
 
-/*
-func (ac *ApiClient) InstrumentSectors()(res swagger.,err error) {
-  err = ac.build(InstrumentSectorsCmd). &)
-  return
+// All sectors, or the ones in group if not empty
+func (ac *ApiClient) InstrumentSectors(group string) (res []swagger.Sector, err error) {
+	err = ac.build(InstrumentSectorsCmd).S("group", group).Exec(&res)
+	return
 }
-func (ac *ApiClient) InstrumentSector(pathMap{pathMap{"Sectors",fmtInt}})(res swagger.,err error) {
-  err = ac.build(InstrumentSectorCmd). &)
-  return
+func (ac *ApiClient) InstrumentSector(sectors ...string) (res []swagger.Sector, err error) {
+	err = ac.build(InstrumentSectorCmd).S("sectors", strings.Join(sectors, ",")).Exec(&res)
+	return
 }
-*/
 
 func (ac *ApiClient) InstrumentTypes() (res []swagger.InstrumentType, err error) {
 	err = ac.build(InstrumentTypesCmd).Exec(&res)
 	return
 }
 
-/*
-func (ac *ApiClient) InstrumentType(pathMap{pathMap{"Type",fmtInt}})(res swagger.,err error) {
-  err = ac.build(InstrumentTypeCmd). &)
-  return
+func (ac *ApiClient) InstrumentType(typ string) (res []swagger.InstrumentType, err error) {
+	err = ac.build(InstrumentTypeCmd).S("type", typ).Exec(&res)
+	return
 }
-*/
+
 func (ac *ApiClient) InstrumentUnderlyings(typ, currency string) (res []swagger.Instrument, err error) {
 	err = ac.build(InstrumentUnderlyingsCmd).S("type", typ).S("currency", currency).Exec(&res)
 	return
@@ -318,16 +352,18 @@ func (ac *ApiClient) Market(ids ...int64) (res []swagger.Market, err error) {
 	return
 }
 
-/*
-func (ac *ApiClient) SearchNews()(res swagger.,err error) {
-  err = ac.build(SearchNewsCmd). &)
-  return
+// Search news. Empty query, no sources and zero days, limit or offset are not filtered on.
+func (ac *ApiClient) SearchNews(query string, sources []int64, days, limit, offset int64) (res []swagger.NewsPreview, err error) {
+	err = ac.build(SearchNewsCmd).S("query", query).IA("source_id", sources).OptI("days", days).
+		OptI("limit", limit).OptI("offset", offset).Exec(&res)
+	return
 }
-func (ac *ApiClient) News(pathMap{ids []int64})(res swagger.,err error) {
-  err = ac.build(NewsCmd). &)
-  return
+
+func (ac *ApiClient) News(ids ...int64) (res []swagger.NewsItem, err error) {
+	err = ac.build(NewsCmd).IA("ids", ids).Exec(&res)
+	return
 }
-*/
+
 func (ac *ApiClient) NewsSources() (res []swagger.NewsSource, err error) {
 	err = ac.build(NewsSourcesCmd).Exec(&res)
 	return
@@ -380,7 +416,92 @@ func (ac *ApiClient) FeedStatus() (res map[string]interface{}, err error) {
 	return
 }
 
+// An alert rule for AlertCreate. Value is ignored for status rules, and text is ignored for the others.
+type AlertRule struct {
+	Kind       string
+	Identifier string
+	Market     string
+	Op         string
+	Value      float64
+	Text       string
+	Field      string // Default last for price, and status for status
+	Window     int64  // Minutes. Needed for volume
+	Repeat     bool   // Keep the alert after it triggers
+	Note       string
+}
+
+func (ar AlertRule) Apply(b *RequestBuilder) *RequestBuilder {
+	ret := b.S("kind", ar.Kind).S("id", ar.Identifier).S("market", ar.Market).S("op", ar.Op).
+		F("value", ar.Value).S("text", ar.Text).S("field", ar.Field).OptI("window", ar.Window).S("note", ar.Note)
+	if ar.Repeat {
+		ret = ret.S("repeat", "true")
+	}
+	return ret
+}
+
+func (ac *ApiClient) AlertCreate(rule *AlertRule) (res map[string]interface{}, err error) {
+	err = rule.Apply(ac.build(AlertCreateCmd)).Exec(&res)
+	return
+}
+
+func (ac *ApiClient) AlertList() (res []map[string]interface{}, err error) {
+	err = ac.build(AlertListCmd).Exec(&res)
+	return
+}
+
+func (ac *ApiClient) AlertDelete(alertId string) (res map[string]interface{}, err error) {
+	err = ac.build(AlertDeleteCmd).S("alert_id", alertId).Exec(&res)
+	return
+}
+
+// Intraday P&L of an account. Reload rebuilds it from the account trades and positions.
+func (ac *ApiClient) Portfolio(accno int64, reload bool) (res map[string]interface{}, err error) {
+	builder := ac.build(PortfolioCmd).I("accno", accno)
+	if reload {
+		builder.S("reload", "true")
+	}
+	err = builder.Exec(&res)
+	return
+}
+
+// Compare positions and orders from the private feed with the broker. Correct replaces the local state on mismatch.
+func (ac *ApiClient) Reconcile(correct bool) (res map[string]interface{}, err error) {
+	err = ac.build(ReconcileCmd).S("correct", fmt.Sprintf("%v", correct)).Exec(&res)
+	return
+}
+
 // Custom
 func (ac *ApiClient) CustomRequest(command string) (rb *RequestBuilder) {
 	return ac.build(RequestCommand(command))
 }
+
+// Status of the local reference data. Sync fetches it from the API first.
+func (ac *ApiClient) RefData(sync bool) (res map[string]interface{}, err error) {
+	err = ac.build(RefDataCmd).V("sync", sync).Exec(&res)
+	return
+}
+
+// Search the local reference data. Mode is exact, prefix or fuzzy. Limit 0 for all.
+func (ac *ApiClient) RefDataSearch(query, mode, types string, limit, offset int64) (res []swagger.Instrument, err error) {
+	err = ac.build(RefDataSearchCmd).S("query", query).S("mode", mode).S("instrument_group_type", types).
+		I("limit", limit).I("offset", offset).Exec(&res)
+	return
+}
+
+// Implied volatility, theoretical prices and greeks of the options of an underlying. Empty expiration for all.
+func (ac *ApiClient) OptionAnalytics(underlying int64, expiration string, reload bool) (res map[string]interface{}, err error) {
+	err = ac.build(OptionAnalyticsCmd).I("underlying", underlying).S("expiration", expiration).V("reload", reload).Exec(&res)
+	return
+}
+
+// Metrics of the daemon. Only the families starting with prefix, if set.
+func (ac *ApiClient) Metrics(prefix string) (res []map[string]interface{}, err error) {
+	err = ac.build(MetricsCmd).S("prefix", prefix).Exec(&res)
+	return
+}
+
+// Metrics of the daemon, in the Prometheus text format
+func (ac *ApiClient) MetricsText(prefix string) (res string, err error) {
+	err = ac.build(MetricsCmd).S("prefix", prefix).S("format", "text").Exec(&res)
+	return
+}
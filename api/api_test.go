@@ -22,3 +22,38 @@ func TestGetAccounts(t *testing.T) {
 		t.Error("Expected to get an account back")
 	}
 }
+
+func TestInstrumentSearchStream(t *testing.T) {
+	var transporth api.Transport = func(req *api.Request) (res api.Response) {
+		switch req.Args["offset"] {
+		case "0":
+			res.Success(make([]map[string]interface{}, 100))
+		case "100":
+			res.Success(make([]map[string]interface{}, 5))
+		default:
+			res.Fail(-1, "Too far")
+		}
+		return
+	}
+	cli := api.NewApiClient(transporth)
+
+	found, errc := cli.InstrumentSearchStream("a", "", false)
+	count := 0
+	for _ = range found {
+		count++
+	}
+	if err := <-errc; err != nil || count != 105 {
+		t.Errorf("Expected 105 instruments and no error, but got %d, %+v", count, err)
+	}
+
+	var transportErr api.Transport = func(req *api.Request) (res api.Response) {
+		res.Fail(-1, "Down")
+		return
+	}
+	found, errc = api.NewApiClient(transportErr).InstrumentSearchStream("a", "", false)
+	for _ = range found {
+	}
+	if err := <-errc; err == nil {
+		t.Error("Expected the error of the transport")
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/trace"
+	"time"
 )
 
+var logger = nnlog.For("api")
+
 type ErrorStatus int64
 
 type ErrorHolder struct {
@@ -91,6 +96,7 @@ const (
 	InstrumentSectorsCmd           RequestCommand = "InstrumentSectors"
 	InstrumentSectorCmd            RequestCommand = "InstrumentSector"
 	InstrumentTypesCmd             RequestCommand = "InstrumentTypes"
+	InstrumentTypeCmd              RequestCommand = "InstrumentType"
 	InstrumentUnderlyingsCmd       RequestCommand = "InstrumentUnderlyings"
 	ListsCmd                       RequestCommand = "Lists"
 	ListCmd                        RequestCommand = "List"
@@ -110,6 +116,30 @@ const (
 	FeedStatusCmd RequestCommand = "FeedStatus"
 
 	FeedLastCmd RequestCommand = "FeedLast"
+
+	AlertCreateCmd RequestCommand = "AlertCreate"
+	AlertListCmd   RequestCommand = "AlertList"
+	AlertDeleteCmd RequestCommand = "AlertDelete"
+
+	SyntheticOrderCreateCmd   RequestCommand = "SyntheticOrderCreate"
+	SyntheticBracketCreateCmd RequestCommand = "SyntheticBracketCreate"
+	SyntheticOrdersCmd        RequestCommand = "SyntheticOrders"
+	SyntheticOrderDeleteCmd   RequestCommand = "SyntheticOrderDelete"
+
+	AlgoCreateCmd RequestCommand = "AlgoCreate"
+	AlgoListCmd   RequestCommand = "AlgoList"
+	AlgoCancelCmd RequestCommand = "AlgoCancel"
+
+	PortfolioCmd RequestCommand = "Portfolio"
+
+	ReconcileCmd RequestCommand = "Reconcile"
+
+	RefDataCmd       RequestCommand = "RefData"
+	RefDataSearchCmd RequestCommand = "RefDataSearch"
+
+	OptionAnalyticsCmd RequestCommand = "OptionAnalytics"
+
+	MetricsCmd RequestCommand = "Metrics"
 )
 
 // Is used as return struct for TransportRespondsToCmd
@@ -119,6 +149,8 @@ type RequestCommandInfo struct {
 	Arguments  []RequestArgumentInfo                 `json:"args,omitempty"`
 	TimeToLive int64                                 `json:"ttl,omitempty"`
 	HandlerFn  func(Params) (json.RawMessage, error) `json:"-"` // If implemented, we can
+
+	RequestHandlerFn func(*Request) (json.RawMessage, error) `json:"-"` // Like HandlerFn, but with the trace of the request
 }
 
 // For builder pattern
@@ -144,6 +176,12 @@ func (rci *RequestCommandInfo) Handler(fun func(Params) (json.RawMessage, error)
 	return rci
 }
 
+// For builder pattern. Used instead of Handler, when the handler needs more than the arguments.
+func (rci *RequestCommandInfo) RequestHandler(fun func(*Request) (json.RawMessage, error)) *RequestCommandInfo {
+	rci.RequestHandlerFn = fun
+	return rci
+}
+
 // For builder pattern
 func (rci *RequestCommandInfo) AddArgument(name string) *RequestCommandInfo {
 	return rci.AddFullArgument(name, "", []string{}, false)
@@ -197,8 +235,14 @@ func (rct RequestCommandTransport) Preform(req *Request) (res Response) {
 		}
 		res.Success(arr)
 	} else if cmd, ok := rct[req.Command]; ok {
-		if cmd.HandlerFn != nil {
-			r, err := cmd.HandlerFn(req.Args)
+		if cmd.HandlerFn != nil || cmd.RequestHandlerFn != nil {
+			var r json.RawMessage
+			var err error
+			if cmd.RequestHandlerFn != nil {
+				r, err = cmd.RequestHandlerFn(req)
+			} else {
+				r, err = cmd.HandlerFn(req.Args)
+			}
 			if err != nil {
 				res.Fail(-16, err.Error())
 			} else {
@@ -243,6 +287,27 @@ func (p Params) SubParams(keys ...string) (res Params) {
 type Request struct {
 	Command RequestCommand `json:"cmd"`
 	Args    Params         `json:"args,omitempty"`
+
+	TraceId string `json:"trace_id,omitempty"` // Correlation id, the same for all hops of the request
+	SpanId  string `json:"span_id,omitempty"`  // The hop that sent the request
+
+	Auth string `json:"auth,omitempty"` // Api key or signed token of the client, when the daemon requires it
+}
+
+// The trace of the request, to give to the next hop
+func (req *Request) TraceContext() trace.SpanContext {
+	return trace.SpanContext{TraceId: req.TraceId, SpanId: req.SpanId}
+}
+
+// Start a span as a child of the request, and let the request carry it until done is called.
+func (req *Request) Span(name string, kind trace.Kind) (span *trace.Span, done func()) {
+	span = trace.Start(name, req.TraceContext(), kind)
+	parent := req.SpanId
+	req.TraceId, req.SpanId = span.TraceId, span.SpanId
+	return span, func() {
+		req.SpanId = parent
+		span.Finish()
+	}
 }
 
 func NewRequest(command RequestCommand, params map[string]string) (req *Request, err error) {
@@ -253,7 +318,7 @@ func NewRequest(command RequestCommand, params map[string]string) (req *Request,
 		}
 	}
 
-	fmt.Printf("Request %s -> %s\n", req.Command, req.Args)
+	logger.Debug("Request", "cmd", req.Command, "args", req.Args)
 	return
 }
 
@@ -288,9 +353,13 @@ func (tchf TransportCacheHandlerFn) Handle(rci RequestCommandInfo, th TransportH
 	return tchf(rci, th, r)
 }
 
+// Called after each routed request, with the time it took. Used for metrics.
+type RequestObserver func(req *Request, res *Response, elapsed time.Duration)
+
 type TransportRouter struct {
 	routed       map[RequestCommand]infoAwareTransportHandler
 	cacheHandler TransportCacheHandler
+	observers    []RequestObserver
 }
 
 func NewTransportRouter(transports ...TransportHandler) (tr *TransportRouter, err error) {
@@ -324,11 +393,17 @@ func (tr *TransportRouter) AddTransportHandler(th TransportHandler) (err error)
 			tr.routed[cmd.Command] = infoAwareTransportHandler{th, cmd}
 		}
 	} else {
-		fmt.Printf("\nError unmarshal response of (%s): %+v\n\n", res.String(), err)
+		logger.Error("Unable to route transport handler", "response", res.String(), "err", err)
 	}
 	return
 }
 
+// Observe all routed requests. Add observers before the router is used.
+func (tr *TransportRouter) AddObserver(obs RequestObserver) *TransportRouter {
+	tr.observers = append(tr.observers, obs)
+	return tr
+}
+
 func (tr TransportRouter) Preform(req *Request) (res Response) {
 	if req.Command == TransportRespondsToCmd {
 		resArgs := []RequestCommandInfo{}
@@ -340,7 +415,17 @@ func (tr TransportRouter) Preform(req *Request) (res Response) {
 	}
 
 	if iath, ok := tr.routed[req.Command]; ok {
-		return tr.cacheHandler.Handle(iath.RequestCommandInfo, iath.TransportHandler, req)
+		start := time.Now()
+		span, done := req.Span("route "+string(req.Command), trace.KindInternal)
+		res = tr.cacheHandler.Handle(iath.RequestCommandInfo, iath.TransportHandler, req)
+		if res.IsError() {
+			span.SetError(res.Error)
+		}
+		done()
+		for _, obs := range tr.observers {
+			obs(req, &res, time.Since(start))
+		}
+		return
 	}
 	cmds := []RequestCommand{}
 	for cmd, _ := range tr.routed {
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/Forau/yanngo/api"
+	"os"
+	"sync"
+	"time"
+)
+
+// One request, allowed or denied
+type AuditEntry struct {
+	Time    time.Time          `json:"time"`
+	Client  string             `json:"client,omitempty"` // Empty if not authenticated
+	Role    string             `json:"role,omitempty"`
+	Command api.RequestCommand `json:"cmd"`
+	Args    api.Params         `json:"args,omitempty"`
+	Allowed bool               `json:"allowed"`
+	Reason  string             `json:"reason,omitempty"` // Why it was denied
+	Error   string             `json:"error,omitempty"`  // Error of an allowed request
+	TraceId string             `json:"trace_id,omitempty"`
+}
+
+type Auditor interface {
+	Audit(entry AuditEntry)
+}
+
+type AuditorFn func(entry AuditEntry)
+
+func (af AuditorFn) Audit(entry AuditEntry) {
+	af(entry)
+}
+
+// Allowed requests on debug, and denied on warn
+var LogAuditor = AuditorFn(func(e AuditEntry) {
+	if e.Allowed {
+		logger.Debug("Request allowed", "client", e.Client, "role", e.Role, "cmd", e.Command, "trace_id", e.TraceId, "error", e.Error)
+	} else {
+		logger.Warn("Request denied", "client", e.Client, "role", e.Role, "cmd", e.Command, "trace_id", e.TraceId, "reason", e.Reason)
+	}
+})
+
+// Appends the entries as json lines
+type FileAuditor struct {
+	sync.Mutex
+	file *os.File
+}
+
+func NewFileAuditor(path string) (*FileAuditor, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditor{file: f}, nil
+}
+
+func (fa *FileAuditor) Audit(entry AuditEntry) {
+	b, err := json.Marshal(entry)
+	if err == nil {
+		fa.Lock()
+		_, err = fa.file.Write(append(b, '\n'))
+		fa.Unlock()
+	}
+	if err != nil {
+		logger.Error("Unable to write audit entry", "client", entry.Client, "cmd", entry.Command, "err", err)
+	}
+}
+
+func (fa *FileAuditor) Close() error {
+	fa.Lock()
+	defer fa.Unlock()
+	return fa.file.Close()
+}
+
+// Audit to all of the auditors
+func MultiAuditor(auditors ...Auditor) Auditor {
+	return AuditorFn(func(entry AuditEntry) {
+		for _, a := range auditors {
+			a.Audit(entry)
+		}
+	})
+}
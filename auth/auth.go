@@ -0,0 +1,386 @@
+// Package auth lets the daemon know who its clients are, and what they may do.
+//
+// Clients send an api key, or a token signed by the daemon secret, in Request.Auth. Each client has a role, that
+// allows a set of commands, and can be limited to some accounts. Every request, allowed or denied, is audited.
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/crypto"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("auth")
+
+var decisions = metrics.Default.Counter("yanngo_auth_requests_total", "Requests checked by the daemon, per result", "result")
+
+// Error statuses of the responses
+const (
+	UnauthenticatedStatus api.ErrorStatus = -401
+	ForbiddenStatus       api.ErrorStatus = -403
+)
+
+// The built in roles
+const (
+	ReadOnly = "read-only"
+	Trader   = "trader"
+	Admin    = "admin"
+)
+
+// Allows all commands, in Role.Commands
+const AnyCommand api.RequestCommand = "*"
+
+// Commands that only read. Session is not here, since it has the Nordnet session key.
+var ReadOnlyCommands = []api.RequestCommand{
+	api.AccountsCmd, api.AccountCmd, api.AccountLedgersCmd, api.AccountOrdersCmd, api.AccountPositionsCmd, api.AccountTradesCmd,
+	api.CountriesCmd, api.IndicatorsCmd, api.InstrumentsCmd, api.InstrumentSearchCmd, api.InstrumentLookupCmd,
+	api.InstrumentLeveragesCmd, api.InstrumentLeverageFiltersCmd, api.InstrumentOptionPairsCmd, api.InstrumentOptionPairFiltersCmd,
+	api.InstrumentSectorsCmd, api.InstrumentSectorCmd, api.InstrumentTypesCmd, api.InstrumentTypeCmd, api.InstrumentUnderlyingsCmd,
+	api.ListsCmd, api.ListCmd, api.MarketCmd, api.SearchNewsCmd, api.NewsCmd, api.NewsSourcesCmd, api.RealtimeAccessCmd,
+	api.TickSizesCmd, api.TickSizeCmd, api.TradableInfoCmd, api.TradableIntradayCmd, api.TradableTradesCmd,
+	api.FeedStatusCmd, api.FeedLastCmd, "FeedGetOrders", "FeedGetState",
+	api.AlertListCmd, api.SyntheticOrdersCmd, api.AlgoListCmd, api.PortfolioCmd,
+	api.RefDataCmd, api.RefDataSearchCmd, api.OptionAnalyticsCmd,
+}
+
+// Commands that place, change or cancel orders, or change what the daemon does for the client
+var TraderCommands = []api.RequestCommand{
+	api.CreateOrderCmd, api.ActivateOrderCmd, api.UpdateOrderCmd, api.DeleteOrderCmd,
+	api.FeedSubCmd, api.FeedUnsubCmd, api.AlertCreateCmd, api.AlertDeleteCmd,
+	api.SyntheticOrderCreateCmd, api.SyntheticBracketCreateCmd, api.SyntheticOrderDeleteCmd,
+	api.AlgoCreateCmd, api.AlgoCancelCmd,
+}
+
+// Commands on the id of something with an account, and the command that lists them with their account.
+// Clients with an account limit may only use them on ids of their accounts.
+var OwnedCommands = map[api.RequestCommand]api.RequestCommand{
+	api.AlgoCancelCmd:           api.AlgoListCmd,
+	api.SyntheticOrderDeleteCmd: api.SyntheticOrdersCmd,
+}
+
+// Commands whose results are filtered to the accounts of clients with an account limit
+var FilteredCommands = []api.RequestCommand{
+	api.AccountsCmd, "FeedGetOrders", "FeedGetState", api.AlgoListCmd, api.SyntheticOrdersCmd,
+}
+
+// Commands refused to clients with an account limit, since what they change belongs to no account, and so to all.
+// Alert rules have no account, so a limited client could create rules it can not delete. Both are refused.
+var UnlimitedCommands = []api.RequestCommand{api.AlertCreateCmd, api.AlertDeleteCmd}
+
+type Role struct {
+	Name     string               `json:"name"`
+	Commands []api.RequestCommand `json:"commands"`
+}
+
+// TransportRespondsTo is allowed for all roles, so clients can see what there is
+func (r *Role) Allows(cmd api.RequestCommand) bool {
+	if cmd == api.TransportRespondsToCmd {
+		return true
+	}
+	for _, c := range r.Commands {
+		if c == cmd || c == AnyCommand {
+			return true
+		}
+	}
+	return false
+}
+
+func DefaultRoles() []*Role {
+	return []*Role{
+		{Name: ReadOnly, Commands: append([]api.RequestCommand{}, ReadOnlyCommands...)},
+		{Name: Trader, Commands: append(append([]api.RequestCommand{}, ReadOnlyCommands...), TraderCommands...)},
+		{Name: Admin, Commands: []api.RequestCommand{AnyCommand}},
+	}
+}
+
+// A client of the daemon
+type Client struct {
+	Id       string  `json:"id"`
+	Role     string  `json:"role"`
+	Accounts []int64 `json:"accounts,omitempty"` // Only these accounts. Empty for all
+	KeyHash  string  `json:"key_hash,omitempty"` // crypto.HashApiKey of the api key. Empty if the client uses tokens
+}
+
+// The limit is checked on the accno argument, on the account of the id of OwnedCommands, and on the results of
+// FilteredCommands. UnlimitedCommands are refused.
+func (c *Client) AllowsAccount(accno int64) bool {
+	if len(c.Accounts) == 0 {
+		return true
+	}
+	for _, a := range c.Accounts {
+		if a == accno {
+			return true
+		}
+	}
+	return false
+}
+
+type Authorizer struct {
+	sync.RWMutex
+	roles   map[string]*Role
+	keys    map[string]*Client // On key hash
+	secret  []byte
+	auditor Auditor
+}
+
+// An authorizer with the default roles, no clients, and audit to the log
+func NewAuthorizer() *Authorizer {
+	a := &Authorizer{roles: make(map[string]*Role), keys: make(map[string]*Client), auditor: LogAuditor}
+	for _, r := range DefaultRoles() {
+		a.AddRole(r)
+	}
+	return a
+}
+
+// Add or replace a role
+func (a *Authorizer) AddRole(r *Role) *Authorizer {
+	a.Lock()
+	defer a.Unlock()
+	a.roles[r.Name] = r
+	return a
+}
+
+// Add a client with an api key
+func (a *Authorizer) AddClient(c *Client) *Authorizer {
+	a.Lock()
+	defer a.Unlock()
+	a.keys[strings.ToLower(c.KeyHash)] = c
+	return a
+}
+
+// The secret that tokens are signed with. Tokens are not accepted without one.
+func (a *Authorizer) TokenSecret(secret []byte) *Authorizer {
+	a.Lock()
+	defer a.Unlock()
+	a.secret = secret
+	return a
+}
+
+func (a *Authorizer) Audit(auditor Auditor) *Authorizer {
+	a.Lock()
+	defer a.Unlock()
+	a.auditor = auditor
+	return a
+}
+
+// Find the client of an api key or a signed token
+func (a *Authorizer) Authenticate(cred string) (*Client, error) {
+	if cred == "" {
+		return nil, fmt.Errorf("No credentials")
+	}
+	a.RLock()
+	defer a.RUnlock()
+	if strings.Contains(cred, ".") { // Api keys are base64url, and have no dots
+		claims, err := crypto.VerifyToken(a.secret, cred)
+		if err != nil {
+			return nil, err
+		}
+		return &Client{Id: claims.Subject, Role: claims.Role, Accounts: claims.Accounts}, nil
+	}
+	if c, ok := a.keys[crypto.HashApiKey(cred)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unknown api key")
+}
+
+// Check that the client may do the request
+func (a *Authorizer) Authorize(c *Client, req *api.Request) error {
+	a.RLock()
+	role, ok := a.roles[c.Role]
+	a.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unknown role '%s' of %s", c.Role, c.Id)
+	}
+	if !role.Allows(req.Command) {
+		return fmt.Errorf("%s is not allowed for role %s", req.Command, role.Name)
+	}
+	if len(c.Accounts) > 0 && hasCommand(UnlimitedCommands, req.Command) {
+		return fmt.Errorf("%s is not allowed for %s, that is limited to accounts %v", req.Command, c.Id, c.Accounts)
+	}
+	if s, ok := req.Args["accno"]; ok && len(c.Accounts) > 0 {
+		for _, part := range strings.Split(s, ",") {
+			accno, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil || !c.AllowsAccount(accno) {
+				return fmt.Errorf("Account %s is not allowed for %s", part, c.Id)
+			}
+		}
+	}
+	return nil
+}
+
+func hasCommand(cmds []api.RequestCommand, cmd api.RequestCommand) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// For OwnedCommands, check that the id belongs to an account of the client. The account is looked up with the list command of th.
+func (c *Client) authorizeOwner(th api.TransportHandler, req *api.Request) error {
+	list, ok := OwnedCommands[req.Command]
+	if !ok || len(c.Accounts) == 0 {
+		return nil
+	}
+	res := th.Preform(&api.Request{Command: list, Args: api.Params{}, TraceId: req.TraceId})
+	var elements []json.RawMessage
+	if res.IsError() {
+		return fmt.Errorf("Unable to find the account of %s: %s", req.Args["id"], res.Error.Message)
+	} else if err := json.Unmarshal(res.Payload, &elements); err != nil {
+		return fmt.Errorf("Unable to find the account of %s: %v", req.Args["id"], err)
+	}
+	for _, raw := range elements {
+		var o owned
+		if json.Unmarshal(raw, &o) == nil && o.Id == req.Args["id"] {
+			if accno, ok := o.accno(); ok && c.AllowsAccount(accno) {
+				return nil
+			}
+			break
+		}
+	}
+	return fmt.Errorf("%s %s is not on an account of %s", req.Command, req.Args["id"], c.Id)
+}
+
+func (a *Authorizer) audit(entry AuditEntry) {
+	a.RLock()
+	auditor := a.auditor
+	a.RUnlock()
+	if auditor != nil {
+		auditor.Audit(entry)
+	}
+}
+
+// Only let authenticated and authorized requests through to th. The credentials are removed from the request before it is passed on.
+func (a *Authorizer) Wrap(th api.TransportHandler) api.Transport {
+	return func(req *api.Request) (res api.Response) {
+		entry := AuditEntry{Time: time.Now(), Command: req.Command, Args: req.Args, TraceId: req.TraceId}
+		client, err := a.Authenticate(req.Auth)
+		req.Auth = ""
+		if err != nil {
+			decisions.With("unauthenticated").Inc()
+			entry.Reason = err.Error()
+			a.audit(entry)
+			res.Fail(UnauthenticatedStatus, "Unauthenticated: "+err.Error())
+			return
+		}
+		entry.Client, entry.Role = client.Id, client.Role
+		if err = a.Authorize(client, req); err == nil {
+			err = client.authorizeOwner(th, req)
+		}
+		if err != nil {
+			decisions.With("denied").Inc()
+			entry.Reason = err.Error()
+			a.audit(entry)
+			res.Fail(ForbiddenStatus, "Forbidden: "+err.Error())
+			return
+		}
+
+		decisions.With("allowed").Inc()
+		res = th.Preform(req)
+		if hasCommand(FilteredCommands, req.Command) && len(client.Accounts) > 0 && !res.IsError() {
+			res.Payload = filterAccounts(client, res.Payload)
+		}
+		entry.Allowed = true
+		if res.IsError() {
+			entry.Error = res.Error.Message
+		}
+		a.audit(entry)
+		return
+	}
+}
+
+// Where the elements of results have their account. In accno, or in that of the parent order of algos,
+// or of the data of FeedGetState.
+type owned struct {
+	Id     string      `json:"id"`
+	Accno  json.Number `json:"accno"`
+	Parent *owned      `json:"parent"`
+	Data   *owned      `json:"data"`
+}
+
+func (o *owned) accno() (int64, bool) {
+	if o.Accno != "" {
+		accno, err := o.Accno.Int64()
+		return accno, err == nil
+	} else if o.Parent != nil {
+		return o.Parent.accno()
+	} else if o.Data != nil {
+		return o.Data.accno()
+	}
+	return 0, false
+}
+
+// Only the elements of accounts the client may see. Elements without an account are removed, except the public
+// data of FeedGetState, like prices.
+func filterAccounts(c *Client, payload json.RawMessage) json.RawMessage {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(payload, &elements); err != nil {
+		logger.Warn("Unable to filter accounts", "client", c.Id, "err", err)
+		return json.RawMessage("[]")
+	}
+	res := []json.RawMessage{}
+	for _, raw := range elements {
+		var o owned
+		if err := json.Unmarshal(raw, &o); err != nil {
+			continue
+		}
+		if accno, ok := o.accno(); (ok && c.AllowsAccount(accno)) || (!ok && o.Data != nil && o.Data.Accno == "") {
+			res = append(res, raw)
+		}
+	}
+	b, _ := json.Marshal(res)
+	return b
+}
+
+// Sends the credentials with every request, for clients of a daemon that requires them
+func ClientTransport(cred string, th api.TransportHandler) api.Transport {
+	return func(req *api.Request) api.Response {
+		req.Auth = cred
+		return th.Preform(req)
+	}
+}
+
+// What the configuration file has
+type Config struct {
+	TokenSecret string    `json:"token_secret,omitempty"`
+	Roles       []*Role   `json:"roles,omitempty"` // Added to, or replacing, the default roles
+	Clients     []*Client `json:"clients"`
+}
+
+// Load an authorizer from a json Config
+func LoadConfig(path string) (*Authorizer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf Config
+	if err = json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	a := NewAuthorizer()
+	for _, r := range conf.Roles {
+		a.AddRole(r)
+	}
+	for _, c := range conf.Clients {
+		if _, ok := a.roles[c.Role]; !ok {
+			return nil, fmt.Errorf("Client %s has unknown role '%s'", c.Id, c.Role)
+		}
+		if c.KeyHash != "" {
+			a.AddClient(c)
+		}
+	}
+	if conf.TokenSecret != "" {
+		a.TokenSecret([]byte(conf.TokenSecret))
+	}
+	logger.Info("Loaded clients", "path", path, "clients", len(conf.Clients), "roles", len(a.roles))
+	return a, nil
+}
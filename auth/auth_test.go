@@ -0,0 +1,251 @@
+package auth_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/auth"
+	"github.com/Forau/yanngo/crypto"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type auditLog struct {
+	sync.Mutex
+	entries []auth.AuditEntry
+}
+
+func (al *auditLog) Audit(e auth.AuditEntry) {
+	al.Lock()
+	defer al.Unlock()
+	al.entries = append(al.entries, e)
+}
+
+func TestAuthorizer(t *testing.T) {
+	// The daemon side commands, that record what they got
+	var got []*api.Request
+	backend := make(api.RequestCommandTransport)
+	handler := func(req *api.Request) (json.RawMessage, error) {
+		got = append(got, req)
+		if req.Command == api.AccountsCmd {
+			return json.RawMessage(`[{"accno":123,"type":"ISK"},{"accno":456,"type":"KF"}]`), nil
+		}
+		if req.Args["accno"] == "789" {
+			return nil, fmt.Errorf("No such account")
+		}
+		return json.RawMessage("[]"), nil
+	}
+	for _, cmd := range []api.RequestCommand{api.AccountsCmd, api.AccountOrdersCmd, api.CreateOrderCmd, api.SessionCmd} {
+		backend.AddCommand(string(cmd)).AddOptArgument("accno").RequestHandler(handler)
+	}
+
+	readKey, _ := crypto.NewApiKey()
+	adminKey, _ := crypto.NewApiKey()
+	secret := []byte("secret")
+	dir := t.TempDir()
+	conf, _ := json.Marshal(auth.Config{TokenSecret: string(secret), Clients: []*auth.Client{
+		{Id: "viewer", Role: auth.ReadOnly, KeyHash: crypto.HashApiKey(readKey)},
+		{Id: "ops", Role: auth.Admin, KeyHash: crypto.HashApiKey(adminKey)},
+	}})
+	ioutil.WriteFile(filepath.Join(dir, "auth.json"), conf, 0600)
+	authorizer, err := auth.LoadConfig(filepath.Join(dir, "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := &auditLog{}
+	fileAudit, err := auth.NewFileAuditor(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer.Audit(auth.MultiAuditor(audit, fileAudit))
+	server := authorizer.Wrap(backend)
+
+	traderToken, _ := crypto.SignToken(secret, crypto.TokenClaims{Subject: "bot", Role: auth.Trader, Accounts: []int64{123}})
+	expired, _ := crypto.SignToken(secret, crypto.TokenClaims{Subject: "old", Role: auth.Admin, Expires: time.Now().Add(-time.Hour).Unix()})
+	forged, _ := crypto.SignToken([]byte("guess"), crypto.TokenClaims{Subject: "evil", Role: auth.Admin})
+	unknownRole, _ := crypto.SignToken(secret, crypto.TokenClaims{Subject: "odd", Role: "superuser"})
+
+	tests := []struct {
+		cred   string
+		cmd    api.RequestCommand
+		accno  string
+		status api.ErrorStatus
+	}{
+		{"", api.AccountOrdersCmd, "123", auth.UnauthenticatedStatus},
+		{"wrong", api.AccountOrdersCmd, "123", auth.UnauthenticatedStatus},
+		{expired, api.AccountOrdersCmd, "123", auth.UnauthenticatedStatus},
+		{forged, api.SessionCmd, "", auth.UnauthenticatedStatus},
+		{unknownRole, api.AccountOrdersCmd, "", auth.ForbiddenStatus},
+		{readKey, api.AccountOrdersCmd, "456", 0},
+		{readKey, api.CreateOrderCmd, "123", auth.ForbiddenStatus},
+		{readKey, api.SessionCmd, "", auth.ForbiddenStatus},
+		{readKey, api.TransportRespondsToCmd, "", 0},
+		{traderToken, api.CreateOrderCmd, "123", 0},
+		{traderToken, api.CreateOrderCmd, "456", auth.ForbiddenStatus},
+		{traderToken, api.CreateOrderCmd, "123,456", auth.ForbiddenStatus},
+		{traderToken, api.SessionCmd, "", auth.ForbiddenStatus},
+		{adminKey, api.SessionCmd, "", 0},
+		{adminKey, api.CreateOrderCmd, "456", 0},
+		{adminKey, api.AccountOrdersCmd, "789", -16},
+	}
+	for idx, test := range tests {
+		req := &api.Request{Command: test.cmd, Args: api.Params{}, Auth: test.cred}
+		if test.accno != "" {
+			req.Args["accno"] = test.accno
+		}
+		res := server(req)
+		if (test.status == 0 && res.IsError()) || (test.status != 0 && (!res.IsError() || res.Error.Status != test.status)) {
+			t.Errorf("%d: Expected status %d for %s %s, got %s", idx, test.status, test.cmd, test.accno, res.String())
+		}
+	}
+	for _, req := range got {
+		if req.Auth != "" {
+			t.Errorf("Expected the credentials to be removed: %+v", req)
+		}
+	}
+	if len(got) != 5 { // TransportRespondsTo is answered by the transport itself
+		t.Errorf("Expected 5 requests to reach the backend, got %d", len(got))
+	}
+
+	// The accounts are filtered for limited clients
+	cli := api.NewApiClient(auth.ClientTransport(traderToken, server))
+	accounts, err := cli.Accounts()
+	if err != nil || len(accounts) != 1 || accounts[0].Accno != 123 {
+		t.Errorf("Expected only account 123: %+v, %+v", accounts, err)
+	}
+	accounts, err = api.NewApiClient(auth.ClientTransport(adminKey, server)).Accounts()
+	if err != nil || len(accounts) != 2 {
+		t.Errorf("Expected all accounts: %+v, %+v", accounts, err)
+	}
+	if _, err = api.NewApiClient(auth.ClientTransport(traderToken, server)).AccountOrders(123); err != nil {
+		t.Error(err)
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+	if len(audit.entries) != len(tests)+3 {
+		t.Fatalf("Expected every request audited, got %d", len(audit.entries))
+	}
+	denied := audit.entries[6]
+	if denied.Allowed || denied.Client != "viewer" || denied.Role != auth.ReadOnly || denied.Command != api.CreateOrderCmd ||
+		!strings.Contains(denied.Reason, "not allowed") {
+		t.Errorf("Unexpected denied entry: %+v", denied)
+	}
+	if allowed := audit.entries[9]; !allowed.Allowed || allowed.Client != "bot" || allowed.Args["accno"] != "123" {
+		t.Errorf("Unexpected allowed entry: %+v", allowed)
+	}
+	if failed := audit.entries[15]; !failed.Allowed || failed.Client != "ops" || failed.Error != "No such account" {
+		t.Errorf("Unexpected failed entry: %+v", failed)
+	}
+	if unknown := audit.entries[1]; unknown.Allowed || unknown.Client != "" || unknown.Reason != "Unknown api key" {
+		t.Errorf("Unexpected unauthenticated entry: %+v", unknown)
+	}
+
+	fileAudit.Close()
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != len(audit.entries) ||
+		!strings.Contains(lines[6], `"client":"viewer"`) || strings.Contains(string(b), readKey) {
+		t.Errorf("Unexpected audit file:\n%s", b)
+	}
+}
+
+func TestAccountLimit(t *testing.T) {
+	backend := make(api.RequestCommandTransport)
+	var cancelled []string
+	lists := map[api.RequestCommand]string{
+		api.AlgoListCmd:        `[{"id":"a1","parent":{"accno":123}},{"id":"a2","parent":{"accno":456}}]`,
+		api.SyntheticOrdersCmd: `[{"id":"s1","accno":456},{"id":"s2","accno":123}]`,
+		"FeedGetOrders":        `[{"accno":123,"order_id":1},{"accno":456,"order_id":2}]`,
+		"FeedGetState":         `[{"type":"price","data":{"i":"101","m":11}},{"type":"trade","data":{"accno":456}}]`,
+	}
+	for cmd, payload := range lists {
+		payload := payload
+		backend.AddCommand(string(cmd)).Handler(func(api.Params) (json.RawMessage, error) {
+			return json.RawMessage(payload), nil
+		})
+	}
+	for _, cmd := range []api.RequestCommand{api.AlgoCancelCmd, api.SyntheticOrderDeleteCmd, api.AlertCreateCmd, api.AlertDeleteCmd} {
+		backend.AddCommand(string(cmd)).AddOptArgument("id").AddOptArgument("alert_id").Handler(func(params api.Params) (json.RawMessage, error) {
+			cancelled = append(cancelled, params["id"]+params["alert_id"])
+			return json.RawMessage("{}"), nil
+		})
+	}
+	secret := []byte("secret")
+	server := auth.NewAuthorizer().TokenSecret(secret).Audit(nil).Wrap(backend)
+	limited, _ := crypto.SignToken(secret, crypto.TokenClaims{Subject: "bot", Role: auth.Trader, Accounts: []int64{123}})
+	trader, _ := crypto.SignToken(secret, crypto.TokenClaims{Subject: "all", Role: auth.Trader})
+
+	call := func(cred string, cmd api.RequestCommand, args api.Params) api.Response {
+		return server(&api.Request{Command: cmd, Args: args, Auth: cred})
+	}
+	for cmd, expected := range map[api.RequestCommand]string{
+		api.AlgoListCmd:        `[{"id":"a1","parent":{"accno":123}}]`,
+		api.SyntheticOrdersCmd: `[{"id":"s2","accno":123}]`,
+		"FeedGetOrders":        `[{"accno":123,"order_id":1}]`,
+		"FeedGetState":         `[{"type":"price","data":{"i":"101","m":11}}]`,
+	} {
+		if res := call(limited, cmd, api.Params{}); res.IsError() || string(res.Payload) != expected {
+			t.Errorf("Expected %s filtered to %s, got %s", cmd, expected, res.String())
+		}
+		if res := call(trader, cmd, api.Params{}); res.IsError() || string(res.Payload) != lists[cmd] {
+			t.Errorf("Expected %s unfiltered, got %s", cmd, res.String())
+		}
+	}
+
+	tests := []struct {
+		cred   string
+		cmd    api.RequestCommand
+		args   api.Params
+		status api.ErrorStatus
+	}{
+		{limited, api.AlgoCancelCmd, api.Params{"id": "a1"}, 0},
+		{limited, api.AlgoCancelCmd, api.Params{"id": "a2"}, auth.ForbiddenStatus},
+		{limited, api.AlgoCancelCmd, api.Params{"id": "unknown"}, auth.ForbiddenStatus},
+		{limited, api.SyntheticOrderDeleteCmd, api.Params{"id": "s1"}, auth.ForbiddenStatus},
+		{limited, api.SyntheticOrderDeleteCmd, api.Params{"id": "s2"}, 0},
+		{limited, api.AlertCreateCmd, api.Params{"id": "c"}, auth.ForbiddenStatus},
+		{limited, api.AlertDeleteCmd, api.Params{"alert_id": "x"}, auth.ForbiddenStatus},
+		{trader, api.AlgoCancelCmd, api.Params{"id": "a2"}, 0},
+		{trader, api.AlertDeleteCmd, api.Params{"alert_id": "x"}, 0},
+	}
+	for idx, test := range tests {
+		res := call(test.cred, test.cmd, test.args)
+		if (test.status == 0 && res.IsError()) || (test.status != 0 && (!res.IsError() || res.Error.Status != test.status)) {
+			t.Errorf("%d: Expected status %d for %s %v, got %s", idx, test.status, test.cmd, test.args, res.String())
+		}
+	}
+	if strings.Join(cancelled, ",") != "a1,s2,a2,x" {
+		t.Errorf("Expected only the allowed cancels to reach the backend: %v", cancelled)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.json")
+	ioutil.WriteFile(path, []byte(`{"roles":[{"name":"quotes","commands":["Market"]}],
+		"clients":[{"id":"q","role":"quotes","key_hash":"`+crypto.HashApiKey("qkey")+`"}]}`), 0600)
+	authorizer, err := auth.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := authorizer.Authenticate("qkey")
+	if err != nil || c.Id != "q" {
+		t.Fatalf("Unexpected client %+v: %+v", c, err)
+	}
+	if authorizer.Authorize(c, &api.Request{Command: api.MarketCmd}) != nil || authorizer.Authorize(c, &api.Request{Command: api.AccountsCmd}) == nil {
+		t.Error("Expected only Market for the custom role")
+	}
+	if _, err := authorizer.Authenticate("a.b"); err == nil {
+		t.Error("Expected tokens to fail without a secret")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"clients":[{"id":"x","role":"nobody","key_hash":"00"}]}`), 0600)
+	if _, err := auth.LoadConfig(path); err == nil || !strings.Contains(err.Error(), "nobody") {
+		t.Errorf("Expected an unknown role error: %+v", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Package backtest replays recorded feed messages into a strategy, and simulates the fills with a paper broker.
+// Feed it the output of nsq_tail on the feed topic, one message per line.
+package backtest
+
+import (
+	"bufio"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/transports/paper"
+	"io"
+)
+
+// Account number of the simulated account
+const Accno = 1
+
+// Default for how long to hold messages back, to get them in time order
+const DefaultSortDelay = 5000
+
+// The hooks a strategy implements. Orders are placed with bt.Broker().
+type Strategy interface {
+	OnFeed(bt *Backtest, msg *feedmodel.FeedMsg)       // Market data, in time order
+	OnOrderEvent(bt *Backtest, msg *feedmodel.FeedMsg) // 'order' and 'privtrade' messages from the broker
+}
+
+type EquityPoint struct {
+	Time   int64   `json:"time"`
+	Equity float64 `json:"equity"`
+}
+
+type Backtest struct {
+	strategy   Strategy
+	broker     *paper.PaperBroker
+	cash       float64
+	commission paper.CommissionFn
+	sortDelay  int64
+	sampling   int64
+
+	now       int64
+	start     int64
+	curve     []EquityPoint
+	pending   []*feedmodel.FeedMsg // Broker events not yet delivered
+	inHook    bool
+	sorted    feed.FeedClient
+	processed int64
+}
+
+func NewBacktest(strategy Strategy, cash float64) *Backtest {
+	bt := &Backtest{
+		strategy:   strategy,
+		cash:       cash,
+		commission: func(float64) float64 { return 0 },
+		sortDelay:  DefaultSortDelay,
+		sampling:   omxtime.MinuteX1,
+	}
+	bt.broker = paper.NewPaperBroker(Accno, "SEK", cash).
+		SetClock(func() int64 { return bt.now }).
+		SetPublisher(bt.onBrokerEvent)
+	return bt
+}
+
+// Millis from an order is placed, until it can be filled
+func (bt *Backtest) SetLatency(millis int64) *Backtest {
+	bt.broker.SetLatency(millis)
+	return bt
+}
+
+// Ticks worse than the book, for each fill
+func (bt *Backtest) SetSlippage(ticks int64) *Backtest {
+	bt.broker.SetSlippage(ticks)
+	return bt
+}
+
+func (bt *Backtest) SetCommission(fn paper.CommissionFn) *Backtest {
+	bt.commission = fn
+	bt.broker.SetCommission(fn)
+	return bt
+}
+
+// Millis to hold messages back while sorting them on time. Must be set before the first message.
+func (bt *Backtest) SetSortDelay(millis int64) *Backtest {
+	bt.sortDelay = millis
+	return bt
+}
+
+// Millis between the points on the equity curve
+func (bt *Backtest) SetSampling(millis int64) *Backtest {
+	bt.sampling = millis
+	return bt
+}
+
+// The simulated account. Use Accno as account number.
+func (bt *Backtest) Broker() *paper.PaperBroker {
+	return bt.broker
+}
+
+// Time of the message being replayed, in millis
+func (bt *Backtest) Now() int64 {
+	return bt.now
+}
+
+// The feed client to send messages to. Messages are sorted on time, so send a nil when done to flush.
+// Not thread safe.
+func (bt *Backtest) Client() feed.FeedClient {
+	if bt.sorted == nil {
+		bt.sorted = feed.FeedSorterDelayedIfNotSeqId(bt.sortDelay, bt.replay)
+	}
+	return bt.sorted
+}
+
+// Replay all messages from the reader, one json message per line, and return the report.
+func (bt *Backtest) Run(r io.Reader) (*Report, error) {
+	fc := bt.Client()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		fc.Handle("backtest", line) // Bad lines are logged and skipped
+	}
+	fc(nil)
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return bt.Report(), nil
+}
+
+type timestamps struct {
+	Tick_timestamp  int64
+	Trade_timestamp int64
+	Timestamp       int64
+}
+
+// Called in time order by the sorter
+func (bt *Backtest) replay(msg *feedmodel.FeedMsg) {
+	if msg.Type == "order" || msg.Type == "privtrade" {
+		return // Recorded from a real account, so not ours
+	}
+	var ts timestamps
+	msg.DecodeData(&ts)
+	t := ts.Tick_timestamp
+	if t == 0 {
+		t = ts.Trade_timestamp
+	}
+	if t == 0 {
+		t = ts.Timestamp
+	}
+	if t > bt.now {
+		bt.sample(t)
+		bt.now = t
+	}
+	if bt.start == 0 {
+		bt.start = bt.now
+	}
+	bt.processed++
+
+	bt.inHook = true
+	bt.broker.OnMessage(msg) // Resting orders trade on the new prices, before the strategy sees them
+	bt.broker.Match()        // And orders that passed their latency
+	bt.strategy.OnFeed(bt, msg)
+	bt.inHook = false
+	bt.deliver()
+}
+
+// Add points for the sample periods we passed, valued at the prices we had
+func (bt *Backtest) sample(next int64) {
+	if bt.now == 0 || bt.sampling <= 0 {
+		return
+	}
+	if len(bt.curve) == 0 {
+		bt.curve = append(bt.curve, EquityPoint{bt.now, bt.broker.Equity()})
+	}
+	last := bt.curve[len(bt.curve)-1].Time
+	if next-last >= bt.sampling {
+		bt.curve = append(bt.curve, EquityPoint{next - (next-last)%bt.sampling, bt.broker.Equity()})
+	}
+}
+
+// Events are queued, so the strategy is never called from within its own hook
+func (bt *Backtest) onBrokerEvent(msg *feedmodel.FeedMsg) {
+	bt.pending = append(bt.pending, msg)
+	if !bt.inHook {
+		bt.deliver()
+	}
+}
+
+func (bt *Backtest) deliver() {
+	for len(bt.pending) > 0 && !bt.inHook {
+		msg := bt.pending[0]
+		bt.pending = bt.pending[1:]
+		bt.inHook = true
+		bt.strategy.OnOrderEvent(bt, msg)
+		bt.inHook = false
+	}
+}
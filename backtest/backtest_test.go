@@ -0,0 +1,146 @@
+package backtest_test
+
+import (
+	"github.com/Forau/yanngo/backtest"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Buys on the first price, and sells when the bid reaches the target
+type targetStrategy struct {
+	target   float64
+	ordered  bool
+	position float64
+	seen     []int64
+	events   []string
+}
+
+func (ts *targetStrategy) OnFeed(bt *backtest.Backtest, msg *feedmodel.FeedMsg) {
+	var price feedmodel.FeedPriceData
+	if msg.Type != "price" || msg.DecodeData(&price) != nil {
+		return
+	}
+	ts.seen = append(ts.seen, bt.Now())
+	if !ts.ordered {
+		ts.ordered = true
+		bt.Broker().CreateOrder(backtest.Accno, price.Identifier, price.Market, "BUY", price.Ask, 100, "", "")
+		if len(ts.events) != 0 {
+			panic("Order event delivered from within OnFeed")
+		}
+	} else if ts.position > 0 && price.Bid >= ts.target {
+		bt.Broker().CreateOrder(backtest.Accno, price.Identifier, price.Market, "SELL", price.Bid, ts.position, "", "")
+	}
+}
+
+func (ts *targetStrategy) OnOrderEvent(bt *backtest.Backtest, msg *feedmodel.FeedMsg) {
+	ts.events = append(ts.events, msg.Type)
+	var trade feedmodel.FeedPrivateTradeData
+	if msg.Type == "privtrade" && msg.DecodeData(&trade) == nil {
+		if trade.Side == "BUY" {
+			ts.position += trade.Volume
+		} else {
+			ts.position -= trade.Volume
+		}
+	}
+}
+
+const recorded = `{"type":"price","data":{"i":"101","m":11,"tick_timestamp":3000,"bid":99,"ask":100}}
+{"type":"price","data":{"i":"101","m":11,"tick_timestamp":1000,"bid":99,"ask":100}}
+{"type":"privtrade","data":{"order_id":77,"side":"BUY","volume":1000}}
+{"type":"price","data":{"i":"101","m":11,"tick_timestamp":61000,"bid":104,"ask":105}}
+
+not json
+{"type":"price","data":{"i":"101","m":11,"tick_timestamp":121000,"bid":101,"ask":102}}
+`
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.001
+}
+
+func TestBacktest(t *testing.T) {
+	strategy := &targetStrategy{target: 104}
+	report, err := backtest.NewBacktest(strategy, 100000).SetCommission(paper.PercentCommission(0.1, 1)).
+		Run(strings.NewReader(recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Report: %s", report)
+
+	if len(strategy.seen) != 4 || strategy.seen[0] != 1000 || strategy.seen[1] != 3000 {
+		t.Errorf("Expected prices in time order, but got %v", strategy.seen)
+	}
+	if strings.Join(strategy.events, ",") != "order,privtrade,order,order,privtrade,order" {
+		t.Errorf("Unexpected order events: %v", strategy.events)
+	}
+	if report.Start != 1000 || report.End != 121000 || report.Messages != 4 || len(report.Trades) != 2 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if !near(report.EndEquity, 100379.6) || !near(report.Commission, 20.4) || !near(report.Return, 0.003796) {
+		t.Errorf("Unexpected result: %s", report)
+	}
+	if !near(report.MaxDrawdownValue, 60) || !near(report.MaxDrawdown, 0.0006) || report.Sharpe <= 0 {
+		t.Errorf("Unexpected risk: %s", report)
+	}
+	if len(report.Curve) != 3 || report.Curve[1].Time != 61000 || !near(report.Curve[1].Equity, 99940) {
+		t.Errorf("Unexpected equity curve: %+v", report.Curve)
+	}
+	if len(report.Instruments) != 1 {
+		t.Fatalf("Expected one instrument: %+v", report.Instruments)
+	}
+	if pnl := report.Instruments[0]; pnl.Identifier != "101" || pnl.Trades != 2 || pnl.Position != 0 ||
+		!near(pnl.Realized, 400) || !near(pnl.Total, 379.6) {
+		t.Errorf("Unexpected instrument P&L: %+v", pnl)
+	}
+}
+
+func TestBacktestLatencyAndSlippage(t *testing.T) {
+	strategy := &targetStrategy{target: 104}
+	report, _ := backtest.NewBacktest(strategy, 100000).SetLatency(60000).SetSlippage(1).
+		Run(strings.NewReader(recorded))
+
+	// The buy reaches the market at 61000, when the ask is above its limit. It never fills.
+	if len(report.Trades) != 0 || report.EndEquity != 100000 || strategy.position != 0 {
+		t.Errorf("Expected no trades with latency: %+v", report)
+	}
+
+	strategy = &targetStrategy{target: 104}
+	report, _ = backtest.NewBacktest(strategy, 100000).SetSlippage(1).Run(strings.NewReader(recorded))
+	if len(report.Trades) != 2 || report.Trades[0].Price.Value != 100.25 || report.Trades[1].Price.Value != 103.75 {
+		t.Errorf("Expected one tick slippage on both trades: %+v", report.Trades)
+	}
+}
+
+func TestSharpeWithGaps(t *testing.T) {
+	friday, _ := omxtime.NewOmxTimeDate("2026-10-16")
+	monday := friday.NextTradingDay()
+	run := func(times ...int64) *backtest.Report {
+		var lines []string
+		for idx, mid := range []float64{100, 101, 100.5, 102, 101.5, 103} {
+			lines = append(lines, fmt.Sprintf(`{"type":"price","data":{"i":"101","m":11,"tick_timestamp":%d,"bid":%v,"ask":%v}}`,
+				times[idx], mid-0.5, mid+0.5))
+		}
+		report, err := backtest.NewBacktest(&targetStrategy{target: 1000}, 100000).Run(strings.NewReader(strings.Join(lines, "\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	m := int64(omxtime.MinuteX1)
+	open, end := friday.OmxOpen, friday.OmxClose
+	steady := run(open, open+m, open+2*m, open+3*m, open+4*m, open+5*m)
+	gap := run(open, open+m, open+2*m, open+3*m, open+4*m, open+64*m)
+	weekend := run(end-5*m, end-4*m, end-3*m, end-2*m, end-m, monday.OmxOpen)
+	t.Logf("Sharpe steady %v, with a gap %v, over the weekend %v", steady.Sharpe, gap.Sharpe, weekend.Sharpe)
+	if steady.Sharpe <= 0 || gap.Sharpe >= steady.Sharpe/2 {
+		t.Errorf("Expected the same moves over an hour more to give a lower Sharpe: %v, %v", steady.Sharpe, gap.Sharpe)
+	}
+	if weekend.Sharpe <= gap.Sharpe {
+		t.Errorf("Expected the weekend not to count as trading time: %v, %v", weekend.Sharpe, gap.Sharpe)
+	}
+}
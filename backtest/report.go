@@ -0,0 +1,223 @@
+package backtest
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/swagger"
+	"math"
+	"sort"
+)
+
+// Trading days times the 8.5 hours of a trading day. Used to annualize the Sharpe ratio.
+const TradingMillisPerYear = 252 * 510 * 60 * 1000
+
+type InstrumentPnL struct {
+	Identifier string  `json:"identifier"`
+	MarketId   int64   `json:"market_id"`
+	Trades     int     `json:"trades"`
+	Volume     float64 `json:"volume"`   // Traded, both sides
+	Position   float64 `json:"position"` // At the end
+	Realized   float64 `json:"realized"`
+	Unrealized float64 `json:"unrealized"`
+	Commission float64 `json:"commission"`
+	Total      float64 `json:"total"` // Realized + Unrealized - Commission
+}
+
+type Report struct {
+	Start            int64           `json:"start"`
+	End              int64           `json:"end"`
+	Messages         int64           `json:"messages"`
+	StartEquity      float64         `json:"start_equity"`
+	EndEquity        float64         `json:"end_equity"`
+	Return           float64         `json:"return"`             // Fraction of start equity
+	MaxDrawdown      float64         `json:"max_drawdown"`       // Fraction of the peak
+	MaxDrawdownValue float64         `json:"max_drawdown_value"` //
+	Sharpe           float64         `json:"sharpe"`             // Annualized, zero risk free rate
+	Commission       float64         `json:"commission"`
+	Curve            []EquityPoint   `json:"curve"`
+	Trades           []swagger.Trade `json:"trades"`
+	Instruments      []InstrumentPnL `json:"instruments"`
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("Return %.2f%%, equity %.2f -> %.2f, max drawdown %.2f%% (%.2f), sharpe %.2f, %d trades, commission %.2f",
+		r.Return*100, r.StartEquity, r.EndEquity, r.MaxDrawdown*100, r.MaxDrawdownValue, r.Sharpe, len(r.Trades), r.Commission)
+}
+
+// The report, so far. Can be called during the run, but messages still being sorted are not included.
+func (bt *Backtest) Report() *Report {
+	r := &Report{
+		Start:       bt.start,
+		End:         bt.now,
+		Messages:    bt.processed,
+		StartEquity: bt.cash,
+		EndEquity:   bt.broker.Equity(),
+		Trades:      bt.broker.Trades(),
+	}
+	r.Curve = append([]EquityPoint{}, bt.curve...)
+	if len(r.Curve) == 0 || r.Curve[len(r.Curve)-1].Time < bt.now {
+		r.Curve = append(r.Curve, EquityPoint{bt.now, r.EndEquity})
+	}
+	if r.StartEquity != 0 {
+		r.Return = (r.EndEquity - r.StartEquity) / r.StartEquity
+	}
+	r.MaxDrawdown, r.MaxDrawdownValue = drawdown(r.StartEquity, r.Curve)
+	r.Sharpe = sharpe(r.Start, r.StartEquity, r.Curve, bt.sampling)
+	r.Instruments = bt.instrumentPnL(r.Trades)
+	for _, i := range r.Instruments {
+		r.Commission += i.Commission
+	}
+	return r
+}
+
+func drawdown(start float64, curve []EquityPoint) (maxDD, maxValue float64) {
+	peak := start
+	for _, p := range curve {
+		if p.Equity > peak {
+			peak = p.Equity
+		}
+		if dd := peak - p.Equity; dd > maxValue {
+			maxValue = dd
+			if peak > 0 {
+				maxDD = dd / peak
+			}
+		}
+	}
+	return
+}
+
+// Returns between the points of the curve, annualized with the sampling interval. Each return is weighted by the
+// trading time between its points, so a gap, like a night or a quiet hour, is not counted as one sampling period.
+func sharpe(startTime int64, start float64, curve []EquityPoint, sampling int64) float64 {
+	if sampling <= 0 {
+		return 0
+	}
+	var returns, periods []float64
+	prev, prevTime := start, startTime
+	for _, p := range curve {
+		if p.Time <= prevTime {
+			continue // No time has passed. The change is part of the next return.
+		}
+		if prev != 0 {
+			dt := tradingMillis(prevTime, p.Time)
+			if dt == 0 {
+				dt = p.Time - prevTime // Not within the hours of omxtime, so use the clock
+			}
+			returns = append(returns, (p.Equity-prev)/prev)
+			periods = append(periods, float64(dt)/float64(sampling))
+		}
+		prev, prevTime = p.Equity, p.Time
+	}
+	if len(returns) < 2 {
+		return 0
+	}
+	var sum, total float64
+	for idx, r := range returns {
+		sum += r
+		total += periods[idx]
+	}
+	mean := sum / total // Per sampling period
+	var variance float64
+	for idx, r := range returns {
+		d := r - mean*periods[idx]
+		variance += d * d / periods[idx] // The variance of a return grows with its time
+	}
+	stdDev := math.Sqrt(variance / float64(len(returns)-1))
+	if stdDev == 0 {
+		return 0
+	}
+	return mean / stdDev * math.Sqrt(float64(TradingMillisPerYear)/float64(sampling))
+}
+
+// Millis between from and to, when the market is open, by the hours of omxtime
+func tradingMillis(from, to int64) (res int64) {
+	for ot := omxtime.NewOmxTimeMillis(from); ot.Millis < to; ot = ot.NextTradingDay() {
+		open, end := ot.OmxOpen, ot.OmxClose
+		if open < 0 {
+			continue
+		}
+		if open < from {
+			open = from
+		}
+		if end > to {
+			end = to
+		}
+		if end > open {
+			res += end - open
+		}
+	}
+	return
+}
+
+type pnlKey struct {
+	identifier string
+	market     int64
+}
+
+// Realized with average cost, like the broker. Unrealized from the positions of the broker.
+func (bt *Backtest) instrumentPnL(trades []swagger.Trade) (res []InstrumentPnL) {
+	pnls := make(map[pnlKey]*InstrumentPnL)
+	avg := make(map[pnlKey]float64)
+	get := func(key pnlKey) *InstrumentPnL {
+		p, ok := pnls[key]
+		if !ok {
+			p = &InstrumentPnL{Identifier: key.identifier, MarketId: key.market}
+			pnls[key] = p
+		}
+		return p
+	}
+
+	for _, t := range trades {
+		key := pnlKey{t.Tradable.Identifier, t.Tradable.MarketId}
+		p := get(key)
+		price, qty := t.Price.Value, t.Volume
+		if t.Side == "SELL" {
+			qty = -qty
+		}
+		p.Trades++
+		p.Volume += t.Volume
+		p.Commission += bt.commission(price * t.Volume)
+
+		newPos := p.Position + qty
+		switch {
+		case p.Position != 0 && (p.Position > 0) != (qty > 0):
+			closed := math.Min(math.Abs(qty), math.Abs(p.Position))
+			if p.Position > 0 {
+				p.Realized += closed * (price - avg[key])
+			} else {
+				p.Realized += closed * (avg[key] - price)
+			}
+			if newPos != 0 && (newPos > 0) != (p.Position > 0) {
+				avg[key] = price // Flipped side
+			}
+		case newPos != 0:
+			avg[key] = (avg[key]*p.Position + price*qty) / newPos
+		}
+		p.Position = newPos
+	}
+
+	for _, pos := range bt.broker.Positions() {
+		if len(pos.Instrument.Tradables) == 0 {
+			continue
+		}
+		tr := pos.Instrument.Tradables[0]
+		p := get(pnlKey{tr.Identifier, tr.MarketId})
+		p.Unrealized = pos.MarketValue.Value - pos.AcqPrice.Value*float64(pos.Qty)
+	}
+
+	res = []InstrumentPnL{}
+	for _, p := range pnls {
+		p.Total = p.Realized + p.Unrealized - p.Commission
+		res = append(res, *p)
+	}
+	sort.Sort(byIdentifier(res))
+	return
+}
+
+type byIdentifier []InstrumentPnL
+
+func (a byIdentifier) Len() int      { return len(a) }
+func (a byIdentifier) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byIdentifier) Less(i, j int) bool {
+	return a[i].MarketId < a[j].MarketId || (a[i].MarketId == a[j].MarketId && a[i].Identifier < a[j].Identifier)
+}
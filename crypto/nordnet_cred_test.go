@@ -4,8 +4,12 @@ import (
 	"github.com/Forau/yanngo/crypto"
 	"testing"
 
+	"bytes"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"time"
 )
@@ -54,3 +58,160 @@ func TestGenerateCredentials(t *testing.T) {
 		t.Error("Expected cred and cred2 to be different")
 	}
 }
+
+func TestTokens(t *testing.T) {
+	secret := []byte("daemon secret")
+	token, err := crypto.SignToken(secret, crypto.TokenClaims{Subject: "bot", Role: "trader", Accounts: []int64{123}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := crypto.VerifyToken(secret, token)
+	if err != nil || claims.Subject != "bot" || claims.Role != "trader" || len(claims.Accounts) != 1 || claims.Accounts[0] != 123 {
+		t.Errorf("Unexpected claims %+v: %+v", claims, err)
+	}
+
+	if _, err := crypto.VerifyToken([]byte("other secret"), token); err == nil {
+		t.Error("Expected an error with the wrong secret")
+	}
+	forged, _ := crypto.SignToken([]byte("other secret"), crypto.TokenClaims{Subject: "bot", Role: "admin"})
+	if _, err := crypto.VerifyToken(secret, strings.Split(forged, ".")[0]+"."+strings.Split(token, ".")[1]); err == nil {
+		t.Error("Expected an error with changed claims")
+	}
+	expired, _ := crypto.SignToken(secret, crypto.TokenClaims{Subject: "bot", Expires: time.Now().Add(-time.Minute).Unix()})
+	if _, err := crypto.VerifyToken(secret, expired); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the token to be expired: %+v", err)
+	}
+	if _, err := crypto.SignToken(nil, claims); err == nil {
+		t.Error("Expected an error without a secret")
+	}
+
+	key, err := crypto.NewApiKey()
+	if err != nil || len(key) != 43 || strings.Contains(key, ".") {
+		t.Errorf("Unexpected api key '%s': %+v", key, err)
+	}
+	if hash := crypto.HashApiKey(key); len(hash) != 64 || hash != crypto.HashApiKey(key) || hash == crypto.HashApiKey(key+"x") {
+		t.Errorf("Unexpected hash: %s", hash)
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	// From RFC 7914
+	tests := []struct {
+		pass, salt string
+		N, r, p    int
+		expected   string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, test := range tests {
+		key, err := crypto.Scrypt([]byte(test.pass), []byte(test.salt), test.N, test.r, test.p, 64)
+		if err != nil || hex.EncodeToString(key) != test.expected {
+			t.Errorf("Unexpected key for '%s': %x, %+v", test.pass, key, err)
+		}
+	}
+	if _, err := crypto.Scrypt([]byte("pass"), nil, 1000, 1, 1, 32); err == nil {
+		t.Error("Expected an error when N is not a power of two")
+	}
+}
+
+func TestCredentialStore(t *testing.T) {
+	crypto.ScryptN = 1 << 10 // Fast enough for tests
+	pem, err := ioutil.ReadFile("../NEXTAPI_TEST_public.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "creds.json")
+	cs, err := crypto.OpenCredentialStore(path, []byte("first"))
+	if err != nil || len(cs.Environments()) != 0 {
+		t.Fatalf("Expected a new empty store: %+v", err)
+	}
+	if err = cs.Set("test", crypto.Credentials{User: "me", Pass: "hunter2", Pem: pem}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.Set("prod", crypto.Credentials{User: "me"}); err == nil {
+		t.Error("Expected an error without password and PEM")
+	}
+	cs.Set("prod", crypto.Credentials{User: "real", Pass: "secret", Pem: pem, Endpoint: "https://api.nordnet.se/next/2"})
+	if err = cs.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := ioutil.ReadFile(path)
+	if bytes.Contains(raw, []byte("hunter2")) || bytes.Contains(raw, []byte("real")) {
+		t.Errorf("Expected the file to be encrypted: %s", raw)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600: %+v, %+v", fi, err)
+	}
+	if _, err = crypto.OpenCredentialStore(path, []byte("wrong")); err == nil || !strings.Contains(err.Error(), "passphrase") {
+		t.Errorf("Expected a wrong passphrase error: %+v", err)
+	}
+
+	cs, err = crypto.OpenCredentialStore(path, []byte("first"))
+	if err != nil || strings.Join(cs.Environments(), ",") != "prod,test" {
+		t.Fatalf("Unexpected store %v: %+v", cs, err)
+	}
+	if c, err := cs.Get("prod"); err != nil || c.User != "real" || c.Endpoint != "https://api.nordnet.se/next/2" || c.Updated.IsZero() {
+		t.Errorf("Unexpected credentials %+v: %+v", c, err)
+	}
+	gen, err := crypto.NewCredentialsGeneratorFromStore(cs, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred, err := gen(); err != nil || cred == "" {
+		t.Errorf("Unexpected generated credentials '%s': %+v", cred, err)
+	}
+	if _, err = crypto.NewCredentialsGeneratorFromStore(cs, "staging"); err == nil {
+		t.Error("Expected an error for an unknown environment")
+	}
+
+	// Rotate
+	cs.Delete("prod")
+	cs.ChangePassphrase([]byte("second"))
+	if err = cs.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = crypto.OpenCredentialStore(path, []byte("first")); err == nil {
+		t.Error("Expected the old passphrase to fail after rotation")
+	}
+	cs, err = crypto.OpenCredentialStore(path, []byte("second"))
+	if err != nil || strings.Join(cs.Environments(), ",") != "test" {
+		t.Errorf("Unexpected rotated store: %+v", err)
+	}
+	if files, _ := filepath.Glob(path + "*"); len(files) != 1 {
+		t.Errorf("Expected no temp files left: %v", files)
+	}
+}
+
+func TestCredentialsFromEnv(t *testing.T) {
+	for _, name := range []string{crypto.UserEnv, crypto.PassEnv, crypto.PemEnv, crypto.EndpointEnv} {
+		t.Setenv(name, "")
+		t.Setenv(name+"_FILE", "")
+	}
+	if c, err := crypto.CredentialsFromEnv(); c != nil || err != nil {
+		t.Errorf("Expected nothing without a user: %+v, %+v", c, err)
+	}
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "pass"), []byte("hunter2\n"), 0600)
+	t.Setenv(crypto.UserEnv, "me")
+	t.Setenv(crypto.PassEnv+"_FILE", filepath.Join(dir, "pass"))
+	if _, err := crypto.CredentialsFromEnv(); err == nil {
+		t.Error("Expected an error without a PEM")
+	}
+	t.Setenv(crypto.PemEnv+"_FILE", "../NEXTAPI_TEST_public.pem")
+	c, err := crypto.CredentialsFromEnv()
+	if err != nil || c.User != "me" || c.Pass != "hunter2" || !bytes.Contains(c.Pem, []byte("PUBLIC KEY")) {
+		t.Errorf("Unexpected credentials %+v: %+v", c, err)
+	}
+
+	t.Setenv(crypto.PassphraseEnv, "")
+	t.Setenv(crypto.PassphraseEnv+"_FILE", "")
+	if _, err := crypto.OpenCredentialStoreFromEnv(filepath.Join(dir, "creds.json")); err == nil {
+		t.Error("Expected an error without a passphrase")
+	}
+	t.Setenv(crypto.PassphraseEnv, "pp")
+	if _, err := crypto.OpenCredentialStoreFromEnv(filepath.Join(dir, "creds.json")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// The scrypt key derivation function, as in RFC 7914. N must be a power of two above 1.
+func Scrypt(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, fmt.Errorf("scrypt: N must be a power of two above 1, was %d", N)
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || r > (1<<31-1)/128/p || N > (1<<31-1)/128/r {
+		return nil, fmt.Errorf("scrypt: parameters are too large, N %d, r %d, p %d", N, r, p)
+	}
+	b := pbkdf2(password, salt, p*128*r)
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*N*r)
+	for i := 0; i < p; i++ {
+		smix(b[i*128*r:], r, N, v, xy)
+	}
+	return pbkdf2(password, b, keyLen), nil
+}
+
+// PBKDF2 with HMAC-SHA256, and one iteration, as scrypt uses it
+func pbkdf2(password, salt []byte, keyLen int) []byte {
+	mac := hmac.New(sha256.New, password)
+	res := make([]byte, 0, keyLen+sha256.Size)
+	var idx [4]byte
+	for i := uint32(1); len(res) < keyLen; i++ {
+		binary.BigEndian.PutUint32(idx[:], i)
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(idx[:])
+		res = mac.Sum(res)
+	}
+	return res[:keyLen]
+}
+
+func smix(b []byte, r, N int, v, xy []uint32) {
+	var tmp [16]uint32
+	R := 32 * r
+	x, y := xy[:R], xy[R:]
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	for i := 0; i < N; i += 2 {
+		copy(v[i*R:], x)
+		blockMix(&tmp, x, y, r)
+		copy(v[(i+1)*R:], y)
+		blockMix(&tmp, y, x, r)
+	}
+	for i := 0; i < N; i += 2 {
+		blockXOR(x, v[integerify(x, r, N)*R:], R)
+		blockMix(&tmp, x, y, r)
+		blockXOR(y, v[integerify(y, r, N)*R:], R)
+		blockMix(&tmp, y, x, r)
+	}
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+}
+
+func integerify(b []uint32, r, N int) int {
+	j := (2*r - 1) * 16
+	return int((uint64(b[j]) | uint64(b[j+1])<<32) & uint64(N-1))
+}
+
+func blockXOR(dst, src []uint32, n int) {
+	for i := 0; i < n; i++ {
+		dst[i] ^= src[i]
+	}
+}
+
+// BlockMix with Salsa20/8. Even blocks go to the first half of out, and odd to the second.
+func blockMix(tmp *[16]uint32, in, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i += 2 {
+		salsaXOR(tmp, in[i*16:], out[i*8:])
+		salsaXOR(tmp, in[i*16+16:], out[i*8+r*16:])
+	}
+}
+
+func salsaXOR(tmp *[16]uint32, in, out []uint32) {
+	for i := range tmp {
+		tmp[i] ^= in[i]
+	}
+	salsa208(tmp)
+	copy(out, tmp[:])
+}
+
+func salsa208(b *[16]uint32) {
+	x := *b
+	qr := func(a, b, c, d int) {
+		x[b] ^= bits.RotateLeft32(x[a]+x[d], 7)
+		x[c] ^= bits.RotateLeft32(x[b]+x[a], 9)
+		x[d] ^= bits.RotateLeft32(x[c]+x[b], 13)
+		x[a] ^= bits.RotateLeft32(x[d]+x[c], 18)
+	}
+	for i := 0; i < 8; i += 2 {
+		qr(0, 4, 8, 12) // Columns
+		qr(5, 9, 13, 1)
+		qr(10, 14, 2, 6)
+		qr(15, 3, 7, 11)
+		qr(0, 1, 2, 3) // Rows
+		qr(5, 6, 7, 4)
+		qr(10, 11, 8, 9)
+		qr(15, 12, 13, 14)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
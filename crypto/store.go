@@ -0,0 +1,264 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/nnutils"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nordnet credentials of one environment, like test or prod
+type Credentials struct {
+	User     string    `json:"user"`
+	Pass     string    `json:"pass"`
+	Pem      []byte    `json:"pem"`
+	Endpoint string    `json:"endpoint,omitempty"` // The base URL. Empty for the default of the daemon
+	Updated  time.Time `json:"updated,omitempty"`
+}
+
+func (c *Credentials) Valid() error {
+	if c.User == "" || c.Pass == "" || len(c.Pem) == 0 {
+		return fmt.Errorf("Credentials need a user, a password and a PEM")
+	}
+	return nil
+}
+
+// Cost of new stores. 2^15 takes about 100ms, and 32MB.
+var (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+const storeHeader = "yanngo-credentials-v1"
+
+// The file. Everything but the kdf parameters is encrypted, and the parameters are authenticated.
+type storeFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+func (sf *storeFile) additionalData() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%d:%d:%d", storeHeader, sf.KDF, sf.N, sf.R, sf.P))
+}
+
+func (sf *storeFile) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := Scrypt(passphrase, sf.Salt, sf.N, sf.R, sf.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Credentials per environment, in a file encrypted with a passphrase (scrypt and AES-256-GCM).
+// Changes are only written with Save.
+type CredentialStore struct {
+	sync.Mutex
+	path       string
+	passphrase []byte
+	entries    map[string]*Credentials
+}
+
+// Open the store at path. A store that does not exist is empty, and is created on Save.
+func OpenCredentialStore(path string, passphrase []byte) (*CredentialStore, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("No passphrase for %s", path)
+	}
+	cs := &CredentialStore{path: path, passphrase: passphrase, entries: make(map[string]*Credentials)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sf storeFile
+	if err = json.Unmarshal(b, &sf); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	if sf.Version != 1 || sf.KDF != "scrypt" {
+		return nil, fmt.Errorf("Unknown store %s, version %d with %s", path, sf.Version, sf.KDF)
+	}
+	aead, err := sf.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(sf.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Malformed store %s", path)
+	}
+	plain, err := aead.Open(nil, sf.Nonce, sf.Data, sf.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt %s. Wrong passphrase?", path)
+	}
+	if err = json.Unmarshal(plain, &cs.entries); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// The environments in the store, sorted
+func (cs *CredentialStore) Environments() []string {
+	cs.Lock()
+	defer cs.Unlock()
+	res := make([]string, 0, len(cs.entries))
+	for env := range cs.entries {
+		res = append(res, env)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (cs *CredentialStore) Get(env string) (*Credentials, error) {
+	cs.Lock()
+	defer cs.Unlock()
+	if c, ok := cs.entries[env]; ok {
+		cp := *c
+		return &cp, nil
+	}
+	return nil, fmt.Errorf("No credentials for '%s' in %s", env, cs.path)
+}
+
+// Add, or replace, the credentials of env
+func (cs *CredentialStore) Set(env string, c Credentials) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	c.Updated = time.Now().UTC()
+	cs.Lock()
+	defer cs.Unlock()
+	cs.entries[env] = &c
+	return nil
+}
+
+func (cs *CredentialStore) Delete(env string) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	_, ok := cs.entries[env]
+	delete(cs.entries, env)
+	return ok
+}
+
+// Use another passphrase from the next Save
+func (cs *CredentialStore) ChangePassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("Empty passphrase")
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.passphrase = passphrase
+	return nil
+}
+
+// Write the store, with a new salt and nonce. The file is replaced, so a failed write keeps the old one.
+func (cs *CredentialStore) Save() error {
+	cs.Lock()
+	defer cs.Unlock()
+	plain, err := json.Marshal(cs.entries)
+	if err != nil {
+		return err
+	}
+	sf := storeFile{Version: 1, KDF: "scrypt", N: ScryptN, R: ScryptR, P: ScryptP, Salt: make([]byte, 16), Nonce: make([]byte, 12)}
+	if _, err = rand.Read(sf.Salt); err != nil {
+		return err
+	}
+	if _, err = rand.Read(sf.Nonce); err != nil {
+		return err
+	}
+	aead, err := sf.aead(cs.passphrase)
+	if err != nil {
+		return err
+	}
+	sf.Data = aead.Seal(nil, sf.Nonce, plain, sf.additionalData())
+	b, err := json.MarshalIndent(&sf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return nnutils.WriteFileAtomic(cs.path, b, 0600)
+}
+
+// Environment variables the credentials are read from. Each can also be given as a file, with _FILE appended to the name,
+// like NORDNET_PASS_FILE=/run/secrets/nordnet_pass.
+const (
+	UserEnv       = "NORDNET_USER"
+	PassEnv       = "NORDNET_PASS"
+	PemEnv        = "NORDNET_PEM" // The PEM itself. Use NORDNET_PEM_FILE for a path
+	EndpointEnv   = "NORDNET_URL"
+	PassphraseEnv = "YANNGO_STORE_PASSPHRASE"
+)
+
+// The value of the environment variable name, or the content of the file in name_FILE. Trailing newlines of files are removed.
+func FromEnv(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// Credentials from NORDNET_USER, NORDNET_PASS, NORDNET_PEM and NORDNET_URL, or their _FILE variants.
+// Returns nil if no user is set.
+func CredentialsFromEnv() (*Credentials, error) {
+	c := &Credentials{}
+	var err error
+	if c.User, err = FromEnv(UserEnv); err != nil || c.User == "" {
+		return nil, err
+	}
+	if c.Pass, err = FromEnv(PassEnv); err != nil {
+		return nil, err
+	}
+	pem, err := FromEnv(PemEnv)
+	if err != nil {
+		return nil, err
+	}
+	c.Pem = []byte(pem)
+	if c.Endpoint, err = FromEnv(EndpointEnv); err != nil {
+		return nil, err
+	}
+	return c, c.Valid()
+}
+
+// Open the store with the passphrase from YANNGO_STORE_PASSPHRASE, or YANNGO_STORE_PASSPHRASE_FILE
+func OpenCredentialStoreFromEnv(path string) (*CredentialStore, error) {
+	passphrase, err := FromEnv(PassphraseEnv)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("Set %s or %s_FILE to open %s", PassphraseEnv, PassphraseEnv, path)
+	}
+	return OpenCredentialStore(path, []byte(passphrase))
+}
+
+// Like NewCredentialsGenerator, with the credentials of env in the store
+func NewCredentialsGeneratorFromStore(cs *CredentialStore, env string) (GenerateCredentials, error) {
+	c, err := cs.Get(env)
+	if err != nil {
+		return nil, err
+	}
+	return NewCredentialsGenerator([]byte(c.User), []byte(c.Pass), c.Pem)
+}
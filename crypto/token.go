@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A new random api key for a client of the daemon. Only the hash of it needs to be kept by the daemon.
+func NewApiKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hex encoded sha256 of the key
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// What a signed token says about the client
+type TokenClaims struct {
+	Subject  string  `json:"sub"`
+	Role     string  `json:"role,omitempty"`
+	Accounts []int64 `json:"accounts,omitempty"`
+	Expires  int64   `json:"exp,omitempty"` // Unix seconds. 0 for never
+}
+
+func tokenMac(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Make a token like <claims>.<signature>, both base64url, signed with HMAC-SHA256
+func SignToken(secret []byte, claims TokenClaims) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("No secret to sign with")
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMac(secret, payload)), nil
+}
+
+// Verify the signature and expiry of a token made by SignToken, and return the claims
+func VerifyToken(secret []byte, token string) (claims TokenClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(secret) == 0 || len(parts) != 2 {
+		return claims, fmt.Errorf("Malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, tokenMac(secret, parts[0])) {
+		return claims, fmt.Errorf("Invalid token signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, err
+	}
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return claims, err
+	}
+	if claims.Expires != 0 && time.Now().Unix() >= claims.Expires {
+		return claims, fmt.Errorf("Token for %s expired at %s", claims.Subject, time.Unix(claims.Expires, 0))
+	}
+	return claims, nil
+}
@@ -0,0 +1,103 @@
+// nsq_tail -topic nordnet.feed --nsqd-tcp-address 127.0.0.1:5150 > feed.log
+// go run main.go -fast 10 -slow 30 < feed.log
+
+package main
+
+import (
+	"github.com/Forau/yanngo/backtest"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/indicators"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var (
+	cash       = flag.Float64("cash", 100000, "Starting cash")
+	volume     = flag.Float64("volume", 100, "Volume to trade")
+	fast       = flag.Int("fast", 10, "Fast SMA period, in trades")
+	slow       = flag.Int("slow", 30, "Slow SMA period, in trades")
+	latency    = flag.Int64("latency", 100, "Order latency in millis")
+	slippage   = flag.Int64("slippage", 0, "Slippage in ticks")
+	commission = flag.Float64("commission", 0.069, "Commission in percent")
+	minimum    = flag.Float64("min", 39, "Minimum commission")
+	full       = flag.Bool("full", false, "Print the full report as json")
+)
+
+type instrument struct {
+	fast, slow *indicators.SMA
+	above      bool
+	position   float64
+}
+
+// Goes long when the fast SMA of the last price crosses above the slow, and flat when it crosses below
+type crossover struct {
+	instruments map[string]*instrument
+}
+
+func (c *crossover) OnFeed(bt *backtest.Backtest, msg *feedmodel.FeedMsg) {
+	var price feedmodel.FeedPriceData
+	if msg.Type != "price" || msg.DecodeData(&price) != nil || price.Last <= 0 {
+		return
+	}
+	key := fmt.Sprintf("%d:%s", price.Market, price.Identifier)
+	inst, ok := c.instruments[key]
+	if !ok {
+		inst = &instrument{fast: indicators.NewSMA(*fast), slow: indicators.NewSMA(*slow)}
+		c.instruments[key] = inst
+	}
+	inst.fast.Update(price.Last)
+	inst.slow.Update(price.Last)
+	if !inst.slow.Ready() {
+		return
+	}
+	above := inst.fast.Value() > inst.slow.Value()
+	if above == inst.above {
+		return
+	}
+	inst.above = above
+	if above && inst.position == 0 && price.Ask > 0 {
+		bt.Broker().CreateOrder(backtest.Accno, price.Identifier, price.Market, "BUY", price.Ask, *volume, "FAK", "")
+	} else if !above && inst.position > 0 && price.Bid > 0 {
+		bt.Broker().CreateOrder(backtest.Accno, price.Identifier, price.Market, "SELL", price.Bid, inst.position, "FAK", "")
+	}
+}
+
+func (c *crossover) OnOrderEvent(bt *backtest.Backtest, msg *feedmodel.FeedMsg) {
+	var trade feedmodel.FeedPrivateTradeData
+	if msg.Type != "privtrade" || msg.DecodeData(&trade) != nil {
+		return
+	}
+	if inst, ok := c.instruments[fmt.Sprintf("%d:%s", trade.Tradable.MarketId, trade.Tradable.Identifier)]; ok {
+		if trade.Side == "BUY" {
+			inst.position += trade.Volume
+		} else {
+			inst.position -= trade.Volume
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	bt := backtest.NewBacktest(&crossover{instruments: make(map[string]*instrument)}, *cash).
+		SetLatency(*latency).SetSlippage(*slippage).SetCommission(paper.PercentCommission(*commission, *minimum))
+	report, err := bt.Run(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *full {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Println(report)
+	for _, i := range report.Instruments {
+		fmt.Printf("%d:%-8s trades %4d  position %8.0f  realized %10.2f  unrealized %10.2f  commission %8.2f  total %10.2f\n",
+			i.MarketId, i.Identifier, i.Trades, i.Position, i.Realized, i.Unrealized, i.Commission, i.Total)
+	}
+}
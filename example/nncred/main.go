@@ -0,0 +1,95 @@
+// Manages the encrypted credential store of nsqnnd.
+//
+// export YANNGO_STORE_PASSPHRASE_FILE=~/.yanngo/passphrase
+// go run main.go -store creds.json -env test -user me -pem NEXTAPI_TEST_public.pem set   (Reads the password from NORDNET_PASS, or stdin)
+// go run main.go -store creds.json list
+// go run main.go -store creds.json -env test delete
+// go run main.go -store creds.json rotate   (Reads the new passphrase from YANNGO_STORE_NEW_PASSPHRASE, or stdin)
+
+package main
+
+import (
+	"github.com/Forau/yanngo/crypto"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	store    = flag.String("store", "", "The credential store. Created on the first set")
+	env      = flag.String("env", "test", "The environment, like test or prod")
+	user     = flag.String("user", "", "User name, for set")
+	pemFile  = flag.String("pem", "", "The PEM file, for set")
+	endpoint = flag.String("url", "", "The base URL, for set. Empty to use the default of the daemon")
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// The value of the environment variable, or a line from stdin
+func secret(name, prompt string) string {
+	if v, err := crypto.FromEnv(name); err != nil {
+		log.Fatal(err)
+	} else if v != "" {
+		return v
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -store <file> [flags] set|list|delete|rotate\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *store == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cs, err := crypto.OpenCredentialStore(*store, []byte(secret(crypto.PassphraseEnv, "Passphrase: ")))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		for _, e := range cs.Environments() {
+			c, _ := cs.Get(e)
+			fmt.Printf("%s\t%s\t%s\t%s\n", e, c.User, c.Endpoint, c.Updated.Format("2006-01-02 15:04"))
+		}
+		return
+	case "set":
+		pem, err := ioutil.ReadFile(*pemFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c := crypto.Credentials{User: *user, Pass: secret(crypto.PassEnv, "Nordnet password: "), Pem: pem, Endpoint: *endpoint}
+		if err = cs.Set(*env, c); err != nil {
+			log.Fatal(err)
+		}
+	case "delete":
+		if !cs.Delete(*env) {
+			log.Fatalf("No '%s' in %s", *env, *store)
+		}
+	case "rotate":
+		if err = cs.ChangePassphrase([]byte(secret("YANNGO_STORE_NEW_PASSPHRASE", "New passphrase: "))); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err = cs.Save(); err != nil {
+		log.Fatal(err)
+	}
+}
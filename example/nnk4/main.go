@@ -0,0 +1,186 @@
+// Builds the K4 for a year, from archived trade files and the trades of an account.
+//
+// go run main.go -year 2026 -trades 2025.csv -trades 2026.csv -rates rates.csv -accno 123 -nsqd 127.0.0.1:5150 \
+//     -csv k4.csv -sru . -pnr 191212121212 -name "Tolvan Tolvansson" -postnr 12345 -city Stockholm
+
+package main
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/auth"
+	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/remote/nsqconn"
+	"github.com/Forau/yanngo/tax"
+	"github.com/Forau/yanngo/transports"
+
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// For multiple flags
+type StringArray []string
+
+func (a *StringArray) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+func (a *StringArray) String() string {
+	return strings.Join(*a, ",")
+}
+
+var (
+	year     = flag.Int("year", 0, "Year of the declaration")
+	rates    = flag.String("rates", "", "Csv with date,currency,rate to SEK")
+	topic    = flag.String("topic", "nordnet.api", "Topic server's API is listening on")
+	accno    = flag.Int64("accno", 0, "Fetch AccountTrades for the account. Needs -nsqd")
+	csvOut   = flag.String("csv", "", "Write the K4 as csv to this file. - for stdout")
+	sruDir   = flag.String("sru", "", "Write INFO.SRU and BLANKETTER.SRU to this directory")
+	pnr      = flag.String("pnr", "", "Personnummer, 12 digits. For SRU")
+	name     = flag.String("name", "", "Name, for SRU")
+	postnr   = flag.String("postnr", "", "Postal code, for SRU")
+	city     = flag.String("city", "", "City, for SRU")
+	email    = flag.String("email", "", "Email, for SRU")
+	address  = flag.String("address", "", "Address, for SRU")
+	envelope = flag.String("envelope", "", "Json file with the keys to sign, and encrypt, all nsq messages with. Empty for plain json")
+	authKey  = flag.String("auth", "", "Api key or token, if the daemon requires one")
+)
+
+func accountTrades(nsqIps []string) []tax.Trade {
+	nsqb := nsqconn.NewNsqBuilder()
+	nsqb.AddNsqdIps(nsqIps...)
+	nsqd, err := nsqb.Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ps remote.PubSub = nsqd
+	if *envelope != "" {
+		conf, err := remote.LoadEnvelopeConfig(*envelope)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ps, err = conf.Wrap(nsqd); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pubsub, err := remote.NewReplyablePubSub(ps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli := api.NewApiClient(auth.ClientTransport(*authKey, transports.NewRemoteTransportClient(remote.MakeRequestReplyChannel(pubsub, *topic))))
+	trades, err := cli.AccountTrades(*accno)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := make([]tax.Trade, len(trades))
+	for idx, t := range trades {
+		res[idx] = tax.TradeFromSwagger(t)
+	}
+	log.Printf("Fetched %d trades for account %d", len(res), *accno)
+	return res
+}
+
+func main() {
+	var nsqIps, tradeFiles, sections, deferrals StringArray
+	flag.Var(&nsqIps, "nsqd", "NSQD ip's. (Can be used multiple times for each nsqd)")
+	flag.Var(&tradeFiles, "trades", "Archived trades, as csv or json. (Can be used multiple times)")
+	flag.Var(&sections, "section", "Section of a security, as security=C. Default is A. (Can be used multiple times)")
+	flag.Var(&deferrals, "deferral", "Row in section B, as name=amount. (Can be used multiple times)")
+	flag.Parse()
+
+	if *year == 0 {
+		log.Fatal("-year is required")
+	}
+
+	var rs tax.RateSource
+	if *rates != "" {
+		f, err := os.Open(*rates)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dr, err := tax.LoadRates(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", *rates, err)
+		}
+		rs = dr.Rate
+	}
+	calc := tax.NewCalculator(rs)
+
+	for _, s := range sections {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Bad section '%s'", s)
+		}
+		calc.SetSection(parts[0], strings.ToUpper(parts[1]))
+	}
+	for _, d := range deferrals {
+		parts := strings.SplitN(d, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Bad deferral '%s'", d)
+		}
+		amount, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			log.Fatalf("Bad amount of deferral '%s': %v", d, err)
+		}
+		calc.AddDeferral(parts[0], amount)
+	}
+
+	for _, file := range tradeFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		trades, err := tax.LoadTrades(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", file, err)
+		}
+		calc.AddTrades(trades...)
+	}
+	if *accno != 0 {
+		calc.AddTrades(accountTrades(nsqIps)...)
+	}
+
+	k4, err := calc.Report(*year)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, w := range k4.Warnings {
+		log.Printf("WARNING: %s", w)
+	}
+
+	if *csvOut == "-" || (*csvOut == "" && *sruDir == "") {
+		err = k4.WriteCSV(os.Stdout)
+	} else if *csvOut != "" {
+		var f *os.File
+		if f, err = os.Create(*csvOut); err == nil {
+			err = k4.WriteCSV(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *sruDir != "" {
+		info, err := os.Create(filepath.Join(*sruDir, "INFO.SRU"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer info.Close()
+		forms, err := os.Create(filepath.Join(*sruDir, "BLANKETTER.SRU"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer forms.Close()
+		err = k4.WriteSRU(tax.SRUInfo{Pnr: *pnr, Name: *name, Address: *address, PostalCode: *postnr, City: *city, Email: *email},
+			info, forms)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
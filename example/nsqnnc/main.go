@@ -4,6 +4,7 @@ import (
 	"github.com/Forau/gocop"
 
 	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/auth"
 	"github.com/Forau/yanngo/remote"
 	"github.com/Forau/yanngo/remote/nsqconn"
 	"github.com/Forau/yanngo/transports"
@@ -31,8 +32,10 @@ func (a *StringArray) String() string {
 }
 
 var (
-	topic = flag.String("topic", "nordnet.api", "Topic server's API is listening on")
-	inbox = flag.String("inbox", "", "Topic the client listens on. Use for debugging.  If not set, random is provided")
+	topic    = flag.String("topic", "nordnet.api", "Topic server's API is listening on")
+	inbox    = flag.String("inbox", "", "Topic the client listens on. Use for debugging.  If not set, random is provided")
+	envelope = flag.String("envelope", "", "Json file with the keys to sign, and encrypt, all nsq messages with. Empty for plain json")
+	authKey  = flag.String("auth", "", "Api key or token, if the daemon requires one")
 )
 
 func printResult(in interface{}, err error) {
@@ -122,11 +125,22 @@ func main() {
 		panic(err)
 	}
 
+	var ps remote.PubSub = nsqd
+	if *envelope != "" {
+		conf, err := remote.LoadEnvelopeConfig(*envelope)
+		if err != nil {
+			panic(err)
+		}
+		if ps, err = conf.Wrap(nsqd); err != nil {
+			panic(err)
+		}
+	}
+
 	var pubsub remote.ReplyablePubSub
 	if *inbox != "" {
-		pubsub, err = remote.NewReplyablePubSubWithInbox(nsqd, *inbox)
+		pubsub, err = remote.NewReplyablePubSubWithInbox(ps, *inbox)
 	} else {
-		pubsub, err = remote.NewReplyablePubSub(nsqd)
+		pubsub, err = remote.NewReplyablePubSub(ps)
 	}
 	if err != nil {
 		panic(err)
@@ -134,6 +148,9 @@ func main() {
 
 	rchan := remote.MakeRequestReplyChannel(pubsub, *topic)
 	rtrans := transports.NewRemoteTransportClient(rchan)
+	if *authKey != "" {
+		rtrans = auth.ClientTransport(*authKey, rtrans)
+	}
 	cli := api.NewApiClient(rtrans)
 
 	cp := gocop.NewCommandParser()
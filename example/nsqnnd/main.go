@@ -1,19 +1,38 @@
 package main
 
 import (
+	"github.com/Forau/yanngo/algo"
 	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/auth"
+	"github.com/Forau/yanngo/crypto"
 	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/alerts"
 	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/nnutils"
+	"github.com/Forau/yanngo/options"
+	"github.com/Forau/yanngo/orders"
+	"github.com/Forau/yanngo/portfolio"
+	"github.com/Forau/yanngo/reconcile"
+	"github.com/Forau/yanngo/refdata"
 	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/remote/natsconn"
 	"github.com/Forau/yanngo/remote/nsqconn"
+	"github.com/Forau/yanngo/trace"
 	"github.com/Forau/yanngo/transports"
+	"github.com/Forau/yanngo/transports/paper"
 
 	"io/ioutil"
 	"os"
 
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // For multiple flags
@@ -28,48 +47,138 @@ func (a *StringArray) String() string {
 }
 
 var (
-	user      = flag.String("user", "", "User name")
-	pass      = flag.String("pass", "", "Password")
-	endpoint  = flag.String("url", "https://api.test.nordnet.se/next/2", "The base URL.")
-	topic     = flag.String("topic", "nordnet.api", "Topic to listen on")
-	feedTopic = flag.String("feedtop", "nordnet.feed", "Topic to send feed on")
-	pemFile   = flag.String("pem", "../../NEXTAPI_TEST_public.pem", "The PEM file")
+	user          = flag.String("user", "", "User name. Prefer -store, or NORDNET_USER, as flags show up in ps")
+	pass          = flag.String("pass", "", "Password. Prefer -store, or NORDNET_PASS, as flags show up in ps")
+	credStore     = flag.String("store", "", "Encrypted credential store, see example/nncred. The passphrase is read from YANNGO_STORE_PASSPHRASE(_FILE)")
+	credEnv       = flag.String("env", "test", "The environment in -store to use. Several, like personal,company, to host each as a login. The first is the default")
+	endpoint      = flag.String("url", "https://api.test.nordnet.se/next/2", "The base URL.")
+	topic         = flag.String("topic", "nordnet.api", "Topic to listen on")
+	feedTopic     = flag.String("feedtop", "nordnet.feed", "Topic to send feed on")
+	pemFile       = flag.String("pem", "../../NEXTAPI_TEST_public.pem", "The PEM file")
+	snapshot      = flag.String("snapshot", "", "File to keep feed state in between restarts. Empty to disable")
+	alertFile     = flag.String("alerts", "", "File to keep alert rules in. Empty to not persist them")
+	syntheticFile = flag.String("synthetic", "", "File to keep synthetic orders, like stops and brackets, in. Empty to not persist them")
+	paperCash     = flag.Float64("paper", 0, "Paper trade with this much cash instead of placing real orders. 0 to disable")
+	refFile       = flag.String("refdata", "", "File to keep reference data in between restarts. Empty to not persist it")
+	logLevel      = flag.String("loglevel", "info", "Log level of the library. debug, info, warn or error")
+	metricsAt     = flag.String("metrics", "", "Address to serve /metrics on, like ':9100'. Empty to only have the Metrics command")
+	traceTo       = flag.String("trace", "", "Export spans to this file, or OTLP/HTTP url like http://localhost:4318/v1/traces. Empty to disable")
+	authConf      = flag.String("auth", "", "Json file with the clients and roles. Empty to let anyone on the topic do anything")
+	auditFile     = flag.String("audit", "", "File to append the audit trail of client requests to. Empty to only log it")
+	envelope      = flag.String("envelope", "", "Json file with the keys to sign, and encrypt, all nsq messages with. Empty for plain json")
+	natsUrls      = flag.String("nats", "", "NATS urls, comma separated, like nats://127.0.0.1:4222. Used instead of -nsqd when set")
+	genKey        = flag.Bool("genkey", false, "Print a new api key, and the key_hash for the -auth file, then exit")
 )
 
 func main() {
 	var nsqIps StringArray
 	flag.Var(&nsqIps, "nsqd", "NSQD ip's. (Can be used multiple times for each nsqd)")
+	var accountMap StringArray
+	flag.Var(&accountMap, "account", "Route an account to a login, like 123456=company. Else found from the accounts of each login. (Can be used multiple times)")
 
 	flag.Parse()
 
-	file, err := os.Open(*pemFile)
-	if err != nil {
-		panic(err)
+	if *genKey {
+		key, err := crypto.NewApiKey()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("key: %s\nkey_hash: %s\n", key, crypto.HashApiKey(key))
+		return
 	}
-	pem, err := ioutil.ReadAll(file)
-	if err != nil {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
 		panic(err)
 	}
+	nnlog.SetDefault(nnlog.NewTextLogger(os.Stderr, level))
+	if *traceTo != "" {
+		trace.SetExporter(trace.NewExporter(*traceTo), "nsqnnd")
+		defer trace.Flush()
+	}
 
-	baseNordnetTransport, err := transports.NewDefaultTransport(*endpoint, []byte(*user), []byte(*pass), pem)
-	if err != nil {
-		panic(err)
+	// Each login has its own session, and rate limit
+	logins := strings.Split(*credEnv, ",")
+	if len(logins) > 1 && *credStore == "" {
+		panic("Several logins in -env needs a -store")
+	}
+	baseNordnetTransport := transports.NewMultiLoginTransport()
+	for _, login := range logins {
+		creds, err := loadCredentials(login)
+		if err != nil {
+			panic(err)
+		}
+		url := *endpoint
+		if creds.Endpoint != "" {
+			url = creds.Endpoint
+		}
+		generate, err := crypto.NewCredentialsGenerator([]byte(creds.User), []byte(creds.Pass), creds.Pem)
+		if err != nil {
+			panic(err)
+		}
+		loginTransport, err := transports.NewDefaultTransportWithGenerator(url, generate)
+		if err != nil {
+			panic(err)
+		}
+		baseNordnetTransport.AddLogin(login, loginTransport)
+	}
+	for _, am := range accountMap {
+		parts := strings.SplitN(am, "=", 2)
+		accno, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 || baseNordnetTransport.Login(parts[1]) == nil {
+			panic(fmt.Sprintf("Bad -account %s. Should be accno=login, with a login from -env", am))
+		}
+		baseNordnetTransport.MapAccount(accno, parts[1])
 	}
 	cacheHandler := transports.NewSimpleMemoryCacheHandler()
-	nordnetTransport, _ := api.NewCachedTransportRouter(cacheHandler, baseNordnetTransport)
-
-	nsqb := nsqconn.NewNsqBuilder()
-	nsqb.AddNsqdIps(nsqIps...)
-
-	log.Printf("Added IP's: %+v", nsqIps)
+	nordnetTransport, _ := api.NewCachedTransportRouter(cacheHandler, baseNordnetTransport, metrics.NewTransport(metrics.Default))
+	nordnetTransport.AddObserver(metrics.Default.RequestObserver())
+	if *metricsAt != "" {
+		metrics.Default.ListenAndServe(*metricsAt)
+	}
 
-	nsqd, err := nsqb.Build()
+	var bus remote.PubSub
+	var nc *natsconn.NatsConn
+	var err error
+	if *natsUrls != "" {
+		// Daemons in the same queue share the requests
+		nc, err = natsconn.NewNatsBuilder().AddUrls(strings.Split(*natsUrls, ",")...).Queue("nsqnnd").Build()
+		bus = nc
+		log.Printf("Connected to NATS: %s", *natsUrls)
+	} else {
+		nsqb := nsqconn.NewNsqBuilder()
+		nsqb.AddNsqdIps(nsqIps...)
+		log.Printf("Added IP's: %+v", nsqIps)
+		bus, err = nsqb.Build()
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	// TODO: Optional for server?
-	pubsub, err := remote.NewReplyablePubSubWithInbox(nsqd, "INBOX.nsqnnd.client")
+	var ps remote.PubSub = bus
+	var sps *remote.SecurePubSub
+	if *envelope != "" {
+		conf, err := remote.LoadEnvelopeConfig(*envelope)
+		if err != nil {
+			panic(err)
+		}
+		if sps, err = conf.Wrap(bus); err != nil {
+			panic(err)
+		}
+		ps = sps
+	}
+
+	// NATS has its own request/reply, so only NSQ needs the shared inbox
+	var pubsub remote.ReplyablePubSub
+	switch {
+	case nc != nil && sps != nil:
+		pubsub = natsconn.NewSecureNatsConn(nc, sps)
+	case nc != nil:
+		pubsub = nc
+	default:
+		// TODO: Optional for server?
+		pubsub, err = remote.NewReplyablePubSubWithInbox(ps, "INBOX.nsqnnd.client")
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -78,20 +187,101 @@ func main() {
 
 	log.Printf("We have our transport: %+v", nordnetTransport)
 
-	err = transports.BindRemoteTransportServer(*topic, pubsub, nordnetTransport)
+	var remoteTransport api.TransportHandler = nordnetTransport
+	if *authConf != "" {
+		authorizer, err := auth.LoadConfig(*authConf)
+		if err != nil {
+			panic(err)
+		}
+		if *auditFile != "" {
+			auditor, err := auth.NewFileAuditor(*auditFile)
+			if err != nil {
+				panic(err)
+			}
+			authorizer.Audit(auth.MultiAuditor(auth.LogAuditor, auditor))
+		}
+		remoteTransport = authorizer.Wrap(nordnetTransport)
+	} else {
+		log.Printf("No -auth file, so all clients on %s can do everything", *topic)
+	}
+
+	err = transports.BindRemoteTransportServer(*topic, pubsub, remoteTransport)
 	if err != nil {
 		panic(err)
 	}
 
 	apiCli := api.NewApiClient(nordnetTransport)
 	// Feed
-	feedTopicStream := remote.MakeStreamTopicChannel(nsqd, *feedTopic)
-	feedCb := feed.NewFeedTransport(feedTopicStream).SetInfo("topic", *feedTopic)
+	feedTopicStream := remote.MakeStreamTopicChannel(ps, *feedTopic)
+	feedCb := feed.NewFeedTransport(feedTopicStream).SetInfo("topic", *feedTopic).SetSnapshotClient(apiCli)
+	if *snapshot != "" {
+		if err := feedCb.EnableSnapshots(*snapshot, time.Minute); err != nil {
+			log.Printf("Unable to restore snapshot from %s: %+v", *snapshot, err)
+		}
+	}
 	err = nordnetTransport.AddTransportHandler(feedCb)
 	if err != nil {
 		log.Printf("Unable to route %+v: %+v", feedCb, err)
 	}
 
+	if *paperCash > 0 {
+		broker := paper.NewPaperBroker(1, "SEK", *paperCash).Bind(feedCb)
+		if err = nordnetTransport.AddTransportHandler(paper.NewPaperTransport(broker, nil)); err != nil {
+			log.Printf("Unable to route %+v: %+v", broker, err)
+		}
+	}
+
+	alertEngine, err := alerts.NewAlertEngine(*alertFile)
+	if err != nil {
+		log.Printf("Unable to load alerts from %s: %+v", *alertFile, err)
+	}
+	if err = nordnetTransport.AddTransportHandler(alertEngine.Bind(feedCb)); err != nil {
+		log.Printf("Unable to route %+v: %+v", alertEngine, err)
+	}
+
+	synthetic, err := orders.NewSyntheticEngine(apiCli, *syntheticFile)
+	if err != nil {
+		log.Printf("Unable to load synthetic orders from %s: %+v", *syntheticFile, err)
+	}
+	if err = nordnetTransport.AddTransportHandler(synthetic.Bind(feedCb)); err != nil {
+		log.Printf("Unable to route %+v: %+v", synthetic, err)
+	}
+
+	algos := algo.NewAlgoEngine(apiCli).Bind(feedCb).Start(10 * time.Second)
+	if err = nordnetTransport.AddTransportHandler(algos); err != nil {
+		log.Printf("Unable to route %+v: %+v", algos, err)
+	}
+
+	// Accounts are loaded on the first Portfolio command
+	pnl := portfolio.NewPortfolio(apiCli).Bind(feedCb)
+	if err = nordnetTransport.AddTransportHandler(pnl); err != nil {
+		log.Printf("Unable to route %+v: %+v", pnl, err)
+	}
+
+	reconciler := reconcile.NewReconciler(apiCli).Bind(feedCb).Start(5 * time.Minute).
+		AddCorrector(func(accno int64) { pnl.Load(accno) })
+	if err = nordnetTransport.AddTransportHandler(reconciler); err != nil {
+		log.Printf("Unable to route %+v: %+v", reconciler, err)
+	}
+
+	// Synced from the base transport, since the router would route the sync back to the store
+	refStore := refdata.NewStore(baseNordnetTransport)
+	if *refFile != "" {
+		if err = refStore.SetFile(*refFile); err != nil {
+			log.Printf("Unable to load reference data from %s: %+v", *refFile, err)
+		}
+	}
+	refStore.Start(6 * time.Hour)
+	if err = nordnetTransport.AddTransportHandler(refStore); err != nil {
+		log.Printf("Unable to route %+v: %+v", refStore, err)
+	}
+
+	// Chains are loaded on the first OptionAnalytics command of the underlying
+	analyzer := options.NewAnalyzer(apiCli).Bind(feedCb)
+	if err = nordnetTransport.AddTransportHandler(analyzer); err != nil {
+		log.Printf("Unable to route %+v: %+v", analyzer, err)
+	}
+
 	feedd, err := feed.NewFeedDaemon(feed.MakePrivateSessionProvider(apiCli),
 		feed.MakePublicSessionProvider(apiCli),
 		feedCb,
@@ -100,6 +290,14 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// The other logins only add their orders and trades
+	for _, login := range logins[1:] {
+		_, err := feed.NewFeedDaemonWithOptions(feed.MakePrivateSessionProvider(apiCli.Login(login)), nil,
+			feed.LoginCallback(login, feedCb), nnutils.DefaultBackoffPolicy, nil)
+		if err != nil {
+			log.Printf("Unable to start the private feed of %s: %+v", login, err)
+		}
+	}
 	feedCb.AddSubscription(&feedmodel.FeedCmd{Cmd: "subscribe", Args: map[string]interface{}{"t": "price", "i": "101", "m": 11}})
 	log.Printf("We have feedd: %+v", feedd)
 
@@ -130,3 +328,22 @@ func main() {
 	c := make(chan interface{})
 	log.Print(<-c)
 }
+
+// The credentials of env from -store, else the NORDNET_* environment, or the -user, -pass and -pem flags, in that order
+func loadCredentials(env string) (*crypto.Credentials, error) {
+	if *credStore != "" {
+		cs, err := crypto.OpenCredentialStoreFromEnv(*credStore)
+		if err != nil {
+			return nil, err
+		}
+		return cs.Get(env)
+	}
+	if creds, err := crypto.CredentialsFromEnv(); creds != nil || err != nil {
+		return creds, err
+	}
+	pem, err := ioutil.ReadFile(*pemFile)
+	if err != nil {
+		return nil, err
+	}
+	return &crypto.Credentials{User: *user, Pass: *pass, Pem: pem}, nil
+}
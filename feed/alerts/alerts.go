@@ -0,0 +1,479 @@
+// Package alerts evaluates alert rules on the merged feed messages, and publishes 'alert' messages when they trigger.
+// The engine is hosted next to the FeedState, and registers the AlertCreate, AlertList and AlertDelete commands.
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/nnutils"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("feed/alerts")
+
+// Kinds of rules
+const (
+	KindPrice  = "price"  // A field in price (or indicator) messages, like last, bid or ask
+	KindSpread = "spread" // Spread between bid and ask, in ticks
+	KindVolume = "volume" // Traded volume during the last window minutes
+	KindStatus = "status" // A field in trading_status messages, compared as text
+)
+
+// Operators. The numeric ones trigger when the condition becomes true, so a rule does not fire on every message.
+const (
+	OpAbove      = "above"
+	OpBelow      = "below"
+	OpCrossAbove = "cross_above" // Like above, but we must have seen a value below first
+	OpCrossBelow = "cross_below"
+	OpEquals     = "equals" // Text rules
+)
+
+type Rule struct {
+	Id         string  `json:"alert_id"`
+	Kind       string  `json:"kind"`
+	Identifier string  `json:"i,omitempty"`
+	Market     string  `json:"m,omitempty"`
+	Field      string  `json:"field,omitempty"` // Defaults to last for price, and status for status
+	Op         string  `json:"op"`
+	Value      float64 `json:"value,omitempty"`
+	Text       string  `json:"text,omitempty"`
+	Window     int64   `json:"window,omitempty"` // Minutes, for volume
+	Repeat     bool    `json:"repeat,omitempty"` // If false, the rule is disabled after it triggers
+	Note       string  `json:"note,omitempty"`
+
+	Active    bool  `json:"active"`
+	Created   int64 `json:"created"`
+	Triggered int64 `json:"triggered,omitempty"` // Millis of last trigger
+	Count     int64 `json:"count,omitempty"`     // Number of triggers
+
+	armed   bool    // Condition has been false since last trigger
+	hasPrev bool    // Used by the cross operators
+	prev    float64 //
+}
+
+func (r *Rule) msgTypes() []string {
+	switch r.Kind {
+	case KindStatus:
+		return []string{"trading_status"}
+	case KindPrice:
+		return []string{"price", "indicator"}
+	}
+	return []string{"price"}
+}
+
+func (r *Rule) Condition() string {
+	subject := r.Field
+	switch r.Kind {
+	case KindSpread:
+		subject = "spread_ticks"
+	case KindVolume:
+		subject = fmt.Sprintf("volume_%dm", r.Window)
+	}
+	if r.Op == OpEquals {
+		return fmt.Sprintf("%s %s %s", subject, r.Op, r.Text)
+	}
+	return fmt.Sprintf("%s %s %v", subject, r.Op, r.Value)
+}
+
+func (r *Rule) validate() error {
+	switch r.Kind {
+	case KindPrice:
+		if r.Field == "" {
+			r.Field = "last"
+		}
+	case KindSpread:
+	case KindVolume:
+		if r.Window <= 0 {
+			return fmt.Errorf("Volume rules need a window in minutes")
+		}
+	case KindStatus:
+		if r.Field == "" {
+			r.Field = "status"
+		}
+		r.Op = OpEquals
+		return nil
+	default:
+		return fmt.Errorf("Unknown kind '%s'", r.Kind)
+	}
+	switch r.Op {
+	case OpAbove, OpBelow, OpCrossAbove, OpCrossBelow:
+	default:
+		return fmt.Errorf("Unknown operator '%s' for %s rules", r.Op, r.Kind)
+	}
+	return nil
+}
+
+// Returns true if the rule should trigger on the new value
+func (r *Rule) evalNumber(val float64) (trigger bool) {
+	var cond bool
+	switch r.Op {
+	case OpAbove:
+		cond = val > r.Value
+	case OpBelow:
+		cond = val < r.Value
+	case OpCrossAbove:
+		cond = r.hasPrev && r.prev < r.Value && val >= r.Value
+	case OpCrossBelow:
+		cond = r.hasPrev && r.prev > r.Value && val <= r.Value
+	}
+	r.prev, r.hasPrev = val, true
+	return r.edge(cond)
+}
+
+func (r *Rule) evalText(val string) bool {
+	return r.edge(strings.EqualFold(val, r.Text))
+}
+
+func (r *Rule) edge(cond bool) (trigger bool) {
+	trigger = cond && r.armed
+	r.armed = !cond
+	return
+}
+
+type volumeSample struct {
+	timestamp, turnover int64
+}
+
+// Engine holding the rules. Use Bind to attach it to a FeedState, or call OnMessage and set the publisher manually.
+type AlertEngine struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	rules   map[string]*Rule
+	volumes map[string][]volumeSample // Per 'market:identifier'
+	ticks   nnutils.TickTableUtil
+	publish feed.FeedClient
+
+	file     string
+	saveLock sync.Mutex
+}
+
+// Create an engine. If file is not empty, rules are loaded from it, and saved to it on every change.
+func NewAlertEngine(file string) (*AlertEngine, error) {
+	ae := &AlertEngine{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		rules:                   make(map[string]*Rule),
+		volumes:                 make(map[string][]volumeSample),
+		ticks:                   nnutils.NewDefaultTickTableUtil(),
+		file:                    file,
+		publish:                 func(*feedmodel.FeedMsg) {},
+	}
+	ae.init()
+	if file != "" {
+		if err := ae.load(); err != nil && !os.IsNotExist(err) {
+			return ae, err
+		}
+	}
+	return ae, nil
+}
+
+// Listen to the messages of the FeedState, and publish alerts on its topic
+func (ae *AlertEngine) Bind(fs *feed.FeedState) *AlertEngine {
+	ae.SetPublisher(fs.Publish)
+	fs.AddListener(ae.OnMessage)
+	return ae
+}
+
+func (ae *AlertEngine) SetPublisher(publish feed.FeedClient) *AlertEngine {
+	ae.Lock()
+	defer ae.Unlock()
+	ae.publish = publish
+	return ae
+}
+
+// Tick table used by spread rules. Default is nnutils.DEFAULT_TICK_TABLE
+func (ae *AlertEngine) SetTickTable(ticks nnutils.TickTableUtil) *AlertEngine {
+	ae.Lock()
+	defer ae.Unlock()
+	ae.ticks = ticks
+	return ae
+}
+
+func (ae *AlertEngine) AddRule(rule *Rule) (*Rule, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+	ae.Lock()
+	rule.Id = fmt.Sprintf("%d", rand.Uint32())
+	rule.Active, rule.armed = true, true
+	rule.Created = time.Now().UnixNano() / int64(time.Millisecond)
+	ae.rules[rule.Id] = rule
+	ae.Unlock()
+	return rule, ae.save()
+}
+
+func (ae *AlertEngine) DeleteRule(id string) error {
+	ae.Lock()
+	_, ok := ae.rules[id]
+	delete(ae.rules, id)
+	ae.Unlock()
+	if !ok {
+		return fmt.Errorf("Alert %s not found", id)
+	}
+	return ae.save()
+}
+
+func (ae *AlertEngine) Rules() (res []Rule) {
+	ae.Lock()
+	defer ae.Unlock()
+	for _, r := range ae.rules {
+		res = append(res, *r)
+	}
+	return
+}
+
+// Evaluate the rules on a merged feed message. Implements feed.FeedClient.
+func (ae *AlertEngine) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil || (msg.Type != "price" && msg.Type != "indicator" && msg.Type != "trading_status") {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg.Data))
+	dec.UseNumber()
+	payload := make(map[string]interface{})
+	if err := dec.Decode(&payload); err != nil {
+		return
+	}
+	id, market := fmt.Sprintf("%v", payload["i"]), fmt.Sprintf("%v", payload["m"])
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	timestamp := now
+	if ts, ok := number(payload, "tick_timestamp"); ok && ts > 0 {
+		timestamp = int64(ts)
+	}
+
+	var triggered []*feedmodel.FeedAlertData
+	ae.Lock()
+	publish := ae.publish
+	if msg.Type == "price" {
+		ae.addVolumeSample(market+":"+id, timestamp, payload)
+	}
+	for _, r := range ae.rules {
+		if !r.Active || r.Identifier != id || r.Market != market || !hasType(r.msgTypes(), msg.Type) {
+			continue
+		}
+		alert := &feedmodel.FeedAlertData{AlertId: r.Id, Kind: r.Kind, Identifier: id, Market: market,
+			Condition: r.Condition(), Note: r.Note, Timestamp: now}
+		trigger := false
+		if r.Kind == KindStatus {
+			if text, ok := payload[r.Field]; ok {
+				alert.Text = fmt.Sprintf("%v", text)
+				trigger = r.evalText(alert.Text)
+			}
+		} else if val, ok := ae.ruleValue(r, market+":"+id, timestamp, payload); ok {
+			alert.Value = val
+			trigger = r.evalNumber(val)
+		}
+		if trigger {
+			r.Triggered, r.Active = now, r.Repeat
+			r.Count++
+			triggered = append(triggered, alert)
+		}
+	}
+	ae.Unlock()
+
+	for _, alert := range triggered {
+		if out, err := feedmodel.NewFeedMsgFromObject("alert", alert); err == nil {
+			publish(out)
+		} else {
+			logger.Error("Unable to make alert message", "alert_id", alert.AlertId, "err", err)
+		}
+	}
+	if len(triggered) > 0 {
+		if err := ae.save(); err != nil {
+			logger.Error("Unable to save alerts", "err", err)
+		}
+	}
+}
+
+// Caller must hold the lock
+func (ae *AlertEngine) ruleValue(r *Rule, key string, timestamp int64, payload map[string]interface{}) (float64, bool) {
+	switch r.Kind {
+	case KindPrice:
+		return number(payload, r.Field)
+	case KindSpread:
+		bid, ok1 := number(payload, "bid")
+		ask, ok2 := number(payload, "ask")
+		if !ok1 || !ok2 || bid <= 0 || ask <= 0 {
+			return 0, false
+		}
+		return float64(ae.ticks.TicksBetween(bid, ask)), true
+	case KindVolume:
+		samples := ae.volumes[key]
+		if len(samples) == 0 {
+			return 0, false
+		}
+		from := timestamp - r.Window*60*1000
+		base := samples[0]
+		for _, s := range samples {
+			if s.timestamp > from {
+				break
+			}
+			base = s
+		}
+		last := samples[len(samples)-1].turnover
+		if last < base.turnover { // New day
+			return float64(last), true
+		}
+		return float64(last - base.turnover), true
+	}
+	return 0, false
+}
+
+// Caller must hold the lock. Keeps samples for the longest volume window.
+func (ae *AlertEngine) addVolumeSample(key string, timestamp int64, payload map[string]interface{}) {
+	turnover, ok := number(payload, "turnover_volume")
+	if !ok {
+		return
+	}
+	var maxWindow int64
+	for _, r := range ae.rules {
+		if r.Kind == KindVolume && r.Market+":"+r.Identifier == key && r.Window > maxWindow {
+			maxWindow = r.Window
+		}
+	}
+	if maxWindow == 0 {
+		delete(ae.volumes, key)
+		return
+	}
+	samples := append(ae.volumes[key], volumeSample{timestamp, int64(turnover)})
+	from := timestamp - maxWindow*60*1000
+	for len(samples) > 1 && samples[1].timestamp <= from {
+		samples = samples[1:]
+	}
+	ae.volumes[key] = samples
+}
+
+func hasType(types []string, typ string) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func number(payload map[string]interface{}, field string) (float64, bool) {
+	switch v := payload[field].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// ---------- Persistence
+
+func (ae *AlertEngine) load() error {
+	b, err := ioutil.ReadFile(ae.file)
+	if err != nil {
+		return err
+	}
+	var rules []*Rule
+	if err = json.Unmarshal(b, &rules); err != nil {
+		return err
+	}
+	ae.Lock()
+	defer ae.Unlock()
+	for _, r := range rules {
+		r.armed = true
+		ae.rules[r.Id] = r
+	}
+	return nil
+}
+
+// Write all rules. Writes to a temp file first, like the feed snapshots.
+// Saves are serialized, so the last one written has the latest rules.
+func (ae *AlertEngine) save() error {
+	if ae.file == "" {
+		return nil
+	}
+	ae.saveLock.Lock()
+	defer ae.saveLock.Unlock()
+	rules := ae.Rules()
+	if rules == nil {
+		rules = []Rule{}
+	}
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return nnutils.WriteFileAtomic(ae.file, b, 0600)
+}
+
+// ---------- Transport commands
+
+func (ae *AlertEngine) create(params api.Params) (json.RawMessage, error) {
+	rule := &Rule{
+		Kind:       params["kind"],
+		Identifier: params["id"],
+		Market:     params["market"],
+		Field:      params["field"],
+		Op:         params["op"],
+		Text:       params["text"],
+		Repeat:     params["repeat"] == "true",
+		Note:       params["note"],
+	}
+	if v := params["value"]; v != "" {
+		if _, err := fmt.Sscan(v, &rule.Value); err != nil {
+			return nil, fmt.Errorf("Bad value '%s': %v", v, err)
+		}
+	}
+	if w := params["window"]; w != "" {
+		if _, err := fmt.Sscan(w, &rule.Window); err != nil {
+			return nil, fmt.Errorf("Bad window '%s': %v", w, err)
+		}
+	}
+	rule, err := ae.AddRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rule)
+}
+
+func (ae *AlertEngine) init() {
+	ae.AddCommand(string(api.AlertCreateCmd)).Description("Create an alert, evaluated on the feed. The instrument must be subscribed").
+		AddFullArgument("kind", "Kind of rule", []string{KindPrice, KindSpread, KindVolume, KindStatus}, false).
+		AddFullArgument("id", "Instrument id", []string{}, false).
+		AddFullArgument("market", "Market id", []string{}, false).
+		AddFullArgument("op", "Operator. Not used for status", []string{OpAbove, OpBelow, OpCrossAbove, OpCrossBelow}, true).
+		AddFullArgument("value", "Value to compare with. Ticks for spread", []string{}, true).
+		AddFullArgument("text", "Text to compare with, for status", []string{}, true).
+		AddFullArgument("field", "Field in the message. Default last for price, and status for status", []string{}, true).
+		AddFullArgument("window", "Minutes, for volume", []string{}, true).
+		AddFullArgument("repeat", "Keep the alert after it triggers", []string{"true", "false"}, true).
+		AddFullArgument("note", "Sent with the alert", []string{}, true).
+		Handler(ae.create)
+
+	ae.AddCommand(string(api.AlertListCmd)).Description("List alerts").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			rules := ae.Rules()
+			if rules == nil {
+				rules = []Rule{}
+			}
+			return json.Marshal(rules)
+		})
+
+	ae.AddCommand(string(api.AlertDeleteCmd)).Description("Delete an alert").
+		AddFullArgument("alert_id", "Id from AlertCreate or AlertList", []string{}, false).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if err := ae.DeleteRule(params["alert_id"]); err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]string{"alert_id": params["alert_id"], "status": "deleted"})
+		})
+}
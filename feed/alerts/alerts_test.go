@@ -0,0 +1,94 @@
+package alerts_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/alerts"
+	"github.com/Forau/yanngo/feed/feedmodel"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func priceMsg(last, bid, ask float64, turnover, ts int64) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsg([]byte(fmt.Sprintf(
+		`{"type":"price","data":{"i":"101","m":11,"last":%v,"bid":%v,"ask":%v,"turnover_volume":%d,"tick_timestamp":%d}}`,
+		last, bid, ask, turnover, ts)))
+	return msg
+}
+
+func TestAlertRules(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "alerts")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alerts.json")
+
+	ae, err := alerts.NewAlertEngine(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []feedmodel.FeedAlertData
+	fs := feed.NewFeedTransport(func(b []byte) error { return nil })
+	ae.Bind(fs)
+	fs.AddListener((&feed.FeedDispatcher{OnAlert: func(a *feedmodel.FeedAlertData) { got = append(got, *a) }}).Client())
+
+	cli := api.NewApiClient(ae)
+	cross, err := cli.AlertCreate(&api.AlertRule{Kind: alerts.KindPrice, Identifier: "101", Market: "11", Op: alerts.OpCrossAbove, Value: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ae.AddRule(&alerts.Rule{Kind: alerts.KindSpread, Identifier: "101", Market: "11", Op: alerts.OpAbove, Value: 5, Repeat: true})
+	volume, err := cli.AlertCreate(&api.AlertRule{Kind: alerts.KindVolume, Identifier: "101", Market: "11", Op: alerts.OpAbove, Value: 1000,
+		Window: 5, Note: "Volume spike"})
+	if err != nil || fmt.Sprint(volume["window"]) != "5" || volume["note"] != "Volume spike" {
+		t.Fatalf("Unexpected volume rule %+v: %+v", volume, err)
+	}
+	ae.AddRule(&alerts.Rule{Kind: alerts.KindStatus, Identifier: "101", Market: "11", Text: "H"})
+
+	fs.OnMessage(priceMsg(59, 59, 59.1, 100, 0), feedmodel.PublicFeedType)
+	fs.OnMessage(priceMsg(61, 60.5, 61, 500, 60000), feedmodel.PublicFeedType)   // Cross, and spread 2 ticks
+	fs.OnMessage(priceMsg(62, 61, 63, 900, 120000), feedmodel.PublicFeedType)    // Spread 8 ticks
+	fs.OnMessage(priceMsg(59, 59, 62, 1200, 180000), feedmodel.PublicFeedType)   // Spread still wide, volume 1100
+	fs.OnMessage(priceMsg(61, 61, 61.1, 1300, 600000), feedmodel.PublicFeedType) // Cross again, but the rule is one shot
+	fs.OnMessage(priceMsg(61, 60, 62, 1400, 610000), feedmodel.PublicFeedType)   // Spread wide again
+	status, _ := feedmodel.NewFeedMsg([]byte(`{"type":"trading_status","data":{"i":"101","m":11,"status":"H"}}`))
+	fs.OnMessage(status, feedmodel.PublicFeedType)
+
+	t.Logf("Alerts: %+v", got)
+	kinds := []string{}
+	for _, a := range got {
+		kinds = append(kinds, a.Kind)
+	}
+	if fmt.Sprint(kinds) != "[price spread volume spread status]" {
+		t.Fatalf("Unexpected alerts: %v", kinds)
+	}
+	if got[0].AlertId != cross["alert_id"] || got[0].Value != 61 || got[2].Value != 1100 {
+		t.Errorf("Unexpected alert values: %+v", got)
+	}
+
+	// Rules persist, including the triggered one shot
+	ae2, err := alerts.NewAlertEngine(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := api.NewApiClient(ae2).AlertList()
+	if err != nil || len(rules) != 4 {
+		t.Fatalf("Expected 4 rules after reload, but got %+v: %+v", rules, err)
+	}
+	for _, r := range ae2.Rules() {
+		if r.Active != (r.Kind == alerts.KindSpread) {
+			t.Errorf("Only the repeating rule should be active: %+v", r)
+		}
+	}
+	if _, err = api.NewApiClient(ae2).AlertDelete(cross["alert_id"].(string)); err != nil {
+		t.Error(err)
+	}
+	if _, err = api.NewApiClient(ae2).AlertDelete("nope"); err == nil {
+		t.Error("Expected error when deleting unknown alert")
+	}
+	if len(ae2.Rules()) != 3 {
+		t.Errorf("Expected 3 rules after delete, but got %+v", ae2.Rules())
+	}
+}
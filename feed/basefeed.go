@@ -3,9 +3,12 @@ package feed
 import (
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnutils"
 	"io"
-	"log"
+	"log/slog"
+	"sync"
 	"time"
 )
 
@@ -20,6 +23,38 @@ type Callback interface {
 	OnError(err error, ft feedmodel.FeedType)
 }
 
+// Optional interface for a Callback. If implemented, it will get all connection state transitions.
+type StateCallback interface {
+	OnStateChange(state ConnState, ft feedmodel.FeedType, err error)
+}
+
+// Listener for connection state transitions. err is set on disconnects, and when we give up.
+type StateListener func(state ConnState, ft feedmodel.FeedType, err error)
+
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota + 1
+	StateLoggedIn
+	StateDisconnected
+	StateClosed // Closed by us, or we gave up reconnecting. No more transitions after this.
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case StateConnecting:
+		return "connecting"
+	case StateLoggedIn:
+		return "logged_in"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
 type SessionProvider func() (key, url string, err error)
 
 // Arguments for sending the login command
@@ -27,37 +62,20 @@ type loginArgs struct {
 	SessionKey string `json:"session_key"`
 }
 
-func makeDelayRetry(msg string) func() {
-	resetTimer := time.Now().Add(time.Minute)
-	counter := 0
-	return func() {
-		if time.Now().After(resetTimer) {
-			counter = 0
-		}
-		resetTimer = time.Now().Add(time.Minute) // Reset in one minute, if no other call
-		counter++
-		var delay time.Duration
-		switch counter {
-		case 1:
-			delay = 0
-		case 2:
-			delay = 5000
-		default:
-			delay = 30000
-		}
-		log.Printf(msg, delay)
-		time.Sleep(delay * time.Millisecond)
-	}
-}
-
 type baseFeed struct {
-	conn    io.ReadWriteCloser
+	conn    io.ReadWriteCloser // Guarded by stateLock, like encoder
 	encoder *json.Encoder
 	decoder *json.Decoder
 
 	feedType feedmodel.FeedType
 	callback Callback
 	quit     chan interface{}
+
+	backoff  nnutils.BackoffPolicy
+	listener StateListener
+
+	stateLock sync.Mutex
+	state     ConnState
 }
 
 // For debugging
@@ -73,62 +91,134 @@ func (c *ConnWrap) Read(p []byte) (n int, err error) {
 
 func (c *ConnWrap) Write(p []byte) (n int, err error) {
 	n, err = c.conn.Write(p)
-	log.Printf("Write[%d](%v): %s", n, err, string(p))
+	if logger.Enabled(slog.LevelDebug) {
+		logger.Debug("Write", "bytes", n, "data", string(p), "err", err) // The login is redacted
+	}
 	return
 }
 
 func (c *ConnWrap) Close() (err error) {
 	err = c.conn.Close()
-	log.Printf("Close(%v)", err)
+	logger.Debug("Close", "err", err)
 	return
 }
 
-func newBaseFeed(sp SessionProvider, callback Callback, feedType feedmodel.FeedType) (feed *baseFeed, err error) {
-	feed = &baseFeed{quit: make(chan interface{}), feedType: feedType, callback: callback}
+func newBaseFeed(sp SessionProvider, callback Callback, feedType feedmodel.FeedType,
+	backoff nnutils.BackoffPolicy, listener StateListener) (feed *baseFeed, err error) {
+	feed = &baseFeed{quit: make(chan interface{}), feedType: feedType, callback: callback, backoff: backoff, listener: listener}
 	go feed.mainLoop(feed.quit, sp)
 	return
 }
 
+func (f *baseFeed) setState(state ConnState, err error) {
+	f.stateLock.Lock()
+	if f.state == StateClosed || (f.state == state && err == nil) {
+		f.stateLock.Unlock()
+		return
+	}
+	f.state = state
+	f.stateLock.Unlock()
+
+	if sc, ok := f.callback.(StateCallback); ok {
+		sc.OnStateChange(state, f.feedType, err)
+	}
+	if f.listener != nil {
+		f.listener(state, f.feedType, err)
+	}
+}
+
+func (f *baseFeed) State() ConnState {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	return f.state
+}
+
+func (f *baseFeed) currentConn() io.ReadWriteCloser {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	return f.conn
+}
+
+func (f *baseFeed) isQuit(quit chan interface{}) bool {
+	select {
+	case <-quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (f *baseFeed) mainLoop(quit chan interface{}, sp SessionProvider) {
-	defer func() { f.conn.Close() }() // In func, since conn will be changed
+	defer func() {
+		if conn := f.currentConn(); conn != nil {
+			conn.Close()
+		}
+		f.setState(StateClosed, nil)
+	}() // In func, since conn will be changed
 	go func() {
-		connectDelay := makeDelayRetry("Sleeping %dms before next reconnect")
-		for quit != nil {
+		connectDelay := f.backoff.NewBackoff()
+		for !f.isQuit(quit) {
+			if delay, ok := connectDelay.Next(); !ok {
+				f.setState(StateClosed, fmt.Errorf("Gave up after %d attempts", connectDelay.Attempt()-1))
+				return
+			} else if delay > 0 {
+				logger.Info("Sleeping before next reconnect", "feed", f.feedType, "delay", delay)
+				select {
+				case <-time.After(delay):
+				case <-f.quit:
+					return
+				}
+			}
+			f.setState(StateConnecting, nil)
+
 			var conn *tls.Conn
 			key, url, err := sp()
 			if err == nil {
 				conn, err = tls.Dial("tcp", url, DefaultTLS)
 			}
 			if err != nil {
-				log.Printf("Error connection: %+v", err)
+				logger.Warn("Unable to connect", "feed", f.feedType, "err", err)
+				f.setState(StateDisconnected, err)
 			} else {
 				connw := &ConnWrap{conn}
+				f.stateLock.Lock()
 				f.conn = connw
+				f.stateLock.Unlock()
 				enc := json.NewEncoder(connw) // Dont assign befor our login, let other writers fail on old connection
 				// Login
 				enc.Encode(&feedmodel.FeedCmd{Cmd: "login", Args: &loginArgs{SessionKey: key}})
+				f.stateLock.Lock()
 				f.encoder = enc
+				f.stateLock.Unlock()
 				f.decoder = json.NewDecoder(connw)
 				f.decoder.UseNumber()
 
+				f.setState(StateLoggedIn, nil)
 				f.callback.OnConnect(f.Write, f.feedType)
 
 				var readerr error
-				for readerr == nil && quit != nil {
+				gotMsg := false
+				for readerr == nil && !f.isQuit(quit) {
 					msg := &feedmodel.FeedMsg{}
 					if readerr = f.decoder.Decode(msg); readerr == nil {
+						gotMsg = true
 						f.callback.OnMessage(msg, f.feedType)
 					} else {
 						f.callback.OnError(readerr, f.feedType)
 					}
 				}
-				log.Printf("Got error while reading %+v  (Quit: %+v)", err, quit)
+				closed := f.isQuit(quit)
+				logger.Info("Stopped reading", "feed", f.feedType, "closed", closed, "err", readerr)
+				if !closed {
+					f.setState(StateDisconnected, readerr)
+				}
+				if gotMsg {
+					connectDelay.Reset() // The connection worked, so only count failures in a row
+				}
 			}
-			connectDelay()
 		}
 	}()
 	<-quit
-	quit = nil
 }
 
 func (f *baseFeed) Write(any *feedmodel.FeedCmd) (err error) {
@@ -137,10 +227,13 @@ func (f *baseFeed) Write(any *feedmodel.FeedCmd) (err error) {
 			err = e
 			f.callback.OnError(e, f.feedType)
 		}
-		log.Printf("Writing %+v -> %+v", any, err)
+		logger.Debug("Writing", "feed", f.feedType, "cmd", any.Cmd, "err", err)
 	}()
 
-	err = f.encoder.Encode(any)
+	f.stateLock.Lock()
+	enc := f.encoder
+	f.stateLock.Unlock()
+	err = enc.Encode(any)
 	return
 }
 
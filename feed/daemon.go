@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/Forau/yanngo/api"
 	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnutils"
 	//	"log"
 )
 
@@ -87,18 +88,36 @@ func NewFeedDaemonAPI(api *api.ApiClient) (fd *FeedDaemon, err error) {
 }
 
 func NewFeedDaemon(privSess, pubSess SessionProvider, cb Callback) (fd *FeedDaemon, err error) {
+	return NewFeedDaemonWithOptions(privSess, pubSess, cb, nnutils.DefaultBackoffPolicy, nil)
+}
+
+// Same as NewFeedDaemon, but with own reconnect policy, and a listener for connection states. The listener can be nil.
+// pubSess can be nil, to only connect the private feed, like for the extra logins of a daemon.
+func NewFeedDaemonWithOptions(privSess, pubSess SessionProvider, cb Callback,
+	backoff nnutils.BackoffPolicy, listener StateListener) (fd *FeedDaemon, err error) {
 	fd = &FeedDaemon{}
 
-	fd.private, err = newBaseFeed(privSess, cb, feedmodel.PrivateFeedType)
-	if err != nil {
+	fd.private, err = newBaseFeed(privSess, cb, feedmodel.PrivateFeedType, backoff, listener)
+	if err != nil || pubSess == nil {
 		return
 	}
-	fd.public, err = newBaseFeed(pubSess, cb, feedmodel.PublicFeedType)
+	fd.public, err = newBaseFeed(pubSess, cb, feedmodel.PublicFeedType, backoff, listener)
 	return
 }
 
+// Current connection state of the feeds. The public state is 0 without a public feed.
+func (fd *FeedDaemon) State() (private, public ConnState) {
+	if fd.public == nil {
+		return fd.private.State(), 0
+	}
+	return fd.private.State(), fd.public.State()
+}
+
 func (fd *FeedDaemon) Close() error {
 	err1 := fd.private.Close()
+	if fd.public == nil {
+		return err1
+	}
 	err2 := fd.public.Close()
 	if err1 != nil {
 		return err1
@@ -111,16 +130,60 @@ func (fd *FeedDaemon) Subscribe(typ, ident, market string) error {
 	if e != nil {
 		return e
 	}
+	if fd.public == nil {
+		return fmt.Errorf("No public feed to subscribe on")
+	}
 
 	return fd.public.Write(cmd)
 }
 
 // ONLY for testing....
 func (fd *FeedDaemon) KillSockets() (string, error) {
-	err := fd.private.conn.Close()
-	if err != nil {
+	err := fd.private.currentConn().Close()
+	if err != nil || fd.public == nil {
 		return "", err
 	}
-	err = fd.public.conn.Close()
+	err = fd.public.currentConn().Close()
 	return "Killed sockets", err
 }
+
+// Forwards the orders, trades and errors of the private feed of another login to cb. Heartbeats, connects and state
+// changes are only logged, so cb keeps track of the feeds of its own login. A FeedState does not take the forwarded
+// messages as heartbeats either.
+func LoginCallback(login string, cb Callback) Callback {
+	return &loginCallback{login: login, cb: cb}
+}
+
+type loginCallback struct {
+	login string
+	cb    Callback
+}
+
+func (lc *loginCallback) OnConnect(w CmdWriter, ft feedmodel.FeedType) {
+	logger.Info("Connected", "login", lc.login, "feed", ft)
+}
+
+// Callbacks that can tell the messages of another login from those of their own feed
+type loginMessageHandler interface {
+	onLoginMessage(msg *feedmodel.FeedMsg, ft feedmodel.FeedType)
+}
+
+func (lc *loginCallback) OnMessage(msg *feedmodel.FeedMsg, ft feedmodel.FeedType) {
+	if msg.Type != "order" && msg.Type != "trade" {
+		return
+	}
+	if h, ok := lc.cb.(loginMessageHandler); ok {
+		h.onLoginMessage(msg, ft)
+	} else {
+		lc.cb.OnMessage(msg, ft)
+	}
+}
+
+func (lc *loginCallback) OnError(err error, ft feedmodel.FeedType) {
+	logger.Warn("Feed error", "login", lc.login, "feed", ft, "err", err)
+	lc.cb.OnError(err, ft)
+}
+
+func (lc *loginCallback) OnStateChange(state ConnState, ft feedmodel.FeedType, err error) {
+	logger.Info("State changed", "login", lc.login, "feed", ft, "state", state, "err", err)
+}
@@ -8,12 +8,19 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"github.com/Forau/yanngo/api"
 	"github.com/Forau/yanngo/feed"
 	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnutils"
 	"github.com/Forau/yanngo/remote"
 
+	"io/ioutil"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -65,23 +72,22 @@ func init() {
 }
 
 type testSrv struct {
-	listen   net.Listener
-	t        *testing.T
-	exit     chan interface{}
-	isClosed bool
+	listen net.Listener
+	t      *testing.T
+	exit   chan interface{}
+	closed chan interface{}
 
 	connFn func(c net.Conn)
 }
 
 func (ts *testSrv) Close() error {
 	close(ts.exit)
-	for i := 0; i < 10; i++ {
-		if ts.isClosed {
-			return nil
-		}
-		time.Sleep(100 * time.Millisecond)
+	select {
+	case <-ts.closed:
+		return nil
+	case <-time.After(time.Second):
+		return fmt.Errorf("Server did not close within one second...")
 	}
-	return fmt.Errorf("Server did not close within one second...")
 }
 
 func (ts *testSrv) mainLoop() {
@@ -97,8 +103,8 @@ func (ts *testSrv) mainLoop() {
 		}
 	}(ts.listen)
 	<-ts.exit // Wait for exit
-	ts.isClosed = true
-	ts.t.Logf("Exiting main loop for %+v", ts)
+	ts.t.Logf("Exiting main loop for %s", ts.listen.Addr())
+	close(ts.closed)
 }
 
 func newTestSrv(t *testing.T, connFn func(net.Conn)) (srv *testSrv) {
@@ -111,6 +117,7 @@ func newTestSrv(t *testing.T, connFn func(net.Conn)) (srv *testSrv) {
 		listen: l,
 		t:      t,
 		exit:   make(chan interface{}),
+		closed: make(chan interface{}),
 		connFn: connFn,
 	}
 	go srv.mainLoop()
@@ -241,3 +248,248 @@ func TestFeedTransportState(t *testing.T) {
 	}
 
 }
+
+func TestFeedStaleAndGap(t *testing.T) {
+	statuses := make(chan feedmodel.FeedStatusData, 10)
+	trades := 0
+	pubChan := remote.StreamTopicChannel(func(b []byte) (err error) {
+		msg, err := feedmodel.NewFeedMsg(b)
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case "feed_status":
+			var status feedmodel.FeedStatusData
+			if err = msg.DecodeData(&status); err == nil {
+				statuses <- status
+			}
+		case "resynctrade":
+			trades++
+		case "trade":
+			t.Errorf("Did not expect a live trade: %s", msg.String())
+		}
+		return
+	})
+	restTransport := api.Transport(func(req *api.Request) (res api.Response) {
+		switch req.Command {
+		case api.TradableInfoCmd:
+			res.Payload = []byte(`[{"market_id":11,"identifier":"101"}]`)
+		case api.TradableTradesCmd:
+			res.Payload = []byte(`[{"market_id":11,"identifier":"101","trades":[{"price":73.2,"volume":100,"trade_id":"1"},{"price":73.3,"volume":200,"trade_id":"2"}]}]`)
+		default:
+			res.Fail(-1, "Not in test")
+		}
+		return
+	})
+
+	ft := feed.NewFeedTransport(pubChan).
+		SetStaleLimit(10 * time.Millisecond).
+		SetMarketHours(func(key feed.FeedSubscriptionKey, millis int64) bool { return true }).
+		SetSnapshotClient(api.NewApiClient(restTransport))
+	ft.AddSubscription(&feedmodel.FeedCmd{Cmd: "subscribe", Args: map[string]interface{}{"t": "price", "i": "101", "m": 11}})
+
+	expectStatus := func(status string) {
+		select {
+		case res := <-statuses:
+			t.Logf("Got status: %+v", res)
+			if res.Status != status {
+				t.Errorf("Expected status %s, but got %+v", status, res)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Timeout waiting for status %s", status)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	ft.CheckStale(time.Now())
+	expectStatus(feedmodel.FeedStatusStale)
+
+	ft.CheckStale(time.Now()) // Should not report again
+	select {
+	case res := <-statuses:
+		t.Errorf("Did not expect status, but got %+v", res)
+	default:
+	}
+
+	msg, _ := feedmodel.NewFeedMsg([]byte(`{"type":"price","data":{"i":"101","m":11,"last":73.05}}`))
+	ft.OnMessage(msg, feedmodel.PublicFeedType)
+	expectStatus(feedmodel.FeedStatusFresh)
+
+	writer := feed.CmdWriter(func(cmd *feedmodel.FeedCmd) error { return nil })
+	ft.OnConnect(writer, feedmodel.PublicFeedType)
+	ft.OnConnect(writer, feedmodel.PublicFeedType)
+	expectStatus(feedmodel.FeedStatusGap)
+	expectStatus(feedmodel.FeedStatusResync)
+	if trades != 2 {
+		t.Errorf("Expected 2 trades from the refresh, but got %d", trades)
+	}
+}
+
+func TestFeedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feedsnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "feed.snapshot")
+
+	nopChan := remote.StreamTopicChannel(func(b []byte) error { return nil })
+	lastOf := func(ft *feed.FeedState) (res map[string]interface{}) {
+		resp := ft.Preform(&api.Request{Command: api.FeedLastCmd, Args: api.Params{"type": "price", "id": "101", "market": "11"}})
+		if resp.IsError() {
+			t.Fatalf("FeedLast failed: %+v", resp.Error)
+		}
+		if err := resp.Unmarshal(&res); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	ft := feed.NewFeedTransport(nopChan)
+	ft.AddSubscription(&feedmodel.FeedCmd{Cmd: "subscribe", Args: map[string]interface{}{"t": "price", "i": "101", "m": 11}})
+	for _, data := range []string{
+		`{"type":"price","data":{"i":"101","m":11,"last":73.05,"bid":73.00}}`,
+		`{"type":"order","data":{"accno":123,"order_id":42,"volume":100}}`,
+	} {
+		msg, _ := feedmodel.NewFeedMsg([]byte(data))
+		ft.OnMessage(msg, feedmodel.PublicFeedType)
+	}
+	if err := ft.SaveSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := feed.NewFeedTransport(nopChan)
+	if err := restored.RestoreSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+	last := lastOf(restored)
+	t.Logf("Restored: %+v", last)
+	if last[feed.RestoredStaleField] != true || fmt.Sprintf("%v", last["last"]) != "73.05" {
+		t.Errorf("Expected restored price to be stale with last 73.05, but got %+v", last)
+	}
+
+	msg, _ := feedmodel.NewFeedMsg([]byte(`{"type":"price","data":{"i":"101","m":11,"last":73.10}}`))
+	restored.OnMessage(msg, feedmodel.PublicFeedType)
+	last = lastOf(restored)
+	if _, ok := last[feed.RestoredStaleField]; ok || fmt.Sprintf("%v", last["bid"]) != "73.00" {
+		t.Errorf("Expected fresh price, with the old bid kept, but got %+v", last)
+	}
+
+	// Clients subscribing again, and a second restore, should not add duplicates
+	restored.AddSubscription(&feedmodel.FeedCmd{Cmd: "subscribe", Args: map[string]interface{}{"t": "price", "i": "101", "m": 11}})
+	if err := restored.RestoreSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+	status := restored.Preform(&api.Request{Command: api.FeedStatusCmd, Args: api.Params{}})
+	var statusMap map[string]interface{}
+	status.Unmarshal(&statusMap)
+	if subs, ok := statusMap["subsctiptions"].([]interface{}); !ok || len(subs) != 1 {
+		t.Errorf("Expected the subscription to be restored, but got %+v", statusMap["subsctiptions"])
+	}
+
+	// Saved every interval, until stopped
+	os.Remove(file)
+	if err := restored.EnableSnapshots(file, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	restored.StopSnapshots()
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected a snapshot to be saved: %+v", err)
+	}
+	os.Remove(file)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected no snapshot after stop: %+v", err)
+	}
+}
+
+func TestLoginCallback(t *testing.T) {
+	var lock sync.Mutex
+	var types []string
+	ft := feed.NewFeedTransport(func(data []byte) error {
+		msg, _ := feedmodel.NewFeedMsg(data)
+		lock.Lock()
+		types = append(types, msg.Type)
+		lock.Unlock()
+		return nil
+	})
+	cb := feed.LoginCallback("other", ft)
+	for _, data := range []string{
+		`{"type":"heartbeat","data":{}}`,
+		`{"type":"order","data":{"accno":456,"order_id":7,"volume":10}}`,
+		`{"type":"trade","data":{"accno":456,"order_id":7,"trade_id":"T1","volume":10}}`,
+	} {
+		msg, _ := feedmodel.NewFeedMsg([]byte(data))
+		cb.OnMessage(msg, feedmodel.PrivateFeedType)
+	}
+	lock.Lock()
+	if strings.Join(types, ",") != "order,privtrade" {
+		t.Errorf("Expected the order and trade of the other login, but got %v", types)
+	}
+	lock.Unlock()
+	status, err := api.NewApiClient(ft).FeedStatus()
+	if hbs, ok := status["heartbeats"].(map[string]interface{}); err != nil || !ok || hbs["NumPriv"] != 0.0 {
+		t.Errorf("Expected no heartbeats from the other login: %+v, %+v", status["heartbeats"], err)
+	}
+}
+
+func TestFeedStateTransitions(t *testing.T) {
+	srv := newTestSrv(t, func(c net.Conn) {
+		defer c.Close()
+		c.Write([]byte(`{"type":"heartbeat","data":{}}` + "\n"))
+		buff := make([]byte, 1024)
+		for {
+			if _, err := c.Read(buff); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	states := make(chan string, 100)
+	listener := feed.StateListener(func(state feed.ConnState, ft feedmodel.FeedType, err error) {
+		t.Logf("State[%v]: %v (%v)", ft, state, err)
+		states <- fmt.Sprintf("%v:%v", ft, state)
+	})
+	goodSess := func() (key, url string, err error) {
+		return "KEY", srv.listen.Addr().String(), nil
+	}
+	badSess := func() (key, url string, err error) {
+		return "", "", fmt.Errorf("No session in test")
+	}
+	policy := nnutils.BackoffPolicy{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+
+	fd, err := feed.NewFeedDaemonWithOptions(badSess, goodSess, &simpleCallback{t, make(chan bool, 2)}, policy, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]bool{"private:closed": false, "public:logged_in": false}
+	timeout := time.After(2 * time.Second)
+	for !expect["private:closed"] || !expect["public:logged_in"] {
+		select {
+		case s := <-states:
+			if _, ok := expect[s]; ok {
+				expect[s] = true
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for states: %+v", expect)
+		}
+	}
+	if priv, pub := fd.State(); priv != feed.StateClosed || pub != feed.StateLoggedIn {
+		t.Errorf("Expected private closed, and public logged in, but got %v and %v", priv, pub)
+	}
+
+	fd.Close()
+	for {
+		select {
+		case s := <-states:
+			if s == "public:closed" {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for public feed to close")
+		}
+	}
+}
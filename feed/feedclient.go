@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"github.com/Forau/yanngo/feed/feedmodel"
 	"github.com/Forau/yanngo/remote"
-	"log"
 
 	"sort"
 )
@@ -21,7 +20,7 @@ func (fc FeedClient) Handle(topic string, data []byte) (err error) {
 	if err = der.Decode(&msg); err == nil {
 		fc(&msg)
 	} else {
-		log.Printf("[%s] WARNING: %v: (%s)", topic, err, string(data))
+		logger.Warn("Unable to decode feed message", "topic", topic, "data", string(data), "err", err)
 	}
 	return
 }
@@ -36,6 +35,125 @@ func BindFeedClient(ps remote.PubSub, feedUri string, fc FeedClient) error {
 	return ps.Sub(feedUri, fc)
 }
 
+// FeedDispatcher decodes messages to the typed structs in feedmodel, and routes them to one handler per type.
+// Handlers not set are ignored. Use Client() to get a FeedClient, so it can be bound or wrapped in a FeedSorter.
+type FeedDispatcher struct {
+	OnPrice         func(*feedmodel.FeedPriceData)
+	OnDepth         func(*feedmodel.FeedDepthData)
+	OnTrade         func(*feedmodel.FeedTradeData)
+	OnPrivateTrade  func(*feedmodel.FeedPrivateTradeData)
+	OnOrder         func(*feedmodel.FeedOrderData)
+	OnIndicator     func(*feedmodel.FeedIndicatorData)
+	OnNews          func(*feedmodel.FeedNewsData)
+	OnTradingStatus func(*feedmodel.FeedTradingStatusData)
+	OnFeedStatus    func(*feedmodel.FeedStatusData)
+	OnAlert         func(*feedmodel.FeedAlertData)
+
+	OnUnknown func(*feedmodel.FeedMsg)        // Types we do not have a struct for
+	OnError   func(*feedmodel.FeedMsg, error) // Decode errors. If nil, they are logged
+}
+
+func (fd *FeedDispatcher) Dispatch(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	var err error
+	switch msg.Type {
+	case "price":
+		if fd.OnPrice != nil {
+			var data feedmodel.FeedPriceData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnPrice(&data)
+			}
+		}
+	case "depth":
+		if fd.OnDepth != nil {
+			var data feedmodel.FeedDepthData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnDepth(&data)
+			}
+		}
+	case "trade":
+		if fd.OnTrade != nil {
+			var data feedmodel.FeedTradeData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnTrade(&data)
+			}
+		}
+	case "privtrade":
+		if fd.OnPrivateTrade != nil {
+			var data feedmodel.FeedPrivateTradeData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnPrivateTrade(&data)
+			}
+		}
+	case "order":
+		if fd.OnOrder != nil {
+			var data feedmodel.FeedOrderData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnOrder(&data)
+			}
+		}
+	case "indicator":
+		if fd.OnIndicator != nil {
+			var data feedmodel.FeedIndicatorData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnIndicator(&data)
+			}
+		}
+	case "news":
+		if fd.OnNews != nil {
+			var data feedmodel.FeedNewsData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnNews(&data)
+			}
+		}
+	case "trading_status":
+		if fd.OnTradingStatus != nil {
+			var data feedmodel.FeedTradingStatusData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnTradingStatus(&data)
+			}
+		}
+	case "feed_status":
+		if fd.OnFeedStatus != nil {
+			var data feedmodel.FeedStatusData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnFeedStatus(&data)
+			}
+		}
+	case "alert":
+		if fd.OnAlert != nil {
+			var data feedmodel.FeedAlertData
+			if err = msg.DecodeData(&data); err == nil {
+				fd.OnAlert(&data)
+			}
+		}
+	default:
+		if fd.OnUnknown != nil {
+			fd.OnUnknown(msg)
+		}
+	}
+
+	if err != nil {
+		if fd.OnError != nil {
+			fd.OnError(msg, err)
+		} else {
+			logger.Warn("Unable to decode message", "msg", msg.String(), "err", err)
+		}
+	}
+}
+
+// The dispatcher as a FeedClient
+func (fd *FeedDispatcher) Client() FeedClient {
+	return fd.Dispatch
+}
+
+// Bind the dispatcher to a feed topic
+func (fd *FeedDispatcher) Bind(ps remote.PubSub, feedUri string) error {
+	return fd.Client().Bind(ps, feedUri)
+}
+
 // FeedSorter will try and get out of order messages back in order.
 // This can occure if you send the feed to a event queue.
 // Requires that SeqId is set.
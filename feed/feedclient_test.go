@@ -50,3 +50,56 @@ func TestFeedClient(t *testing.T) {
 	}
 	close(msgChan)
 }
+
+func TestFeedDispatcher(t *testing.T) {
+	var prices []*feedmodel.FeedPriceData
+	var orders []*feedmodel.FeedOrderData
+	var privTrades []*feedmodel.FeedPrivateTradeData
+	var depths []*feedmodel.FeedDepthData
+	var unknown, errors int
+
+	fd := &feed.FeedDispatcher{
+		OnPrice:        func(p *feedmodel.FeedPriceData) { prices = append(prices, p) },
+		OnOrder:        func(o *feedmodel.FeedOrderData) { orders = append(orders, o) },
+		OnPrivateTrade: func(tr *feedmodel.FeedPrivateTradeData) { privTrades = append(privTrades, tr) },
+		OnDepth:        func(d *feedmodel.FeedDepthData) { depths = append(depths, d) },
+		OnUnknown:      func(msg *feedmodel.FeedMsg) { unknown++ },
+		OnError:        func(msg *feedmodel.FeedMsg, err error) { t.Logf("Expected error: %+v", err); errors++ },
+	}
+	fc := fd.Client()
+
+	for _, data := range []string{
+		`{"type":"price","data":{"i":"101","m":11,"last":73.05,"last_volume":204062,"tick_timestamp":1466185530378}}`,
+		`{"type":"depth","data":{"i":"101","m":11,"bid1":72.85,"bid_volume1":410206,"ask2":73.10}}`,
+		`{"type":"order","data":{"accno":123,"order_id":42,"price":{"value":73.5,"currency":"SEK"},"volume":100,"tradable":{"identifier":"101","market_id":11},"side":"BUY","order_state":"LOCAL"}}`,
+		`{"type":"privtrade","data":{"accno":123,"order_id":42,"trade_id":"T1","tradable":{"identifier":"101","market_id":11},"price":{"value":73.5,"currency":"SEK"},"volume":100,"side":"BUY"}}`,
+		`{"type":"news","data":{"news_id":1}}`,
+		`{"type":"somethingNew","data":{}}`,
+		`{"type":"price","data":{"i":101}}`,
+	} {
+		msg, err := feedmodel.NewFeedMsg([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fc(msg)
+	}
+
+	if len(prices) != 1 || prices[0].Last != 73.05 || prices[0].Market != 11 {
+		t.Errorf("Unexpected prices: %+v", prices)
+	}
+	if len(depths) != 1 || depths[0].Levels()[0].Bid != 72.85 || depths[0].Levels()[1].Ask != 73.10 {
+		t.Errorf("Unexpected depths: %+v", depths)
+	}
+	if len(orders) != 1 || orders[0].OrderId != 42 || orders[0].Price.Value != 73.5 || orders[0].Tradable.Identifier != "101" {
+		t.Errorf("Unexpected orders: %+v", orders)
+	}
+	if len(privTrades) != 1 || privTrades[0].TradeId != "T1" || privTrades[0].Volume != 100 {
+		t.Errorf("Unexpected private trades: %+v", privTrades)
+	}
+	if unknown != 1 {
+		t.Errorf("Expected 1 unknown message, but got %d", unknown)
+	}
+	if errors != 1 {
+		t.Errorf("Expected 1 decode error, but got %d", errors)
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/Forau/yanngo/nnlog"
 	"sort"
-
-	"log"
 )
 
+var logger = nnlog.For("feed/feedmodel")
+
 type FeedType uint64
 
 const (
@@ -35,6 +36,17 @@ func (ts TradeSide) String() string {
 	}
 }
 
+func (ft FeedType) String() string {
+	switch ft {
+	case PrivateFeedType:
+		return "private"
+	case PublicFeedType:
+		return "public"
+	default:
+		return "unknown"
+	}
+}
+
 // Used when sending feed commands
 type FeedCmd struct {
 	Cmd  string      `json:"cmd"`
@@ -230,6 +242,7 @@ func FilterCount(num int64) FilterBreakMatcher {
 	}
 }
 
+// A public trade. Sent on topic as 'trade', or as 'resynctrade' when refreshed via REST after a gap.
 type FeedTradeData struct {
 	Identifier      string  `json:"i,omitempty"`
 	Market          int64   `json:"m,omitempty"`
@@ -332,6 +345,171 @@ func (fids FeedIndicatorDataSequence) Sort() {
 	sort.Sort(fids)
 }
 
+// Struct to represent a depth update. Nordnet sends up to five levels, and only changed fields.
+type FeedDepthData struct {
+	Identifier     string  `json:"i,omitempty"`
+	Market         int64   `json:"m,omitempty"`
+	Tick_timestamp int64   `json:"tick_timestamp,omitempty"`
+	Bid1           float64 `json:"bid1,omitempty"`
+	Bid_volume1    int64   `json:"bid_volume1,omitempty"`
+	Bid_orders1    int64   `json:"bid_orders1,omitempty"`
+	Ask1           float64 `json:"ask1,omitempty"`
+	Ask_volume1    int64   `json:"ask_volume1,omitempty"`
+	Ask_orders1    int64   `json:"ask_orders1,omitempty"`
+	Bid2           float64 `json:"bid2,omitempty"`
+	Bid_volume2    int64   `json:"bid_volume2,omitempty"`
+	Bid_orders2    int64   `json:"bid_orders2,omitempty"`
+	Ask2           float64 `json:"ask2,omitempty"`
+	Ask_volume2    int64   `json:"ask_volume2,omitempty"`
+	Ask_orders2    int64   `json:"ask_orders2,omitempty"`
+	Bid3           float64 `json:"bid3,omitempty"`
+	Bid_volume3    int64   `json:"bid_volume3,omitempty"`
+	Bid_orders3    int64   `json:"bid_orders3,omitempty"`
+	Ask3           float64 `json:"ask3,omitempty"`
+	Ask_volume3    int64   `json:"ask_volume3,omitempty"`
+	Ask_orders3    int64   `json:"ask_orders3,omitempty"`
+	Bid4           float64 `json:"bid4,omitempty"`
+	Bid_volume4    int64   `json:"bid_volume4,omitempty"`
+	Bid_orders4    int64   `json:"bid_orders4,omitempty"`
+	Ask4           float64 `json:"ask4,omitempty"`
+	Ask_volume4    int64   `json:"ask_volume4,omitempty"`
+	Ask_orders4    int64   `json:"ask_orders4,omitempty"`
+	Bid5           float64 `json:"bid5,omitempty"`
+	Bid_volume5    int64   `json:"bid_volume5,omitempty"`
+	Bid_orders5    int64   `json:"bid_orders5,omitempty"`
+	Ask5           float64 `json:"ask5,omitempty"`
+	Ask_volume5    int64   `json:"ask_volume5,omitempty"`
+	Ask_orders5    int64   `json:"ask_orders5,omitempty"`
+}
+
+// One level in the book
+type FeedDepthLevel struct {
+	Bid, Ask             float64
+	BidVolume, AskVolume int64
+	BidOrders, AskOrders int64
+}
+
+// The depth as levels, best price first
+func (fdd *FeedDepthData) Levels() []FeedDepthLevel {
+	return []FeedDepthLevel{
+		{fdd.Bid1, fdd.Ask1, fdd.Bid_volume1, fdd.Ask_volume1, fdd.Bid_orders1, fdd.Ask_orders1},
+		{fdd.Bid2, fdd.Ask2, fdd.Bid_volume2, fdd.Ask_volume2, fdd.Bid_orders2, fdd.Ask_orders2},
+		{fdd.Bid3, fdd.Ask3, fdd.Bid_volume3, fdd.Ask_volume3, fdd.Bid_orders3, fdd.Ask_orders3},
+		{fdd.Bid4, fdd.Ask4, fdd.Bid_volume4, fdd.Ask_volume4, fdd.Bid_orders4, fdd.Ask_orders4},
+		{fdd.Bid5, fdd.Ask5, fdd.Bid_volume5, fdd.Ask_volume5, fdd.Bid_orders5, fdd.Ask_orders5},
+	}
+}
+
+type FeedNewsData struct {
+	News_id     int64   `json:"news_id,omitempty"`
+	Source_id   int64   `json:"source_id,omitempty"`
+	Headline    string  `json:"headline,omitempty"`
+	Instruments []int64 `json:"instruments,omitempty"`
+	Lang        string  `json:"lang,omitempty"`
+	Type        string  `json:"type,omitempty"`
+	Timestamp   int64   `json:"timestamp,omitempty"`
+}
+
+type FeedTradingStatusData struct {
+	Identifier     string `json:"i,omitempty"`
+	Market         int64  `json:"m,omitempty"`
+	Tick_timestamp int64  `json:"tick_timestamp,omitempty"`
+	Status         string `json:"status,omitempty"`
+	Source_status  string `json:"source_status,omitempty"`
+	Halted         string `json:"halted,omitempty"`
+}
+
+// Statuses used in FeedStatusData
+const (
+	FeedStatusStale  = "stale"  // A subscription has not been updated within the limit, while the market is open
+	FeedStatusFresh  = "fresh"  // A stale subscription got data again
+	FeedStatusGap    = "gap"    // The feed reconnected, and messages in between might be lost
+	FeedStatusResync = "resync" // Snapshots were refreshed after a gap
+)
+
+// Sent on the feed topic as 'feed_status' when the daemon detects problems with the feed itself
+type FeedStatusData struct {
+	Status     string `json:"status"`
+	Feed       string `json:"feed,omitempty"` // 'public' or 'private'
+	Type       string `json:"t,omitempty"`
+	Identifier string `json:"i,omitempty"`
+	Market     string `json:"m,omitempty"`
+	LastUpdate int64  `json:"last_update,omitempty"` // Millis of last data before the event
+	Timestamp  int64  `json:"timestamp"`
+	Message    string `json:"msg,omitempty"`
+}
+
+// Sent on the feed topic as 'alert' when an alert rule triggers
+type FeedAlertData struct {
+	AlertId    string  `json:"alert_id"`
+	Kind       string  `json:"kind"`
+	Identifier string  `json:"i,omitempty"`
+	Market     string  `json:"m,omitempty"`
+	Condition  string  `json:"condition"`       // Human readable, like 'last cross_above 60'
+	Value      float64 `json:"value,omitempty"` // The value that triggered
+	Text       string  `json:"text,omitempty"`  // For text rules, like trading status
+	Note       string  `json:"note,omitempty"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+// ---------- Private feed. The structs mirror the ones in swagger, without importing it.
+
+type FeedAmount struct {
+	Value    float64 `json:"value,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+type FeedTradableId struct {
+	Identifier string `json:"identifier,omitempty"`
+	MarketId   int64  `json:"market_id,omitempty"`
+}
+
+type FeedActivationCondition struct {
+	Type             string  `json:"type,omitempty"`
+	TrailingValue    float64 `json:"trailing_value,omitempty"`
+	TriggerValue     float64 `json:"trigger_value,omitempty"`
+	TriggerCondition string  `json:"trigger_condition,omitempty"`
+}
+
+type FeedValidity struct {
+	Type       string `json:"type,omitempty"`
+	ValidUntil int64  `json:"valid_until,omitempty"`
+}
+
+// Order update from the private feed. Same as swagger.Order
+type FeedOrderData struct {
+	Accno               int64                   `json:"accno,omitempty"`
+	OrderId             int64                   `json:"order_id,omitempty"`
+	Price               FeedAmount              `json:"price,omitempty"`
+	Volume              float64                 `json:"volume,omitempty"`
+	Tradable            FeedTradableId          `json:"tradable,omitempty"`
+	OpenVolume          float64                 `json:"open_volume,omitempty"`
+	TradedVolume        float64                 `json:"traded_volume,omitempty"`
+	Side                string                  `json:"side,omitempty"`
+	Modified            int64                   `json:"modified,omitempty"`
+	Reference           string                  `json:"reference,omitempty"`
+	ActivationCondition FeedActivationCondition `json:"activation_condition,omitempty"`
+	PriceCondition      string                  `json:"price_condition,omitempty"`
+	VolumeCondition     string                  `json:"volume_condition,omitempty"`
+	Validity            FeedValidity            `json:"validity,omitempty"`
+	ActionState         string                  `json:"action_state,omitempty"`
+	OrderType           string                  `json:"order_type,omitempty"`
+	OrderState          string                  `json:"order_state,omitempty"`
+}
+
+// Trade from the private feed, sent on topic as 'privtrade'. Same as swagger.Trade
+type FeedPrivateTradeData struct {
+	Accno        int64          `json:"accno,omitempty"`
+	OrderId      int64          `json:"order_id,omitempty"`
+	TradeId      string         `json:"trade_id,omitempty"`
+	Tradable     FeedTradableId `json:"tradable,omitempty"`
+	Price        FeedAmount     `json:"price,omitempty"`
+	Volume       float64        `json:"volume,omitempty"`
+	Side         string         `json:"side,omitempty"`
+	Counterparty string         `json:"counterparty,omitempty"`
+	Tradetime    int64          `json:"tradetime,omitempty"`
+}
+
 /// A struct like swagger.TradableId, since we dont want to import that package here.
 type tradableId struct {
 	identifier string
@@ -360,14 +538,14 @@ func (tc *TradeCatcher) OnFeed(msg *FeedMsg) {
 		if err := msg.DecodeData(&price); err == nil {
 			tc.OnPrice(&price)
 		} else {
-			log.Printf("Could not decode price data: %+v", err)
+			logger.Warn("Could not decode price data", "err", err)
 		}
 	} else if msg.Type == "trade" {
 		var trade FeedTradeData
 		if err := msg.DecodeData(&trade); err == nil {
 			tc.OnTrade(&trade)
 		} else {
-			log.Printf("Could not decode trade data: %+v", err)
+			logger.Warn("Could not decode trade data", "err", err)
 		}
 	}
 }
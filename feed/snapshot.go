@@ -0,0 +1,137 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnutils"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Field set on restored state and orders, until fresh data is merged in
+const RestoredStaleField = "stale"
+
+type snapshotEntry struct {
+	Key  FeedSubscriptionKey    `json:"key"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// What we write to disk. Subscriptions and the merged state.
+type feedSnapshot struct {
+	Timestamp int64                    `json:"timestamp"`
+	Subs      []*feedmodel.FeedCmd     `json:"subs"`
+	State     []snapshotEntry          `json:"state"`
+	Orders    []map[string]interface{} `json:"orders"`
+}
+
+// Caller must hold the tradeState lock, since the maps are shared
+func (fs *FeedState) makeSnapshot() *feedSnapshot {
+	snap := &feedSnapshot{Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Subs: fs.subscriptions()}
+	for key, data := range fs.tradeState.state {
+		snap.State = append(snap.State, snapshotEntry{key, data})
+	}
+	for _, order := range fs.tradeState.orders {
+		snap.Orders = append(snap.Orders, order)
+	}
+	return snap
+}
+
+// Write subscriptions and state to file. Writes to a temp file first, so we never leave a half written snapshot.
+func (fs *FeedState) SaveSnapshot(file string) error {
+	fs.tradeState.RLock()
+	b, err := json.Marshal(fs.makeSnapshot())
+	fs.tradeState.RUnlock()
+	if err != nil {
+		return err
+	}
+	return nnutils.WriteFileAtomic(file, b, 0600)
+}
+
+// Restore subscriptions and state from file. Restored entries are marked stale until fresh data arrives.
+// Subscriptions we already have are not added again.
+func (fs *FeedState) RestoreSnapshot(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var snap feedSnapshot
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&snap); err != nil {
+		return err
+	}
+	taken := time.Unix(0, snap.Timestamp*int64(time.Millisecond))
+
+	for _, sub := range snap.Subs {
+		fs.AddSubscription(sub)
+	}
+
+	fs.tradeState.Lock()
+	for _, entry := range snap.State {
+		if _, ok := fs.tradeState.state[entry.Key]; !ok && entry.Data != nil {
+			entry.Data[RestoredStaleField] = true
+			fs.tradeState.state[entry.Key] = entry.Data
+		}
+	}
+	for _, order := range snap.Orders {
+		key := orderKey(order)
+		if _, ok := fs.tradeState.orders[key]; !ok {
+			order[RestoredStaleField] = true
+			fs.tradeState.orders[key] = order
+		}
+	}
+	fs.tradeState.Unlock()
+
+	for _, entry := range snap.State {
+		fs.stale.markStale(entry.Key, taken)
+	}
+	logger.Info("Restored snapshot", "taken", taken, "subscriptions", len(snap.Subs), "states", len(snap.State),
+		"orders", len(snap.Orders))
+	return nil
+}
+
+// Restore from file if it exists, and then save to it every interval, until StopSnapshots.
+// Enabling again replaces the previous file and interval.
+func (fs *FeedState) EnableSnapshots(file string, interval time.Duration) error {
+	if _, err := os.Stat(file); err == nil {
+		if err = fs.RestoreSnapshot(file); err != nil {
+			return err
+		}
+	}
+	fs.StopSnapshots()
+	quit, done := make(chan struct{}), make(chan struct{})
+	fs.snapLock.Lock()
+	fs.snapQuit, fs.snapDone = quit, done
+	fs.snapLock.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if err := fs.SaveSnapshot(file); err != nil {
+					logger.Error("Unable to save snapshot", "file", file, "err", err)
+				}
+			}
+		}
+	}()
+	fs.SetInfo("snapshot", file)
+	return nil
+}
+
+// Stop saving snapshots, and wait for a save in progress. Call SaveSnapshot after, to keep the latest state.
+func (fs *FeedState) StopSnapshots() {
+	fs.snapLock.Lock()
+	defer fs.snapLock.Unlock()
+	if fs.snapQuit != nil {
+		close(fs.snapQuit)
+		<-fs.snapDone
+		fs.snapQuit, fs.snapDone = nil, nil
+	}
+}
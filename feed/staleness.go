@@ -0,0 +1,184 @@
+package feed
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/swagger"
+	"sync"
+	"time"
+)
+
+// Default time a subscription may be silent during market hours before it is reported as stale
+var DefaultStaleLimit = 5 * time.Minute
+
+// Return true if the market for the subscription is open at the given time
+type MarketHoursFn func(key FeedSubscriptionKey, millis int64) bool
+
+// Only types that updates continuously are tracked. News and trading_status can be silent for days.
+func isTrackedType(typ string) bool {
+	switch typ {
+	case "price", "depth", "trade", "indicator":
+		return true
+	}
+	return false
+}
+
+type staleEntry struct {
+	lastSeen time.Time
+	stale    bool
+}
+
+// Keeps track of when each subscription last got data, so we can tell when a single instrument stops updating.
+type staleTracker struct {
+	sync.Mutex
+	entries  map[FeedSubscriptionKey]*staleEntry
+	calendar map[string]swagger.CalendarDay // From TradableInfo, on 'market:identifier'
+	limit    time.Duration
+	isOpen   MarketHoursFn
+}
+
+func newStaleTracker() *staleTracker {
+	st := &staleTracker{
+		entries:  make(map[FeedSubscriptionKey]*staleEntry),
+		calendar: make(map[string]swagger.CalendarDay),
+		limit:    DefaultStaleLimit,
+	}
+	st.isOpen = st.defaultMarketHours
+	return st
+}
+
+// Use the calendar from TradableInfo if we have it for today, else guess with omxtime
+func (st *staleTracker) defaultMarketHours(key FeedSubscriptionKey, millis int64) bool {
+	ot := omxtime.NewOmxTimeMillis(millis)
+	if day, ok := st.calendar[key.M+":"+key.I]; ok && day.Date.Format(swagger.DateFormat) == ot.Date {
+		return millis >= day.Open && millis < day.Close
+	}
+	return ot.IsTrading(millis)
+}
+
+func (st *staleTracker) watch(key FeedSubscriptionKey) {
+	if !isTrackedType(key.T) {
+		return
+	}
+	st.Lock()
+	defer st.Unlock()
+	if _, ok := st.entries[key]; !ok {
+		st.entries[key] = &staleEntry{lastSeen: time.Now()}
+	}
+}
+
+// Register data for key. Returns the entry as it was, if it was stale.
+func (st *staleTracker) seen(key FeedSubscriptionKey, now time.Time) (wasStale bool, last time.Time) {
+	st.Lock()
+	defer st.Unlock()
+	if entry, ok := st.entries[key]; ok {
+		wasStale, last = entry.stale, entry.lastSeen
+		entry.stale = false
+		entry.lastSeen = now
+	}
+	return
+}
+
+// Mark as stale without waiting for the limit. Used for state that is restored, and not yet confirmed by the feed.
+func (st *staleTracker) markStale(key FeedSubscriptionKey, last time.Time) {
+	if !isTrackedType(key.T) {
+		return
+	}
+	st.Lock()
+	defer st.Unlock()
+	st.entries[key] = &staleEntry{lastSeen: last, stale: true}
+}
+
+// Returns the keys that just became stale
+func (st *staleTracker) check(now time.Time) (res []FeedSubscriptionKey, lastSeen []time.Time) {
+	st.Lock()
+	defer st.Unlock()
+	millis := now.UnixNano() / int64(time.Millisecond)
+	for key, entry := range st.entries {
+		if entry.stale || !st.isOpen(key, millis) {
+			continue
+		}
+		// If the market just opened, count from the open and not from yesterdays last tick
+		last := entry.lastSeen
+		if !st.isOpen(key, last.UnixNano()/int64(time.Millisecond)) {
+			last = now.Add(-st.sinceOpen(key, millis))
+		}
+		if now.Sub(last) > st.limit {
+			entry.stale = true
+			res = append(res, key)
+			lastSeen = append(lastSeen, entry.lastSeen)
+		}
+	}
+	return
+}
+
+// How long the market has been open, from the open of the calendar from TradableInfo, else of omxtime
+func (st *staleTracker) sinceOpen(key FeedSubscriptionKey, millis int64) time.Duration {
+	ot := omxtime.NewOmxTimeMillis(millis)
+	open := ot.OmxOpen
+	if day, ok := st.calendar[key.M+":"+key.I]; ok && day.Date.Format(swagger.DateFormat) == ot.Date {
+		open = day.Open
+	}
+	if open < 0 || open > millis {
+		return 0
+	}
+	return time.Duration(millis-open) * time.Millisecond
+}
+
+func (st *staleTracker) keys() (res []FeedSubscriptionKey) {
+	st.Lock()
+	defer st.Unlock()
+	for key := range st.entries {
+		res = append(res, key)
+	}
+	return
+}
+
+func (st *staleTracker) setCalendar(info []swagger.TradableInfo) {
+	st.Lock()
+	defer st.Unlock()
+	today := omxtime.NewOmxTimeNow().Date
+	for _, ti := range info {
+		for _, day := range ti.Calendar {
+			if day.Date.Format(swagger.DateFormat) == today {
+				st.calendar[fmt.Sprintf("%d:%s", ti.MarketId, ti.Identifier)] = day
+			}
+		}
+	}
+}
+
+func (st *staleTracker) Info() map[string]interface{} {
+	st.Lock()
+	defer st.Unlock()
+	res := make(map[string]interface{})
+	stale := []FeedSubscriptionKey{}
+	for key, entry := range st.entries {
+		if entry.stale {
+			stale = append(stale, key)
+		}
+	}
+	res["limit"] = st.limit / time.Millisecond
+	res["tracked"] = len(st.entries)
+	res["stale"] = stale
+	return res
+}
+
+func makeFeedStatusMsg(status string, ft feedmodel.FeedType, key *FeedSubscriptionKey, last time.Time, msg string) *feedmodel.FeedMsg {
+	data := &feedmodel.FeedStatusData{
+		Status:    status,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Message:   msg,
+	}
+	if ft != 0 {
+		data.Feed = ft.String()
+	}
+	if key != nil {
+		data.Type, data.Identifier, data.Market = key.T, key.I, key.M
+	}
+	if !last.IsZero() {
+		data.LastUpdate = last.UnixNano() / int64(time.Millisecond)
+	}
+	ret, _ := feedmodel.NewFeedMsgFromObject("feed_status", data)
+	return ret
+}
@@ -6,8 +6,9 @@ import (
 	"fmt"
 	"github.com/Forau/yanngo/api"
 	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
 	"github.com/Forau/yanngo/remote"
-	"log"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -17,6 +18,15 @@ import (
 	"bytes"
 )
 
+var logger = nnlog.For("feed")
+
+var (
+	feedMessages   = metrics.Default.Counter("yanngo_feed_messages_total", "Messages from Nordnet per feed and type", "feed", "type")
+	feedReconnects = metrics.Default.Counter("yanngo_feed_reconnects_total", "Reconnects per feed", "feed")
+	feedHeartbeats = metrics.Default.Histogram("yanngo_feed_heartbeat_latency_seconds", "Time between heartbeats, or any message, per feed",
+		[]float64{0.1, 0.5, 1, 2, 5, 10, 15, 20, 30, 60}, "feed")
+)
+
 type tradeState struct {
 	sync.RWMutex
 	state  map[FeedSubscriptionKey]map[string]interface{}
@@ -39,6 +49,7 @@ func (ts *tradeState) merge(msg *feedmodel.FeedMsg) (ret *feedmodel.FeedMsg, err
 		ts.Lock()
 		defer ts.Unlock()
 		if current, ok := ts.state[key]; ok {
+			delete(current, RestoredStaleField)
 			for k, v := range payload {
 				current[k] = v
 			}
@@ -58,8 +69,9 @@ func (ts *tradeState) mergeOrder(msg *feedmodel.FeedMsg) (ret *feedmodel.FeedMsg
 	} else {
 		ts.Lock()
 		defer ts.Unlock()
-		key := fmt.Sprintf("%v:%v", order["accno"], order["order_id"])
+		key := orderKey(order)
 		if current, ok := ts.orders[key]; ok {
+			delete(current, RestoredStaleField)
 			for k, v := range order {
 				current[k] = v
 			}
@@ -73,6 +85,10 @@ func (ts *tradeState) mergeOrder(msg *feedmodel.FeedMsg) (ret *feedmodel.FeedMsg
 	return
 }
 
+func orderKey(order map[string]interface{}) string {
+	return fmt.Sprintf("%v:%v", order["accno"], order["order_id"])
+}
+
 func (ts *tradeState) getOrders() (res []map[string]interface{}) {
 	ts.RLock()
 	defer ts.RUnlock()
@@ -121,11 +137,17 @@ func (hbt *heartbeatTracker) RegisterHeartbeat(ft feedmodel.FeedType) {
 		last := hbt.LastPrivateHb
 		hbt.LastPrivateHb = time.Now()
 		hbt.LastPrivateHbms = hbt.LastPrivateHb.Sub(last) / time.Millisecond
+		if !last.IsZero() {
+			feedHeartbeats.With(ft.String()).ObserveDuration(hbt.LastPrivateHb.Sub(last))
+		}
 	} else {
 		hbt.NumPublicHbs++
 		last := hbt.LastPublicHb
 		hbt.LastPublicHb = time.Now()
 		hbt.LastPublicHbms = hbt.LastPublicHb.Sub(last) / time.Millisecond
+		if !last.IsZero() {
+			feedHeartbeats.With(ft.String()).ObserveDuration(hbt.LastPublicHb.Sub(last))
+		}
 	}
 }
 
@@ -150,10 +172,22 @@ type FeedState struct {
 	infoMap               map[string]string // Only for info.
 	hbt                   heartbeatTracker
 	dstChan               remote.StreamTopicChannel
-	subs                  []*feedmodel.FeedCmd
 	pubWriter, privWriter CmdWriter
 
+	subsLock sync.Mutex
+	subs     []*feedmodel.FeedCmd
+	subKeys  map[FeedSubscriptionKey]bool
+
 	tradeState tradeState
+	stale      *staleTracker
+	restCli    *api.ApiClient // Optional. Used to refresh snapshots after a gap
+
+	listenerLock sync.RWMutex
+	listeners    []FeedClient
+
+	snapLock sync.Mutex
+	snapQuit chan struct{} // Closed to stop the snapshot loop
+	snapDone chan struct{} // Closed by the loop when it returns
 
 	sendSeqId int64
 }
@@ -165,6 +199,8 @@ func NewFeedTransport(dstChan remote.StreamTopicChannel) *FeedState {
 			state:  make(map[FeedSubscriptionKey]map[string]interface{}),
 			orders: make(map[string]map[string]interface{}),
 		},
+		subKeys:                 make(map[FeedSubscriptionKey]bool),
+		stale:                   newStaleTracker(),
 		infoMap:                 make(map[string]string),
 		RequestCommandTransport: make(api.RequestCommandTransport),
 	}
@@ -178,16 +214,106 @@ func (fs *FeedState) monitor() {
 	for {
 		time.Sleep(time.Second * 10)
 		if fs.privWriter != nil && fs.hbt.LastPrivateHb.Add(time.Second*10).Before(time.Now()) {
-			log.Printf("Missed a private ping. Pinging our self...: %+v", fs.hbt.Info())
+			logger.Info("Missed a private ping. Pinging our self", "heartbeats", fs.hbt.Info())
 			fs.privWriter(&feedmodel.FeedCmd{Cmd: "heartbeat"})
 		}
 
 		if fs.pubWriter != nil && fs.hbt.LastPublicHb.Add(time.Second*10).Before(time.Now()) {
-			log.Printf("Missed a public ping. Pinging our self...: %+v", fs.hbt.Info())
+			logger.Info("Missed a public ping. Pinging our self", "heartbeats", fs.hbt.Info())
 			fs.pubWriter(&feedmodel.FeedCmd{Cmd: "heartbeat"})
 		}
 
+		fs.CheckStale(time.Now())
+	}
+}
+
+// Check subscriptions for staleness, and send a feed_status for each that just became stale.
+// Called from the monitor, but can be called manually.
+func (fs *FeedState) CheckStale(now time.Time) {
+	keys, lastSeen := fs.stale.check(now)
+	for idx := range keys {
+		logger.Warn("Subscription is stale", "subscription", keys[idx], "last_seen", lastSeen[idx])
+		fs.sendToTopic(makeFeedStatusMsg(feedmodel.FeedStatusStale, feedmodel.PublicFeedType, &keys[idx], lastSeen[idx], ""))
+	}
+}
+
+// How long a subscription may be silent, while the market is open, before it is stale
+func (fs *FeedState) SetStaleLimit(limit time.Duration) *FeedState {
+	fs.stale.Lock()
+	defer fs.stale.Unlock()
+	fs.stale.limit = limit
+	return fs
+}
+
+// Override the market hours. Default is the calendar from TradableInfo if known, else omxtime.
+func (fs *FeedState) SetMarketHours(fn MarketHoursFn) *FeedState {
+	fs.stale.Lock()
+	defer fs.stale.Unlock()
+	fs.stale.isOpen = fn
+	return fs
+}
+
+// Set the client used to refresh snapshots via REST when the public feed reconnects
+func (fs *FeedState) SetSnapshotClient(cli *api.ApiClient) *FeedState {
+	fs.restCli = cli
+	return fs
+}
+
+// Refresh tradable calendars and trades via REST, and send what we got on the topic.
+// Used after a gap, since messages during the reconnect are lost. The trades are sent as 'resynctrade', since
+// they can already have been seen as 'trade', and should not be counted again.
+func (fs *FeedState) RefreshSnapshots() error {
+	if fs.restCli == nil {
+		return fmt.Errorf("No snapshot client set")
+	}
+	idMap := make(map[string]bool)
+	for _, key := range fs.stale.keys() {
+		if key.T != "indicator" && key.I != "" && key.M != "" {
+			idMap[key.M+":"+key.I] = true
+		}
+	}
+	if len(idMap) == 0 {
+		return nil
+	}
+	ids := []string{}
+	for id := range idMap {
+		ids = append(ids, id)
+	}
+
+	if info, err := fs.restCli.TradableInfo(ids...); err != nil {
+		logger.Warn("Unable to refresh tradable info", "ids", ids, "err", err)
+	} else {
+		fs.stale.setCalendar(info)
 	}
+
+	trades, err := fs.restCli.TradableTrades(ids...)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, pt := range trades {
+		for _, trade := range pt.Trades {
+			msg, err := feedmodel.NewFeedMsgFromObject("trade", &feedmodel.FeedTradeData{
+				Identifier:     pt.Identifier,
+				Market:         pt.MarketId,
+				Trade_type:     trade.TradeType,
+				Trade_id:       trade.TradeId,
+				Price:          trade.Price,
+				Volume:         trade.Volume,
+				Broker_buying:  trade.BrokerBuying,
+				Broker_selling: trade.BrokerSelling,
+			})
+			if err == nil {
+				fs.tradeState.merge(msg)
+				msg.Type = "resynctrade"
+				fs.sendToTopic(msg)
+				count++
+			}
+		}
+	}
+	fs.sendToTopic(makeFeedStatusMsg(feedmodel.FeedStatusResync, feedmodel.PublicFeedType, nil, time.Time{},
+		fmt.Sprintf("Refreshed %d tradables, and resent %d trades", len(ids), count)))
+	return nil
 }
 
 func (fs *FeedState) SetInfo(key, val string) *FeedState {
@@ -197,12 +323,30 @@ func (fs *FeedState) SetInfo(key, val string) *FeedState {
 
 // Implement feed.Callback
 func (fs *FeedState) OnConnect(w CmdWriter, ft feedmodel.FeedType) {
-	log.Printf("Connect[%v]: %+v", ft, w)
+	logger.Info("Connected", "feed", ft)
 	fs.infoMap[fmt.Sprintf("%d:connect_%d", ft, time.Now().Unix())] = time.Now().String()
+	lastHb := fs.hbt.LastPrivateHb
+	if ft == feedmodel.PublicFeedType {
+		lastHb = fs.hbt.LastPublicHb
+	}
 	fs.hbt.RegisterHeartbeat(ft)
+
+	// If we had a writer, this is a reconnect, and we might have lost messages
+	if (ft == feedmodel.PublicFeedType && fs.pubWriter != nil) || (ft == feedmodel.PrivateFeedType && fs.privWriter != nil) {
+		feedReconnects.With(ft.String()).Inc()
+		fs.sendToTopic(makeFeedStatusMsg(feedmodel.FeedStatusGap, ft, nil, lastHb, "Feed reconnected"))
+		if ft == feedmodel.PublicFeedType && fs.restCli != nil {
+			go func() {
+				if err := fs.RefreshSnapshots(); err != nil {
+					logger.Warn("Unable to refresh snapshots", "err", err)
+				}
+			}()
+		}
+	}
+
 	if ft == feedmodel.PublicFeedType {
 		fs.pubWriter = w
-		for _, s := range fs.subs {
+		for _, s := range fs.subscriptions() {
 			fs.sendCommand(s)
 		}
 	} else {
@@ -214,23 +358,74 @@ func (fs *FeedState) OnMessage(msg *feedmodel.FeedMsg, ft feedmodel.FeedType) {
 	fs.handleAndSend(msg, ft)
 }
 
+// Implement feed.StateCallback
+func (fs *FeedState) OnStateChange(state ConnState, ft feedmodel.FeedType, err error) {
+	logger.Info("State changed", "feed", ft, "state", state, "err", err)
+	fs.infoMap[fmt.Sprintf("%v_state", ft)] = state.String()
+}
+
 func (fs *FeedState) OnError(err error, ft feedmodel.FeedType) {
-	log.Printf("Err[%v]: %+v", ft, err)
+	logger.Warn("Feed error", "feed", ft, "err", err)
 	fs.infoMap[fmt.Sprintf("%d:error_%d", ft, time.Now().Unix())] = err.Error()
 }
 
+// Add a subscription, that is sent again on each connect. Subscriptions with the same key are only kept once.
 func (fs *FeedState) AddSubscription(cmd *feedmodel.FeedCmd) (res string) {
 	res = fmt.Sprintf("%d", rand.Uint32())
-	fs.subs = append(fs.subs, cmd)
+	key, err := subscriptionKeyFromCmd(cmd)
+	fs.subsLock.Lock()
+	if err != nil || !fs.subKeys[key] {
+		fs.subs = append(fs.subs, cmd)
+	}
+	if err == nil {
+		fs.subKeys[key] = true
+	}
+	fs.subsLock.Unlock()
+	if err == nil {
+		fs.stale.watch(key)
+	}
+	return
+}
+
+func (fs *FeedState) subscriptions() []*feedmodel.FeedCmd {
+	fs.subsLock.Lock()
+	defer fs.subsLock.Unlock()
+	return append([]*feedmodel.FeedCmd{}, fs.subs...)
+}
+
+// The args can be any of the arg structs, or a map, so we go through json to find the key
+func subscriptionKeyFromCmd(cmd *feedmodel.FeedCmd) (key FeedSubscriptionKey, err error) {
+	b, err := json.Marshal(cmd.Args)
+	if err != nil {
+		return
+	}
+	key, err = subscriptionKeyFromData(b, "t")
+	return
+}
+
+// Find the key of a message payload, or subscription args. The type is in field typeField, if not empty.
+func subscriptionKeyFromData(data []byte, typeField string) (key FeedSubscriptionKey, err error) {
+	payload, err := unmarshalToMap(data)
+	if err != nil {
+		return
+	}
+	if typeField != "" {
+		key.T = fmt.Sprintf("%v", payload[typeField])
+	}
+	key.I = fmt.Sprintf("%v", payload["i"])
+	key.M = fmt.Sprintf("%v", payload["m"])
+	if s, ok := payload["s"]; ok {
+		fmt.Sscan(fmt.Sprintf("%v", s), &key.S)
+	}
 	return
 }
 
 func (fs *FeedState) sendCommand(cmd *feedmodel.FeedCmd) error {
 	if fs.pubWriter != nil {
-		log.Printf("Sending: %+v", cmd)
+		logger.Debug("Sending command", "cmd", cmd.Cmd, "args", cmd.Args)
 		return fs.pubWriter(cmd)
 	} else {
-		log.Printf("Unable to send command '%+v', writer not ready", cmd)
+		logger.Warn("Unable to send command, writer not ready", "cmd", cmd.Cmd, "args", cmd.Args)
 		return fmt.Errorf("Unable to send command")
 	}
 }
@@ -239,19 +434,61 @@ func (fs *FeedState) sendToTopic(msg *feedmodel.FeedMsg) {
 	msg.SeqId = atomic.AddInt64(&fs.sendSeqId, 1)
 	b, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling %+v: %+v", msg, err)
+		logger.Error("Unable to marshal message", "type", msg.Type, "err", err)
 	} else {
 		err := fs.dstChan(b)
 		_ = err
 		// log.Printf("Pub to Msg(%s) : %+v", string(b), err)
 	}
+
+	fs.listenerLock.RLock()
+	listeners := fs.listeners
+	fs.listenerLock.RUnlock()
+	for _, l := range listeners {
+		l(msg)
+	}
+}
+
+// Add a listener that gets every message we send on the topic, after merge. Used by components hosted next
+// to the FeedState, so they do not need to subscribe to the topic. Listeners are called in the feed goroutine,
+// so they should be quick, and they may call Publish.
+func (fs *FeedState) AddListener(fc FeedClient) *FeedState {
+	fs.listenerLock.Lock()
+	defer fs.listenerLock.Unlock()
+	fs.listeners = append(append([]FeedClient{}, fs.listeners...), fc)
+	return fs
+}
+
+// Send a message of our own on the feed topic. It gets a sequence id, and is seen by the listeners.
+func (fs *FeedState) Publish(msg *feedmodel.FeedMsg) {
+	fs.sendToTopic(msg)
 }
 
 func (fs *FeedState) handleAndSend(msg *feedmodel.FeedMsg, ft feedmodel.FeedType) {
+	fs.handle(msg, ft)
+	fs.hbt.RegisterHeartbeat(ft) // Always register heartbeet
+
+	if ft == feedmodel.PublicFeedType && isTrackedType(msg.Type) {
+		if key, err := subscriptionKeyFromData(msg.Data, ""); err == nil {
+			key.T = msg.Type
+			if wasStale, last := fs.stale.seen(key, time.Now()); wasStale {
+				fs.sendToTopic(makeFeedStatusMsg(feedmodel.FeedStatusFresh, ft, &key, last, ""))
+			}
+		}
+	}
+}
+
+// Messages from the feed of another login, by LoginCallback. They are not heartbeats of our own feed.
+func (fs *FeedState) onLoginMessage(msg *feedmodel.FeedMsg, ft feedmodel.FeedType) {
+	fs.handle(msg, ft)
+}
+
+func (fs *FeedState) handle(msg *feedmodel.FeedMsg, ft feedmodel.FeedType) {
+	feedMessages.With(ft.String(), msg.Type).Inc()
 	switch msg.Type {
 	case "order":
 		if msg2, err := fs.tradeState.mergeOrder(msg); err != nil {
-			log.Printf("Error merging orders: %+v: %+v", msg, err)
+			logger.Warn("Unable to merge order", "msg", msg.String(), "err", err)
 			fs.sendToTopic(msg)
 		} else {
 			fs.sendToTopic(msg2)
@@ -278,9 +515,8 @@ func (fs *FeedState) handleAndSend(msg *feedmodel.FeedMsg, ft feedmodel.FeedType
 		fs.sendToTopic(msg)
 	case "heartbeat":
 	default:
-		log.Printf("Unable to handle msg of type %s: %+v", msg.Type, msg.String())
+		logger.Warn("Unable to handle message", "type", msg.Type, "msg", msg.String())
 	}
-	fs.hbt.RegisterHeartbeat(ft) // Always register heartbeet
 }
 
 func (fs *FeedState) subscribe(params api.Params) (json.RawMessage, error) {
@@ -357,9 +593,10 @@ func (fs *FeedState) init() {
 			for k, v := range fs.infoMap {
 				resMap[k] = v
 			}
-			resMap["subsctiptions"] = fs.subs
+			resMap["subsctiptions"] = fs.subscriptions()
 			resMap["heartbeats"] = fs.hbt.Info()
 			resMap["state"] = fs.tradeState.Info()
+			resMap["staleness"] = fs.stale.Info()
 
 			return json.Marshal(resMap)
 		})
@@ -6,15 +6,26 @@ package httpcli
 import (
 	"encoding/json"
 	"github.com/Forau/yanngo/crypto"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/nnutils"
 	"github.com/Forau/yanngo/swagger"
+	"github.com/Forau/yanngo/trace"
 	"gopkg.in/resty.v0" // https://github.com/go-resty/resty
 
-	"os"
-
 	"fmt"
+	"log/slog"
 	"time"
 )
 
+var logger = nnlog.For("httpcli")
+
+var (
+	rateLimitWaits   = metrics.Default.Counter("yanngo_rate_limit_waits_total", "Requests that waited for the Nordnet rate limit or a login").With()
+	rateLimitSeconds = metrics.Default.Counter("yanngo_rate_limit_wait_seconds_total", "Time spent waiting for the Nordnet rate limit or a login").With()
+	rateLimited      = metrics.Default.Counter("yanngo_rate_limited_total", "Responses with 429 Too Many Requests").With()
+)
+
 type RestError struct {
 	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
@@ -36,37 +47,13 @@ func convertToStringMap(in map[string]interface{}) map[string]string {
 		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
 			res[k] = fmt.Sprintf("%d", t)
 		default:
-			fmt.Printf("Dont know how to convert %T: %+v. Will try make it %v.\n", t, t, t)
+			logger.Warn("Unknown payload type, will format it with %v", "key", k, "type", fmt.Sprintf("%T", t))
 			res[k] = fmt.Sprintf("%v", t)
 		}
 	}
 	return res
 }
 
-// Same as in baseFeed.  TODO: Move to common
-func makeDelayRetry(msg string) func() {
-	resetTimer := time.Now().Add(time.Minute)
-	counter := 0
-	return func() {
-		if time.Now().After(resetTimer) {
-			counter = 0
-		}
-		resetTimer = time.Now().Add(time.Minute) // Reset in one minute, if no other call
-		counter++
-		var delay time.Duration
-		switch counter {
-		case 1:
-			delay = 0
-		case 2:
-			delay = 5000
-		default:
-			delay = 30000
-		}
-		fmt.Printf(msg, delay)
-		time.Sleep(delay * time.Millisecond)
-	}
-}
-
 type RestClient struct {
 	restyCli *resty.Client
 
@@ -75,32 +62,41 @@ type RestClient struct {
 
 	lastSuccess time.Time
 
-	retryDelayLogin func()
+	loginBackoff *nnutils.Backoff
 
 	waitLockTime time.Time
 }
 
 func NewRestClient(uri string, user, pass, pem []byte) *RestClient {
-	var err error
-	rc := &RestClient{retryDelayLogin: makeDelayRetry("Waiting %dms before trying to login again\n")}
-	rc.generate, err = crypto.NewCredentialsGenerator(user, pass, pem)
+	return NewRestClientWithBackoff(uri, user, pass, pem, nnutils.DefaultBackoffPolicy)
+}
+
+// Same as NewRestClient, but with own policy for how to retry logins
+func NewRestClientWithBackoff(uri string, user, pass, pem []byte, backoff nnutils.BackoffPolicy) *RestClient {
+	generate, err := crypto.NewCredentialsGenerator(user, pass, pem)
 	if err != nil {
 		panic(err)
 	}
-	logFile, _ := os.OpenFile("go-resty.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	return NewRestClientWithGenerator(uri, generate, backoff)
+}
 
-	rc.restyCli = resty.New().SetLogger(logFile).SetDebug(true).SetHostURL(uri).SetHeaders(map[string]string{
+// Same as NewRestClientWithBackoff, with the credentials from a generator, like one from a crypto.CredentialStore
+func NewRestClientWithGenerator(uri string, generate crypto.GenerateCredentials, backoff nnutils.BackoffPolicy) *RestClient {
+	rc := &RestClient{generate: generate, loginBackoff: backoff.NewBackoff()}
+	// Resty dumps requests and responses, including headers. Only when we log debug.
+	rc.restyCli = resty.New().SetLogger(nnlog.Writer(logger, slog.LevelDebug, "resty")).
+		SetDebug(logger.Enabled(slog.LevelDebug)).SetHostURL(uri).SetHeaders(map[string]string{
 		"Accept":          "application/json",
 		"Accept-Language": "en",
 		"User-Agent":      "YANNGO v0.0 (Yet Another NordNet GO - API)",
 	})
 
 	rc.restyCli.OnBeforeRequest(func(c *resty.Client, r *resty.Request) error {
-		fmt.Printf(">>> %p >>> %s %s: %v\n", r, r.Method, r.URL, r.RawRequest)
+		logger.Debug("Request", "method", r.Method, "url", r.URL)
 		return nil
 	})
 	rc.restyCli.OnAfterResponse(func(c *resty.Client, r *resty.Response) error {
-		fmt.Printf("<<< %p <<< %s [%s : %v]: %v\n", r.Request, r.Status(), r.Time(), r.Error(), r)
+		logger.Debug("Response", "method", r.Request.Method, "url", r.Request.URL, "status", r.Status(), "time", r.Time())
 		if r.StatusCode() < 300 {
 			rc.lastSuccess = time.Now()
 		}
@@ -121,15 +117,30 @@ func NewRestClient(uri string, user, pass, pem []byte) *RestClient {
 }
 
 func (rc *RestClient) Execute(method, path string, payload map[string]string) (json.RawMessage, error) {
-	for time.Now().Before(rc.waitLockTime) {
-		// We could count exact, but lets just loop every second and print in logs.
-		fmt.Printf("Waiting nicely for nordnet. Now: %v, Allowed at: %v\n", time.Now().String(), rc.waitLockTime.String())
-		time.Sleep(time.Second)
+	return rc.ExecuteTraced(method, path, payload, trace.SpanContext{})
+}
+
+// Like Execute, but as part of the trace sc. The call is sent with a traceparent header.
+func (rc *RestClient) ExecuteTraced(method, path string, payload map[string]string, sc trace.SpanContext) (res json.RawMessage, err error) {
+	span := trace.Start("http "+method, sc, trace.KindClient).SetAttr("http.method", method).SetAttr("http.path", path)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	if start := time.Now(); start.Before(rc.waitLockTime) {
+		rateLimitWaits.Inc()
+		for time.Now().Before(rc.waitLockTime) {
+			// We could count exact, but lets just loop every second and print in logs.
+			logger.Info("Waiting nicely for nordnet", "allowed_at", rc.waitLockTime)
+			time.Sleep(time.Second)
+		}
+		rateLimitSeconds.Add(time.Since(start).Seconds())
 	}
 
 	sess, err := rc.GetSession()
 	if err != nil {
-		fmt.Printf("Login error: %+v\n", err)
+		logger.Error("Login failed", "err", err)
 		return nil, err
 	}
 
@@ -142,7 +153,8 @@ func (rc *RestClient) Execute(method, path string, payload map[string]string) (j
 	}
 
 	restError := RestError{}
-	req := rc.restyCli.R().SetBasicAuth(sess.SessionKey, sess.SessionKey).SetError(&restError)
+	req := rc.restyCli.R().SetBasicAuth(sess.SessionKey, sess.SessionKey).SetError(&restError).
+		SetHeader(trace.TraceparentHeader, span.Context().Traceparent())
 	if payload != nil {
 		if method == "POST" || method == "PUT" {
 			req.SetFormData(payload)
@@ -151,20 +163,21 @@ func (rc *RestClient) Execute(method, path string, payload map[string]string) (j
 		}
 	}
 
-	fmt.Printf("About to execute %+v with %s on %s\n", req, method, path)
 	resp, err := req.Execute(method, path)
 	if err != nil {
-		fmt.Println("HTTP-error: ", err)
+		logger.Warn("HTTP error", "method", method, "path", path, "trace_id", span.TraceId, "err", err)
 		return nil, err
 	}
+	span.SetAttr("http.status_code", fmt.Sprint(resp.StatusCode()))
 	if restError.Code != "" {
-		fmt.Println("REST-error: ", restError)
+		logger.Warn("REST error", "method", method, "path", path, "trace_id", span.TraceId, "status", resp.StatusCode(), "code", restError.Code, "message", restError.Message)
 		if restError.Code == "NEXT_INVALID_SESSION" {
 			if sess == rc.session {
 				rc.session = nil
 			}
-			return rc.Execute(method, path, payload)
+			return rc.ExecuteTraced(method, path, payload, span.Context())
 		} else if resp.StatusCode() == 429 { // Too Many Requests, please wait for 10 seconds before trying again
+			rateLimited.Inc()
 			rc.waitLockTime = time.Now().Add(time.Duration(10) * time.Second)
 		}
 		return nil, fmt.Errorf("%d: %s %s: %v", resp.StatusCode(), method, path, restError)
@@ -182,7 +195,12 @@ func (rc *RestClient) GetSession() (*swagger.Login, error) {
 	// Give 3 sec for login
 	rc.waitLockTime = time.Now().Add(time.Duration(3) * time.Second)
 
-	rc.retryDelayLogin()
+	if delay, ok := rc.loginBackoff.Next(); !ok {
+		return nil, fmt.Errorf("Gave up login after %d attempts", rc.loginBackoff.Attempt()-1)
+	} else if delay > 0 {
+		logger.Info("Waiting before trying to login again", "delay", delay)
+		time.Sleep(delay)
+	}
 
 	auth, err := rc.generate()
 	if err == nil {
@@ -193,11 +211,14 @@ func (rc *RestClient) GetSession() (*swagger.Login, error) {
 			Post("/login")
 
 		if err != nil {
-			fmt.Println("Login error ", err)
+			logger.Error("Login failed", "err", err)
 			return nil, err
 		}
-		fmt.Printf("LOGIN %+v\n", tmpSess)
+		logger.Info("Logged in", "environment", tmpSess.Environment, "expires_in", tmpSess.ExpiresIn)
 		rc.session = tmpSess
+		if tmpSess.SessionKey != "" {
+			rc.loginBackoff.Reset() // Only count failed logins in a row
+		}
 	}
 	rc.waitLockTime = time.Now() // No need to wait, we already got session....
 	return rc.session, nil
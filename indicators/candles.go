@@ -0,0 +1,132 @@
+package indicators
+
+import (
+	"github.com/Forau/yanngo/feed/feedmodel"
+)
+
+// OHLC for one interval. Timestamp is the start of the interval, in millis.
+type Candle struct {
+	Timestamp int64   `json:"timestamp"`
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+	Volume    int64   `json:"volume,omitempty"`
+}
+
+// A late tick is older than the close, so it does not change it
+func (c *Candle) add(price float64, volume int64, late bool) {
+	if price > c.High {
+		c.High = price
+	}
+	if price < c.Low {
+		c.Low = price
+	}
+	if !late {
+		c.Close = price
+	}
+	c.Volume += volume
+}
+
+// Builds candles of intervalMillis from ticks in time order. Completed candles are sent to the callback.
+// With interval 0, every tick is its own candle.
+type CandleBuilder struct {
+	interval int64
+	current  *Candle
+	last     int64 // Timestamp of the newest tick
+	callback func(Candle)
+}
+
+func NewCandleBuilder(intervalMillis int64, callback func(Candle)) *CandleBuilder {
+	return &CandleBuilder{interval: intervalMillis, callback: callback}
+}
+
+func (cb *CandleBuilder) Add(timestamp int64, price float64, volume int64) {
+	if cb.interval <= 0 {
+		cb.callback(Candle{timestamp, price, price, price, price, volume})
+		return
+	}
+	start := timestamp - timestamp%cb.interval
+	late := cb.current != nil && timestamp < cb.last
+	if cb.current != nil && cb.current.Timestamp != start {
+		if start < cb.current.Timestamp {
+			cb.current.add(price, volume, true) // Out of order. Best effort is to keep it in the current candle
+			return
+		}
+		cb.callback(*cb.current)
+		cb.current = nil
+	}
+	if cb.current == nil {
+		cb.current = &Candle{start, price, price, price, price, 0}
+	}
+	cb.current.add(price, volume, late)
+	if !late {
+		cb.last = timestamp
+	}
+}
+
+// Send the candle in progress, if any
+func (cb *CandleBuilder) Flush() {
+	if cb.current != nil {
+		cb.callback(*cb.current)
+		cb.current = nil
+	}
+}
+
+// The candle in progress, or nil
+func (cb *CandleBuilder) Current() *Candle {
+	return cb.current
+}
+
+func collect(intervalMillis int64, fn func(cb *CandleBuilder)) (res []Candle) {
+	cb := NewCandleBuilder(intervalMillis, func(c Candle) { res = append(res, c) })
+	fn(cb)
+	cb.Flush()
+	return
+}
+
+// Candles from trades. The sequence should be sorted.
+func CandlesFromTrades(trades feedmodel.FeedTradeDataSequence, intervalMillis int64) []Candle {
+	return collect(intervalMillis, func(cb *CandleBuilder) {
+		for _, trade := range trades {
+			cb.Add(trade.Trade_timestamp, trade.Price, trade.Volume)
+		}
+	})
+}
+
+// Candles from indicator (index) updates. The sequence should be sorted.
+func CandlesFromIndicators(inds feedmodel.FeedIndicatorDataSequence, intervalMillis int64) []Candle {
+	return collect(intervalMillis, func(cb *CandleBuilder) {
+		for _, ind := range inds {
+			if ind.Last != 0 {
+				cb.Add(ind.Tick_timestamp, ind.Last, 0)
+			}
+		}
+	})
+}
+
+// Candles from a linked price chain. Only the updates that are trades are used.
+func CandlesFromPrices(prices *feedmodel.FeedPriceData, intervalMillis int64) []Candle {
+	return collect(intervalMillis, func(cb *CandleBuilder) {
+		if prices == nil {
+			return
+		}
+		var lastVolume int64
+		for _, price := range prices.ToLimitedSlice(feedmodel.FilterTrades().Filter(feedmodel.FilterOnlyLastPerTickTimestamp())) {
+			volume := price.Last_volume
+			if lastVolume > 0 && price.Turnover_volume > lastVolume {
+				volume = price.Turnover_volume - lastVolume
+			}
+			lastVolume = price.Turnover_volume
+			cb.Add(price.Trade_timestamp, price.Last, volume)
+		}
+	})
+}
+
+// The close of each candle
+func Closes(candles []Candle) (res []float64) {
+	for _, c := range candles {
+		res = append(res, c.Close)
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package indicators
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+)
+
+var logger = nnlog.For("indicators")
+
+// Type of the feed messages with derived values
+const DerivedMsgType = "derived"
+
+// Data of a 'derived' feed message
+type DerivedData struct {
+	Name       string             `json:"name"`
+	Identifier string             `json:"i"`
+	Market     int64              `json:"m"`
+	Timestamp  int64              `json:"timestamp"` // Start of the candle
+	Value      float64            `json:"value"`
+	Extra      map[string]float64 `json:"extra,omitempty"` // Like signal for MACD, or bands for Bollinger
+	Candle     Candle             `json:"candle"`
+}
+
+// Extra values for the indicators with more then one line
+func extraValues(ind CandleIndicator) map[string]float64 {
+	if ci, ok := ind.(closeIndicator); ok {
+		switch i := ci.Indicator.(type) {
+		case *MACD:
+			return map[string]float64{"signal": i.Signal(), "histogram": i.Histogram()}
+		case *Bollinger:
+			return map[string]float64{"upper": i.Upper(), "lower": i.Lower()}
+		}
+	}
+	return nil
+}
+
+type instrumentIndicator struct {
+	ind     CandleIndicator
+	candles *CandleBuilder
+}
+
+// Creates a FeedClient that builds candles from the trades in price messages, updates one indicator per instrument,
+// and sends the derived values to out as messages of type 'derived', when the indicator is ready.
+// Wrap in a feed.FeedSorter if the source is async. Not thread safe.
+func NewFeedIndicatorClient(name string, intervalMillis int64, factory func() CandleIndicator, out feed.FeedClient) feed.FeedClient {
+	perInstrument := make(map[string]*instrumentIndicator)
+
+	catcher := feedmodel.NewTradeCatcher(func(trade *feedmodel.FeedTradeData) {
+		key := fmt.Sprintf("%d:%s", trade.Market, trade.Identifier)
+		ii, ok := perInstrument[key]
+		if !ok {
+			ii = &instrumentIndicator{ind: factory()}
+			identifier, market := trade.Identifier, trade.Market
+			ii.candles = NewCandleBuilder(intervalMillis, func(c Candle) {
+				value := ii.ind.UpdateCandle(c)
+				if !ii.ind.Ready() {
+					return
+				}
+				msg, err := feedmodel.NewFeedMsgFromObject(DerivedMsgType, &DerivedData{
+					Name:       name,
+					Identifier: identifier,
+					Market:     market,
+					Timestamp:  c.Timestamp,
+					Value:      value,
+					Extra:      extraValues(ii.ind),
+					Candle:     c,
+				})
+				if err != nil {
+					logger.Error("Unable to make derived message", "indicator", name, "err", err)
+				} else {
+					out(msg)
+				}
+			})
+			perInstrument[key] = ii
+		}
+		ii.candles.Add(trade.Trade_timestamp, trade.Price, trade.Volume)
+	})
+
+	return func(msg *feedmodel.FeedMsg) {
+		if msg == nil {
+			for _, ii := range perInstrument {
+				ii.candles.Flush()
+			}
+		} else if msg.Type == "price" {
+			var price feedmodel.FeedPriceData
+			if err := msg.DecodeData(&price); err == nil {
+				catcher.OnPrice(&price)
+			}
+		}
+	}
+}
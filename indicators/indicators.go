@@ -0,0 +1,278 @@
+// Package indicators contains streaming technical indicators. They are updated one value or candle at a time,
+// but can also be computed in batch over the sequences in feedmodel.
+package indicators
+
+import (
+	"math"
+)
+
+// Indicator over single values, like the close of a candle or the last price of a trade
+type Indicator interface {
+	Update(value float64) float64 // Add a value, and return the new indicator value
+	Value() float64               // Current value. Only valid if Ready
+	Ready() bool                  // True when we have seen enough values
+}
+
+// Indicator that needs the full candle, like ATR
+type CandleIndicator interface {
+	UpdateCandle(c Candle) float64
+	Value() float64
+	Ready() bool
+}
+
+type closeIndicator struct {
+	Indicator
+}
+
+func (ci closeIndicator) UpdateCandle(c Candle) float64 {
+	return ci.Update(c.Close)
+}
+
+// Let a value indicator be updated with candles, using the close
+func OnClose(ind Indicator) CandleIndicator {
+	if ci, ok := ind.(CandleIndicator); ok {
+		return ci
+	}
+	return closeIndicator{ind}
+}
+
+// Run the indicator over all values. Values before the indicator is ready is NaN.
+func Batch(ind Indicator, values []float64) (res []float64) {
+	for _, v := range values {
+		if r := ind.Update(v); ind.Ready() {
+			res = append(res, r)
+		} else {
+			res = append(res, math.NaN())
+		}
+	}
+	return
+}
+
+// Run the candle indicator over all candles. Values before the indicator is ready is NaN.
+func BatchCandles(ind CandleIndicator, candles []Candle) (res []float64) {
+	for _, c := range candles {
+		if r := ind.UpdateCandle(c); ind.Ready() {
+			res = append(res, r)
+		} else {
+			res = append(res, math.NaN())
+		}
+	}
+	return
+}
+
+// ---------- SMA
+
+// Simple moving average
+type SMA struct {
+	period int
+	window []float64
+	idx    int
+	count  int
+	sum    float64
+}
+
+func NewSMA(period int) *SMA {
+	if period < 1 {
+		period = 1
+	}
+	return &SMA{period: period, window: make([]float64, period)}
+}
+
+func (s *SMA) Update(value float64) float64 {
+	s.sum += value - s.window[s.idx]
+	s.window[s.idx] = value
+	s.idx = (s.idx + 1) % s.period
+	if s.count < s.period {
+		s.count++
+	}
+	return s.Value()
+}
+
+func (s *SMA) Value() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+func (s *SMA) Ready() bool { return s.count >= s.period }
+
+// Population standard deviation over the current window
+func (s *SMA) StdDev() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	mean := s.Value()
+	var sq float64
+	for i := 0; i < s.count; i++ {
+		d := s.window[i] - mean
+		sq += d * d
+	}
+	return math.Sqrt(sq / float64(s.count))
+}
+
+// ---------- EMA
+
+// Exponential moving average. Seeded with the SMA of the first period values.
+type EMA struct {
+	period int
+	alpha  float64
+	seed   *SMA
+	value  float64
+}
+
+func NewEMA(period int) *EMA {
+	return newEMAWithAlpha(period, 2/float64(period+1))
+}
+
+// Wilder's smoothing, as used in RSI and ATR. Same as an EMA with alpha 1/period.
+func NewWilder(period int) *EMA {
+	return newEMAWithAlpha(period, 1/float64(period))
+}
+
+func newEMAWithAlpha(period int, alpha float64) *EMA {
+	if period < 1 {
+		period = 1
+	}
+	return &EMA{period: period, alpha: alpha, seed: NewSMA(period)}
+}
+
+func (e *EMA) Update(value float64) float64 {
+	if e.seed != nil {
+		e.value = e.seed.Update(value)
+		if e.seed.Ready() {
+			e.seed = nil
+		}
+	} else {
+		e.value += e.alpha * (value - e.value)
+	}
+	return e.value
+}
+
+func (e *EMA) Value() float64 { return e.value }
+func (e *EMA) Ready() bool    { return e.seed == nil }
+
+// ---------- RSI
+
+// Relative strength index, with Wilder's smoothing
+type RSI struct {
+	gain, loss *EMA
+	last       float64
+	hasLast    bool
+}
+
+func NewRSI(period int) *RSI {
+	return &RSI{gain: NewWilder(period), loss: NewWilder(period)}
+}
+
+func (r *RSI) Update(value float64) float64 {
+	if r.hasLast {
+		diff := value - r.last
+		r.gain.Update(math.Max(diff, 0))
+		r.loss.Update(math.Max(-diff, 0))
+	}
+	r.last, r.hasLast = value, true
+	return r.Value()
+}
+
+func (r *RSI) Value() float64 {
+	if r.loss.Value() == 0 {
+		if r.gain.Value() == 0 {
+			return 50
+		}
+		return 100
+	}
+	return 100 - 100/(1+r.gain.Value()/r.loss.Value())
+}
+
+func (r *RSI) Ready() bool { return r.gain.Ready() }
+
+// ---------- MACD
+
+// Moving average convergence divergence. Value is the MACD line.
+type MACD struct {
+	fast, slow, signal *EMA
+	macd               float64
+}
+
+func NewMACD(fast, slow, signal int) *MACD {
+	return &MACD{fast: NewEMA(fast), slow: NewEMA(slow), signal: NewEMA(signal)}
+}
+
+// The common 12, 26, 9
+func NewDefaultMACD() *MACD {
+	return NewMACD(12, 26, 9)
+}
+
+func (m *MACD) Update(value float64) float64 {
+	f, s := m.fast.Update(value), m.slow.Update(value)
+	if m.slow.Ready() {
+		m.macd = f - s
+		m.signal.Update(m.macd)
+	}
+	return m.macd
+}
+
+func (m *MACD) Value() float64     { return m.macd }
+func (m *MACD) Signal() float64    { return m.signal.Value() }
+func (m *MACD) Histogram() float64 { return m.macd - m.signal.Value() }
+func (m *MACD) Ready() bool        { return m.slow.Ready() && m.signal.Ready() }
+
+// ---------- Bollinger
+
+// Bollinger bands. Value is the middle band.
+type Bollinger struct {
+	sma *SMA
+	k   float64
+}
+
+func NewBollinger(period int, k float64) *Bollinger {
+	return &Bollinger{sma: NewSMA(period), k: k}
+}
+
+// The common 20, 2
+func NewDefaultBollinger() *Bollinger {
+	return NewBollinger(20, 2)
+}
+
+func (b *Bollinger) Update(value float64) float64 {
+	return b.sma.Update(value)
+}
+
+func (b *Bollinger) Value() float64 { return b.sma.Value() }
+func (b *Bollinger) Upper() float64 { return b.sma.Value() + b.k*b.sma.StdDev() }
+func (b *Bollinger) Lower() float64 { return b.sma.Value() - b.k*b.sma.StdDev() }
+func (b *Bollinger) Ready() bool    { return b.sma.Ready() }
+
+// Where the value is within the bands. 0 at lower, 1 at upper.
+func (b *Bollinger) PercentB(value float64) float64 {
+	if w := b.Upper() - b.Lower(); w != 0 {
+		return (value - b.Lower()) / w
+	}
+	return 0.5
+}
+
+// ---------- ATR
+
+// Average true range, with Wilder's smoothing
+type ATR struct {
+	avg       *EMA
+	lastClose float64
+	hasLast   bool
+}
+
+func NewATR(period int) *ATR {
+	return &ATR{avg: NewWilder(period)}
+}
+
+func (a *ATR) UpdateCandle(c Candle) float64 {
+	tr := c.High - c.Low
+	if a.hasLast {
+		tr = math.Max(tr, math.Max(math.Abs(c.High-a.lastClose), math.Abs(c.Low-a.lastClose)))
+	}
+	a.lastClose, a.hasLast = c.Close, true
+	return a.avg.Update(tr)
+}
+
+func (a *ATR) Value() float64 { return a.avg.Value() }
+func (a *ATR) Ready() bool    { return a.avg.Ready() }
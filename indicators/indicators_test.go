@@ -0,0 +1,128 @@
+package indicators_test
+
+import (
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/indicators"
+
+	"fmt"
+	"math"
+	"testing"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.0001
+}
+
+func TestMovingAverages(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5}
+
+	sma := indicators.Batch(indicators.NewSMA(3), values)
+	ema := indicators.Batch(indicators.NewEMA(3), values)
+	t.Logf("SMA: %v, EMA: %v", sma, ema)
+	for idx, exp := range []float64{math.NaN(), math.NaN(), 2, 3, 4} {
+		if math.IsNaN(exp) != math.IsNaN(sma[idx]) || (!math.IsNaN(exp) && !near(exp, sma[idx])) {
+			t.Errorf("SMA[%d]: Expected %f, but got %f", idx, exp, sma[idx])
+		}
+	}
+	for idx, exp := range []float64{2, 3, 4} {
+		if !near(exp, ema[idx+2]) {
+			t.Errorf("EMA[%d]: Expected %f, but got %f", idx+2, exp, ema[idx+2])
+		}
+	}
+}
+
+func TestRSI(t *testing.T) {
+	up, updown := indicators.NewRSI(14), indicators.NewRSI(14)
+	for i := 0; i < 30; i++ {
+		up.Update(float64(i))
+		updown.Update(float64(10 + i%2))
+	}
+	if !up.Ready() || up.Value() != 100 {
+		t.Errorf("Expected RSI 100 on only gains, but got %f", up.Value())
+	}
+	if updown.Value() < 45 || updown.Value() > 55 {
+		t.Errorf("Expected RSI close to 50 on equal gains and losses, but got %f", updown.Value())
+	}
+}
+
+func TestMACDAndBollinger(t *testing.T) {
+	macd := indicators.NewDefaultMACD()
+	for i := 0; i < 50; i++ {
+		macd.Update(42)
+	}
+	if !macd.Ready() || macd.Value() != 0 || macd.Histogram() != 0 {
+		t.Errorf("Expected a flat MACD on constant input, but got %f, %f", macd.Value(), macd.Histogram())
+	}
+
+	bb := indicators.NewBollinger(3, 2)
+	for _, v := range []float64{1, 2, 3} {
+		bb.Update(v)
+	}
+	std := math.Sqrt(2.0 / 3.0)
+	if !near(bb.Value(), 2) || !near(bb.Upper(), 2+2*std) || !near(bb.Lower(), 2-2*std) {
+		t.Errorf("Unexpected bands: %f %f %f", bb.Lower(), bb.Value(), bb.Upper())
+	}
+	if !near(bb.PercentB(2), 0.5) {
+		t.Errorf("Expected middle to be 0.5, but got %f", bb.PercentB(2))
+	}
+}
+
+func TestATRAndCandles(t *testing.T) {
+	trades := feedmodel.FeedTradeDataSequence{
+		{Trade_timestamp: 0, Price: 9, Volume: 1}, {Trade_timestamp: 100, Price: 10, Volume: 1},
+		{Trade_timestamp: 200, Price: 8, Volume: 1}, {Trade_timestamp: 900, Price: 9, Volume: 1},
+		{Trade_timestamp: 1000, Price: 9, Volume: 1}, {Trade_timestamp: 1500, Price: 11, Volume: 1},
+		{Trade_timestamp: 1999, Price: 10, Volume: 1},
+		{Trade_timestamp: 2000, Price: 12, Volume: 1}, {Trade_timestamp: 2100, Price: 15, Volume: 1},
+		{Trade_timestamp: 2200, Price: 14, Volume: 1},
+	}
+	candles := indicators.CandlesFromTrades(trades, 1000)
+	t.Logf("Candles: %+v", candles)
+	if len(candles) != 3 || candles[0].High != 10 || candles[0].Low != 8 || candles[0].Close != 9 || candles[0].Volume != 4 {
+		t.Fatalf("Unexpected candles: %+v", candles)
+	}
+
+	// Late ticks count for high, low and volume, but the close is the newest price
+	var built []indicators.Candle
+	cb := indicators.NewCandleBuilder(1000, func(c indicators.Candle) { built = append(built, c) })
+	cb.Add(1100, 10, 1)
+	cb.Add(1500, 11, 1)
+	cb.Add(1200, 13, 1)
+	cb.Add(900, 7, 1)
+	cb.Flush()
+	if len(built) != 1 || built[0].Close != 11 || built[0].High != 13 || built[0].Low != 7 || built[0].Volume != 4 {
+		t.Errorf("Unexpected candle with late ticks: %+v", built)
+	}
+
+	atr := indicators.BatchCandles(indicators.NewATR(2), candles)
+	t.Logf("ATR: %v", atr)
+	if !math.IsNaN(atr[0]) || !near(atr[1], 2) || !near(atr[2], 3.5) {
+		t.Errorf("Unexpected ATR: %v", atr)
+	}
+}
+
+func TestFeedIndicatorClient(t *testing.T) {
+	var derived []indicators.DerivedData
+	fc := indicators.NewFeedIndicatorClient("sma2", 0,
+		func() indicators.CandleIndicator { return indicators.OnClose(indicators.NewSMA(2)) },
+		func(msg *feedmodel.FeedMsg) {
+			var data indicators.DerivedData
+			if err := msg.DecodeData(&data); err != nil || msg.Type != indicators.DerivedMsgType {
+				t.Errorf("Unexpected message %+v: %+v", msg, err)
+			}
+			derived = append(derived, data)
+		})
+
+	for idx, last := range []float64{10, 11, 12, 13} {
+		ts := int64(1000 + idx)
+		msg, _ := feedmodel.NewFeedMsg([]byte(fmt.Sprintf(
+			`{"type":"price","data":{"i":"101","m":11,"last":%f,"turnover_volume":%d,"trade_timestamp":%d,"tick_timestamp":%d}}`,
+			last, 100*(idx+1), ts, ts)))
+		fc(msg)
+	}
+	// First price is only a reference, so we get trades on 11, 12 and 13. SMA 2 is ready on 12.
+	t.Logf("Derived: %+v", derived)
+	if len(derived) != 2 || !near(derived[0].Value, 11.5) || !near(derived[1].Value, 12.5) || derived[1].Identifier != "101" {
+		t.Errorf("Unexpected derived values: %+v", derived)
+	}
+}
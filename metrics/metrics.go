@@ -0,0 +1,330 @@
+// Package metrics counts what the library does, and exposes it in the Prometheus text format, on an http handler
+// and through the Metrics command. Packages register their metrics on Default when they are loaded.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types, as in the Prometheus text format
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// Buckets for latencies, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// One value, with the labels. Histograms are flattened to _bucket, _sum and _count samples.
+type Sample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+type Family struct {
+	Name    string   `json:"name"`
+	Help    string   `json:"help"`
+	Type    string   `json:"type"`
+	Samples []Sample `json:"samples"`
+}
+
+type series struct {
+	sync.Mutex
+	values  []string
+	value   float64
+	count   uint64
+	buckets []uint64
+}
+
+type family struct {
+	sync.Mutex
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	fn      func() float64
+	series  map[string]*series
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, but got values %v", f.name, f.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	f.Lock()
+	defer f.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string{}, values...)}
+		if f.typ == HistogramType {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) gather() Family {
+	res := Family{Name: f.name, Help: f.help, Type: f.typ, Samples: []Sample{}}
+	if f.fn != nil {
+		res.Samples = append(res.Samples, Sample{Name: f.name, Value: f.fn()})
+		return res
+	}
+	f.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.Unlock()
+	sort.Sort(byValues(all))
+
+	for _, s := range all {
+		labels := func(extra ...string) map[string]string {
+			res := make(map[string]string)
+			for idx, l := range f.labels {
+				res[l] = s.values[idx]
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				res[extra[i]] = extra[i+1]
+			}
+			return res
+		}
+		s.Lock()
+		if f.typ == HistogramType {
+			cumulative := uint64(0)
+			for idx, b := range f.buckets {
+				cumulative += s.buckets[idx]
+				res.Samples = append(res.Samples, Sample{f.name + "_bucket", labels("le", formatFloat(b)), float64(cumulative)})
+			}
+			res.Samples = append(res.Samples, Sample{f.name + "_bucket", labels("le", "+Inf"), float64(s.count)},
+				Sample{f.name + "_sum", labels(), s.value}, Sample{f.name + "_count", labels(), float64(s.count)})
+		} else {
+			res.Samples = append(res.Samples, Sample{f.name, labels(), s.value})
+		}
+		s.Unlock()
+	}
+	return res
+}
+
+type byValues []*series
+
+func (a byValues) Len() int      { return len(a) }
+func (a byValues) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byValues) Less(i, j int) bool {
+	return strings.Join(a[i].values, "\xff") < strings.Join(a[j].values, "\xff")
+}
+
+// Holds the metric families. Registering a name again returns the existing metric, if the type and labels match.
+type Registry struct {
+	sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// The registry used by the library
+var Default = NewRegistry()
+
+func (r *Registry) register(name, help, typ string, buckets []float64, fn func() float64, labels []string) *family {
+	r.Lock()
+	defer r.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") || (fn != nil) != (f.fn != nil) {
+			panic(fmt.Sprintf("metrics: %s is already registered as %s%v", name, f.typ, f.labels))
+		}
+		return f
+	}
+	f := &family{name: name, help: help, typ: typ, labels: labels, buckets: buckets, fn: fn, series: make(map[string]*series)}
+	r.families[name] = f
+	return f
+}
+
+// Snapshot of all families, sorted on name
+func (r *Registry) Gather() []Family {
+	r.Lock()
+	all := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		all = append(all, f)
+	}
+	r.Unlock()
+
+	res := make([]Family, 0, len(all))
+	for _, f := range all {
+		res = append(res, f.gather())
+	}
+	sort.Sort(byName(res))
+	return res
+}
+
+type byName []Family
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// Only increases
+type Counter struct {
+	s *series
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.s.Lock()
+	c.s.value += v
+	c.s.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.s.Lock()
+	defer c.s.Unlock()
+	return c.s.value
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, CounterType, nil, nil, labels)}
+}
+
+// The counter of the label values, in the order of the labels
+func (cv *CounterVec) With(values ...string) *Counter {
+	return &Counter{cv.f.with(values)}
+}
+
+type Gauge struct {
+	s *series
+}
+
+func (g *Gauge) Set(v float64) {
+	g.s.Lock()
+	g.s.value = v
+	g.s.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.s.Lock()
+	g.s.value += v
+	g.s.Unlock()
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Value() float64 {
+	g.s.Lock()
+	defer g.s.Unlock()
+	return g.s.value
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, GaugeType, nil, nil, labels)}
+}
+
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{gv.f.with(values)}
+}
+
+// A gauge without labels, read when gathered
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, GaugeType, nil, fn, nil)
+}
+
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.buckets, v) // First bucket with v <= le
+	h.s.Lock()
+	if idx < len(h.s.buckets) {
+		h.s.buckets[idx]++
+	}
+	h.s.count++
+	h.s.value += v
+	h.s.Unlock()
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+// Buckets are upper bounds, and are sorted. Nil for DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{r.register(name, help, HistogramType, buckets, nil, labels)}
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{hv.f.with(values), hv.f.buckets}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprint(v)
+}
+
+// Lookups of a cache, and the hit ratio of them
+type CacheStats struct {
+	hits, misses *Counter
+	ratio        *Gauge
+}
+
+func (r *Registry) CacheStats(cache string) *CacheStats {
+	lookups := r.Counter("yanngo_cache_lookups_total", "Cache lookups per cache and result", "cache", "result")
+	return &CacheStats{hits: lookups.With(cache, "hit"), misses: lookups.With(cache, "miss"),
+		ratio: r.Gauge("yanngo_cache_hit_ratio", "Hits of all lookups per cache, 0 to 1", "cache").With(cache)}
+}
+
+func (cs *CacheStats) update() {
+	hits, misses := cs.hits.Value(), cs.misses.Value()
+	cs.ratio.Set(hits / (hits + misses))
+}
+
+func (cs *CacheStats) Hit() {
+	cs.hits.Inc()
+	cs.update()
+}
+
+// Also for stale entries
+func (cs *CacheStats) Miss() {
+	cs.misses.Inc()
+	cs.update()
+}
@@ -0,0 +1,139 @@
+package metrics_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/metrics"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := metrics.NewRegistry()
+	msgs := reg.Counter("test_messages_total", "Messages per feed\nand type", "feed", "type")
+	msgs.With("public", "price").Add(2)
+	msgs.With("private", "order").Inc()
+	reg.Counter("test_messages_total", "Registered again", "feed", "type").With("public", "price").Inc()
+	msgs.With("public", "price").Add(-5) // Ignored
+
+	reg.Gauge("test_pending", "Pending").With().Inc()
+	reg.Gauge("test_pending", "Pending").With().Add(2)
+	reg.Gauge("test_pending", "Pending").With().Dec()
+	reg.GaugeFunc("test_func", "From a func", func() float64 { return 0.5 })
+
+	lat := reg.Histogram("test_latency_seconds", "Latency", []float64{1, 0.1}, "cmd")
+	for _, v := range []float64{0.0625, 0.125, 0.5, 3} {
+		lat.With(`a"b`).Observe(v)
+	}
+	cache := reg.CacheStats("memory")
+	cache.Hit()
+	cache.Hit()
+	cache.Hit()
+	cache.Miss()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic on a different type")
+			}
+		}()
+		reg.Gauge("test_messages_total", "Other type", "feed", "type")
+	}()
+
+	expected := `# HELP test_func From a func
+# TYPE test_func gauge
+test_func 0.5
+# HELP test_latency_seconds Latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{cmd="a\"b",le="0.1"} 1
+test_latency_seconds_bucket{cmd="a\"b",le="1"} 3
+test_latency_seconds_bucket{cmd="a\"b",le="+Inf"} 4
+test_latency_seconds_sum{cmd="a\"b"} 3.6875
+test_latency_seconds_count{cmd="a\"b"} 4
+# HELP test_messages_total Messages per feed\nand type
+# TYPE test_messages_total counter
+test_messages_total{feed="private",type="order"} 1
+test_messages_total{feed="public",type="price"} 3
+# HELP test_pending Pending
+# TYPE test_pending gauge
+test_pending 2
+`
+	var sb strings.Builder
+	if err := metrics.WriteText(&sb, reg.GatherPrefix("test_")); err != nil || sb.String() != expected {
+		t.Errorf("Expected:\n%s\nBut got (%+v):\n%s", expected, err, sb.String())
+	}
+
+	srv := httptest.NewServer(reg.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != metrics.TextContentType ||
+		!strings.Contains(string(body), `yanngo_cache_hit_ratio{cache="memory"} 0.75`+"\n") ||
+		!strings.Contains(string(body), `yanngo_cache_lookups_total{cache="memory",result="miss"} 1`+"\n") {
+		t.Errorf("Unexpected /metrics %s:\n%s", resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestRouterAndCommand(t *testing.T) {
+	reg := metrics.NewRegistry()
+	echo := make(api.RequestCommandTransport)
+	echo.AddCommand("Echo").AddArgument("fail").Handler(func(p api.Params) (json.RawMessage, error) {
+		time.Sleep(time.Millisecond)
+		if p["fail"] == "true" {
+			return nil, fmt.Errorf("Failed")
+		}
+		return json.Marshal("ok")
+	})
+	router, err := api.NewTransportRouter(echo, metrics.NewTransport(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.AddObserver(reg.RequestObserver())
+
+	for _, fail := range []string{"false", "true", "false"} {
+		router.Preform(&api.Request{Command: "Echo", Args: api.Params{"fail": fail}})
+	}
+	router.Preform(&api.Request{Command: "Unknown"}) // Not routed, so not counted
+
+	cli := api.NewApiClient(router)
+	families, err := cli.Metrics("yanngo_request")
+	if err != nil || len(families) != 3 {
+		t.Fatalf("Expected the request families: %+v, %+v", families, err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, s := range f["samples"].([]interface{}) {
+			sample := s.(map[string]interface{})
+			labels, _ := sample["labels"].(map[string]interface{})
+			name := sample["name"].(string)
+			if le, ok := labels["le"]; ok {
+				name += le.(string)
+			}
+			values[name] += sample["value"].(float64)
+			if labels["cmd"] != "Echo" && labels["cmd"] != string(api.MetricsCmd) {
+				t.Errorf("Unexpected cmd label: %+v", sample)
+			}
+		}
+	}
+	// The Metrics call itself is observed when it returns, so it is not in its own response
+	if values["yanngo_requests_total"] != 3 || values["yanngo_request_errors_total"] != 1 ||
+		values["yanngo_request_duration_seconds_count"] != 3 || values["yanngo_request_duration_seconds_sum"] < 0.003 ||
+		values["yanngo_request_duration_seconds_bucket+Inf"] != 3 {
+		t.Errorf("Unexpected values: %+v", values)
+	}
+
+	text, err := cli.MetricsText("yanngo_requests_total")
+	if err != nil || text != "# HELP yanngo_requests_total Routed requests per command\n# TYPE yanngo_requests_total counter\n"+
+		"yanngo_requests_total{cmd=\"Echo\"} 3\nyanngo_requests_total{cmd=\"Metrics\"} 1\n" {
+		t.Errorf("Unexpected text %+v:\n%s", err, text)
+	}
+}
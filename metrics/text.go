@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Content type of the Prometheus text format
+const TextContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeLabels(w io.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "le" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := labels["le"]; ok {
+		names = append(names, "le") // Last, like everyone else
+	}
+	io.WriteString(w, "{")
+	for idx, name := range names {
+		if idx > 0 {
+			io.WriteString(w, ",")
+		}
+		fmt.Fprintf(w, `%s="%s"`, name, labelEscaper.Replace(labels[name]))
+	}
+	io.WriteString(w, "}")
+}
+
+// Write the families in the Prometheus text format
+func WriteText(w io.Writer, families []Family) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.Name, helpEscaper.Replace(f.Help), f.Name, f.Type)
+		for _, s := range f.Samples {
+			io.WriteString(bw, s.Name)
+			writeLabels(bw, s.Labels)
+			fmt.Fprintf(bw, " %s\n", formatFloat(s.Value))
+		}
+	}
+	return bw.Flush()
+}
+
+// All metrics of the registry in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	return WriteText(w, r.Gather())
+}
+
+// Serves the registry on /metrics, or wherever it is mounted
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", TextContentType)
+		if err := r.WriteText(w); err != nil {
+			logger.Warn("Unable to write metrics", "remote", req.RemoteAddr, "err", err)
+		}
+	})
+}
+
+// Serve the registry on addr, like ':9100', in the background
+func (r *Registry) ListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("Metrics endpoint stopped", "addr", addr, "err", err)
+		}
+	}()
+}
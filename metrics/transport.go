@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/nnlog"
+	"strings"
+	"time"
+)
+
+var logger = nnlog.For("metrics")
+
+// Counts requests, errors and latency per command. Add it to a router with TransportRouter.AddObserver.
+func (r *Registry) RequestObserver() api.RequestObserver {
+	requests := r.Counter("yanngo_requests_total", "Routed requests per command", "cmd")
+	errors := r.Counter("yanngo_request_errors_total", "Routed requests that failed, per command", "cmd")
+	latency := r.Histogram("yanngo_request_duration_seconds", "Latency of routed requests per command", nil, "cmd")
+	return func(req *api.Request, res *api.Response, elapsed time.Duration) {
+		cmd := string(req.Command)
+		requests.With(cmd).Inc()
+		if res.IsError() {
+			errors.With(cmd).Inc()
+		}
+		latency.With(cmd).ObserveDuration(elapsed)
+	}
+}
+
+// Only the families with a name starting with prefix
+func (r *Registry) GatherPrefix(prefix string) []Family {
+	res := []Family{}
+	for _, f := range r.Gather() {
+		if strings.HasPrefix(f.Name, prefix) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// The Metrics command, on the registry
+func NewTransport(r *Registry) api.RequestCommandTransport {
+	transp := make(api.RequestCommandTransport)
+	transp.AddCommand(string(api.MetricsCmd)).Description("Metrics of the daemon").
+		AddFullArgument("prefix", "Only metrics with a name starting with this", []string{}, true).
+		AddFullArgument("format", "Default json", []string{"json", "text"}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			families := r.GatherPrefix(params["prefix"])
+			switch params["format"] {
+			case "", "json":
+				return json.Marshal(families)
+			case "text":
+				var buf bytes.Buffer
+				if err := WriteText(&buf, families); err != nil {
+					return nil, err
+				}
+				return json.Marshal(buf.String())
+			}
+			return nil, fmt.Errorf("Unknown format '%s'", params["format"])
+		})
+	return transp
+}
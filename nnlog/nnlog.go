@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Forau @ github.com. MIT License.
+
+// Package nnlog is the logging of the library. Leveled, with key/value fields, and backed by log/slog.
+//
+// All packages log through For(name), where name is the package path below yanngo, like "feed" or "remote".
+// Use SetDefault to send everything to your own pipeline, or SetLogger to silence or redirect a single package.
+// Sensitive fields, like session keys and auth strings, are redacted before they reach the handler.
+package nnlog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Leveled logger. kv is alternating keys and values, like slog.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	With(kv ...interface{}) Logger
+	Enabled(level slog.Level) bool
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// Logger on a slog.Handler. Records pass the redaction before the handler.
+func NewSlogLogger(h slog.Handler) Logger {
+	return &slogLogger{slog.New(NewRedactHandler(h))}
+}
+
+// Text to w, from the given level
+func NewTextLogger(w io.Writer, level slog.Level) Logger {
+	return NewSlogLogger(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+func (sl *slogLogger) Debug(msg string, kv ...interface{}) { sl.l.Debug(msg, kv...) }
+func (sl *slogLogger) Info(msg string, kv ...interface{})  { sl.l.Info(msg, kv...) }
+func (sl *slogLogger) Warn(msg string, kv ...interface{})  { sl.l.Warn(msg, kv...) }
+func (sl *slogLogger) Error(msg string, kv ...interface{}) { sl.l.Error(msg, kv...) }
+
+func (sl *slogLogger) With(kv ...interface{}) Logger {
+	return &slogLogger{sl.l.With(kv...)}
+}
+
+func (sl *slogLogger) Enabled(level slog.Level) bool {
+	return sl.l.Enabled(context.Background(), level)
+}
+
+// Log on a level given at runtime
+func Log(l Logger, level slog.Level, msg string, kv ...interface{}) {
+	switch {
+	case level < slog.LevelInfo:
+		l.Debug(msg, kv...)
+	case level < slog.LevelWarn:
+		l.Info(msg, kv...)
+	case level < slog.LevelError:
+		l.Warn(msg, kv...)
+	default:
+		l.Error(msg, kv...)
+	}
+}
+
+type discard struct{}
+
+func (discard) Debug(string, ...interface{}) {}
+func (discard) Info(string, ...interface{})  {}
+func (discard) Warn(string, ...interface{})  {}
+func (discard) Error(string, ...interface{}) {}
+func (d discard) With(...interface{}) Logger { return d }
+func (discard) Enabled(slog.Level) bool      { return false }
+
+// Logs nothing
+var Discard Logger = discard{}
+
+var (
+	lock     sync.RWMutex
+	def      = NewTextLogger(os.Stderr, slog.LevelInfo)
+	packages = make(map[string]Logger)
+)
+
+// Logger of all packages without an own logger. Default is text to stderr, from info.
+func SetDefault(l Logger) {
+	if l == nil {
+		l = Discard
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	def = l
+}
+
+func Default() Logger {
+	lock.RLock()
+	defer lock.RUnlock()
+	return def
+}
+
+// Logger of a single package. Nil to use the default again.
+func SetLogger(pkg string, l Logger) {
+	lock.Lock()
+	defer lock.Unlock()
+	if l == nil {
+		delete(packages, pkg)
+	} else {
+		packages[pkg] = l
+	}
+}
+
+func lookup(pkg string) Logger {
+	lock.RLock()
+	defer lock.RUnlock()
+	if l, ok := packages[pkg]; ok {
+		return l
+	}
+	return def
+}
+
+// The logger of a package. Looks up the current logger on every call, so it can be kept in a package variable.
+func For(pkg string) Logger {
+	return &pkgLogger{pkg: pkg}
+}
+
+type pkgLogger struct {
+	pkg string
+	kv  []interface{}
+}
+
+func (pl *pkgLogger) log(level slog.Level, msg string, kv []interface{}) {
+	l := lookup(pl.pkg)
+	if !l.Enabled(level) {
+		return
+	}
+	fields := make([]interface{}, 0, 2+len(pl.kv)+len(kv))
+	fields = append(append(append(fields, "pkg", pl.pkg), pl.kv...), kv...)
+	Log(l, level, msg, fields...)
+}
+
+func (pl *pkgLogger) Debug(msg string, kv ...interface{}) { pl.log(slog.LevelDebug, msg, kv) }
+func (pl *pkgLogger) Info(msg string, kv ...interface{})  { pl.log(slog.LevelInfo, msg, kv) }
+func (pl *pkgLogger) Warn(msg string, kv ...interface{})  { pl.log(slog.LevelWarn, msg, kv) }
+func (pl *pkgLogger) Error(msg string, kv ...interface{}) { pl.log(slog.LevelError, msg, kv) }
+
+func (pl *pkgLogger) With(kv ...interface{}) Logger {
+	return &pkgLogger{pkg: pl.pkg, kv: append(append([]interface{}{}, pl.kv...), kv...)}
+}
+
+func (pl *pkgLogger) Enabled(level slog.Level) bool {
+	return lookup(pl.pkg).Enabled(level)
+}
+
+type writer struct {
+	sync.Mutex
+	l     Logger
+	level slog.Level
+	msg   string
+	buf   []byte
+}
+
+// An io.Writer that logs each line as msg, with the line in the field "text". For libraries that want a writer.
+func Writer(l Logger, level slog.Level, msg string) io.Writer {
+	return &writer{l: l, level: level, msg: msg}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if line := w.buf[:idx]; len(bytes.TrimSpace(line)) > 0 && w.l.Enabled(w.level) {
+			Log(w.l, w.level, w.msg, "text", string(line))
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
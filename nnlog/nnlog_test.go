@@ -0,0 +1,76 @@
+package nnlog_test
+
+import (
+	"github.com/Forau/yanngo/nnlog"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type login struct {
+	SessionKey  string
+	Environment string
+}
+
+func TestRedactString(t *testing.T) {
+	tests := map[string]string{
+		`{"cmd":"login","args":{"session_key":"abc123"}}`: `{"cmd":"login","args":{"session_key":"[REDACTED]"}}`,
+		`auth=c2VjcmV0&service=NEXTAPI`:                   `auth=[REDACTED]&service=NEXTAPI`,
+		`Authorization: Basic dXNlcjpwYXNz`:               `Authorization: Basic [REDACTED]`,
+		`&{SessionKey:abc123 Environment:test}`:           `&{SessionKey:[REDACTED] Environment:test}`,
+		`{"text":"PASSWORD=hunter2 author=me"}`:           `{"text":"PASSWORD=[REDACTED] author=me"}`,
+		`Request Accounts -> map[accno:123]`:              `Request Accounts -> map[accno:123]`,
+	}
+	for in, expected := range tests {
+		if res := nnlog.RedactString(in); res != expected {
+			t.Errorf("Expected '%s' to be '%s', but got '%s'", in, expected, res)
+		}
+	}
+
+	nnlog.AddSensitiveKey("Pin-Code")
+	if res := nnlog.RedactString("pin_code=1234"); res != "pin_code=[REDACTED]" {
+		t.Errorf("Expected added key to be redacted, but got '%s'", res)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := nnlog.NewSlogLogger(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	l.With("auth", "secret").Info("Login", "user", "me", "session", &login{"abc123", "test"}, "key", "session_key=abc123",
+		slog.Group("conn", "token", "xyz"))
+	if strings.Contains(buf.String(), "secret") || strings.Contains(buf.String(), "abc123") || strings.Contains(buf.String(), "xyz") {
+		t.Errorf("Expected sensitive values to be redacted: %s", buf.String())
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil || rec["user"] != "me" || rec["auth"] != nnlog.Redacted {
+		t.Errorf("Expected a json record, but got %+v: %+v", rec, err)
+	}
+
+	defer nnlog.SetDefault(nnlog.Default())
+	defer nnlog.SetLogger("remote", nil)
+	buf.Reset()
+	nnlog.SetDefault(nnlog.NewTextLogger(buf, slog.LevelInfo))
+	remote, feed := nnlog.For("remote"), nnlog.For("feed").With("feed", "PUBLIC")
+
+	feed.Debug("Hidden")
+	feed.Warn("Reconnect", "attempt", 2)
+	nnlog.SetLogger("remote", nnlog.Discard)
+	remote.Error("Silenced")
+	if res := buf.String(); strings.Contains(res, "Hidden") || strings.Contains(res, "Silenced") ||
+		!strings.Contains(res, `level=WARN msg=Reconnect pkg=feed feed=PUBLIC attempt=2`) {
+		t.Errorf("Unexpected log: %s", res)
+	}
+
+	buf.Reset()
+	w := nnlog.Writer(nnlog.For("httpcli"), slog.LevelInfo, "resty")
+	fmt.Fprintf(w, "first\nAuthorization: Basic dXNlcjpwYXNz\n\npart")
+	fmt.Fprintf(w, "ial\n")
+	if res := buf.String(); strings.Count(res, "msg=resty") != 3 || !strings.Contains(res, `text="Authorization: Basic [REDACTED]"`) ||
+		!strings.Contains(res, "text=partial") {
+		t.Errorf("Expected a record per line: %s", res)
+	}
+}
@@ -0,0 +1,119 @@
+package nnlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Replaces the value of sensitive fields
+const Redacted = "[REDACTED]"
+
+var (
+	sensitiveLock sync.RWMutex
+	sensitive     = map[string]bool{"sessionkey": true, "auth": true, "authorization": true, "password": true,
+		"passwd": true, "pass": true, "secret": true, "token": true, "privatekey": true, "pem": true}
+	// key=value, key: value and "key":"value". The value may start with Basic or Bearer.
+	sensitiveRe = regexp.MustCompile(`(?i)("?\b([a-z_-]+)"?\s*[:=]\s*)((?:basic|bearer)\s+)?("[^"]*"|[^\s&,;{}\[\]:"]+)`)
+)
+
+func normalizeKey(key string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+}
+
+// Redact values of fields with this name, in addition to session keys, auth, passwords, secrets and tokens.
+// Case, '_' and '-' are ignored.
+func AddSensitiveKey(key string) {
+	sensitiveLock.Lock()
+	defer sensitiveLock.Unlock()
+	sensitive[normalizeKey(key)] = true
+}
+
+func IsSensitive(key string) bool {
+	sensitiveLock.RLock()
+	defer sensitiveLock.RUnlock()
+	return sensitive[normalizeKey(key)]
+}
+
+// Redacts sensitive values in free text, like json, query strings and %+v of structs
+func RedactString(s string) string {
+	return sensitiveRe.ReplaceAllStringFunc(s, func(m string) string {
+		parts := sensitiveRe.FindStringSubmatch(m)
+		if !IsSensitive(parts[2]) {
+			if strings.HasPrefix(parts[4], `"`) {
+				return parts[1] + parts[3] + RedactString(parts[4]) // Like {"text":"auth=..."}
+			}
+			return m
+		}
+		if strings.HasPrefix(parts[4], `"`) {
+			return parts[1] + parts[3] + `"` + Redacted + `"`
+		}
+		return parts[1] + parts[3] + Redacted
+	})
+}
+
+// Redacts an attribute, by its key or by its content
+func RedactAttr(a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		res := make([]slog.Attr, len(attrs))
+		for idx, ga := range attrs {
+			res[idx] = RedactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(res...)}
+	case slog.KindAny:
+		// Only stringify values that would leak
+		str := fmt.Sprintf("%+v", v.Any())
+		if red := RedactString(str); red != str {
+			return slog.String(a.Key, red)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+type redactHandler struct {
+	h slog.Handler
+}
+
+// Redacts the message and all attributes, before passing the record to h
+func NewRedactHandler(h slog.Handler) slog.Handler {
+	if rh, ok := h.(*redactHandler); ok {
+		return rh
+	}
+	return &redactHandler{h}
+}
+
+func (rh *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return rh.h.Enabled(ctx, level)
+}
+
+func (rh *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	res := slog.NewRecord(r.Time, r.Level, RedactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		res.AddAttrs(RedactAttr(a))
+		return true
+	})
+	return rh.h.Handle(ctx, res)
+}
+
+func (rh *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	res := make([]slog.Attr, len(attrs))
+	for idx, a := range attrs {
+		res[idx] = RedactAttr(a)
+	}
+	return &redactHandler{rh.h.WithAttrs(res)}
+}
+
+func (rh *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{rh.h.WithGroup(name)}
+}
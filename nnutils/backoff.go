@@ -0,0 +1,98 @@
+package nnutils
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Policy for how long to wait between retries. Exponential with jitter.
+// The first retry is immediate, then we wait Initial, and multiply up to Max.
+type BackoffPolicy struct {
+	Initial     time.Duration // Delay before the second retry
+	Max         time.Duration // Never wait longer then this
+	Multiplier  float64       // Growth per attempt. Below 1 is treated as 1
+	Jitter      float64       // Fraction of the delay that is random, 0 to 1
+	MaxAttempts int           // Give up after this many attempts. 0 is forever
+	ResetAfter  time.Duration // If no retry within this time, start over from the first attempt
+}
+
+// Same delays as we always had: 0, 5s and then 30s. Reset after a minute of silence.
+var DefaultBackoffPolicy = BackoffPolicy{
+	Initial:    5 * time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 6,
+	ResetAfter: time.Minute,
+}
+
+// Delay before the given attempt, starting at 1. No jitter applied.
+func (bp BackoffPolicy) Delay(attempt int) time.Duration {
+	if attempt <= 1 {
+		return 0
+	}
+	mult := math.Max(bp.Multiplier, 1)
+	delay := float64(bp.Initial) * math.Pow(mult, float64(attempt-2))
+	if bp.Max > 0 && delay > float64(bp.Max) {
+		return bp.Max
+	}
+	return time.Duration(delay)
+}
+
+// Create a stateful Backoff from the policy
+func (bp BackoffPolicy) NewBackoff() *Backoff {
+	return &Backoff{policy: bp, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Keeps track of the attempts for one retry loop
+type Backoff struct {
+	sync.Mutex
+	policy  BackoffPolicy
+	attempt int
+	last    time.Time
+	rnd     *rand.Rand
+}
+
+// The delay before the next attempt. ok is false if we have used all attempts.
+func (b *Backoff) Next() (delay time.Duration, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	if b.policy.ResetAfter > 0 && !b.last.IsZero() && now.Sub(b.last) > b.policy.ResetAfter {
+		b.attempt = 0
+	}
+	b.last = now
+	b.attempt++
+	if b.policy.MaxAttempts > 0 && b.attempt > b.policy.MaxAttempts {
+		return 0, false
+	}
+	delay = b.policy.Delay(b.attempt)
+	if jitter := math.Min(math.Max(b.policy.Jitter, 0), 1); jitter > 0 && delay > 0 {
+		spread := float64(delay) * jitter
+		delay = time.Duration(float64(delay) - spread + b.rnd.Float64()*spread*2)
+	}
+	return delay, true
+}
+
+// Sleep until next attempt. Returns false, without sleeping, if we should give up.
+func (b *Backoff) Wait() bool {
+	delay, ok := b.Next()
+	if ok {
+		time.Sleep(delay)
+	}
+	return ok
+}
+
+// Start over, for example after a successful attempt
+func (b *Backoff) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.attempt = 0
+}
+
+// Number of attempts since last reset
+func (b *Backoff) Attempt() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.attempt
+}
@@ -0,0 +1,50 @@
+package nnutils_test
+
+import (
+	"github.com/Forau/yanngo/nnutils"
+
+	"testing"
+	"time"
+)
+
+func TestDefaultBackoffPolicy(t *testing.T) {
+	bp := nnutils.DefaultBackoffPolicy
+	for attempt, exp := range []time.Duration{0, 0, 5 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if attempt == 0 {
+			continue
+		}
+		if delay := bp.Delay(attempt); delay != exp {
+			t.Errorf("Expected delay %v for attempt %d, but got %v", exp, attempt, delay)
+		}
+	}
+}
+
+func TestBackoffJitterAndMaxAttempts(t *testing.T) {
+	bp := nnutils.BackoffPolicy{
+		Initial:     100 * time.Millisecond,
+		Max:         time.Second,
+		Multiplier:  2,
+		Jitter:      0.5,
+		MaxAttempts: 5,
+	}
+	b := bp.NewBackoff()
+	for attempt := 1; attempt <= 5; attempt++ {
+		delay, ok := b.Next()
+		exp := bp.Delay(attempt)
+		t.Logf("Attempt %d: %v (%v without jitter)", attempt, delay, exp)
+		if !ok {
+			t.Errorf("Expected attempt %d to be allowed", attempt)
+		}
+		if delay < exp/2 || delay > exp+exp/2 {
+			t.Errorf("Delay %v is outside jitter of %v", delay, exp)
+		}
+	}
+	if _, ok := b.Next(); ok {
+		t.Error("Expected to give up after 5 attempts")
+	}
+
+	b.Reset()
+	if delay, ok := b.Next(); !ok || delay != 0 {
+		t.Errorf("Expected first attempt after reset to be immediate, but got %v, %v", delay, ok)
+	}
+}
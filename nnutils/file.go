@@ -0,0 +1,28 @@
+package nnutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Replace file with data. Writes to a temp file in the same directory first, and renames it, so a reader
+// never sees a half written file, and a failed write keeps the old one.
+// Concurrent writers to the same file do not mix their data, but the caller decides which one is renamed last.
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(perm); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
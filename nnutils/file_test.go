@@ -0,0 +1,45 @@
+package nnutils_test
+
+import (
+	"github.com/Forau/yanngo/nnutils"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nnutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := nnutils.WriteFileAtomic(file, []byte(fmt.Sprintf("[%d,%d,%d]", i, i, i)), 0600); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	b, err := ioutil.ReadFile(file)
+	var a, b2, c int
+	if n, _ := fmt.Sscanf(string(b), "[%d,%d,%d]", &a, &b2, &c); err != nil || n != 3 || a != b2 || b2 != c {
+		t.Errorf("Expected one whole write, but got %s: %+v", b, err)
+	}
+	if st, err := os.Stat(file); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600: %+v, %+v", st, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected no temp files left, but got %d files", len(files))
+	}
+}
@@ -0,0 +1,103 @@
+// Package options builds option chains per underlying from InstrumentOptionPairs, and keeps implied volatility,
+// theoretical prices and Black-Scholes greeks updated from the price feed.
+package options
+
+import (
+	"fmt"
+	"math"
+)
+
+// Bounds for the implied volatility search
+const (
+	MinVolatility = 0.0001
+	MaxVolatility = 5.0
+)
+
+// Price and greeks of one option. Vega and Rho are per percentage point, and Theta per calendar day.
+type Greeks struct {
+	Price float64 `json:"price"`
+	Delta float64 `json:"delta"`
+	Gamma float64 `json:"gamma"`
+	Vega  float64 `json:"vega"`
+	Theta float64 `json:"theta"`
+	Rho   float64 `json:"rho"`
+}
+
+func normCdf(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+func normPdf(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
+
+// European option without dividends. Years to expiry, and rate and volatility as fractions, like 0.02 and 0.25.
+// At or after expiry, the price is the intrinsic value.
+func BlackScholes(call bool, spot, strike, years, rate, vol float64) (g Greeks) {
+	if years <= 0 || vol <= 0 {
+		if call && spot > strike {
+			g.Price, g.Delta = spot-strike, 1
+		} else if !call && spot < strike {
+			g.Price, g.Delta = strike-spot, -1
+		}
+		return
+	}
+	sqrtT := math.Sqrt(years)
+	d1 := (math.Log(spot/strike) + (rate+vol*vol/2)*years) / (vol * sqrtT)
+	d2 := d1 - vol*sqrtT
+	discount := math.Exp(-rate * years)
+
+	g.Gamma = normPdf(d1) / (spot * vol * sqrtT)
+	g.Vega = spot * normPdf(d1) * sqrtT / 100
+	decay := -spot * normPdf(d1) * vol / (2 * sqrtT)
+	if call {
+		g.Price = spot*normCdf(d1) - strike*discount*normCdf(d2)
+		g.Delta = normCdf(d1)
+		g.Theta = (decay - rate*strike*discount*normCdf(d2)) / 365
+		g.Rho = strike * years * discount * normCdf(d2) / 100
+	} else {
+		g.Price = strike*discount*normCdf(-d2) - spot*normCdf(-d1)
+		g.Delta = normCdf(d1) - 1
+		g.Theta = (decay + rate*strike*discount*normCdf(-d2)) / 365
+		g.Rho = -strike * years * discount * normCdf(-d2) / 100
+	}
+	return
+}
+
+// The volatility where BlackScholes gives the price. Newton-Raphson, with bisection when it does not converge.
+func ImpliedVolatility(call bool, price, spot, strike, years, rate float64) (float64, error) {
+	if price <= 0 || spot <= 0 || strike <= 0 || years <= 0 {
+		return 0, fmt.Errorf("Can not imply volatility from price %v, spot %v, strike %v and %v years", price, spot, strike, years)
+	}
+	low, high := BlackScholes(call, spot, strike, years, rate, MinVolatility).Price, BlackScholes(call, spot, strike, years, rate, MaxVolatility).Price
+	if price < low-1e-9 || price > high+1e-9 {
+		return 0, fmt.Errorf("Price %v is outside of the possible %v to %v", price, low, high)
+	}
+
+	vol := 0.25
+	for i := 0; i < 50; i++ {
+		g := BlackScholes(call, spot, strike, years, rate, vol)
+		diff := g.Price - price
+		if math.Abs(diff) < 1e-8 {
+			return vol, nil
+		}
+		vega := g.Vega * 100
+		if vega < 1e-10 {
+			break
+		}
+		if vol -= diff / vega; vol < MinVolatility || vol > MaxVolatility {
+			break
+		}
+	}
+
+	lo, hi := MinVolatility, MaxVolatility
+	for i := 0; i < 200 && hi-lo > 1e-10; i++ {
+		mid := (lo + hi) / 2
+		if BlackScholes(call, spot, strike, years, rate, mid).Price < price {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2, nil
+}
@@ -0,0 +1,523 @@
+package options
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/swagger"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("options")
+
+// Message type of the analytics of a chain, sent on the feed topic
+const AnalyticsMsgType = "option_analytics"
+
+// How often, at most, prices publish the analytics of a chain
+var DefaultPublishInterval = time.Second
+
+const (
+	Call = "CALL"
+	Put  = "PUT"
+)
+
+const millisPerYear = 365 * 24 * 60 * 60 * 1000
+
+// Analytics of one option
+type Option struct {
+	Underlying   int64   `json:"underlying"` // Instrument id
+	InstrumentId int64   `json:"instrument_id"`
+	Identifier   string  `json:"identifier"`
+	MarketId     int64   `json:"market_id"`
+	Kind         string  `json:"kind"` // CALL or PUT
+	Strike       float64 `json:"strike"`
+	Expiration   string  `json:"expiration"` // 2006-01-02
+	Years        float64 `json:"years"`      // To expiry
+	Spot         float64 `json:"spot"`
+	Bid          float64 `json:"bid,omitempty"`
+	Ask          float64 `json:"ask,omitempty"`
+	Last         float64 `json:"last,omitempty"`
+	IV           float64 `json:"iv,omitempty"` // From the mid price, or last if no bid and ask
+	BidIV        float64 `json:"bid_iv,omitempty"`
+	AskIV        float64 `json:"ask_iv,omitempty"`
+	Volatility   float64 `json:"volatility,omitempty"` // Used for the greeks. IV, or the at the money IV of the expiration
+	Theo         float64 `json:"theo,omitempty"`       // Theoretical price, at the at the money IV of the expiration
+	Delta        float64 `json:"delta"`
+	Gamma        float64 `json:"gamma"`
+	Vega         float64 `json:"vega"`
+	Theta        float64 `json:"theta"`
+	Rho          float64 `json:"rho"`
+	Timestamp    int64   `json:"timestamp"`
+}
+
+// All loaded options of an underlying, sorted on expiration, strike and kind.
+// Published as AnalyticsMsgType when an option, or the underlying, gets a new price.
+type Chain struct {
+	Underlying int64    `json:"underlying"`
+	Identifier string   `json:"identifier"`
+	MarketId   int64    `json:"market_id"`
+	Spot       float64  `json:"spot"`
+	Rate       float64  `json:"rate"`
+	Timestamp  int64    `json:"timestamp"`
+	Options    []Option `json:"options"`
+}
+
+type tradableKey struct {
+	identifier string
+	market     int64
+}
+
+type quote struct {
+	bid, ask, last float64
+}
+
+// Mid, or last if there is no bid and ask
+func (q *quote) price() float64 {
+	if q == nil {
+		return 0
+	} else if q.bid > 0 && q.ask > 0 {
+		return (q.bid + q.ask) / 2
+	}
+	return q.last
+}
+
+type option struct {
+	instrumentId int64
+	key          tradableKey
+	kind         string
+	strike       float64
+	expiration   string
+	expiry       int64 // Millis, at the close of the expiration day
+}
+
+type chain struct {
+	underlying int64
+	key        tradableKey
+	options    []*option
+}
+
+// The engine. Use Bind to attach it to a FeedState, and Load the underlyings to follow.
+type Analyzer struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	cli       *api.ApiClient
+	rate      float64
+	subscribe bool
+	chains    map[int64]*chain
+	quotes    map[tradableKey]*quote
+	clock     func() int64
+	publish   feed.FeedClient
+
+	interval time.Duration
+	dirty    map[int64]bool      // Underlyings with prices not yet published
+	sent     map[int64]time.Time // When each chain was last published
+	flushing bool                // A flush is scheduled
+}
+
+func NewAnalyzer(cli *api.ApiClient) *Analyzer {
+	a := &Analyzer{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		cli:                     cli,
+		subscribe:               true,
+		chains:                  make(map[int64]*chain),
+		quotes:                  make(map[tradableKey]*quote),
+		clock:                   func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+		publish:                 func(*feedmodel.FeedMsg) {},
+		interval:                DefaultPublishInterval,
+		dirty:                   make(map[int64]bool),
+		sent:                    make(map[int64]time.Time),
+	}
+	a.init()
+	return a
+}
+
+// Listen to the messages of the FeedState, and publish analytics on its topic
+func (a *Analyzer) Bind(fs *feed.FeedState) *Analyzer {
+	a.SetPublisher(fs.Publish)
+	fs.AddListener(a.OnMessage)
+	return a
+}
+
+func (a *Analyzer) SetPublisher(publish feed.FeedClient) *Analyzer {
+	a.Lock()
+	defer a.Unlock()
+	a.publish = publish
+	return a
+}
+
+func (a *Analyzer) SetClock(clock func() int64) *Analyzer {
+	a.Lock()
+	defer a.Unlock()
+	a.clock = clock
+	return a
+}
+
+// How often, at most, prices publish the analytics of a chain. They are then computed by a timer, not on the feed.
+// Zero publishes on every price.
+func (a *Analyzer) SetPublishInterval(interval time.Duration) *Analyzer {
+	a.Lock()
+	defer a.Unlock()
+	a.interval = interval
+	return a
+}
+
+// Risk free rate, as a fraction. Default 0.
+func (a *Analyzer) SetRate(rate float64) *Analyzer {
+	a.Lock()
+	defer a.Unlock()
+	a.rate = rate
+	return a
+}
+
+// If true, which is default, Load subscribes to prices of the underlying and the options
+func (a *Analyzer) SetSubscribe(subscribe bool) *Analyzer {
+	a.Lock()
+	defer a.Unlock()
+	a.subscribe = subscribe
+	return a
+}
+
+// Close of the day, in millis
+func expiryMillis(date string) (int64, error) {
+	ot, err := omxtime.NewOmxTimeDate(date)
+	if err != nil {
+		return 0, err
+	} else if ot.OmxClose > 0 {
+		return ot.OmxClose, nil
+	}
+	return ot.Millis + 24*60*60*1000, nil
+}
+
+func newOption(instr swagger.Instrument, kind string, strike float64, expiration swagger.Date) (*option, error) {
+	if instr.InstrumentId == 0 || len(instr.Tradables) == 0 {
+		return nil, nil
+	}
+	date := expiration.Format(swagger.DateFormat)
+	if expiration.IsZero() {
+		date = instr.ExpirationDate.Format(swagger.DateFormat)
+	}
+	if strike == 0 {
+		strike = instr.StrikePrice
+	}
+	expiry, err := expiryMillis(date)
+	if err != nil {
+		return nil, err
+	}
+	t := instr.Tradables[0]
+	return &option{instrumentId: instr.InstrumentId, key: tradableKey{t.Identifier, t.MarketId}, kind: kind,
+		strike: strike, expiration: date, expiry: expiry}, nil
+}
+
+// Build the chain of the underlying from InstrumentOptionPairs. Replaces the loaded options of the same expiration,
+// or all if expiration is empty.
+func (a *Analyzer) Load(underlying int64, expiration string) (*Chain, error) {
+	instrs, err := a.cli.Instruments(underlying)
+	if err != nil {
+		return nil, err
+	} else if len(instrs) == 0 || len(instrs[0].Tradables) == 0 {
+		return nil, fmt.Errorf("No tradable underlying %d", underlying)
+	}
+	pairs, err := a.cli.InstrumentOptionPairs(underlying, expiration, "")
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*option
+	for _, pair := range pairs {
+		for kind, instr := range map[string]swagger.Instrument{Call: pair.Call, Put: pair.Put} {
+			opt, err := newOption(instr, kind, pair.StrikePrice, pair.ExpirationDate)
+			if err != nil {
+				return nil, fmt.Errorf("Option %d: %v", instr.InstrumentId, err)
+			} else if opt != nil {
+				loaded = append(loaded, opt)
+			}
+		}
+	}
+
+	t := instrs[0].Tradables[0]
+	a.Lock()
+	ch, ok := a.chains[underlying]
+	if !ok {
+		ch = &chain{underlying: underlying}
+		a.chains[underlying] = ch
+	}
+	ch.key = tradableKey{t.Identifier, t.MarketId}
+	kept := []*option{}
+	for _, opt := range ch.options {
+		if expiration != "" && opt.expiration != expiration {
+			kept = append(kept, opt)
+		}
+	}
+	ch.options = append(kept, loaded...)
+	sort.Sort(byExpiration(ch.options))
+	subscribe := a.subscribe
+	v := a.viewLocked(ch)
+	a.Unlock()
+
+	if subscribe {
+		for _, key := range append([]tradableKey{ch.key}, keys(loaded)...) {
+			if _, err := a.cli.FeedSub("price", key.identifier, strconv.FormatInt(key.market, 10)); err != nil {
+				logger.Warn("Unable to subscribe", "identifier", key.identifier, "market", key.market, "err", err)
+			}
+		}
+	}
+	return v.chain(expiration), nil
+}
+
+func keys(opts []*option) (res []tradableKey) {
+	for _, opt := range opts {
+		res = append(res, opt.key)
+	}
+	return
+}
+
+// The chain of a loaded underlying, with all expirations if expiration is empty. Nil if not loaded.
+func (a *Analyzer) Chain(underlying int64, expiration string) *Chain {
+	a.Lock()
+	ch, ok := a.chains[underlying]
+	if !ok {
+		a.Unlock()
+		return nil
+	}
+	v := a.viewLocked(ch)
+	a.Unlock()
+	return v.chain(expiration)
+}
+
+// What the analytics of a chain are computed from. A copy, so they can be computed without the lock.
+type view struct {
+	ch     chain
+	quotes map[tradableKey]*quote
+	rate   float64
+	now    int64
+}
+
+// Caller must hold the lock
+func (a *Analyzer) viewLocked(ch *chain) *view {
+	v := &view{ch: chain{underlying: ch.underlying, key: ch.key, options: append([]*option{}, ch.options...)},
+		quotes: make(map[tradableKey]*quote), rate: a.rate, now: a.clock()}
+	for _, key := range append([]tradableKey{ch.key}, keys(ch.options)...) {
+		if q, ok := a.quotes[key]; ok {
+			cp := *q
+			v.quotes[key] = &cp
+		}
+	}
+	return v
+}
+
+func (v *view) chain(expiration string) *Chain {
+	ch := &v.ch
+	res := &Chain{Underlying: ch.underlying, Identifier: ch.key.identifier, MarketId: ch.key.market,
+		Spot: v.quotes[ch.key].price(), Rate: v.rate, Timestamp: v.now, Options: []Option{}}
+	atm := v.atm()
+	for _, opt := range ch.options {
+		if expiration == "" || opt.expiration == expiration {
+			res.Options = append(res.Options, v.analyze(opt, atm))
+		}
+	}
+	return res
+}
+
+// At the money IV per expiration. The mean IV of the options with the strike closest to spot.
+func (v *view) atm() map[string]float64 {
+	ch, now := &v.ch, v.now
+	spot := v.quotes[ch.key].price()
+	res := make(map[string]float64)
+	if spot <= 0 {
+		return res
+	}
+	closest := make(map[string]float64)
+	for _, opt := range ch.options {
+		if c, ok := closest[opt.expiration]; !ok || math.Abs(opt.strike-spot) < math.Abs(c-spot) {
+			closest[opt.expiration] = opt.strike
+		}
+	}
+	sum, count := make(map[string]float64), make(map[string]int)
+	for _, opt := range ch.options {
+		if opt.strike != closest[opt.expiration] {
+			continue
+		}
+		years := float64(opt.expiry-now) / millisPerYear
+		if iv, err := ImpliedVolatility(opt.kind == Call, v.quotes[opt.key].price(), spot, opt.strike, years, v.rate); err == nil {
+			sum[opt.expiration] += iv
+			count[opt.expiration]++
+		}
+	}
+	for exp, s := range sum {
+		res[exp] = s / float64(count[exp])
+	}
+	return res
+}
+
+func (v *view) analyze(opt *option, atm map[string]float64) Option {
+	ch, now := &v.ch, v.now
+	q := v.quotes[opt.key]
+	if q == nil {
+		q = &quote{}
+	}
+	res := Option{
+		Underlying:   ch.underlying,
+		InstrumentId: opt.instrumentId,
+		Identifier:   opt.key.identifier,
+		MarketId:     opt.key.market,
+		Kind:         opt.kind,
+		Strike:       opt.strike,
+		Expiration:   opt.expiration,
+		Years:        float64(opt.expiry-now) / millisPerYear,
+		Spot:         v.quotes[ch.key].price(),
+		Bid:          q.bid,
+		Ask:          q.ask,
+		Last:         q.last,
+		Timestamp:    now,
+	}
+	if res.Spot <= 0 {
+		return res
+	}
+	call := opt.kind == Call
+	implied := func(price float64) float64 {
+		if iv, err := ImpliedVolatility(call, price, res.Spot, opt.strike, res.Years, v.rate); err == nil {
+			return iv
+		}
+		return 0
+	}
+	res.IV, res.BidIV, res.AskIV = implied(q.price()), implied(q.bid), implied(q.ask)
+
+	res.Volatility = res.IV
+	if res.Volatility == 0 {
+		res.Volatility = atm[opt.expiration]
+	}
+	if vol := atm[opt.expiration]; vol > 0 {
+		res.Theo = BlackScholes(call, res.Spot, opt.strike, res.Years, v.rate, vol).Price
+	}
+	if res.Volatility > 0 || res.Years <= 0 {
+		g := BlackScholes(call, res.Spot, opt.strike, res.Years, v.rate, res.Volatility)
+		res.Delta, res.Gamma, res.Vega, res.Theta, res.Rho = g.Delta, g.Gamma, g.Vega, g.Theta, g.Rho
+		if res.Theo == 0 {
+			res.Theo = g.Price
+		}
+	}
+	return res
+}
+
+// Handle price messages. Implements feed.FeedClient.
+func (a *Analyzer) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil || msg.Type != "price" {
+		return
+	}
+	var price feedmodel.FeedPriceData
+	if msg.DecodeData(&price) != nil {
+		return
+	}
+	key := tradableKey{price.Identifier, price.Market}
+
+	a.Lock()
+	q, ok := a.quotes[key]
+	if !ok {
+		q = &quote{}
+		a.quotes[key] = q
+	}
+	if price.Bid > 0 || price.Ask > 0 {
+		q.bid, q.ask = price.Bid, price.Ask
+	}
+	if price.Last > 0 {
+		q.last = price.Last
+	}
+	for underlying, ch := range a.chains {
+		if ch.key == key || ch.has(key) {
+			a.dirty[underlying] = true
+		}
+	}
+	now := a.interval <= 0
+	if !now && !a.flushing && len(a.dirty) > 0 {
+		a.flushing = true
+		time.AfterFunc(0, a.flush)
+	}
+	a.Unlock()
+	if now {
+		a.flush()
+	}
+}
+
+func (ch *chain) has(key tradableKey) bool {
+	for _, opt := range ch.options {
+		if opt.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish the chains with new prices, that were not published within the interval. Schedules itself for the rest.
+func (a *Analyzer) flush() {
+	a.Lock()
+	a.flushing = false
+	now := time.Now()
+	var views []*view
+	var wait time.Duration
+	for underlying := range a.dirty {
+		if left := a.sent[underlying].Add(a.interval).Sub(now); left > 0 {
+			if wait == 0 || left < wait {
+				wait = left
+			}
+			continue
+		}
+		if ch, ok := a.chains[underlying]; ok {
+			views = append(views, a.viewLocked(ch))
+		}
+		delete(a.dirty, underlying)
+		a.sent[underlying] = now
+	}
+	if wait > 0 {
+		a.flushing = true
+		time.AfterFunc(wait, a.flush)
+	}
+	publish := a.publish
+	a.Unlock()
+
+	for _, v := range views {
+		if msg, err := feedmodel.NewFeedMsgFromObject(AnalyticsMsgType, v.chain("")); err == nil {
+			publish(msg)
+		}
+	}
+}
+
+type byExpiration []*option
+
+func (a byExpiration) Len() int      { return len(a) }
+func (a byExpiration) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byExpiration) Less(i, j int) bool {
+	if a[i].expiration != a[j].expiration {
+		return a[i].expiration < a[j].expiration
+	} else if a[i].strike != a[j].strike {
+		return a[i].strike < a[j].strike
+	}
+	return a[i].kind < a[j].kind
+}
+
+func (a *Analyzer) init() {
+	a.AddCommand(string(api.OptionAnalyticsCmd)).Description("Implied volatility, theoretical prices and greeks of an option chain").
+		AddFullArgument("underlying", "Instrument id of the underlying", []string{}, false).
+		AddFullArgument("expiration", "Only this expiration date, as 2006-01-02", []string{}, true).
+		AddFullArgument("reload", "Load the option pairs again", []string{"true", "false"}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			underlying, err := strconv.ParseInt(params["underlying"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad underlying '%s': %v", params["underlying"], err)
+			}
+			ch := a.Chain(underlying, params["expiration"])
+			if ch == nil || len(ch.Options) == 0 || params["reload"] == "true" {
+				if ch, err = a.Load(underlying, params["expiration"]); err != nil {
+					return nil, err
+				}
+			}
+			return json.Marshal(ch)
+		})
+}
@@ -0,0 +1,163 @@
+package options_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/options"
+	"github.com/Forau/yanngo/swagger"
+
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestBlackScholes(t *testing.T) {
+	call := options.BlackScholes(true, 100, 100, 1, 0.05, 0.2)
+	put := options.BlackScholes(false, 100, 100, 1, 0.05, 0.2)
+	expected := []struct{ got, want float64 }{
+		{call.Price, 10.4506}, {call.Delta, 0.6368}, {call.Gamma, 0.01876}, {call.Vega, 0.3752},
+		{call.Theta, -6.4140 / 365}, {call.Rho, 0.5323},
+		{put.Price, 5.5735}, {put.Delta, -0.3632}, {put.Gamma, 0.01876}, {put.Theta, -1.6579 / 365}, {put.Rho, -0.4189},
+	}
+	for idx, e := range expected {
+		if !near(e.got, e.want, 1e-4) {
+			t.Errorf("%d: Expected %v, but got %v", idx, e.want, e.got)
+		}
+	}
+	// Put-call parity
+	if parity := call.Price - put.Price - (100 - 100*math.Exp(-0.05)); !near(parity, 0, 1e-9) {
+		t.Errorf("Expected put-call parity, but differs %v", parity)
+	}
+	if expired := options.BlackScholes(false, 90, 100, 0, 0.05, 0.2); expired.Price != 10 || expired.Delta != -1 {
+		t.Errorf("Expected intrinsic value at expiry: %+v", expired)
+	}
+
+	for _, strike := range []float64{50, 90, 100, 110, 200} {
+		for _, call := range []bool{true, false} {
+			price := options.BlackScholes(call, 100, strike, 0.25, 0.02, 0.35).Price
+			if iv, err := options.ImpliedVolatility(call, price, 100, strike, 0.25, 0.02); err != nil || !near(iv, 0.35, 1e-4) {
+				t.Errorf("Expected iv 0.35 for strike %v, call %v, but got %v, %+v", strike, call, iv, err)
+			}
+		}
+	}
+	if _, err := options.ImpliedVolatility(true, 5, 100, 90, 0.25, 0); err == nil {
+		t.Error("Expected error for a price below the intrinsic value")
+	}
+}
+
+func TestAnalyzer(t *testing.T) {
+	expiration := "2026-12-18"
+	date := func(s string) (d swagger.Date) {
+		d.Time, _ = time.Parse(swagger.DateFormat, s)
+		return
+	}
+	instrument := func(id int64) swagger.Instrument {
+		return swagger.Instrument{InstrumentId: id, Tradables: []swagger.Tradable{{MarketId: 11, Identifier: fmt.Sprintf("%d", id)}}}
+	}
+	subscribed := 0
+	var remote api.Transport = func(req *api.Request) (res api.Response) {
+		switch req.Command {
+		case api.InstrumentsCmd:
+			res.Success([]swagger.Instrument{instrument(101)})
+		case api.InstrumentOptionPairsCmd:
+			pairs := []swagger.OptionPair{}
+			for idx, strike := range []float64{90, 100, 110} {
+				pairs = append(pairs, swagger.OptionPair{StrikePrice: strike, ExpirationDate: date(expiration),
+					Call: instrument(int64(1000 + idx)), Put: instrument(int64(2000 + idx))})
+			}
+			res.Success(pairs)
+		case api.FeedSubCmd:
+			subscribed++
+			res.Success(map[string]interface{}{})
+		default:
+			res.Fail(-18, "Command not found")
+		}
+		return
+	}
+
+	day, _ := omxtime.NewOmxTimeDate("2026-10-19")
+	now := day.OmxOpen + 3600*1000
+	analyzer := options.NewAnalyzer(api.NewApiClient(remote)).SetRate(0.02).SetClock(func() int64 { return now }).SetPublishInterval(0)
+	var lock sync.Mutex
+	var published []options.Chain
+	analyzer.SetPublisher(func(msg *feedmodel.FeedMsg) {
+		var ch options.Chain
+		if msg.Type == options.AnalyticsMsgType && msg.DecodeData(&ch) == nil {
+			lock.Lock()
+			published = append(published, ch)
+			lock.Unlock()
+		}
+	})
+
+	cli := api.NewApiClient(analyzer)
+	chain, err := cli.OptionAnalytics(101, "", false)
+	if err != nil || len(chain["options"].([]interface{})) != 6 || subscribed != 7 {
+		t.Fatalf("Expected a loaded chain, and subscriptions: %+v, %+v, %d", chain, err, subscribed)
+	}
+
+	price := func(id, bid, ask float64) {
+		msg, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: fmt.Sprintf("%v", id), Market: 11, Bid: bid, Ask: ask})
+		analyzer.OnMessage(msg)
+	}
+	expiry, _ := omxtime.NewOmxTimeDate(expiration)
+	years := float64(expiry.OmxClose-now) / (365 * 24 * 3600 * 1000)
+	vols := map[float64]float64{90: 0.35, 100: 0.3, 110: 0.28} // A smile
+	for idx, strike := range []float64{90, 100, 110} {
+		c := options.BlackScholes(true, 100, strike, years, 0.02, vols[strike]).Price
+		p := options.BlackScholes(false, 100, strike, years, 0.02, vols[strike]).Price
+		price(float64(1000+idx), c-0.01, c+0.01)
+		price(float64(2000+idx), p-0.01, p+0.01)
+	}
+	if len(published) != 6 {
+		t.Errorf("Expected one update per option price, but got %d", len(published))
+	}
+
+	published = nil
+	price(101, 99.99, 100.01)
+	if len(published) != 1 || len(published[0].Options) != 6 || published[0].Spot != 100 {
+		t.Fatalf("Expected the chain on underlying price, but got %+v", published)
+	}
+	for _, opt := range published[0].Options {
+		want := options.BlackScholes(opt.Kind == options.Call, 100, opt.Strike, years, 0.02, vols[opt.Strike])
+		theo := options.BlackScholes(opt.Kind == options.Call, 100, opt.Strike, years, 0.02, 0.3).Price
+		if !near(opt.IV, vols[opt.Strike], 1e-4) || !near(opt.Delta, want.Delta, 1e-3) || !near(opt.Vega, want.Vega, 1e-3) ||
+			!near(opt.Theo, theo, 1e-3) || opt.BidIV >= opt.IV || opt.AskIV <= opt.IV || opt.Expiration != expiration {
+			t.Errorf("Unexpected analytics of %s %v: %+v, expected %+v and theo %v", opt.Kind, opt.Strike, opt, want, theo)
+		}
+	}
+
+	ch := analyzer.Chain(101, expiration)
+	if ch == nil || ch.Spot != 100 || len(ch.Options) != 6 || ch.Options[0].Strike != 90 || ch.Options[0].Kind != options.Call {
+		t.Errorf("Expected a sorted chain: %+v", ch)
+	}
+
+	// Throttled, the prices of a chain are published together, off the feed
+	analyzer.SetPublishInterval(100 * time.Millisecond)
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(published)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		price(101, 99.99+float64(i), 100.01+float64(i))
+		price(1000, 10, 11)
+	}
+	price(999, 1, 2) // Not in a chain
+	time.Sleep(150 * time.Millisecond)
+	if n := count(); n < 2 || n > 3 {
+		t.Errorf("Expected the prices in one or two updates of the chain, but got %d", n-1)
+	}
+	lock.Lock()
+	if last := published[len(published)-1]; last.Spot != 119 {
+		t.Errorf("Expected the last spot in the last update: %+v", last)
+	}
+	lock.Unlock()
+}
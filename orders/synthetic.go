@@ -0,0 +1,701 @@
+// Package orders holds conditional orders locally, and submits real orders when they trigger.
+// Useful when the exchange does not support STOP_LIMIT, STOP_TRAILING or OCO for an instrument.
+package orders
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/nnutils"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("orders")
+
+// Message type for state changes, sent on the feed topic
+const SyntheticMsgType = "synthetic_order"
+
+// Types of synthetic orders
+const (
+	StopOrder       = "STOP"        // Sell when the price falls to the trigger, or buy when it rises to it
+	TakeProfitOrder = "TAKE_PROFIT" // Sell when the price rises to the trigger, or buy when it falls to it
+	TrailingOrder   = "TRAILING"    // Stop that follows the best price, by percent or ticks
+	LimitOrder      = "LIMIT"       // A real order placed directly, as the take profit leg in a bracket
+)
+
+// States
+const (
+	StateWaiting   = "WAITING"   // Held locally, waiting for the trigger
+	StateSubmitted = "SUBMITTED" // Real order is placed
+	StateFilled    = "FILLED"
+	StateCancelled = "CANCELLED"
+	StateFailed    = "FAILED"
+)
+
+type SyntheticOrder struct {
+	Id         string `json:"id"`
+	Type       string `json:"type"`
+	Accno      int64  `json:"accno"`
+	Identifier string `json:"identifier"`
+	MarketId   int64  `json:"market_id"`
+	Side       string `json:"side"`
+	Volume     int64  `json:"volume"`
+	Field      string `json:"field,omitempty"` // Price field to watch. last, bid or ask. Default last
+
+	TriggerPrice float64 `json:"trigger_price,omitempty"` // STOP and TAKE_PROFIT. Limit price for LIMIT
+	TrailPercent float64 `json:"trail_percent,omitempty"` // TRAILING, either percent or ticks
+	TrailTicks   int64   `json:"trail_ticks,omitempty"`
+	LimitTicks   int64   `json:"limit_ticks,omitempty"` // Ticks worse than the triggering price for the real order
+	Group        string  `json:"group,omitempty"`       // Orders in a group cancel each other. Set by bracket
+
+	State        string  `json:"state"`
+	Extreme      float64 `json:"extreme,omitempty"` // Best price seen, for TRAILING
+	OrderId      int64   `json:"order_id,omitempty"`
+	FilledVolume int64   `json:"filled_volume,omitempty"`
+	Message      string  `json:"message,omitempty"`
+	Created      int64   `json:"created"`
+	Updated      int64   `json:"updated"`
+}
+
+func (so *SyntheticOrder) isSell() bool {
+	return so.Side == "SELL"
+}
+
+func (so *SyntheticOrder) remaining() int64 {
+	return so.Volume - so.FilledVolume
+}
+
+func (so *SyntheticOrder) done() bool {
+	return so.State == StateFilled || so.State == StateCancelled || so.State == StateFailed
+}
+
+func (so *SyntheticOrder) validate() error {
+	if so.Side != "BUY" && so.Side != "SELL" {
+		return fmt.Errorf("Side must be BUY or SELL, not '%s'", so.Side)
+	}
+	if so.Volume <= 0 || so.Identifier == "" || so.MarketId == 0 || so.Accno == 0 {
+		return fmt.Errorf("Need accno, identifier, market_id and volume")
+	}
+	switch so.Field {
+	case "":
+		so.Field = "last"
+	case "last", "bid", "ask":
+	default:
+		return fmt.Errorf("Unknown price field '%s'", so.Field)
+	}
+	switch so.Type {
+	case StopOrder, TakeProfitOrder, LimitOrder:
+		if so.TriggerPrice <= 0 {
+			return fmt.Errorf("%s needs a trigger price", so.Type)
+		}
+	case TrailingOrder:
+		if (so.TrailPercent <= 0) == (so.TrailTicks <= 0) {
+			return fmt.Errorf("Trailing stop needs one of trail percent or trail ticks")
+		}
+	default:
+		return fmt.Errorf("Unknown type '%s'", so.Type)
+	}
+	return nil
+}
+
+// Price where the order triggers, given the current extreme for trailing stops
+func (so *SyntheticOrder) triggerLevel(ticks nnutils.TickTableUtil) float64 {
+	if so.Type != TrailingOrder {
+		return so.TriggerPrice
+	}
+	dir := int64(1)
+	if so.isSell() {
+		dir = -1
+	}
+	if so.TrailPercent > 0 {
+		return so.Extreme * (1 + float64(dir)*so.TrailPercent/100)
+	}
+	return ticks.AddTicks(so.Extreme, dir*so.TrailTicks)
+}
+
+// Update with a new price, and return true if the order should trigger
+func (so *SyntheticOrder) onPrice(price float64, ticks nnutils.TickTableUtil) bool {
+	if so.Type == TrailingOrder {
+		if so.Extreme == 0 || (so.isSell() && price > so.Extreme) || (!so.isSell() && price < so.Extreme) {
+			so.Extreme = price
+		}
+	}
+	level := so.triggerLevel(ticks)
+	// Stops sell on the way down, and take profit sells on the way up. The other way around for buy.
+	if (so.Type == TakeProfitOrder) == so.isSell() {
+		return price >= level
+	}
+	return price <= level
+}
+
+type action struct {
+	order  *SyntheticOrder
+	price  float64
+	delete bool // Delete the real order, instead of placing one
+}
+
+// A fill or delete of an order we did not know, while orders were being placed
+type orderEvent struct {
+	accno, orderId, volume int64
+	deleted                bool
+}
+
+// The engine. Feed it merged messages from the FeedState, with Bind, or by calling OnMessage.
+// Orders triggered by messages are placed by a worker, so the feed is not held up by the REST calls.
+// Commands place their orders from the calling goroutine, outside the lock.
+type SyntheticEngine struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	orders  map[string]*SyntheticOrder
+	cli     *api.ApiClient
+	ticks   nnutils.TickTableUtil
+	publish feed.FeedClient
+
+	work     chan []action
+	pending  sync.WaitGroup
+	workLock sync.RWMutex // Held while sending to work, so Close never closes it under a sender
+	closed   bool
+
+	// The feed can report a fill before CreateOrder returns the order id, so events of unknown orders are kept
+	// while a placement is in flight, and replayed when the id is known.
+	placing int
+	early   []orderEvent
+
+	file     string
+	saveLock sync.Mutex
+}
+
+// How many batches of triggered actions can wait for the worker, before OnMessage blocks
+var WorkQueueSize = 1024
+
+// Create an engine. If file is not empty, orders are loaded from it, and saved to it on every change.
+// The best price of trailing stops is saved with the other changes, so after a restart it can be somewhat behind.
+func NewSyntheticEngine(cli *api.ApiClient, file string) (*SyntheticEngine, error) {
+	se := &SyntheticEngine{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		orders:                  make(map[string]*SyntheticOrder),
+		cli:                     cli,
+		ticks:                   nnutils.NewDefaultTickTableUtil(),
+		publish:                 func(*feedmodel.FeedMsg) {},
+		work:                    make(chan []action, WorkQueueSize),
+		file:                    file,
+	}
+	se.init()
+	go se.worker()
+	if file != "" {
+		if err := se.load(); err != nil && !os.IsNotExist(err) {
+			return se, err
+		}
+	}
+	return se, nil
+}
+
+// Runs until Close
+func (se *SyntheticEngine) worker() {
+	for actions := range se.work {
+		se.execute(actions)
+		se.pending.Done()
+	}
+}
+
+// Hand actions to the worker
+func (se *SyntheticEngine) queue(actions []action) {
+	if len(actions) == 0 {
+		return
+	}
+	se.workLock.RLock()
+	defer se.workLock.RUnlock()
+	if se.closed {
+		logger.Warn("Engine is closed, dropping triggered orders", "actions", len(actions))
+		return
+	}
+	se.pending.Add(1)
+	se.work <- actions
+}
+
+// Stop the worker, after it has handled what is already queued. Orders that trigger after this are not placed.
+func (se *SyntheticEngine) Close() {
+	se.workLock.Lock()
+	defer se.workLock.Unlock()
+	if !se.closed {
+		se.closed = true
+		close(se.work)
+	}
+}
+
+// Wait until the worker has handled all triggered orders. Mostly for tests.
+func (se *SyntheticEngine) Wait() {
+	se.pending.Wait()
+}
+
+// Listen to the messages of the FeedState, and publish state changes on its topic
+func (se *SyntheticEngine) Bind(fs *feed.FeedState) *SyntheticEngine {
+	se.SetPublisher(fs.Publish)
+	fs.AddListener(se.OnMessage)
+	return se
+}
+
+func (se *SyntheticEngine) SetPublisher(publish feed.FeedClient) *SyntheticEngine {
+	se.Lock()
+	defer se.Unlock()
+	se.publish = publish
+	return se
+}
+
+// Tick table used for trailing by ticks, and limit offsets. Default is nnutils.DEFAULT_TICK_TABLE
+func (se *SyntheticEngine) SetTickTable(ticks nnutils.TickTableUtil) *SyntheticEngine {
+	se.Lock()
+	defer se.Unlock()
+	se.ticks = ticks
+	return se
+}
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (se *SyntheticEngine) add(so *SyntheticOrder) error {
+	if err := so.validate(); err != nil {
+		return err
+	}
+	se.Lock()
+	defer se.Unlock()
+	so.Id = fmt.Sprintf("%d", rand.Uint32())
+	so.State = StateWaiting
+	so.Created, so.Updated = now(), now()
+	se.orders[so.Id] = so
+	return nil
+}
+
+// Add a conditional order. It is held locally until triggered.
+func (se *SyntheticEngine) Add(so *SyntheticOrder) (*SyntheticOrder, error) {
+	if so.Type == LimitOrder {
+		return nil, fmt.Errorf("Use CreateOrder for plain limit orders")
+	}
+	if err := se.add(so); err != nil {
+		return nil, err
+	}
+	se.notify(so)
+	se.Lock()
+	defer se.Unlock()
+	res := *so
+	return &res, nil
+}
+
+// Exit a position with a take profit and a stop. The take profit is placed as a real limit order right away,
+// and the stop is held locally. When one fills or triggers, the other is cancelled.
+// If trailPercent is above 0, the stop trails instead.
+func (se *SyntheticEngine) Bracket(accno int64, identifier string, market int64, side string, volume int64,
+	takeProfit, stop, trailPercent float64) (res []*SyntheticOrder, err error) {
+	group := fmt.Sprintf("%d", rand.Uint32())
+	tp := &SyntheticOrder{Type: LimitOrder, Accno: accno, Identifier: identifier, MarketId: market, Side: side,
+		Volume: volume, TriggerPrice: takeProfit, Group: group}
+	sl := &SyntheticOrder{Type: StopOrder, Accno: accno, Identifier: identifier, MarketId: market, Side: side,
+		Volume: volume, TriggerPrice: stop, Group: group}
+	if trailPercent > 0 {
+		sl.Type, sl.TriggerPrice, sl.TrailPercent = TrailingOrder, 0, trailPercent
+	}
+	if err = tp.validate(); err == nil {
+		err = sl.validate()
+	}
+	if err != nil {
+		return
+	}
+	se.add(tp)
+	se.add(sl)
+	se.Lock()
+	tp.State = StateSubmitted
+	se.Unlock()
+	se.execute([]action{{order: tp, price: takeProfit}})
+	se.notify(sl)
+	se.Lock()
+	defer se.Unlock()
+	tpCopy, slCopy := *tp, *sl
+	return []*SyntheticOrder{&tpCopy, &slCopy}, nil
+}
+
+// Cancel an order, and the other orders in its group, so both legs of a bracket are cancelled.
+// If a real order is placed, it is deleted.
+func (se *SyntheticEngine) Cancel(id string) error {
+	se.Lock()
+	so, ok := se.orders[id]
+	if !ok || so.done() {
+		se.Unlock()
+		return fmt.Errorf("Order %s not found, or already done", id)
+	}
+	actions := append(se.cancelLocked(so, "Cancelled by user"), action{order: so, price: -1})
+	actions = append(actions, se.cancelGroupLocked(so, "Other order in group cancelled")...)
+	se.Unlock()
+	se.execute(actions)
+	return nil
+}
+
+// Caller must hold the lock
+func (se *SyntheticEngine) cancelLocked(so *SyntheticOrder, reason string) (actions []action) {
+	if so.State == StateSubmitted {
+		actions = append(actions, action{order: so, delete: true})
+	}
+	so.State, so.Message, so.Updated = StateCancelled, reason, now()
+	return
+}
+
+func (se *SyntheticEngine) Orders() (res []SyntheticOrder) {
+	se.Lock()
+	defer se.Unlock()
+	for _, so := range se.orders {
+		res = append(res, *so)
+	}
+	sort.Sort(byCreated(res))
+	return
+}
+
+type byCreated []SyntheticOrder
+
+func (bc byCreated) Len() int           { return len(bc) }
+func (bc byCreated) Swap(i, j int)      { bc[i], bc[j] = bc[j], bc[i] }
+func (bc byCreated) Less(i, j int) bool { return bc[i].Created < bc[j].Created }
+
+// Handle price, privtrade and order messages. Implements feed.FeedClient.
+func (se *SyntheticEngine) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	switch msg.Type {
+	case "price":
+		var price feedmodel.FeedPriceData
+		if err := msg.DecodeData(&price); err == nil {
+			se.onPrice(&price)
+		}
+	case "privtrade":
+		var trade feedmodel.FeedPrivateTradeData
+		if err := msg.DecodeData(&trade); err == nil {
+			se.onFill(trade.Accno, trade.OrderId, int64(trade.Volume))
+		}
+	case "order":
+		var order feedmodel.FeedOrderData
+		if err := msg.DecodeData(&order); err == nil && order.OrderState == "DELETED" {
+			se.onDeleted(order.Accno, order.OrderId)
+		}
+	}
+}
+
+func (se *SyntheticEngine) onPrice(price *feedmodel.FeedPriceData) {
+	values := map[string]float64{"last": price.Last, "bid": price.Bid, "ask": price.Ask}
+	var actions []action
+	se.Lock()
+	for _, so := range se.orders {
+		if so.State != StateWaiting || so.Type == LimitOrder || so.Identifier != price.Identifier || so.MarketId != price.Market {
+			continue
+		}
+		value := values[so.Field]
+		if value <= 0 {
+			continue
+		}
+		extreme := so.Extreme
+		if so.onPrice(value, se.ticks) {
+			so.State = StateSubmitted // So we do not trigger again, before the order is placed
+			// The real order is a limit order some ticks worse than the trigger, to get filled
+			dir := int64(1)
+			if so.isSell() {
+				dir = -1
+			}
+			actions = append(actions, action{order: so, price: se.ticks.AddTicks(value, dir*so.LimitTicks)})
+			actions = append(actions, se.cancelGroupLocked(so, "Other order in group triggered")...)
+		} else if extreme != so.Extreme {
+			so.Updated = now()
+		}
+	}
+	se.Unlock()
+	se.queue(actions)
+}
+
+// Caller must hold the lock
+func (se *SyntheticEngine) cancelGroupLocked(so *SyntheticOrder, reason string) (actions []action) {
+	if so.Group == "" {
+		return
+	}
+	for _, other := range se.orders {
+		if other != so && other.Group == so.Group && !other.done() {
+			actions = append(actions, se.cancelLocked(other, reason)...)
+			actions = append(actions, action{order: other, price: -1}) // Only notify
+		}
+	}
+	return
+}
+
+func (se *SyntheticEngine) onFill(accno, orderId, volume int64) {
+	se.Lock()
+	actions := se.fillLocked(accno, orderId, volume)
+	se.Unlock()
+	se.queue(actions)
+}
+
+// Caller must hold the lock
+func (se *SyntheticEngine) fillLocked(accno, orderId, volume int64) (actions []action) {
+	matched := false
+	for _, so := range se.orders {
+		if so.OrderId != orderId || so.Accno != accno || so.State != StateSubmitted {
+			continue
+		}
+		matched = true
+		so.FilledVolume += volume
+		so.Updated = now()
+		if so.remaining() <= 0 {
+			so.State = StateFilled
+			actions = append(actions, se.cancelGroupLocked(so, "Other order in group filled")...)
+		} else if so.Group != "" {
+			// Partial fill. Reduce the ones waiting in the group, so we do not sell more then we have.
+			for _, other := range se.orders {
+				if other != so && other.Group == so.Group && other.State == StateWaiting {
+					other.Volume -= volume
+					if other.Volume <= 0 {
+						actions = append(actions, se.cancelLocked(other, "Other order in group filled")...)
+					}
+					actions = append(actions, action{order: other, price: -1})
+				}
+			}
+		}
+		actions = append(actions, action{order: so, price: -1})
+	}
+	if !matched && se.placing > 0 {
+		se.early = append(se.early, orderEvent{accno: accno, orderId: orderId, volume: volume})
+	}
+	return
+}
+
+func (se *SyntheticEngine) onDeleted(accno, orderId int64) {
+	se.Lock()
+	actions := se.deletedLocked(accno, orderId)
+	se.Unlock()
+	se.queue(actions)
+}
+
+// Caller must hold the lock
+func (se *SyntheticEngine) deletedLocked(accno, orderId int64) (actions []action) {
+	for _, so := range se.orders {
+		if so.OrderId == orderId && so.Accno == accno && so.State == StateSubmitted {
+			so.State, so.Message, so.Updated = StateCancelled, "Order deleted", now()
+			actions = append(actions, action{order: so, price: -1})
+		}
+	}
+	if len(actions) == 0 && se.placing > 0 {
+		se.early = append(se.early, orderEvent{accno: accno, orderId: orderId, deleted: true})
+	}
+	return
+}
+
+// Apply the events that arrived for an order before its id was known. Caller must hold the lock.
+func (se *SyntheticEngine) replayLocked(accno, orderId int64) (actions []action) {
+	early := se.early
+	se.early = nil
+	for _, ev := range early {
+		switch {
+		case ev.accno != accno || ev.orderId != orderId:
+			se.early = append(se.early, ev)
+		case ev.deleted:
+			actions = append(actions, se.deletedLocked(accno, orderId)...)
+		default:
+			actions = append(actions, se.fillLocked(accno, orderId, ev.volume)...)
+		}
+	}
+	return
+}
+
+// Place or delete the real orders, and notify about the changes. Price -1 only notifies.
+func (se *SyntheticEngine) execute(actions []action) {
+	for _, a := range actions {
+		so := a.order
+		var replay []action
+		if a.delete {
+			se.Lock()
+			accno, orderId := so.Accno, so.OrderId
+			se.Unlock()
+			if orderId == 0 {
+				continue // Still being placed. Deleted when the placement is done.
+			}
+			if _, err := se.cli.DeleteOrder(accno, orderId); err != nil {
+				logger.Error("Unable to delete order of synthetic", "order_id", orderId, "id", so.Id, "err", err)
+			}
+			continue
+		}
+		if a.price >= 0 {
+			se.Lock()
+			order := &api.AccountOrder{Accno: so.Accno, Identifier: so.Identifier, MarketId: so.MarketId,
+				Price: a.price, Volume: so.remaining(), Side: api.OrderSide(so.Side), OrderType: api.LIMIT,
+				Reference: "synthetic:" + so.Id}
+			se.placing++
+			se.Unlock()
+
+			reply, err := se.cli.CreateOrder(order)
+
+			se.Lock()
+			se.placing--
+			so.Updated = now()
+			cancelled := so.State == StateCancelled // While we placed it
+			if err != nil {
+				so.State, so.Message = StateFailed, err.Error()
+			} else if cancelled {
+				so.OrderId = reply.OrderId
+			} else {
+				so.State, so.OrderId, so.Message = StateSubmitted, reply.OrderId, reply.Message
+			}
+			if err == nil {
+				replay = se.replayLocked(so.Accno, reply.OrderId)
+			}
+			if se.placing == 0 {
+				se.early = nil // The rest are of orders that are not ours
+			}
+			se.Unlock()
+			if err != nil {
+				logger.Error("Unable to place order of synthetic", "id", so.Id, "err", err)
+			} else if cancelled {
+				if _, err = se.cli.DeleteOrder(order.Accno, reply.OrderId); err != nil {
+					logger.Error("Unable to delete order of cancelled synthetic", "order_id", reply.OrderId, "id", so.Id, "err", err)
+				}
+			}
+		}
+		se.notify(so)
+		se.execute(replay)
+	}
+}
+
+// Publish the state of so, and save all orders
+func (se *SyntheticEngine) notify(so *SyntheticOrder) {
+	se.Lock()
+	current := *so
+	publish := se.publish
+	se.Unlock()
+	if msg, err := feedmodel.NewFeedMsgFromObject(SyntheticMsgType, &current); err == nil {
+		publish(msg)
+	}
+	if err := se.save(); err != nil {
+		logger.Error("Unable to save synthetic orders", "file", se.file, "err", err)
+	}
+}
+
+func (se *SyntheticEngine) load() error {
+	b, err := ioutil.ReadFile(se.file)
+	if err != nil {
+		return err
+	}
+	var orders []*SyntheticOrder
+	if err = json.Unmarshal(b, &orders); err != nil {
+		return err
+	}
+	se.Lock()
+	defer se.Unlock()
+	for _, so := range orders {
+		se.orders[so.Id] = so
+	}
+	return nil
+}
+
+// Write all orders. Writes to a temp file first, like the alert rules.
+func (se *SyntheticEngine) save() error {
+	if se.file == "" {
+		return nil
+	}
+	se.saveLock.Lock()
+	defer se.saveLock.Unlock()
+	orders := se.Orders()
+	if orders == nil {
+		orders = []SyntheticOrder{}
+	}
+	b, err := json.Marshal(orders)
+	if err != nil {
+		return err
+	}
+	return nnutils.WriteFileAtomic(se.file, b, 0600)
+}
+
+// ---------- Transport commands
+
+func parseOrder(params api.Params) (so *SyntheticOrder, err error) {
+	so = &SyntheticOrder{Type: params["type"], Identifier: params["identifier"], Side: params["side"], Field: params["field"]}
+	for _, f := range []struct {
+		key string
+		dst interface{}
+	}{
+		{"accno", &so.Accno}, {"market_id", &so.MarketId}, {"volume", &so.Volume},
+		{"trigger_price", &so.TriggerPrice}, {"trail_percent", &so.TrailPercent},
+		{"trail_ticks", &so.TrailTicks}, {"limit_ticks", &so.LimitTicks},
+	} {
+		if v := params[f.key]; v != "" {
+			if _, err = fmt.Sscan(v, f.dst); err != nil {
+				return nil, fmt.Errorf("Bad %s '%s': %v", f.key, v, err)
+			}
+		}
+	}
+	return
+}
+
+func (se *SyntheticEngine) init() {
+	se.AddCommand(string(api.SyntheticOrderCreateCmd)).Description("Create an order held locally until the price triggers it").
+		AddFullArgument("type", "Order type", []string{StopOrder, TakeProfitOrder, TrailingOrder}, false).
+		AddArgument("accno").AddArgument("identifier").AddArgument("market_id").AddArgument("volume").
+		AddFullArgument("side", "Buy or Sell", []string{"BUY", "SELL"}, false).
+		AddFullArgument("field", "Price to watch. Default last", []string{"last", "bid", "ask"}, true).
+		AddFullArgument("trigger_price", "For STOP and TAKE_PROFIT", []string{}, true).
+		AddFullArgument("trail_percent", "For TRAILING", []string{}, true).
+		AddFullArgument("trail_ticks", "For TRAILING", []string{}, true).
+		AddFullArgument("limit_ticks", "Ticks worse than the trigger for the real order", []string{}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			so, err := parseOrder(params)
+			if err == nil {
+				so, err = se.Add(so)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(so)
+		})
+
+	se.AddCommand(string(api.SyntheticBracketCreateCmd)).Description("Exit a position with a take profit and a stop, that cancel each other").
+		AddArgument("accno").AddArgument("identifier").AddArgument("market_id").AddArgument("volume").
+		AddFullArgument("side", "Side of the exit. SELL for a long position", []string{"BUY", "SELL"}, false).
+		AddFullArgument("take_profit", "Limit price of the take profit", []string{}, false).
+		AddFullArgument("stop", "Stop price. Not used if trail_percent is set", []string{}, true).
+		AddFullArgument("trail_percent", "Trail the stop by percent", []string{}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			so, err := parseOrder(params)
+			if err != nil {
+				return nil, err
+			}
+			var tp, stop, trail float64
+			fmt.Sscan(params["take_profit"], &tp)
+			fmt.Sscan(params["stop"], &stop)
+			fmt.Sscan(params["trail_percent"], &trail)
+			res, err := se.Bracket(so.Accno, so.Identifier, so.MarketId, so.Side, so.Volume, tp, stop, trail)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(res)
+		})
+
+	se.AddCommand(string(api.SyntheticOrdersCmd)).Description("List synthetic orders").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			res := se.Orders()
+			if res == nil {
+				res = []SyntheticOrder{}
+			}
+			return json.Marshal(res)
+		})
+
+	se.AddCommand(string(api.SyntheticOrderDeleteCmd)).Description("Cancel a synthetic order, and the other leg if it is part of a bracket").
+		AddArgument("id").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if err := se.Cancel(params["id"]); err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]string{"id": params["id"], "state": StateCancelled})
+		})
+}
@@ -0,0 +1,223 @@
+package orders_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/orders"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeBroker struct {
+	api.RequestCommandTransport
+	created []api.Params
+	deleted []string
+}
+
+func newFakeBroker() *fakeBroker {
+	fb := &fakeBroker{RequestCommandTransport: make(api.RequestCommandTransport)}
+	fb.AddCommand(string(api.CreateOrderCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		fb.created = append(fb.created, p)
+		return json.Marshal(map[string]interface{}{"order_id": 1000 + len(fb.created), "order_state": "LOCAL"})
+	})
+	fb.AddCommand(string(api.DeleteOrderCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		fb.deleted = append(fb.deleted, p["order_id"])
+		return json.Marshal(map[string]interface{}{"order_id": json.Number(p["order_id"]), "order_state": "DELETED"})
+	})
+	return fb
+}
+
+func price(id string, last float64) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: id, Market: 11, Last: last})
+	return msg
+}
+
+func fill(orderId int64, volume float64) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject("privtrade", &feedmodel.FeedPrivateTradeData{Accno: 1, OrderId: orderId, Volume: volume})
+	return msg
+}
+
+func newEngine(t *testing.T, fb *fakeBroker, file string) *orders.SyntheticEngine {
+	se, err := orders.NewSyntheticEngine(api.NewApiClient(fb), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return se
+}
+
+func TestStopAndTrailing(t *testing.T) {
+	fb := newFakeBroker()
+	se := newEngine(t, fb, "")
+	var events []orders.SyntheticOrder
+	se.SetPublisher(func(msg *feedmodel.FeedMsg) {
+		var so orders.SyntheticOrder
+		msg.DecodeData(&so)
+		events = append(events, so)
+	})
+
+	stop, err := se.Add(&orders.SyntheticOrder{Type: orders.StopOrder, Accno: 1, Identifier: "101", MarketId: 11,
+		Side: "SELL", Volume: 10, TriggerPrice: 95, LimitTicks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = se.Add(&orders.SyntheticOrder{Type: orders.TrailingOrder, Accno: 1, Identifier: "102", MarketId: 11,
+		Side: "SELL", Volume: 10}); err == nil {
+		t.Error("Expected error on trailing stop without trail")
+	}
+	// Through the transport, like a remote client would
+	trailResp := se.Preform(&api.Request{Command: api.SyntheticOrderCreateCmd, Args: api.Params{"type": orders.TrailingOrder,
+		"accno": "1", "identifier": "102", "market_id": "11", "side": "SELL", "volume": "5", "trail_percent": "5"}})
+	if trailResp.IsError() {
+		t.Fatal(trailResp.String())
+	}
+
+	for _, p := range []float64{100, 96} {
+		se.OnMessage(price("101", p))
+	}
+	for _, p := range []float64{100, 110, 105} {
+		se.OnMessage(price("102", p))
+	}
+	if len(fb.created) != 0 {
+		t.Fatalf("Expected no orders yet, but got %+v", fb.created)
+	}
+	se.OnMessage(price("101", 95))
+	se.OnMessage(price("102", 104))
+	se.Wait()
+
+	t.Logf("Created: %+v", fb.created)
+	if len(fb.created) != 2 || fb.created[0]["price"] != "94.50" || fb.created[0]["reference"] != "synthetic:"+stop.Id ||
+		fb.created[1]["price"] != "104.00" || fb.created[1]["volume"] != "5" {
+		t.Errorf("Unexpected orders: %+v", fb.created)
+	}
+	for _, so := range se.Orders() {
+		if so.State != orders.StateSubmitted || so.OrderId == 0 {
+			t.Errorf("Expected order to be submitted: %+v", so)
+		}
+	}
+	if len(events) != 4 || events[3].State != orders.StateSubmitted {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+}
+
+func TestBracket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "synthetic")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "synthetic.json")
+
+	fb := newFakeBroker()
+	se := newEngine(t, fb, file)
+
+	// First bracket. Partial fill on take profit, then the stop triggers.
+	legs, err := se.Bracket(1, "101", 11, "SELL", 100, 120, 90, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.created) != 1 || fb.created[0]["price"] != "120.00" || legs[0].State != orders.StateSubmitted {
+		t.Fatalf("Expected take profit to be placed: %+v, %+v", fb.created, legs)
+	}
+	se.OnMessage(fill(legs[0].OrderId, 40))
+	se.OnMessage(price("101", 89))
+	se.Wait()
+	t.Logf("Created: %+v, deleted: %+v", fb.created, fb.deleted)
+	if len(fb.created) != 2 || fb.created[1]["volume"] != "60" {
+		t.Errorf("Expected stop for the remaining 60: %+v", fb.created)
+	}
+	if len(fb.deleted) != 1 || fb.deleted[0] != fmt.Sprint(legs[0].OrderId) {
+		t.Errorf("Expected take profit to be deleted: %+v", fb.deleted)
+	}
+
+	// Second bracket. Take profit fills, so the stop is cancelled.
+	legs, err = se.Bracket(1, "102", 11, "SELL", 100, 120, 90, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se.OnMessage(fill(legs[0].OrderId, 100))
+	se.OnMessage(price("102", 80))
+	se.Wait()
+	if len(fb.created) != 3 {
+		t.Errorf("Expected no stop order after take profit filled: %+v", fb.created)
+	}
+	for _, so := range se.Orders() {
+		if so.Identifier != "102" {
+			continue
+		}
+		if (so.Id == legs[0].Id && so.State != orders.StateFilled) || (so.Id == legs[1].Id && so.State != orders.StateCancelled) {
+			t.Errorf("Unexpected state: %+v", so)
+		}
+	}
+
+	// Third bracket survives a restart, and cancelling one leg cancels both
+	legs, err = se.Bracket(1, "103", 11, "SELL", 100, 120, 90, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newEngine(t, fb, file)
+	if len(restarted.Orders()) != 6 {
+		t.Fatalf("Expected all orders after restart: %+v", restarted.Orders())
+	}
+	if err = restarted.Cancel(legs[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.deleted) != 2 || fb.deleted[1] != fmt.Sprint(legs[0].OrderId) {
+		t.Errorf("Expected the take profit of the cancelled stop to be deleted: %+v", fb.deleted)
+	}
+	for _, so := range restarted.Orders() {
+		if so.Identifier == "103" && so.State != orders.StateCancelled {
+			t.Errorf("Expected both legs to be cancelled: %+v", so)
+		}
+	}
+	restarted.OnMessage(price("103", 80))
+	restarted.Wait()
+	if len(fb.created) != 4 {
+		t.Errorf("Expected no stop order after cancel: %+v", fb.created)
+	}
+}
+
+// The paper broker publishes the fill of a marketable order before CreateOrder returns
+func TestMarketableBracket(t *testing.T) {
+	broker := paper.NewPaperBroker(1, "SEK", 100000)
+	se, err := orders.NewSyntheticEngine(api.NewApiClient(paper.NewPaperTransport(broker, nil)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.SetPublisher(se.OnMessage)
+	broker.OnMessage(price("101", 110))
+	quote, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11,
+		Bid: 110, Bid_volume: 500, Ask: 111, Ask_volume: 500})
+	broker.OnMessage(quote)
+
+	legs, err := se.Bracket(1, "101", 11, "SELL", 100, 105, 90, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legs[0].State != orders.StateFilled || legs[0].FilledVolume != 100 || legs[1].State != orders.StateCancelled {
+		t.Errorf("Expected take profit filled, and the stop cancelled: %+v, %+v", *legs[0], *legs[1])
+	}
+	se.OnMessage(price("101", 85))
+	se.Wait()
+	if trades := broker.Trades(); len(trades) != 1 {
+		t.Errorf("Expected only the take profit to trade: %+v", trades)
+	}
+}
+
+func TestClose(t *testing.T) {
+	fb := newFakeBroker()
+	se := newEngine(t, fb, "")
+	if _, err := se.Add(&orders.SyntheticOrder{Type: orders.StopOrder, Accno: 1, Identifier: "101", MarketId: 11,
+		Side: "SELL", Volume: 10, TriggerPrice: 95}); err != nil {
+		t.Fatal(err)
+	}
+	se.Close()
+	se.Close()
+	se.OnMessage(price("101", 90))
+	se.Wait()
+	if len(fb.created) != 0 {
+		t.Errorf("Expected no orders placed after close: %+v", fb.created)
+	}
+}
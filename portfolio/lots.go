@@ -0,0 +1,77 @@
+package portfolio
+
+import (
+	"math"
+)
+
+// Accounting methods
+const (
+	FIFO        = "FIFO"
+	AverageCost = "AVERAGE"
+)
+
+// Volume bought or sold short at one price. Negative volume for short lots.
+type Lot struct {
+	Volume  float64 `json:"volume"`
+	Price   float64 `json:"price"`
+	Time    int64   `json:"time,omitempty"`
+	TradeId string  `json:"trade_id,omitempty"`
+}
+
+// Lots of one instrument, and what was realized when closing them
+type lots struct {
+	method   string
+	open     []Lot // Oldest first. Only one with AverageCost
+	realized float64
+}
+
+func (l *lots) position() (pos float64) {
+	for _, lot := range l.open {
+		pos += lot.Volume
+	}
+	return
+}
+
+// Average price of the open lots
+func (l *lots) avgPrice() float64 {
+	var pos, cost float64
+	for _, lot := range l.open {
+		pos += lot.Volume
+		cost += lot.Volume * lot.Price
+	}
+	if pos == 0 {
+		return 0
+	}
+	return cost / pos
+}
+
+// Add a trade. Volume is negative for sells. Closes lots on the other side first, then opens a new lot.
+func (l *lots) add(trade Lot) {
+	for len(l.open) > 0 && trade.Volume != 0 && (l.open[0].Volume > 0) != (trade.Volume > 0) {
+		first := &l.open[0]
+		closed := math.Min(math.Abs(trade.Volume), math.Abs(first.Volume))
+		if first.Volume > 0 {
+			l.realized += closed * (trade.Price - first.Price)
+			first.Volume -= closed
+			trade.Volume += closed
+		} else {
+			l.realized += closed * (first.Price - trade.Price)
+			first.Volume += closed
+			trade.Volume -= closed
+		}
+		if first.Volume == 0 {
+			l.open = l.open[1:]
+		}
+	}
+	if trade.Volume == 0 {
+		return
+	}
+	if l.method == AverageCost && len(l.open) > 0 {
+		avg := &l.open[0]
+		total := avg.Volume + trade.Volume
+		avg.Price = (avg.Volume*avg.Price + trade.Volume*trade.Price) / total
+		avg.Volume, avg.Time, avg.TradeId = total, trade.Time, ""
+		return
+	}
+	l.open = append(l.open, trade)
+}
@@ -0,0 +1,518 @@
+// Package portfolio keeps intraday P&L per account. Lots are built from the trades of the account and the private
+// feed, and marked to market on every price from the public feed. Updates are published on the feed topic, on
+// trades, and at most once per publish interval for prices.
+package portfolio
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/swagger"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("portfolio")
+
+// Message type for updates, sent on the feed topic
+const PortfolioMsgType = "portfolio"
+
+// How often, at most, prices publish the snapshot of an account
+var DefaultPublishInterval = time.Second
+
+// Prices to mark positions with. Each falls back to the others if not known.
+const (
+	MarkLast   = "last"
+	MarkMid    = "mid"
+	MarkBidAsk = "bidask" // Long positions at bid, and short at ask. What we would get, closing them now
+)
+
+type Holding struct {
+	Identifier   string  `json:"identifier"`
+	MarketId     int64   `json:"market_id"`
+	Currency     string  `json:"currency"`
+	Position     float64 `json:"position"`
+	AvgPrice     float64 `json:"avg_price"`
+	MarkPrice    float64 `json:"mark_price"`
+	MarketValue  float64 `json:"market_value"`
+	Realized     float64 `json:"realized"`
+	Unrealized   float64 `json:"unrealized"`
+	ExchangeRate float64 `json:"exchange_rate"` // To account currency. 0 if not known, and then not in the totals
+
+	MarketValueAcc float64 `json:"market_value_acc"`
+	RealizedAcc    float64 `json:"realized_acc"` // At the current rate
+	UnrealizedAcc  float64 `json:"unrealized_acc"`
+
+	Lots []Lot `json:"lots,omitempty"` // Not in the updates of prices
+}
+
+// Published as PortfolioMsgType. Totals are in the account currency.
+type Snapshot struct {
+	Accno       int64     `json:"accno"`
+	Currency    string    `json:"currency"`
+	Method      string    `json:"method"`
+	Timestamp   int64     `json:"timestamp"`
+	MarketValue float64   `json:"market_value"`
+	Realized    float64   `json:"realized"`
+	Unrealized  float64   `json:"unrealized"`
+	Total       float64   `json:"total"` // Realized + Unrealized
+	Holdings    []Holding `json:"holdings"`
+}
+
+type tradableKey struct {
+	identifier string
+	market     int64
+}
+
+type quote struct {
+	bid, ask, last float64
+}
+
+type holding struct {
+	lots
+	currency string
+}
+
+type account struct {
+	accno    int64
+	currency string
+	rates    map[string]float64 // Currency to account currency
+	holdings map[tradableKey]*holding
+	seen     map[string]bool // Trade ids already added
+	live     []liveTrade     // From the feed, since the last Load
+}
+
+type liveTrade struct {
+	tradeId  string
+	key      tradableKey
+	currency string
+	lot      Lot
+}
+
+// The engine. Use Bind to attach it to a FeedState, and Load the accounts to follow.
+type Portfolio struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	cli      *api.ApiClient
+	method   string
+	mark     string
+	accounts map[int64]*account
+	quotes   map[tradableKey]*quote
+	clock    func() int64
+	publish  feed.FeedClient
+
+	interval time.Duration
+	dirty    map[int64]bool      // Accounts with prices not yet published
+	sent     map[int64]time.Time // When each account was last published
+	flushing bool                // A flush is scheduled
+}
+
+func NewPortfolio(cli *api.ApiClient) *Portfolio {
+	p := &Portfolio{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		cli:                     cli,
+		method:                  FIFO,
+		mark:                    MarkLast,
+		accounts:                make(map[int64]*account),
+		quotes:                  make(map[tradableKey]*quote),
+		clock:                   func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+		publish:                 func(*feedmodel.FeedMsg) {},
+		interval:                DefaultPublishInterval,
+		dirty:                   make(map[int64]bool),
+		sent:                    make(map[int64]time.Time),
+	}
+	p.init()
+	return p
+}
+
+// Listen to the messages of the FeedState, and publish updates on its topic
+func (p *Portfolio) Bind(fs *feed.FeedState) *Portfolio {
+	p.SetPublisher(fs.Publish)
+	fs.AddListener(p.OnMessage)
+	return p
+}
+
+func (p *Portfolio) SetPublisher(publish feed.FeedClient) *Portfolio {
+	p.Lock()
+	defer p.Unlock()
+	p.publish = publish
+	return p
+}
+
+// FIFO or AverageCost. Set before loading accounts.
+func (p *Portfolio) SetMethod(method string) *Portfolio {
+	p.Lock()
+	defer p.Unlock()
+	p.method = method
+	return p
+}
+
+// MarkLast, MarkMid or MarkBidAsk
+func (p *Portfolio) SetMarkPrice(mark string) *Portfolio {
+	p.Lock()
+	defer p.Unlock()
+	p.mark = mark
+	return p
+}
+
+// How often, at most, prices publish the snapshot of an account. Snapshots are then built by a timer, not on the feed.
+// Zero publishes on every price.
+func (p *Portfolio) SetPublishInterval(interval time.Duration) *Portfolio {
+	p.Lock()
+	defer p.Unlock()
+	p.interval = interval
+	return p
+}
+
+func (p *Portfolio) SetClock(clock func() int64) *Portfolio {
+	p.Lock()
+	defer p.Unlock()
+	p.clock = clock
+	return p
+}
+
+// Set the rate from currency to the account currency. Load sets them from the ledgers.
+func (p *Portfolio) SetExchangeRate(accno int64, currency string, rate float64) *Portfolio {
+	p.Lock()
+	defer p.Unlock()
+	p.accountLocked(accno).rates[currency] = rate
+	return p
+}
+
+// Caller must hold the lock
+func (p *Portfolio) accountLocked(accno int64) *account {
+	acc, ok := p.accounts[accno]
+	if !ok {
+		acc = &account{accno: accno, rates: make(map[string]float64),
+			holdings: make(map[tradableKey]*holding), seen: make(map[string]bool)}
+		p.accounts[accno] = acc
+	}
+	return acc
+}
+
+// Caller must hold the lock
+func (p *Portfolio) holdingLocked(acc *account, key tradableKey, currency string) *holding {
+	h, ok := acc.holdings[key]
+	if !ok {
+		h = &holding{lots: lots{method: p.method}, currency: currency}
+		acc.holdings[key] = h
+	}
+	if h.currency == "" {
+		h.currency = currency
+	}
+	return h
+}
+
+// (Re)build the lots of an account from its ledgers, positions and todays trades.
+// Positions held from before today become one lot each, at the acquisition price.
+// Trades from the feed that are not among the trades fetched, like those made while fetching, are kept.
+func (p *Portfolio) Load(accno int64) error {
+	ledgers, err := p.cli.AccountLedgers(accno)
+	if err != nil {
+		return err
+	}
+	positions, err := p.cli.AccountPositions(accno)
+	if err != nil {
+		return err
+	}
+	trades, err := p.cli.AccountTrades(accno)
+	if err != nil {
+		return err
+	}
+	sort.Sort(byTradetime(trades))
+
+	p.Lock()
+	old := p.accountLocked(accno)
+	delete(p.accounts, accno)
+	acc := p.accountLocked(accno)
+	for currency, rate := range old.rates {
+		acc.rates[currency] = rate
+	}
+	acc.currency = ledgers.Total.Currency
+	for _, l := range ledgers.Ledgers {
+		if l.ExchangeRate.Value > 0 {
+			acc.rates[l.Currency] = l.ExchangeRate.Value
+		}
+	}
+	if acc.currency != "" {
+		acc.rates[acc.currency] = 1
+	}
+
+	todays := make(map[tradableKey]float64)
+	for _, t := range trades {
+		todays[tradableKey{t.Tradable.Identifier, t.Tradable.MarketId}] += signed(t.Side, t.Volume)
+	}
+	for _, pos := range positions {
+		if len(pos.Instrument.Tradables) == 0 || pos.Qty == 0 {
+			continue
+		}
+		key := tradableKey{pos.Instrument.Tradables[0].Identifier, pos.Instrument.Tradables[0].MarketId}
+		currency := pos.AcqPrice.Currency
+		if currency == "" {
+			currency = pos.Instrument.Currency
+		}
+		h := p.holdingLocked(acc, key, currency)
+		if opening := float64(pos.Qty) - todays[key]; opening != 0 {
+			h.add(Lot{Volume: opening, Price: pos.AcqPrice.Value})
+		}
+		if q, ok := p.quotes[key]; (!ok || q.mark(MarkLast, 0) == 0) && pos.MarketValue.Value != 0 {
+			p.quotes[key] = &quote{last: pos.MarketValue.Value / float64(pos.Qty)} // Until the feed gives us better
+		}
+	}
+	for _, t := range trades {
+		p.addTradeLocked(acc, t.TradeId, tradableKey{t.Tradable.Identifier, t.Tradable.MarketId},
+			t.Price.Currency, Lot{Volume: signed(t.Side, t.Volume), Price: t.Price.Value, Time: t.Tradetime, TradeId: t.TradeId})
+	}
+	for _, lt := range old.live {
+		if p.addTradeLocked(acc, lt.tradeId, lt.key, lt.currency, lt.lot) {
+			acc.live = append(acc.live, lt)
+		}
+	}
+	snap := p.sentLocked(acc, true)
+	publish := p.publish
+	p.Unlock()
+
+	publish(snap.msg())
+	return nil
+}
+
+func signed(side string, volume float64) float64 {
+	if side == "SELL" {
+		return -volume
+	}
+	return volume
+}
+
+// Caller must hold the lock. Returns false for trades already added.
+func (p *Portfolio) addTradeLocked(acc *account, tradeId string, key tradableKey, currency string, lot Lot) bool {
+	if tradeId != "" {
+		if acc.seen[tradeId] {
+			return false
+		}
+		acc.seen[tradeId] = true
+	}
+	p.holdingLocked(acc, key, currency).add(lot)
+	return true
+}
+
+// Handle price and privtrade messages. Implements feed.FeedClient.
+func (p *Portfolio) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	var snap *Snapshot
+	switch msg.Type {
+	case "price":
+		var price feedmodel.FeedPriceData
+		if msg.DecodeData(&price) != nil {
+			return
+		}
+		key := tradableKey{price.Identifier, price.Market}
+		p.Lock()
+		q, ok := p.quotes[key]
+		if !ok {
+			q = &quote{}
+			p.quotes[key] = q
+		}
+		if price.Bid > 0 || price.Ask > 0 {
+			q.bid, q.ask = price.Bid, price.Ask
+		}
+		if price.Last > 0 {
+			q.last = price.Last
+		}
+		for accno, acc := range p.accounts {
+			if h, ok := acc.holdings[key]; ok && len(h.open) > 0 {
+				p.dirty[accno] = true
+			}
+		}
+		now := p.interval <= 0
+		if !now && !p.flushing && len(p.dirty) > 0 {
+			p.flushing = true
+			time.AfterFunc(0, p.flush)
+		}
+		p.Unlock()
+		if now {
+			p.flush()
+		}
+		return
+	case "privtrade":
+		var trade feedmodel.FeedPrivateTradeData
+		if msg.DecodeData(&trade) != nil || trade.Accno == 0 {
+			return
+		}
+		p.Lock()
+		acc := p.accountLocked(trade.Accno)
+		key := tradableKey{trade.Tradable.Identifier, trade.Tradable.MarketId}
+		lot := Lot{Volume: signed(trade.Side, trade.Volume), Price: trade.Price.Value, Time: trade.Tradetime, TradeId: trade.TradeId}
+		if p.addTradeLocked(acc, trade.TradeId, key, trade.Price.Currency, lot) {
+			acc.live = append(acc.live, liveTrade{tradeId: trade.TradeId, key: key, currency: trade.Price.Currency, lot: lot})
+			snap = p.sentLocked(acc, true)
+		}
+	default:
+		return
+	}
+	publish := p.publish
+	p.Unlock()
+
+	if snap != nil {
+		publish(snap.msg())
+	}
+}
+
+// Publish the accounts with new prices, that were not published within the interval. Schedules itself for the rest.
+func (p *Portfolio) flush() {
+	p.Lock()
+	p.flushing = false
+	now := time.Now()
+	var snaps []*Snapshot
+	var wait time.Duration
+	for accno := range p.dirty {
+		if left := p.sent[accno].Add(p.interval).Sub(now); left > 0 {
+			if wait == 0 || left < wait {
+				wait = left
+			}
+			continue
+		}
+		if acc, ok := p.accounts[accno]; ok {
+			snaps = append(snaps, p.sentLocked(acc, false))
+		}
+		delete(p.dirty, accno)
+	}
+	if wait > 0 {
+		p.flushing = true
+		time.AfterFunc(wait, p.flush)
+	}
+	publish := p.publish
+	p.Unlock()
+
+	for _, snap := range snaps {
+		publish(snap.msg())
+	}
+}
+
+// Caller must hold the lock. A snapshot to publish, so the prices of the account are up to date until the next change.
+func (p *Portfolio) sentLocked(acc *account, lots bool) *Snapshot {
+	delete(p.dirty, acc.accno)
+	p.sent[acc.accno] = time.Now()
+	return p.snapshotLocked(acc, lots)
+}
+
+// Price to mark a position with
+func (q *quote) mark(mark string, position float64) float64 {
+	mid := 0.0
+	if q.bid > 0 && q.ask > 0 {
+		mid = (q.bid + q.ask) / 2
+	}
+	var order []float64
+	switch mark {
+	case MarkMid:
+		order = []float64{mid, q.last}
+	case MarkBidAsk:
+		if position < 0 {
+			order = []float64{q.ask, q.last, mid}
+		} else {
+			order = []float64{q.bid, q.last, mid}
+		}
+	default:
+		order = []float64{q.last, mid}
+	}
+	for _, price := range order {
+		if price > 0 {
+			return price
+		}
+	}
+	return 0
+}
+
+// Caller must hold the lock
+func (p *Portfolio) snapshotLocked(acc *account, lots bool) *Snapshot {
+	snap := &Snapshot{Accno: acc.accno, Currency: acc.currency, Method: p.method, Timestamp: p.clock(), Holdings: []Holding{}}
+	for key, h := range acc.holdings {
+		hold := Holding{
+			Identifier:   key.identifier,
+			MarketId:     key.market,
+			Currency:     h.currency,
+			Position:     h.position(),
+			AvgPrice:     h.avgPrice(),
+			Realized:     h.realized,
+			ExchangeRate: acc.rates[h.currency],
+		}
+		if lots {
+			hold.Lots = append([]Lot{}, h.open...)
+		}
+		if q, ok := p.quotes[key]; ok {
+			hold.MarkPrice = q.mark(p.mark, hold.Position)
+		}
+		if hold.MarkPrice > 0 {
+			hold.MarketValue = hold.MarkPrice * hold.Position
+			hold.Unrealized = (hold.MarkPrice - hold.AvgPrice) * hold.Position
+		}
+		hold.MarketValueAcc = hold.MarketValue * hold.ExchangeRate
+		hold.RealizedAcc = hold.Realized * hold.ExchangeRate
+		hold.UnrealizedAcc = hold.Unrealized * hold.ExchangeRate
+
+		snap.MarketValue += hold.MarketValueAcc
+		snap.Realized += hold.RealizedAcc
+		snap.Unrealized += hold.UnrealizedAcc
+		snap.Holdings = append(snap.Holdings, hold)
+	}
+	snap.Total = snap.Realized + snap.Unrealized
+	sort.Sort(byTradable(snap.Holdings))
+	return snap
+}
+
+func (s *Snapshot) msg() *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject(PortfolioMsgType, s)
+	return msg
+}
+
+// The current P&L of an account. Nil if not loaded, and no trades seen.
+func (p *Portfolio) Snapshot(accno int64) *Snapshot {
+	p.Lock()
+	defer p.Unlock()
+	if acc, ok := p.accounts[accno]; ok {
+		return p.snapshotLocked(acc, true)
+	}
+	return nil
+}
+
+type byTradetime []swagger.Trade
+
+func (a byTradetime) Len() int           { return len(a) }
+func (a byTradetime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTradetime) Less(i, j int) bool { return a[i].Tradetime < a[j].Tradetime }
+
+type byTradable []Holding
+
+func (a byTradable) Len() int      { return len(a) }
+func (a byTradable) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byTradable) Less(i, j int) bool {
+	return a[i].MarketId < a[j].MarketId || (a[i].MarketId == a[j].MarketId && a[i].Identifier < a[j].Identifier)
+}
+
+func (p *Portfolio) init() {
+	p.AddCommand(string(api.PortfolioCmd)).Description("Realized and unrealized P&L of an account").
+		AddArgument("accno").
+		AddFullArgument("reload", "Rebuild from the account trades and positions first", []string{"true", "false"}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			accno, err := strconv.ParseInt(params["accno"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad accno '%s': %v", params["accno"], err)
+			}
+			snap := p.Snapshot(accno)
+			if snap == nil || params["reload"] == "true" {
+				if err := p.Load(accno); err != nil {
+					logger.Error("Unable to load account", "accno", accno, "err", err)
+					return nil, err
+				}
+				snap = p.Snapshot(accno)
+			}
+			return json.Marshal(snap)
+		})
+}
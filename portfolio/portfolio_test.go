@@ -0,0 +1,180 @@
+package portfolio_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/portfolio"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.001
+}
+
+func price(id string, market int64, bid, ask, last float64) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: id, Market: market, Bid: bid, Ask: ask, Last: last})
+	return msg
+}
+
+// Buys 10 at 100 and 10 at 110, before the portfolio is loaded, then sells 15 at 120
+func trade(t *testing.T, method string) (*portfolio.Portfolio, []*portfolio.Snapshot) {
+	broker := paper.NewPaperBroker(1, "SEK", 100000)
+	broker.OnMessage(price("101", 11, 99, 100, 0))
+	broker.CreateOrder(1, "101", 11, "BUY", 100, 10, "", "")
+	broker.OnMessage(price("101", 11, 109, 110, 0))
+	broker.CreateOrder(1, "101", 11, "BUY", 110, 10, "", "")
+
+	pf := portfolio.NewPortfolio(api.NewApiClient(paper.NewPaperTransport(broker, nil))).SetMethod(method).SetPublishInterval(0)
+	var snaps []*portfolio.Snapshot
+	pf.SetPublisher(func(msg *feedmodel.FeedMsg) {
+		var snap portfolio.Snapshot
+		if msg.Type == portfolio.PortfolioMsgType && msg.DecodeData(&snap) == nil {
+			snaps = append(snaps, &snap)
+		}
+	})
+	broker.SetPublisher(pf.OnMessage)
+	if err := pf.Load(1); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.OnMessage(price("101", 11, 120, 121, 0))
+	broker.CreateOrder(1, "101", 11, "SELL", 120, 15, "", "")
+	broker.OnMessage(price("101", 11, 120, 121, 0)) // Broker does not republish prices, so give it to both
+	pf.OnMessage(price("101", 11, 129, 131, 130))
+	return pf, snaps
+}
+
+func TestFIFO(t *testing.T) {
+	pf, snaps := trade(t, portfolio.FIFO)
+	if len(snaps) != 3 {
+		t.Fatalf("Expected updates on load, trade and price, but got %d", len(snaps))
+	}
+	if h := snaps[0].Holdings; snaps[0].Currency != "SEK" || len(h) != 1 || h[0].Position != 20 || len(h[0].Lots) != 2 || h[0].AvgPrice != 105 {
+		t.Errorf("Expected two lots after load: %+v", snaps[0])
+	}
+	snap := pf.Snapshot(1)
+	h := snap.Holdings[0]
+	if h.Position != 5 || h.AvgPrice != 110 || !near(h.Realized, 250) || h.MarkPrice != 130 || !near(h.Unrealized, 100) {
+		t.Errorf("Unexpected FIFO holding: %+v", h)
+	}
+	if !near(snap.Total, 350) || !near(snap.MarketValue, 650) || snap.Method != portfolio.FIFO {
+		t.Errorf("Unexpected FIFO totals: %+v", snap)
+	}
+}
+
+func TestAverageCostAndFX(t *testing.T) {
+	pf, _ := trade(t, portfolio.AverageCost)
+	h := pf.Snapshot(1).Holdings[0]
+	if h.Position != 5 || len(h.Lots) != 1 || h.AvgPrice != 105 || !near(h.Realized, 225) || !near(h.Unrealized, 125) {
+		t.Errorf("Unexpected average cost holding: %+v", h)
+	}
+
+	// A trade in USD, that is not in the ledgers
+	usd, _ := feedmodel.NewFeedMsgFromObject("privtrade", &feedmodel.FeedPrivateTradeData{Accno: 1, TradeId: "X1",
+		Tradable: feedmodel.FeedTradableId{Identifier: "200", MarketId: 12}, Price: feedmodel.FeedAmount{Value: 10, Currency: "USD"},
+		Volume: 100, Side: "BUY"})
+	pf.OnMessage(usd)
+	pf.OnMessage(usd) // Duplicates are ignored
+	pf.OnMessage(price("200", 12, 0, 0, 11))
+	snap := pf.Snapshot(1)
+	if h := snap.Holdings[1]; h.Position != 100 || h.ExchangeRate != 0 || !near(h.Unrealized, 100) || !near(snap.Total, 350) {
+		t.Errorf("Expected USD holding outside the totals: %+v", snap)
+	}
+
+	pf.SetExchangeRate(1, "USD", 9.5).SetMarkPrice(portfolio.MarkBidAsk)
+	snap = pf.Snapshot(1)
+	if h := snap.Holdings[1]; !near(h.MarketValueAcc, 10450) || !near(h.UnrealizedAcc, 950) || !near(snap.Total, 350+950-5) {
+		t.Errorf("Expected USD holding converted, and SEK marked at bid: %+v", snap)
+	}
+}
+
+func TestPortfolioCommand(t *testing.T) {
+	pf, _ := trade(t, portfolio.FIFO)
+	res, err := api.NewApiClient(pf).Portfolio(1, false)
+	if err != nil || res["total"] != 350.0 {
+		t.Errorf("Unexpected portfolio: %+v, %+v", res, err)
+	}
+}
+
+type published struct {
+	sync.Mutex
+	snaps []*portfolio.Snapshot
+}
+
+func (p *published) OnMessage(msg *feedmodel.FeedMsg) {
+	var snap portfolio.Snapshot
+	if msg.Type == portfolio.PortfolioMsgType && msg.DecodeData(&snap) == nil {
+		p.Lock()
+		p.snaps = append(p.snaps, &snap)
+		p.Unlock()
+	}
+}
+
+func (p *published) get() []*portfolio.Snapshot {
+	p.Lock()
+	defer p.Unlock()
+	return append([]*portfolio.Snapshot{}, p.snaps...)
+}
+
+func TestThrottledPrices(t *testing.T) {
+	pf, _ := trade(t, portfolio.FIFO)
+	var pub published
+	pf.SetPublisher(pub.OnMessage).SetPublishInterval(100 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond) // Since the updates of trade
+	for i := 0; i < 50; i++ {
+		pf.OnMessage(price("101", 11, 0, 0, 130+float64(i)))
+	}
+	time.Sleep(150 * time.Millisecond)
+	snaps := pub.get()
+	if len(snaps) == 0 || len(snaps) > 2 || snaps[len(snaps)-1].Holdings[0].MarkPrice != 179 || len(snaps[0].Holdings[0].Lots) != 0 {
+		t.Fatalf("Expected the prices in one or two updates, without lots: %+v", snaps)
+	}
+	n := len(snaps)
+
+	pf.OnMessage(price("101", 11, 0, 0, 200))
+	time.Sleep(20 * time.Millisecond)
+	pf.OnMessage(price("101", 11, 0, 0, 201))
+	time.Sleep(20 * time.Millisecond)
+	if snaps = pub.get(); len(snaps) != n+1 || snaps[n].Holdings[0].MarkPrice != 200 {
+		t.Errorf("Expected the first price at once, and the next to wait for the interval: %+v", snaps)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if snaps = pub.get(); len(snaps) != n+2 || snaps[n+1].Holdings[0].MarkPrice != 201 {
+		t.Errorf("Expected the next price after the interval: %+v", snaps)
+	}
+	pf.OnMessage(price("999", 11, 0, 0, 10)) // Not held
+	time.Sleep(150 * time.Millisecond)
+	if snaps = pub.get(); len(snaps) != n+2 {
+		t.Errorf("Expected no update for prices of other instruments: %d", len(snaps))
+	}
+}
+
+func TestTradeDuringLoad(t *testing.T) {
+	broker := paper.NewPaperBroker(1, "SEK", 100000)
+	var pf *portfolio.Portfolio
+	trans := api.Transport(func(req *api.Request) api.Response {
+		res := paper.NewPaperTransport(broker, nil).Preform(req)
+		if req.Command == api.AccountTradesCmd {
+			// Made after the trades were fetched, but before the account was rebuilt
+			late, _ := feedmodel.NewFeedMsgFromObject("privtrade", &feedmodel.FeedPrivateTradeData{Accno: 1, TradeId: "LATE",
+				Tradable: feedmodel.FeedTradableId{Identifier: "300", MarketId: 11}, Price: feedmodel.FeedAmount{Value: 50, Currency: "SEK"},
+				Volume: 10, Side: "BUY"})
+			pf.OnMessage(late)
+		}
+		return res
+	})
+	pf = portfolio.NewPortfolio(api.NewApiClient(trans))
+	for i := 0; i < 2; i++ {
+		if err := pf.Load(1); err != nil {
+			t.Fatal(err)
+		}
+		if h := pf.Snapshot(1).Holdings; len(h) != 1 || h[0].Position != 10 {
+			t.Errorf("Expected the trade from the feed kept on load %d: %+v", i, h)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+// Package reconcile keeps positions and open orders per account from the private feed, and compares them with
+// AccountPositions and AccountOrders. Differences are reported, published on the feed topic, and can be corrected.
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/swagger"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("reconcile")
+
+// Message type for mismatches, sent on the feed topic
+const MismatchMsgType = "reconcile_mismatch"
+
+// Kinds of mismatch
+const (
+	KindPosition      = "position"       // Volume differs
+	KindOrderUnknown  = "order_unknown"  // Open at the broker, but not known locally
+	KindOrderMissing  = "order_missing"  // Open locally, but not at the broker
+	KindOrderVolume   = "order_volume"   // Open volume differs
+	KindOrderPrice    = "order_price"    // Price differs
+	KindAccountFailed = "account_failed" // Could not get the state from the broker
+)
+
+// Tries before giving up on an account, if the feed keeps changing it while we ask the broker
+const maxTries = 3
+
+type Mismatch struct {
+	Accno      int64   `json:"accno"`
+	Kind       string  `json:"kind"`
+	Identifier string  `json:"identifier,omitempty"`
+	MarketId   int64   `json:"market_id,omitempty"`
+	OrderId    int64   `json:"order_id,omitempty"`
+	Local      float64 `json:"local"`
+	Remote     float64 `json:"remote"`
+	Detail     string  `json:"detail,omitempty"`
+}
+
+// Published as MismatchMsgType, once per account with mismatches
+type Report struct {
+	Timestamp   int64      `json:"timestamp"`
+	Accounts    []int64    `json:"accounts"`
+	Initialized []int64    `json:"initialized,omitempty"` // First run for the account. Local state taken from the broker
+	Mismatches  []Mismatch `json:"mismatches"`
+	Corrected   bool       `json:"corrected"`
+}
+
+type tradableKey struct {
+	identifier string
+	market     int64
+}
+
+type order struct {
+	key    tradableKey
+	price  float64
+	open   float64
+	state  string
+	update int64 // Modified, to ignore old messages
+}
+
+type account struct {
+	positions map[tradableKey]float64
+	orders    map[int64]*order // Open orders only
+	seen      map[string]bool  // Trade ids
+	seq       int64            // Bumped on every change from the feed
+}
+
+func newAccount() *account {
+	return &account{positions: make(map[tradableKey]float64), orders: make(map[int64]*order), seen: make(map[string]bool)}
+}
+
+func isOpen(state string) bool {
+	return state != "DELETED" && state != "DONE"
+}
+
+// The reconciler. Use Bind to attach it to a FeedState, and Start to run it periodically.
+type Reconciler struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	cli        *api.ApiClient
+	accounts   map[int64]*account
+	correct    bool
+	correctors []func(accno int64)
+	settle     time.Duration
+	last       *Report
+	clock      func() int64
+	publish    feed.FeedClient
+	quit       chan bool
+}
+
+func NewReconciler(cli *api.ApiClient) *Reconciler {
+	r := &Reconciler{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		cli:                     cli,
+		accounts:                make(map[int64]*account),
+		settle:                  2 * time.Second,
+		clock:                   func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+		publish:                 func(*feedmodel.FeedMsg) {},
+	}
+	r.init()
+	return r
+}
+
+// Listen to the messages of the FeedState, and publish mismatches on its topic
+func (r *Reconciler) Bind(fs *feed.FeedState) *Reconciler {
+	r.SetPublisher(fs.Publish)
+	fs.AddListener(r.OnMessage)
+	return r
+}
+
+func (r *Reconciler) SetPublisher(publish feed.FeedClient) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	r.publish = publish
+	return r
+}
+
+func (r *Reconciler) SetClock(clock func() int64) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	r.clock = clock
+	return r
+}
+
+// If true, the local state of an account is replaced with the state of the broker when they differ
+func (r *Reconciler) SetAutoCorrect(correct bool) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	r.correct = correct
+	return r
+}
+
+// Time to wait before asking the broker again, to confirm a mismatch. Messages can be a bit behind the REST api.
+func (r *Reconciler) SetSettleDelay(settle time.Duration) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	r.settle = settle
+	return r
+}
+
+// Called with the account after it was corrected. Use it to rebuild other state, like a portfolio.
+func (r *Reconciler) AddCorrector(fn func(accno int64)) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	r.correctors = append(r.correctors, fn)
+	return r
+}
+
+// Reconcile every interval, until Stop
+func (r *Reconciler) Start(interval time.Duration) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	if r.quit == nil {
+		r.quit = make(chan bool)
+		go func(quit chan bool) {
+			for {
+				select {
+				case <-quit:
+					return
+				case <-time.After(interval):
+					if _, err := r.Reconcile(); err != nil {
+						logger.Warn("Reconcile failed", "err", err)
+					}
+				}
+			}
+		}(r.quit)
+	}
+	return r
+}
+
+func (r *Reconciler) Stop() {
+	r.Lock()
+	defer r.Unlock()
+	if r.quit != nil {
+		close(r.quit)
+		r.quit = nil
+	}
+}
+
+// Handle privtrade and order messages. Implements feed.FeedClient.
+func (r *Reconciler) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	switch msg.Type {
+	case "privtrade":
+		var trade feedmodel.FeedPrivateTradeData
+		if msg.DecodeData(&trade) != nil || trade.Accno == 0 {
+			return
+		}
+		r.Lock()
+		defer r.Unlock()
+		acc, ok := r.accounts[trade.Accno]
+		if !ok || (trade.TradeId != "" && acc.seen[trade.TradeId]) {
+			return // Accounts are added on the first reconcile
+		}
+		if trade.TradeId != "" {
+			acc.seen[trade.TradeId] = true
+		}
+		volume := trade.Volume
+		if trade.Side == "SELL" {
+			volume = -volume
+		}
+		acc.positions[tradableKey{trade.Tradable.Identifier, trade.Tradable.MarketId}] += volume
+		acc.seq++
+	case "order":
+		var o feedmodel.FeedOrderData
+		if msg.DecodeData(&o) != nil || o.Accno == 0 {
+			return
+		}
+		r.Lock()
+		defer r.Unlock()
+		acc, ok := r.accounts[o.Accno]
+		if !ok {
+			return
+		}
+		if local, ok := acc.orders[o.OrderId]; ok && local.update > o.Modified {
+			return
+		}
+		if isOpen(o.OrderState) {
+			acc.orders[o.OrderId] = &order{key: tradableKey{o.Tradable.Identifier, o.Tradable.MarketId},
+				price: o.Price.Value, open: o.OpenVolume, state: o.OrderState, update: o.Modified}
+		} else {
+			delete(acc.orders, o.OrderId)
+		}
+		acc.seq++
+	}
+}
+
+// The remote state of one account
+type remoteState struct {
+	positions map[tradableKey]float64
+	alias     map[tradableKey]tradableKey // Other tradables of the same instrument, to the one we use
+	orders    map[int64]*order
+}
+
+func (r *Reconciler) fetch(accno int64) (rs *remoteState, err error) {
+	positions, err := r.cli.AccountPositions(accno)
+	if err != nil {
+		return
+	}
+	orders, err := r.cli.AccountOrders(accno)
+	if err != nil {
+		return
+	}
+	rs = &remoteState{positions: make(map[tradableKey]float64), alias: make(map[tradableKey]tradableKey),
+		orders: make(map[int64]*order)}
+	for _, pos := range positions {
+		if len(pos.Instrument.Tradables) == 0 {
+			continue
+		}
+		key := tradableKey{pos.Instrument.Tradables[0].Identifier, pos.Instrument.Tradables[0].MarketId}
+		for _, t := range pos.Instrument.Tradables {
+			rs.alias[tradableKey{t.Identifier, t.MarketId}] = key
+		}
+		rs.positions[key] += float64(pos.Qty)
+	}
+	for _, o := range orders {
+		if isOpen(o.OrderState) {
+			rs.orders[o.OrderId] = remoteOrder(o)
+		}
+	}
+	return
+}
+
+func remoteOrder(o swagger.Order) *order {
+	return &order{key: tradableKey{o.Tradable.Identifier, o.Tradable.MarketId}, price: o.Price.Value,
+		open: o.OpenVolume, state: o.OrderState, update: o.Modified}
+}
+
+// Local positions, with the tradables the broker use
+func (rs *remoteState) localPositions(acc *account) map[tradableKey]float64 {
+	res := make(map[tradableKey]float64)
+	for key, vol := range acc.positions {
+		if alias, ok := rs.alias[key]; ok {
+			key = alias
+		}
+		res[key] += vol
+	}
+	return res
+}
+
+const epsilon = 1e-9
+
+// Compare all accounts from Accounts() now
+func (r *Reconciler) Reconcile() (*Report, error) {
+	r.Lock()
+	correct := r.correct
+	r.Unlock()
+	return r.ReconcileAndCorrect(correct)
+}
+
+// Like Reconcile, but correct overrides SetAutoCorrect
+func (r *Reconciler) ReconcileAndCorrect(correct bool) (*Report, error) {
+	accounts, err := r.cli.Accounts()
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	report := &Report{Timestamp: r.clock(), Accounts: []int64{}, Mismatches: []Mismatch{}, Corrected: correct}
+	settle := r.settle
+	r.Unlock()
+
+	byAccount := make(map[int64][]Mismatch)
+	corrected := []int64{}
+	for _, a := range accounts {
+		report.Accounts = append(report.Accounts, a.Accno)
+		mismatches, initialized, fixed := r.reconcileAccount(a.Accno, correct, settle)
+		if initialized {
+			report.Initialized = append(report.Initialized, a.Accno)
+		}
+		if fixed {
+			corrected = append(corrected, a.Accno)
+		}
+		if len(mismatches) > 0 {
+			byAccount[a.Accno] = mismatches
+			report.Mismatches = append(report.Mismatches, mismatches...)
+		}
+	}
+
+	r.Lock()
+	r.last = report
+	publish := r.publish
+	correctors := append([]func(int64){}, r.correctors...)
+	r.Unlock()
+
+	for _, accno := range report.Accounts {
+		if mismatches, ok := byAccount[accno]; ok {
+			logger.Warn("Mismatches", "accno", accno, "count", len(mismatches), "mismatches", mismatches)
+			msg, _ := feedmodel.NewFeedMsgFromObject(MismatchMsgType, &Report{Timestamp: report.Timestamp,
+				Accounts: []int64{accno}, Mismatches: mismatches, Corrected: report.Corrected})
+			publish(msg)
+		}
+	}
+	for _, accno := range corrected {
+		for _, fn := range correctors {
+			fn(accno)
+		}
+	}
+	return report, nil
+}
+
+func (r *Reconciler) reconcileAccount(accno int64, correct bool, settle time.Duration) (mismatches []Mismatch, initialized, corrected bool) {
+	confirming := false
+	for try := 0; try < maxTries; try++ {
+		r.Lock()
+		acc, known := r.accounts[accno]
+		seq := int64(0)
+		if known {
+			seq = acc.seq
+		}
+		r.Unlock()
+
+		rs, err := r.fetch(accno)
+		if err != nil {
+			return []Mismatch{{Accno: accno, Kind: KindAccountFailed, Detail: err.Error()}}, false, false
+		}
+
+		r.Lock()
+		acc, known = r.accounts[accno]
+		if known && acc.seq != seq {
+			r.Unlock()
+			continue // The feed changed it while we asked. Try again
+		}
+		if !known {
+			r.accounts[accno] = r.fromRemote(rs, nil)
+			r.Unlock()
+			return nil, true, false
+		}
+		mismatches = compare(accno, rs, acc)
+		if len(mismatches) > 0 && settle > 0 && !confirming {
+			r.Unlock()
+			confirming = true
+			time.Sleep(settle)
+			continue
+		}
+		if len(mismatches) > 0 && correct {
+			r.accounts[accno] = r.fromRemote(rs, acc)
+			corrected = true
+		}
+		r.Unlock()
+		return
+	}
+	logger.Info("Account changed during all tries. Skipped this time", "accno", accno, "tries", maxTries)
+	return
+}
+
+// Caller must hold the lock
+func (r *Reconciler) fromRemote(rs *remoteState, old *account) *account {
+	acc := newAccount()
+	if old != nil {
+		acc.seen, acc.seq = old.seen, old.seq+1
+	}
+	for key, vol := range rs.positions {
+		acc.positions[key] = vol
+	}
+	for id, o := range rs.orders {
+		acc.orders[id] = o
+	}
+	return acc
+}
+
+func compare(accno int64, rs *remoteState, acc *account) (res []Mismatch) {
+	local := rs.localPositions(acc)
+	keys := map[tradableKey]bool{}
+	for key := range local {
+		keys[key] = true
+	}
+	for key := range rs.positions {
+		keys[key] = true
+	}
+	for key := range keys {
+		if math.Abs(local[key]-rs.positions[key]) > epsilon {
+			res = append(res, Mismatch{Accno: accno, Kind: KindPosition, Identifier: key.identifier, MarketId: key.market,
+				Local: local[key], Remote: rs.positions[key]})
+		}
+	}
+
+	for id, ro := range rs.orders {
+		lo, ok := acc.orders[id]
+		switch {
+		case !ok:
+			res = append(res, Mismatch{Accno: accno, Kind: KindOrderUnknown, Identifier: ro.key.identifier,
+				MarketId: ro.key.market, OrderId: id, Remote: ro.open, Detail: ro.state})
+		case math.Abs(lo.open-ro.open) > epsilon:
+			res = append(res, Mismatch{Accno: accno, Kind: KindOrderVolume, Identifier: ro.key.identifier,
+				MarketId: ro.key.market, OrderId: id, Local: lo.open, Remote: ro.open})
+		case math.Abs(lo.price-ro.price) > epsilon:
+			res = append(res, Mismatch{Accno: accno, Kind: KindOrderPrice, Identifier: ro.key.identifier,
+				MarketId: ro.key.market, OrderId: id, Local: lo.price, Remote: ro.price})
+		}
+	}
+	for id, lo := range acc.orders {
+		if _, ok := rs.orders[id]; !ok {
+			res = append(res, Mismatch{Accno: accno, Kind: KindOrderMissing, Identifier: lo.key.identifier,
+				MarketId: lo.key.market, OrderId: id, Local: lo.open, Detail: lo.state})
+		}
+	}
+	sort.Sort(byMismatch(res))
+	return
+}
+
+type byMismatch []Mismatch
+
+func (a byMismatch) Len() int      { return len(a) }
+func (a byMismatch) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byMismatch) Less(i, j int) bool {
+	if a[i].Kind != a[j].Kind {
+		return a[i].Kind < a[j].Kind
+	} else if a[i].OrderId != a[j].OrderId {
+		return a[i].OrderId < a[j].OrderId
+	} else if a[i].MarketId != a[j].MarketId {
+		return a[i].MarketId < a[j].MarketId
+	}
+	return a[i].Identifier < a[j].Identifier
+}
+
+// The report from the last run. Nil if we have not run yet.
+func (r *Reconciler) LastReport() *Report {
+	r.Lock()
+	defer r.Unlock()
+	return r.last
+}
+
+func (r *Reconciler) init() {
+	r.AddCommand(string(api.ReconcileCmd)).Description("Compare positions and orders from the private feed with the broker").
+		AddFullArgument("correct", "Replace the local state when it differs. Default as configured", []string{"true", "false"}, true).
+		AddFullArgument("last", "Only return the last report", []string{"true", "false"}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if params["last"] == "true" {
+				return json.Marshal(r.LastReport())
+			}
+			var report *Report
+			var err error
+			if params["correct"] != "" {
+				correct, perr := strconv.ParseBool(params["correct"])
+				if perr != nil {
+					return nil, fmt.Errorf("Bad correct '%s': %v", params["correct"], perr)
+				}
+				report, err = r.ReconcileAndCorrect(correct)
+			} else {
+				report, err = r.Reconcile()
+			}
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(report)
+		})
+}
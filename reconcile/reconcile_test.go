@@ -0,0 +1,77 @@
+package reconcile_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/reconcile"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	broker := paper.NewPaperBroker(1, "SEK", 100000)
+	price, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11, Bid: 99, Ask: 100})
+	broker.OnMessage(price)
+
+	rec := reconcile.NewReconciler(api.NewApiClient(paper.NewPaperTransport(broker, nil))).SetSettleDelay(0)
+	var events []*reconcile.Report
+	rec.SetPublisher(func(msg *feedmodel.FeedMsg) {
+		var report reconcile.Report
+		if msg.Type == reconcile.MismatchMsgType && msg.DecodeData(&report) == nil {
+			events = append(events, &report)
+		}
+	})
+	var corrected []int64
+	rec.AddCorrector(func(accno int64) { corrected = append(corrected, accno) })
+	broker.SetPublisher(rec.OnMessage)
+
+	// Unknown accounts are ignored on the feed, until the first run takes the state from the broker
+	broker.CreateOrder(1, "101", 11, "BUY", 100, 10, "", "")
+	if report, err := rec.Reconcile(); err != nil || len(report.Initialized) != 1 || len(report.Mismatches) != 0 {
+		t.Fatalf("Expected account to be initialized: %+v, %+v", report, err)
+	}
+
+	broker.CreateOrder(1, "101", 11, "BUY", 100, 5, "", "")
+	resting, _ := broker.CreateOrder(1, "101", 11, "BUY", 90, 5, "", "")
+	if report, _ := rec.Reconcile(); len(report.Mismatches) != 0 || len(report.Initialized) != 0 {
+		t.Errorf("Expected the feed to keep us in sync: %+v", report)
+	}
+
+	// Missed messages
+	broker.SetPublisher(func(*feedmodel.FeedMsg) {})
+	broker.CreateOrder(1, "101", 11, "SELL", 99, 3, "", "")
+	broker.DeleteOrder(1, resting.OrderId)
+	unknown, _ := broker.CreateOrder(1, "101", 11, "BUY", 95, 7, "", "")
+	broker.SetPublisher(rec.OnMessage)
+
+	report, _ := rec.Reconcile()
+	expected := []reconcile.Mismatch{
+		{Accno: 1, Kind: reconcile.KindOrderMissing, Identifier: "101", MarketId: 11, OrderId: resting.OrderId, Local: 5, Detail: "ON_MARKET"},
+		{Accno: 1, Kind: reconcile.KindOrderUnknown, Identifier: "101", MarketId: 11, OrderId: unknown.OrderId, Remote: 7, Detail: "ON_MARKET"},
+		{Accno: 1, Kind: reconcile.KindPosition, Identifier: "101", MarketId: 11, Local: 15, Remote: 12},
+	}
+	if len(report.Mismatches) != len(expected) {
+		t.Fatalf("Expected %d mismatches, but got %+v", len(expected), report.Mismatches)
+	}
+	for idx, m := range report.Mismatches {
+		if m != expected[idx] {
+			t.Errorf("Expected %+v, but got %+v", expected[idx], m)
+		}
+	}
+	if len(events) != 1 || len(events[0].Mismatches) != 3 || events[0].Accounts[0] != 1 || events[0].Corrected {
+		t.Errorf("Expected one %s event: %+v", reconcile.MismatchMsgType, events)
+	}
+	if len(corrected) != 0 {
+		t.Errorf("Expected no correction, but got %v", corrected)
+	}
+
+	// Correct, from the command
+	res, err := api.NewApiClient(rec).Reconcile(true)
+	if err != nil || res["corrected"] != true || len(res["mismatches"].([]interface{})) != 3 || len(corrected) != 1 {
+		t.Errorf("Expected corrected mismatches: %+v, %+v, %v", res, err, corrected)
+	}
+	if report, _ := rec.Reconcile(); len(report.Mismatches) != 0 || len(events) != 2 {
+		t.Errorf("Expected to be in sync after correction: %+v", report)
+	}
+}
@@ -0,0 +1,213 @@
+package refdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/swagger"
+	"strconv"
+	"strings"
+)
+
+// Search modes of RefDataSearch
+const (
+	ModeExact  = "exact"
+	ModePrefix = "prefix"
+	ModeFuzzy  = "fuzzy"
+)
+
+func (s *Store) lookupTradable(typ, lookup string) ([]swagger.Instrument, error) {
+	parts := strings.Split(lookup, ":")
+	switch typ {
+	case "market_id_identifier":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Lookup should be [market_id]:[identifier], not '%s'", lookup)
+		}
+		return s.instruments(s.idx.lookup(lookup)), nil
+	case "isin_code_currency_market_id":
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Lookup should be [isin]:[currency]:[market_id], not '%s'", lookup)
+		}
+		market, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad market_id '%s'", parts[2])
+		}
+		res := []swagger.Instrument{}
+		for _, instr := range s.instruments(s.idx.isin[strings.ToUpper(parts[0])]) {
+			if !strings.EqualFold(instr.Currency, parts[1]) {
+				continue
+			}
+			for _, t := range instr.Tradables {
+				if t.MarketId == market {
+					res = append(res, instr)
+					break
+				}
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("Unknown lookup type '%s'", typ)
+}
+
+func (s *Store) init() {
+	s.AddCommand(string(api.RefDataCmd)).Description("Status of the local reference data").
+		AddFullArgument("sync", "Sync from the remote transport first", []string{"true", "false"}, true).
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if params["sync"] == "true" {
+				if err := s.Sync(); err != nil {
+					return nil, err
+				}
+			}
+			return json.Marshal(s.Status())
+		})
+
+	s.AddCommand(string(api.RefDataSearchCmd)).Description("Search the local reference data, even if it is stale").
+		AddFullArgument("query", "Instrument id, ISIN, symbol, market_id:identifier or name", []string{}, false).
+		AddFullArgument("mode", "Default exact", []string{ModeExact, ModePrefix, ModeFuzzy}, true).
+		AddOptArgument("instrument_group_type").AddOptArgument("limit").AddOptArgument("offset").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			limit, err := parseInt(params, "limit")
+			if err != nil {
+				return nil, err
+			}
+			offset, err := parseInt(params, "offset")
+			if err != nil {
+				return nil, err
+			}
+			switch params["mode"] {
+			case "", ModeExact:
+				return json.Marshal(s.Lookup(params["query"]))
+			case ModePrefix, ModeFuzzy:
+				return json.Marshal(s.Search(params["query"], params["instrument_group_type"], params["mode"] == ModeFuzzy, limit, offset))
+			}
+			return nil, fmt.Errorf("Unknown mode '%s'", params["mode"])
+		})
+
+	// Overrides of the remote commands. Local while fresh.
+
+	s.AddCommand(string(api.InstrumentSearchCmd)).Description("Local InstrumentSearch, while the reference data is fresh").
+		AddArgument("query").AddOptArgument("instrument_group_type").AddOptArgument("limit").AddOptArgument("offset").
+		AddFullArgument("fuzzy", "", []string{"true", "false"}, true).
+		Handler(s.override(api.InstrumentSearchCmd, true, func(params api.Params) (interface{}, bool, error) {
+			limit, err := parseInt(params, "limit")
+			if err != nil {
+				return nil, false, err
+			} else if limit == 0 {
+				limit = searchPage
+			}
+			offset, err := parseInt(params, "offset")
+			if err != nil {
+				return nil, false, err
+			}
+			res := s.Search(params["query"], params["instrument_group_type"], params["fuzzy"] == "true", limit, offset)
+			return res, len(res) > 0 && s.covers(params["query"]), nil
+		}))
+
+	s.AddCommand(string(api.InstrumentLookupCmd)).Description("Local InstrumentLookup, while the reference data is fresh").
+		AddFullArgument("type", "Lookup type", []string{"market_id_identifier", "isin_code_currency_market_id"}, false).
+		AddFullArgument("lookup", "Format for market_id_identifier: [market_id]:[identifier].\nFormat for isin_code_currency_market_id: [isin]:[currency]:[market_id]", []string{}, false).
+		Handler(s.override(api.InstrumentLookupCmd, true, func(params api.Params) (interface{}, bool, error) {
+			s.Lock()
+			defer s.Unlock()
+			res, err := s.lookupTradable(params["type"], params["lookup"])
+			return res, len(res) > 0, err
+		}))
+
+	s.AddCommand(string(api.InstrumentsCmd)).Description("Local Instruments, while the reference data is fresh").
+		AddArgument("instruments").
+		Handler(s.override(api.InstrumentsCmd, true, func(params api.Params) (interface{}, bool, error) {
+			ids, err := parseIds(params["instruments"])
+			if err != nil {
+				return nil, false, err
+			}
+			s.Lock()
+			defer s.Unlock()
+			res := s.instruments(ids)
+			return res, len(res) == len(ids), nil // Ask remote if any is missing
+		}))
+
+	s.AddCommand(string(api.MarketCmd)).Description("Local Market, while the reference data is fresh").
+		AddFullArgument("ids", "List of id's. Comma separated", []string{}, true).
+		Handler(s.override(api.MarketCmd, false, func(params api.Params) (interface{}, bool, error) {
+			ids, err := parseIds(params["ids"])
+			if err != nil {
+				return nil, false, err
+			}
+			s.Lock()
+			defer s.Unlock()
+			res := []swagger.Market{}
+			for _, m := range s.data.Markets {
+				if len(ids) == 0 || containsId(ids, m.MarketId) {
+					res = append(res, m)
+				}
+			}
+			return res, len(ids) == 0 || len(res) == len(ids), nil
+		}))
+
+	s.AddCommand(string(api.TickSizeCmd)).Description("Local TickSize, while the reference data is fresh").
+		AddFullArgument("ids", "List of id's. Comma separated", []string{}, true).
+		Handler(s.override(api.TickSizeCmd, false, func(params api.Params) (interface{}, bool, error) {
+			ids, err := parseIds(params["ids"])
+			if err != nil {
+				return nil, false, err
+			}
+			s.Lock()
+			defer s.Unlock()
+			res := []swagger.TicksizeTable{}
+			for _, t := range s.data.TickSizes {
+				if len(ids) == 0 || containsId(ids, t.TickSizeId) {
+					res = append(res, t)
+				}
+			}
+			return res, len(ids) == 0 || len(res) == len(ids), nil
+		}))
+
+	s.AddCommand(string(api.InstrumentSectorsCmd)).Description("Local InstrumentSectors, while the reference data is fresh").
+		AddFullArgument("group", "Only sectors in the group", []string{}, true).
+		Handler(s.override(api.InstrumentSectorsCmd, false, func(params api.Params) (interface{}, bool, error) {
+			s.Lock()
+			defer s.Unlock()
+			res := []swagger.Sector{}
+			for _, sec := range s.data.Sectors {
+				if params["group"] == "" || sec.Group == params["group"] {
+					res = append(res, sec)
+				}
+			}
+			return res, true, nil
+		}))
+
+	s.AddCommand(string(api.InstrumentSectorCmd)).Description("Local InstrumentSector, while the reference data is fresh").
+		AddFullArgument("sectors", "List of sectors. Separated with comma.", []string{}, false).
+		Handler(s.override(api.InstrumentSectorCmd, false, func(params api.Params) (interface{}, bool, error) {
+			filter := strings.Split(params["sectors"], ",")
+			s.Lock()
+			defer s.Unlock()
+			res := []swagger.Sector{}
+			for _, sec := range s.data.Sectors {
+				if contains(filter, sec.Sector) {
+					res = append(res, sec)
+				}
+			}
+			return res, len(res) == len(filter), nil
+		}))
+
+	s.AddCommand(string(api.ListsCmd)).Description("Local Lists, while the reference data is fresh").
+		Handler(s.override(api.ListsCmd, false, func(params api.Params) (interface{}, bool, error) {
+			s.Lock()
+			defer s.Unlock()
+			return s.data.Lists, true, nil
+		}))
+
+	s.AddCommand(string(api.ListCmd)).Description("Local List, while the reference data is fresh").
+		AddArgument("id").
+		Handler(s.override(api.ListCmd, false, func(params api.Params) (interface{}, bool, error) {
+			id, err := strconv.ParseInt(params["id"], 10, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("Bad id '%s'", params["id"])
+			}
+			s.Lock()
+			defer s.Unlock()
+			members, ok := s.data.ListMembers[id]
+			return s.instruments(members), ok, nil
+		}))
+}
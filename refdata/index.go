@@ -0,0 +1,239 @@
+package refdata
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/swagger"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Search key, lower case. Symbols rank before names.
+type key struct {
+	text   string
+	id     int64
+	symbol bool
+}
+
+// In memory index over instruments
+type index struct {
+	instruments map[int64]swagger.Instrument
+	isin        map[string][]int64 // Upper case
+	symbol      map[string][]int64 // Upper case
+	tradables   map[string]int64   // market_id:identifier
+	keys        []key
+	sorted      bool
+}
+
+func newIndex() *index {
+	return &index{
+		instruments: make(map[int64]swagger.Instrument),
+		isin:        make(map[string][]int64),
+		symbol:      make(map[string][]int64),
+		tradables:   make(map[string]int64),
+	}
+}
+
+func tradableKey(market int64, identifier string) string {
+	return fmt.Sprintf("%d:%s", market, identifier)
+}
+
+func appendId(ids []int64, id int64) []int64 {
+	for _, i := range ids {
+		if i == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+func splitWords(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool { return r == ' ' || r == '-' || r == '.' || r == ',' || r == '/' })
+}
+
+// Add, or replace, an instrument. Keys of a replaced instrument are kept until the index is rebuilt.
+func (ix *index) add(instr swagger.Instrument) {
+	if instr.InstrumentId == 0 {
+		return
+	}
+	ix.instruments[instr.InstrumentId] = instr
+	if instr.IsinCode != "" {
+		isin := strings.ToUpper(instr.IsinCode)
+		ix.isin[isin] = appendId(ix.isin[isin], instr.InstrumentId)
+	}
+	if instr.Symbol != "" {
+		sym := strings.ToUpper(instr.Symbol)
+		ix.symbol[sym] = appendId(ix.symbol[sym], instr.InstrumentId)
+		ix.keys = append(ix.keys, key{strings.ToLower(instr.Symbol), instr.InstrumentId, true})
+	}
+	for _, t := range instr.Tradables {
+		ix.tradables[tradableKey(t.MarketId, t.Identifier)] = instr.InstrumentId
+	}
+	if name := strings.ToLower(instr.Name); name != "" {
+		ix.keys = append(ix.keys, key{name, instr.InstrumentId, false})
+		for idx, word := range splitWords(name) {
+			if idx > 0 {
+				ix.keys = append(ix.keys, key{word, instr.InstrumentId, false})
+			}
+		}
+	}
+	ix.sorted = false
+}
+
+// Instrument id, ISIN, symbol or market_id:identifier. Exact, but case insensitive.
+func (ix *index) lookup(query string) (ids []int64) {
+	query = strings.TrimSpace(query)
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		if _, ok := ix.instruments[id]; ok {
+			ids = appendId(ids, id)
+		}
+	}
+	if id, ok := ix.tradables[query]; ok {
+		ids = appendId(ids, id)
+	}
+	for _, id := range ix.isin[strings.ToUpper(query)] {
+		ids = appendId(ids, id)
+	}
+	for _, id := range ix.symbol[strings.ToUpper(query)] {
+		ids = appendId(ids, id)
+	}
+	return
+}
+
+// Max edit distance for a fuzzy match. Short queries are not fuzzy.
+func maxDistance(query string) int {
+	if l := utf8.RuneCountInString(query); l >= 3 {
+		return 1 + l/6
+	}
+	return 0
+}
+
+// Exact lookups first, then prefixes of symbols and names, and if fuzzy, names within a small edit distance.
+// Types is a comma separated list of instrument_group_type, or empty for all.
+func (ix *index) search(query, types string, fuzzy bool) []int64 {
+	if !ix.sorted {
+		sort.Sort(byText(ix.keys))
+		ix.sorted = true
+	}
+	scores := make(map[int64]int)
+	score := func(id int64, s int) {
+		if old, ok := scores[id]; !ok || s < old {
+			scores[id] = s
+		}
+	}
+	for _, id := range ix.lookup(query) {
+		score(id, 0)
+	}
+
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q != "" {
+		for idx := sort.Search(len(ix.keys), func(i int) bool { return ix.keys[i].text >= q }); idx < len(ix.keys) &&
+			strings.HasPrefix(ix.keys[idx].text, q); idx++ {
+			if k := ix.keys[idx]; k.symbol {
+				score(k.id, 1)
+			} else {
+				score(k.id, 2)
+			}
+		}
+	}
+	if max := maxDistance(q); fuzzy && max > 0 {
+		qr := []rune(q)
+		for _, k := range ix.keys {
+			kr := []rune(k.text)
+			d := distance(qr, kr)
+			if len(kr) > len(qr) {
+				if p := distance(qr, kr[:len(qr)]); p < d {
+					d = p
+				}
+			}
+			if d <= max {
+				score(k.id, 3+d)
+			}
+		}
+	}
+
+	var groups []string
+	if types != "" {
+		groups = strings.Split(strings.ToUpper(types), ",")
+	}
+	res := make(scored, 0, len(scores))
+	for id, s := range scores {
+		instr := ix.instruments[id]
+		if len(groups) > 0 && !contains(groups, strings.ToUpper(instr.InstrumentGroupType)) {
+			continue
+		}
+		res = append(res, scoredId{id, s, strings.ToLower(instr.Name)})
+	}
+	sort.Sort(res)
+	ids := make([]int64, len(res))
+	for idx, r := range res {
+		ids[idx] = r.id
+	}
+	return ids
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if strings.TrimSpace(l) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Levenshtein distance
+func distance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(vals ...int) int {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+type byText []key
+
+func (a byText) Len() int           { return len(a) }
+func (a byText) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byText) Less(i, j int) bool { return a[i].text < a[j].text }
+
+type scoredId struct {
+	id    int64
+	score int
+	name  string
+}
+
+type scored []scoredId
+
+func (a scored) Len() int      { return len(a) }
+func (a scored) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a scored) Less(i, j int) bool {
+	if a[i].score != a[j].score {
+		return a[i].score < a[j].score
+	} else if a[i].name != a[j].name {
+		return a[i].name < a[j].name
+	}
+	return a[i].id < a[j].id
+}
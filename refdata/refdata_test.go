@@ -0,0 +1,166 @@
+package refdata_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/refdata"
+	"github.com/Forau/yanngo/swagger"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	ericsson = swagger.Instrument{InstrumentId: 101, Symbol: "ERIC B", Name: "Ericsson B", IsinCode: "SE0000108656",
+		Currency: "SEK", InstrumentGroupType: "EQ", Tradables: []swagger.Tradable{{MarketId: 11, Identifier: "101", TickSizeId: 1}}}
+	volvo = swagger.Instrument{InstrumentId: 102, Symbol: "VOLV B", Name: "Volvo B", IsinCode: "SE0000115446",
+		Currency: "SEK", InstrumentGroupType: "EQ", Tradables: []swagger.Tradable{{MarketId: 11, Identifier: "102", TickSizeId: 1}}}
+	bull = swagger.Instrument{InstrumentId: 201, Symbol: "BULL ERIC X5", Name: "Bull Ericsson X5", IsinCode: "SE0001",
+		Currency: "SEK", InstrumentGroupType: "LEV", Tradables: []swagger.Tradable{{MarketId: 30, Identifier: "201", TickSizeId: 2}}}
+	remoteOnly = swagger.Instrument{InstrumentId: 301, Symbol: "ABB", Name: "ABB Ltd", IsinCode: "CH0012221716",
+		Currency: "SEK", InstrumentGroupType: "EQ", Tradables: []swagger.Tradable{{MarketId: 11, Identifier: "301"}}}
+)
+
+// Fake API, that counts the calls per command
+func newRemote(calls map[api.RequestCommand]int) api.TransportHandler {
+	var handler api.Transport = func(req *api.Request) (res api.Response) {
+		calls[req.Command]++
+		switch req.Command {
+		case api.MarketCmd:
+			res.Success([]swagger.Market{{MarketId: 11, Name: "Stockholm"}, {MarketId: 30, Name: "NGM"}})
+		case api.TickSizeCmd:
+			res.Success([]swagger.TicksizeTable{{TickSizeId: 1, Ticks: []swagger.TicksizeInterval{{FromPrice: 0, ToPrice: 100, Tick: 0.05}}}})
+		case api.InstrumentSectorsCmd:
+			res.Success([]swagger.Sector{{Sector: "1", Name: "Tech"}})
+		case api.ListsCmd:
+			res.Success([]swagger.List{{ListId: 1, Name: "Large Cap"}, {ListId: 2, Name: "Other"}})
+		case api.ListCmd:
+			if req.Args["id"] == "1" {
+				res.Success([]swagger.Instrument{ericsson, volvo})
+			} else {
+				res.Fail(-1, "Should not be synced")
+			}
+		case api.InstrumentSearchCmd:
+			if req.Args["query"] == "bull" {
+				res.Success([]swagger.Instrument{bull})
+			} else {
+				res.Success([]swagger.Instrument{remoteOnly})
+			}
+		default:
+			res.Fail(-18, "Command not found")
+		}
+		return
+	}
+	return handler
+}
+
+func TestStore(t *testing.T) {
+	calls := make(map[api.RequestCommand]int)
+	now := int64(1000000)
+	store := refdata.NewStore(newRemote(calls)).SetClock(func() int64 { return now }).SetMaxAge(time.Hour).
+		SetLists(1).AddQueries("bull")
+	cli := api.NewApiClient(store)
+
+	// Stale, so forwarded. And learned.
+	if res, err := cli.InstrumentSearch("abb"); err != nil || len(res) != 1 || calls[api.InstrumentSearchCmd] != 1 {
+		t.Fatalf("Expected a forwarded search: %+v, %+v", res, err)
+	}
+	if res := store.Lookup("CH0012221716"); len(res) != 1 {
+		t.Errorf("Expected forwarded instruments to be learned: %+v", res)
+	}
+
+	status, err := cli.RefData(true)
+	if err != nil || status["fresh"] != true || status["instruments"].(float64) != 3 || status["tradables"].(float64) != 3 {
+		t.Fatalf("Expected fresh data after sync: %+v, %+v", status, err)
+	}
+
+	for query, expected := range map[string]int64{"101": 101, "se0000115446": 102, "eric b": 101, "30:201": 201} {
+		if res := store.Lookup(query); len(res) != 1 || res[0].InstrumentId != expected {
+			t.Errorf("Expected %d from lookup of %s, but got %+v", expected, query, res)
+		}
+	}
+	if res := store.Lookup("CH0012221716"); len(res) != 0 {
+		t.Errorf("Expected learned instruments to be replaced by the sync: %+v", res)
+	}
+
+	// Local from now on
+	calls[api.InstrumentSearchCmd] = 0
+	res, err := cli.RefDataSearch("eric", refdata.ModePrefix, "", 0, 0)
+	if err != nil || len(res) != 2 || res[0].InstrumentId != 101 || res[1].InstrumentId != 201 {
+		t.Errorf("Expected prefix matches, symbols first: %+v, %+v", res, err)
+	}
+	if res, _ := cli.RefDataSearch("ericson", refdata.ModePrefix, "", 0, 0); len(res) != 0 {
+		t.Errorf("Expected no prefix match: %+v", res)
+	}
+	if res, _ := cli.RefDataSearch("ericson", refdata.ModeFuzzy, "EQ", 0, 0); len(res) != 1 || res[0].InstrumentId != 101 {
+		t.Errorf("Expected fuzzy match, filtered on type: %+v", res)
+	}
+	if res, _ := cli.RefDataSearch("volvi", refdata.ModeFuzzy, "", 0, 0); len(res) != 1 || res[0].InstrumentId != 102 {
+		t.Errorf("Expected fuzzy match: %+v", res)
+	}
+	if res, _ := cli.InstrumentSearch("bull e"); len(res) != 1 || calls[api.InstrumentSearchCmd] != 0 {
+		t.Errorf("Expected a local search, within a synced query: %+v, %d", res, calls[api.InstrumentSearchCmd])
+	}
+	if res, _ := cli.InstrumentSearch("VOLV B"); len(res) != 1 || res[0].InstrumentId != 102 || calls[api.InstrumentSearchCmd] != 0 {
+		t.Errorf("Expected a local search, for the symbol of a list member: %+v, %d", res, calls[api.InstrumentSearchCmd])
+	}
+	if res, _ := cli.InstrumentSearch("e"); len(res) != 1 || res[0].InstrumentId != 301 || calls[api.InstrumentSearchCmd] != 1 {
+		t.Errorf("Expected a forwarded search, since the lists may not have all answers: %+v, %d", res, calls[api.InstrumentSearchCmd])
+	}
+	if res, _ := cli.InstrumentSearch("nothing"); len(res) != 1 || calls[api.InstrumentSearchCmd] != 2 {
+		t.Errorf("Expected a forwarded search without local hits: %+v, %d", res, calls[api.InstrumentSearchCmd])
+	}
+	calls[api.InstrumentSearchCmd] = 0
+	if res, _ := cli.InstrumentLookup("isin_code_currency_market_id", "SE0000108656:SEK:11"); len(res) != 1 {
+		t.Errorf("Expected a local lookup: %+v", res)
+	}
+	if res, _ := cli.List(1); len(res) != 2 || calls[api.ListCmd] != 1 {
+		t.Errorf("Expected a local list: %+v", res)
+	}
+	if res, _ := cli.Market(30); len(res) != 1 || res[0].Name != "NGM" || calls[api.MarketCmd] != 1 {
+		t.Errorf("Expected a local market: %+v", res)
+	}
+	if table, ok := store.TickSize(1); !ok || table.Ticks[0].Tick != 0.05 {
+		t.Errorf("Expected tick size table: %+v", table)
+	}
+
+	// Stale again
+	now += int64(2 * time.Hour / time.Millisecond)
+	if res, _ := cli.InstrumentSearch("e"); len(res) != 1 || calls[api.InstrumentSearchCmd] != 1 {
+		t.Errorf("Expected a forwarded search when stale: %+v", res)
+	}
+	if res, _ := cli.RefDataSearch("101", "", "", 0, 0); len(res) != 1 {
+		t.Errorf("Expected RefDataSearch to be local when stale: %+v", res)
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "refdata.json")
+
+	calls := make(map[api.RequestCommand]int)
+	store := refdata.NewStore(newRemote(calls)).SetLists(1)
+	if err = store.SetFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := refdata.NewStore(newRemote(calls))
+	if err = restored.SetFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if st := restored.Status(); !st.Fresh || st.Instruments != 2 || st.Markets != 2 || st.Lists != 2 {
+		t.Errorf("Expected the store to be restored: %+v", st)
+	}
+	if _, trad, ok := restored.Tradable(11, "102"); !ok || trad.TickSizeId != 1 {
+		t.Errorf("Expected tradable to be found: %+v", trad)
+	}
+}
@@ -0,0 +1,456 @@
+// Package refdata keeps instruments, tradables, markets, tick sizes, sectors and lists in a local store, synced from
+// the API on a schedule. Lookups and searches are local, and the store can replace the remote reference data commands
+// in a TransportRouter. While the data is stale, those commands are forwarded to the remote transport.
+package refdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/nnutils"
+	"github.com/Forau/yanngo/swagger"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("refdata")
+
+// Default max age of the data, before commands are forwarded to the remote transport
+const DefaultMaxAge = 24 * time.Hour
+
+// Page size when syncing searches
+const searchPage = 100
+
+// What is synced, and persisted to file
+type snapshot struct {
+	Synced      int64                   `json:"synced"` // Millis
+	Instruments []swagger.Instrument    `json:"instruments"`
+	Markets     []swagger.Market        `json:"markets"`
+	TickSizes   []swagger.TicksizeTable `json:"tick_sizes"`
+	Sectors     []swagger.Sector        `json:"sectors"`
+	Lists       []swagger.List          `json:"lists"`
+	ListMembers map[int64][]int64       `json:"list_members"` // List id to instrument ids
+}
+
+type Status struct {
+	Synced      int64  `json:"synced"` // Millis of the last successful sync. 0 if never
+	Fresh       bool   `json:"fresh"`
+	Instruments int    `json:"instruments"`
+	Tradables   int    `json:"tradables"`
+	Markets     int    `json:"markets"`
+	TickSizes   int    `json:"tick_sizes"`
+	Sectors     int    `json:"sectors"`
+	Lists       int    `json:"lists"`
+	Error       string `json:"error,omitempty"` // Of the last sync
+}
+
+type Store struct {
+	api.RequestCommandTransport
+
+	sync.Mutex
+	remote  api.TransportHandler
+	cli     *api.ApiClient
+	data    *snapshot
+	idx     *index
+	lists   []int64  // Lists to sync. All if empty
+	queries []string // Searches to sync, besides the lists
+	maxAge  int64
+	file    string
+	lastErr error
+	clock   func() int64
+	quit    chan bool
+}
+
+// The remote transport is used to sync, and for the commands while the data is stale.
+// It should not be a router that has the store itself, or the commands will loop.
+func NewStore(remote api.TransportHandler) *Store {
+	s := &Store{
+		RequestCommandTransport: make(api.RequestCommandTransport),
+		remote:                  remote,
+		cli:                     api.NewApiClient(remote),
+		data:                    &snapshot{ListMembers: make(map[int64][]int64)},
+		idx:                     newIndex(),
+		maxAge:                  int64(DefaultMaxAge / time.Millisecond),
+		clock:                   func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+	}
+	s.init()
+	return s
+}
+
+func (s *Store) SetClock(clock func() int64) *Store {
+	s.Lock()
+	defer s.Unlock()
+	s.clock = clock
+	return s
+}
+
+func (s *Store) SetMaxAge(maxAge time.Duration) *Store {
+	s.Lock()
+	defer s.Unlock()
+	s.maxAge = int64(maxAge / time.Millisecond)
+	return s
+}
+
+// Only sync the instruments of these lists. Default is all lists.
+func (s *Store) SetLists(ids ...int64) *Store {
+	s.Lock()
+	defer s.Unlock()
+	s.lists = ids
+	return s
+}
+
+// Also sync the instruments found by these searches
+func (s *Store) AddQueries(queries ...string) *Store {
+	s.Lock()
+	defer s.Unlock()
+	s.queries = append(s.queries, queries...)
+	return s
+}
+
+// Persist the store to file after each sync. If the file exists, it is loaded, and is fresh if young enough.
+func (s *Store) SetFile(file string) error {
+	s.Lock()
+	s.file = file
+	s.Unlock()
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snap := &snapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	s.replace(snap)
+	return nil
+}
+
+func (s *Store) save() error {
+	s.Lock()
+	file, snap := s.file, s.data
+	s.Unlock()
+	if file == "" {
+		return nil
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return nnutils.WriteFileAtomic(file, data, 0600)
+}
+
+func (s *Store) replace(snap *snapshot) {
+	idx := newIndex()
+	for _, instr := range snap.Instruments {
+		idx.add(instr)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.data, s.idx = snap, idx
+}
+
+// Sync every interval, until Stop. The first sync is done at once, unless the data is fresh.
+func (s *Store) Start(interval time.Duration) *Store {
+	s.Lock()
+	defer s.Unlock()
+	if s.quit == nil {
+		s.quit = make(chan bool)
+		go func(quit chan bool, wait time.Duration) {
+			for {
+				select {
+				case <-quit:
+					return
+				case <-time.After(wait):
+					if err := s.Sync(); err != nil {
+						logger.Warn("Sync failed", "err", err)
+					}
+					wait = interval
+				}
+			}
+		}(s.quit, s.firstWait(interval))
+	}
+	return s
+}
+
+func (s *Store) firstWait(interval time.Duration) time.Duration {
+	if s.data.Synced > 0 && s.clock()-s.data.Synced < s.maxAge {
+		return interval
+	}
+	return 0
+}
+
+func (s *Store) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	if s.quit != nil {
+		close(s.quit)
+		s.quit = nil
+	}
+}
+
+// Fetch everything from the remote transport. The old data is kept if anything fails.
+func (s *Store) Sync() (err error) {
+	defer func() {
+		s.Lock()
+		s.lastErr = err
+		s.Unlock()
+	}()
+	s.Lock()
+	lists, queries := s.lists, s.queries
+	s.Unlock()
+
+	snap := &snapshot{ListMembers: make(map[int64][]int64)}
+	if snap.Markets, err = s.cli.Market(); err != nil {
+		return fmt.Errorf("Markets: %v", err)
+	}
+	if snap.TickSizes, err = s.cli.TickSizes(); err != nil {
+		return fmt.Errorf("TickSizes: %v", err)
+	}
+	if snap.Sectors, err = s.cli.InstrumentSectors(""); err != nil {
+		return fmt.Errorf("InstrumentSectors: %v", err)
+	}
+	if snap.Lists, err = s.cli.Lists(); err != nil {
+		return fmt.Errorf("Lists: %v", err)
+	}
+
+	instruments := make(map[int64]swagger.Instrument)
+	for _, l := range snap.Lists {
+		if len(lists) > 0 && !containsId(lists, l.ListId) {
+			continue
+		}
+		members, err := s.cli.List(l.ListId)
+		if err != nil {
+			return fmt.Errorf("List %d: %v", l.ListId, err)
+		}
+		for _, instr := range members {
+			instruments[instr.InstrumentId] = instr
+			snap.ListMembers[l.ListId] = append(snap.ListMembers[l.ListId], instr.InstrumentId)
+		}
+	}
+	for _, q := range queries {
+		found, errc := s.cli.InstrumentSearchStream(q, "", false)
+		for instr := range found {
+			instruments[instr.InstrumentId] = instr
+		}
+		if err = <-errc; err != nil {
+			return fmt.Errorf("InstrumentSearch %s: %v", q, err)
+		}
+	}
+	for _, instr := range instruments {
+		snap.Instruments = append(snap.Instruments, instr)
+	}
+	sort.Sort(byId(snap.Instruments))
+
+	s.Lock()
+	snap.Synced = s.clock()
+	s.Unlock()
+	s.replace(snap)
+	logger.Info("Synced", "instruments", len(snap.Instruments), "markets", len(snap.Markets), "lists", len(snap.Lists))
+	if err := s.save(); err != nil {
+		logger.Error("Unable to save", "err", err)
+	}
+	return nil
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) Fresh() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.fresh()
+}
+
+func (s *Store) fresh() bool {
+	return s.data.Synced > 0 && s.clock()-s.data.Synced < s.maxAge
+}
+
+func (s *Store) Status() Status {
+	s.Lock()
+	defer s.Unlock()
+	st := Status{
+		Synced:      s.data.Synced,
+		Fresh:       s.fresh(),
+		Instruments: len(s.idx.instruments),
+		Tradables:   len(s.idx.tradables),
+		Markets:     len(s.data.Markets),
+		TickSizes:   len(s.data.TickSizes),
+		Sectors:     len(s.data.Sectors),
+		Lists:       len(s.data.Lists),
+	}
+	if s.lastErr != nil {
+		st.Error = s.lastErr.Error()
+	}
+	return st
+}
+
+func (s *Store) instruments(ids []int64) []swagger.Instrument {
+	res := make([]swagger.Instrument, 0, len(ids))
+	for _, id := range ids {
+		if instr, ok := s.idx.instruments[id]; ok {
+			res = append(res, instr)
+		}
+	}
+	return res
+}
+
+// Exact lookup by instrument id, ISIN, symbol or market_id:identifier
+func (s *Store) Lookup(query string) []swagger.Instrument {
+	s.Lock()
+	defer s.Unlock()
+	return s.instruments(s.idx.lookup(query))
+}
+
+// True if the synced data has all answers to a search for query. That is, if query starts with one of the queries,
+// or finds a list member by id, ISIN, symbol or market_id:identifier. Other searches may have answers outside the lists.
+func (s *Store) covers(query string) bool {
+	q := strings.ToLower(strings.TrimSpace(query))
+	s.Lock()
+	defer s.Unlock()
+	for _, synced := range s.queries {
+		if synced = strings.ToLower(strings.TrimSpace(synced)); synced != "" && strings.HasPrefix(q, synced) {
+			return true
+		}
+	}
+	found := s.idx.lookup(query)
+	for _, id := range found {
+		member := false
+		for _, members := range s.data.ListMembers {
+			if member = containsId(members, id); member {
+				break
+			}
+		}
+		if !member {
+			return false
+		}
+	}
+	return len(found) > 0
+}
+
+// Exact matches, then prefixes of symbol and name, and with fuzzy also names that are close.
+// Types filters on instrument_group_type, comma separated. Limit 0 for all.
+func (s *Store) Search(query, types string, fuzzy bool, limit, offset int) []swagger.Instrument {
+	s.Lock()
+	defer s.Unlock()
+	ids := s.idx.search(query, types, fuzzy)
+	if offset >= len(ids) {
+		return []swagger.Instrument{}
+	}
+	ids = ids[offset:]
+	if limit > 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+	return s.instruments(ids)
+}
+
+// The tradable on a market, with its instrument
+func (s *Store) Tradable(market int64, identifier string) (instr swagger.Instrument, trad swagger.Tradable, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	var id int64
+	if id, ok = s.idx.tradables[tradableKey(market, identifier)]; ok {
+		instr = s.idx.instruments[id]
+		for _, t := range instr.Tradables {
+			if t.MarketId == market && t.Identifier == identifier {
+				trad = t
+			}
+		}
+	}
+	return
+}
+
+func (s *Store) TickSize(id int64) (table swagger.TicksizeTable, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, t := range s.data.TickSizes {
+		if t.TickSizeId == id {
+			return t, true
+		}
+	}
+	return
+}
+
+// Add instruments from answers of the remote transport, so they can be found while waiting for a sync
+func (s *Store) learn(payload json.RawMessage) {
+	var found []swagger.Instrument
+	if json.Unmarshal(payload, &found) != nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, instr := range found {
+		s.idx.add(instr)
+	}
+}
+
+func (s *Store) forward(cmd api.RequestCommand, params api.Params) (json.RawMessage, error) {
+	res := s.remote.Preform(&api.Request{Command: cmd, Args: params})
+	if res.IsError() {
+		return nil, res.Error
+	}
+	return res.Payload, nil
+}
+
+// Handler that is local while the data is fresh, and forwarded when it is not
+func (s *Store) override(cmd api.RequestCommand, learn bool, local func(api.Params) (interface{}, bool, error)) func(api.Params) (json.RawMessage, error) {
+	return func(params api.Params) (json.RawMessage, error) {
+		if s.Fresh() {
+			res, found, err := local(params)
+			if err != nil {
+				return nil, err
+			} else if found {
+				return json.Marshal(res)
+			}
+		}
+		payload, err := s.forward(cmd, params)
+		if err == nil && learn {
+			s.learn(payload)
+		}
+		return payload, err
+	}
+}
+
+func parseIds(str string) (ids []int64, err error) {
+	for _, p := range strings.Split(str, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad id '%s'", p)
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+func parseInt(params api.Params, key string) (int, error) {
+	if params[key] == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(params[key])
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s '%s'", key, params[key])
+	}
+	return v, nil
+}
+
+type byId []swagger.Instrument
+
+func (a byId) Len() int           { return len(a) }
+func (a byId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byId) Less(i, j int) bool { return a[i].InstrumentId < a[j].InstrumentId }
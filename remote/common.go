@@ -3,7 +3,9 @@ package remote
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/trace"
 
 	"math/rand"
 	"sync"
@@ -12,6 +14,14 @@ import (
 	"bytes"
 )
 
+var logger = nnlog.For("remote")
+
+var (
+	pendingReplies  = metrics.Default.Gauge("yanngo_pending_replies", "Requests waiting for a reply").With()
+	requests        = metrics.Default.Counter("yanngo_remote_requests_total", "Requests over pubsub, per result", "result")
+	requestDuration = metrics.Default.Histogram("yanngo_remote_request_duration_seconds", "Latency of requests over pubsub", nil).With()
+)
+
 var rnd *rand.Rand
 
 func init() {
@@ -49,6 +59,12 @@ type ReplyableMessage struct {
 	MsgId   int64
 	ReplyTo string
 	Payload []byte
+	TraceId string `json:",omitempty"` // The trace of the request, if any
+	SpanId  string `json:",omitempty"`
+}
+
+func (rm *ReplyableMessage) TraceContext() trace.SpanContext {
+	return trace.SpanContext{TraceId: rm.TraceId, SpanId: rm.SpanId}
 }
 
 func (rm *ReplyableMessage) Encode() ([]byte, error) {
@@ -62,10 +78,11 @@ type MessageReply struct {
 	NumSeq  int64
 	Payload []byte
 	Error   string
+	TraceId string `json:",omitempty"` // The trace of the request
+	SpanId  string `json:",omitempty"` // The span of the server that replied
 }
 
 func MakeReplies(msgId int64, payload []byte) (ret []MessageReply) {
-	fmt.Printf("Make reply for %d: %d\n", msgId, len(payload))
 	maxSize := int64(500000)
 	payloads := [][]byte{}
 	l := int64(len(payload))
@@ -76,7 +93,7 @@ func MakeReplies(msgId int64, payload []byte) (ret []MessageReply) {
 		}
 		payloads = append(payloads, payload[i:end])
 	}
-	fmt.Printf("Split to %d messages\n", len(payloads))
+	logger.Debug("Make replies", "msg_id", msgId, "bytes", len(payload), "parts", len(payloads))
 
 	l = int64(len(payloads))
 	for idx, pl := range payloads {
@@ -105,7 +122,8 @@ func (mr *MessageReply) Info() string {
 }
 
 // If we use this SubHandler function, then we will handle ReplyableMessage's, and can do basic RPC. We assume json encoding...
-type SubReplyHandlerHelperFn func(topic string, msg []byte) ([]byte, error)
+// sc is the span of the server, to use as parent for the work done.
+type SubReplyHandlerHelperFn func(topic string, msg []byte, sc trace.SpanContext) ([]byte, error)
 
 // A func to handle msg reply. Will only bee needed for pubsub's where it is not included.
 func MakeSubReplyHandler(ps PubSub, fn SubReplyHandlerHelperFn) SubHandler {
@@ -117,24 +135,28 @@ func MakeSubReplyHandler(ps PubSub, fn SubReplyHandlerHelperFn) SubHandler {
 		//		err = json.Unmarshal(data, &msg)
 
 		if err == nil {
+			span := trace.Start("remote.server", msg.TraceContext(), trace.KindServer).SetAttr("topic", topic)
 			var replies []MessageReply
-			b, err := fn(topic, msg.Payload)
+			b, err := fn(topic, msg.Payload, span.Context())
 			if err != nil {
+				span.SetError(err)
 				replies = append(replies, MessageReply{MsgId: msg.MsgId, Error: err.Error()})
 			} else {
 				replies = MakeReplies(msg.MsgId, b)
 			}
+			span.Finish() // Before the reply, so the span is recorded when the client gets it
 
 			for _, reply := range replies {
-				fmt.Printf("Sending %v\n", reply.Info())
+				reply.TraceId, reply.SpanId = span.TraceId, span.SpanId
+				logger.Debug("Sending reply", "msg_id", reply.MsgId, "trace_id", reply.TraceId, "seq", reply.Seq, "num_seq", reply.NumSeq, "bytes", len(reply.Payload))
 				repb, err := reply.Encode()
 				if err != nil {
 					// TODO: Investigate if we get this
-					log.Printf("Unable to encode reply: %+v", reply)
+					logger.Error("Unable to encode reply", "msg_id", reply.MsgId, "trace_id", reply.TraceId, "err", err)
 				} else {
 					err := ps.Pub(msg.ReplyTo, repb)
 					if err != nil {
-						log.Printf("Unable to reply on message %+v with %+v", msg, reply)
+						logger.Error("Unable to reply", "msg_id", msg.MsgId, "trace_id", reply.TraceId, "reply_to", msg.ReplyTo, "seq", reply.Seq, "err", err)
 					}
 				}
 			}
@@ -143,14 +165,14 @@ func MakeSubReplyHandler(ps PubSub, fn SubReplyHandlerHelperFn) SubHandler {
 	})
 }
 
-// Bare function for request reply. Will be mapped 1 to 1 with a topic/endpoints.
-type RequestReplyChannel func([]byte) ([]byte, error)
+// Bare function for request reply. Will be mapped 1 to 1 with a topic/endpoints. sc is the trace of the request, if any.
+type RequestReplyChannel func(data []byte, sc trace.SpanContext) ([]byte, error)
 
 // A wrapper to make a RequestReplyChannel. It the rpc/eventbus has native request reply, then that implementation will have its own RequestReplyChannel creator.
 func MakeRequestReplyChannel(rps ReplyablePubSub, topic string) RequestReplyChannel {
 
-	return func(data []byte) ([]byte, error) {
-		res, err := rps.Request(topic, data)
+	return func(data []byte, sc trace.SpanContext) ([]byte, error) {
+		res, err := rps.RequestTrace(topic, data, sc)
 		//		log.Printf("MakeRequestReplyChannel:: %+v, %+v", res.String(), err)
 		if err != nil {
 			return []byte{}, err
@@ -168,15 +190,17 @@ type ReplySegmentChannel struct {
 func (rsc *ReplySegmentChannel) SendIfComplete(msg *MessageReply) (ok bool) {
 	if msg == nil || msg.NumSeq == 1 {
 		ok = true
-		fmt.Printf("Sending 'complete' for msg %+v\n", msg.Info())
+		if msg != nil {
+			logger.Debug("Reply complete", "msg_id", msg.MsgId, "bytes", len(msg.Payload), "error", msg.Error)
+		}
 	} else {
 		rsc.Parts = append(rsc.Parts, *msg)
 		if newMsg := rsc.assembleParts(); newMsg != nil {
 			msg = newMsg
 			ok = true
-			fmt.Printf("All %d parts assembled. Sending complete on %+v\n", len(rsc.Parts), msg.Info())
+			logger.Debug("All parts assembled", "msg_id", msg.MsgId, "parts", len(rsc.Parts), "bytes", len(msg.Payload))
 		} else {
-			fmt.Printf("All parts not yet assembled... Current cache size: %d\n", len(rsc.Parts))
+			logger.Debug("All parts not yet assembled", "msg_id", msg.MsgId, "parts", len(rsc.Parts), "num_seq", msg.NumSeq)
 		}
 	}
 	if ok {
@@ -199,13 +223,13 @@ func (rsc *ReplySegmentChannel) assembleParts() (msg *MessageReply) {
 			for _, p := range rsc.Parts {
 				if p.Seq == seg {
 					data = append(data, p.Payload...)
-					fmt.Printf("Appending data %d for seq %d. Total size %d\n", len(p.Payload), seg, len(data))
 					segCount++
 				}
 			}
 		}
 		if segCount == parts {
-			msg = &MessageReply{MsgId: rsc.Parts[0].MsgId, Seq: 1, NumSeq: 1, Payload: data}
+			first := rsc.Parts[0]
+			msg = &MessageReply{MsgId: first.MsgId, Seq: 1, NumSeq: 1, Payload: data, TraceId: first.TraceId, SpanId: first.SpanId}
 		}
 	}
 	return
@@ -214,6 +238,8 @@ func (rsc *ReplySegmentChannel) assembleParts() (msg *MessageReply) {
 type ReplyablePubSub interface {
 	PubSub
 	Request(string, []byte) (*MessageReply, error)
+	// Like Request, but the message is sent as part of the trace sc
+	RequestTrace(topic string, data []byte, sc trace.SpanContext) (*MessageReply, error)
 }
 
 // Will implement PubSub, and add functions for ReplyableMessage
@@ -259,7 +285,7 @@ func (rps *replyablePubSub) Handle(topic string, data []byte) (err error) {
 	err = dec.Decode(&reply)
 	//	err = json.Unmarshal(data, &reply)
 	if err != nil {
-		log.Printf("[%s] Unable to handle message %+v: %+v", topic, data, err)
+		logger.Warn("Unable to handle reply", "topic", topic, "data", string(data), "err", err)
 	} else {
 		rps.remove(reply.MsgId, &reply)
 	}
@@ -271,28 +297,30 @@ func (rps *replyablePubSub) remove(mid int64, msg *MessageReply) {
 	defer rps.RWMutex.Unlock()
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("WARN: %+v", err)
+			logger.Warn("Recovered while removing reply listener", "msg_id", mid, "err", err)
 		}
 	}()
 
 	if rsc, ok := rps.replies[mid]; ok {
 		if sent := rsc.SendIfComplete(msg); sent {
 			delete(rps.replies, mid)
+			pendingReplies.Dec()
 		}
 	} else {
-		log.Printf("Not found any listeners for message %+v\n", mid)
+		logger.Warn("No listener for reply", "msg_id", mid)
 	}
 }
 
-func (rps *replyablePubSub) sendReplyableMessage(topic string, data []byte) (msgId int64, ch <-chan *MessageReply, err error) {
+func (rps *replyablePubSub) sendReplyableMessage(topic string, data []byte, sc trace.SpanContext) (msgId int64, ch <-chan *MessageReply, err error) {
 	msgId = rnd.Int63()
 	ch0 := make(chan *MessageReply, 5)
 	ch = ch0
-	msg := &ReplyableMessage{MsgId: msgId, Payload: data}
+	msg := &ReplyableMessage{MsgId: msgId, Payload: data, TraceId: sc.TraceId, SpanId: sc.SpanId}
 	rps.RWMutex.Lock()         // Expencive, but for now, lets lock
 	defer rps.RWMutex.Unlock() // We could unlock sooner, but better safe then sorry
 
 	rps.replies[msg.MsgId] = &ReplySegmentChannel{Channel: ch0}
+	pendingReplies.Inc()
 	msg.ReplyTo = rps.replyTopic
 	b, err2 := msg.Encode()
 	if err2 != nil {
@@ -306,21 +334,42 @@ func (rps *replyablePubSub) sendReplyableMessage(topic string, data []byte) (msg
 	return
 }
 
-// NATS have built in request, but NSQ doesnt, so lets make a simple wrapper
+// NATS have built in request, see remote/natsconn, but NSQ doesnt, so lets make a simple wrapper
 func (rps *replyablePubSub) Request(topic string, data []byte) (res *MessageReply, err error) {
-	msgId, ch, err2 := rps.sendReplyableMessage(topic, data)
+	return rps.RequestTrace(topic, data, trace.SpanContext{})
+}
+
+func (rps *replyablePubSub) RequestTrace(topic string, data []byte, sc trace.SpanContext) (res *MessageReply, err error) {
+	start := time.Now()
+	span := trace.Start("remote.request", sc, trace.KindClient).SetAttr("topic", topic)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	msgId, ch, err2 := rps.sendReplyableMessage(topic, data, span.Context())
 	if err2 != nil {
+		requests.With("error").Inc()
 		return nil, err2
 	}
+	span.SetAttr("msg_id", fmt.Sprint(msgId))
 
 	select {
 	case res = <-ch:
 		if res == nil {
+			requests.With("error").Inc()
 			err = fmt.Errorf("Not no response to request: %d", msgId)
+		} else {
+			requests.With("ok").Inc()
+			if res.Error != "" {
+				span.SetAttr("reply_error", res.Error)
+			}
 		}
 	case <-time.After(time.Millisecond * 30000):
+		requests.With("timeout").Inc()
+		logger.Warn("Request timed out", "topic", topic, "msg_id", msgId, "trace_id", span.TraceId)
 		err = fmt.Errorf("Timeout: No reply in 30 sec")
 		rps.remove(msgId, nil)
 	}
+	requestDuration.ObserveDuration(time.Since(start))
 	return
 }
@@ -0,0 +1,396 @@
+package remote
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/metrics"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rejectedEnvelopes = metrics.Default.Counter("yanngo_envelope_rejected_total", "Messages dropped by a SecurePubSub, per reason", "reason")
+
+// Signs, and verifies, envelopes
+type Signer interface {
+	Sign(data []byte) ([]byte, error)
+	Verify(data, sig []byte) bool
+}
+
+type hmacSigner []byte
+
+// HMAC-SHA256 with a shared key
+func NewHMACSigner(key []byte) Signer {
+	return hmacSigner(key)
+}
+
+func (hs hmacSigner) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, hs)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (hs hmacSigner) Verify(data, sig []byte) bool {
+	expected, _ := hs.Sign(data)
+	return hmac.Equal(expected, sig)
+}
+
+type ed25519Signer struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// Ed25519. The private key can be nil, for keys that are only used to verify others.
+func NewEd25519Signer(private ed25519.PrivateKey, public ed25519.PublicKey) Signer {
+	if public == nil && private != nil {
+		public = private.Public().(ed25519.PublicKey)
+	}
+	return &ed25519Signer{private, public}
+}
+
+func (es *ed25519Signer) Sign(data []byte) ([]byte, error) {
+	if es.private == nil {
+		return nil, fmt.Errorf("No private key to sign with")
+	}
+	return ed25519.Sign(es.private, data), nil
+}
+
+func (es *ed25519Signer) Verify(data, sig []byte) bool {
+	return len(es.public) == ed25519.PublicKeySize && ed25519.Verify(es.public, data, sig)
+}
+
+// A named key. Signer is required, Cipher is an AES key of 16, 24 or 32 bytes, or nil.
+type EnvelopeKey struct {
+	Id     string
+	Signer Signer
+	Cipher []byte
+}
+
+func (ek *EnvelopeKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(ek.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// What is sent on the wire instead of the payload
+type Envelope struct {
+	KeyId    string `json:"kid"`            // The key that signed it
+	EncKeyId string `json:"ekid,omitempty"` // The key that encrypted the payload. Empty if not encrypted
+	Nonce    []byte `json:"nonce"`          // Unique per message. Also the AES-GCM nonce
+	Time     int64  `json:"ts"`             // Unix nanos, when sent
+	Payload  []byte `json:"payload"`
+	Sig      []byte `json:"sig"`
+}
+
+// The header is also bound to the topic, so a message can not be replayed on another topic
+func (e *Envelope) header(topic string) []byte {
+	return []byte(strings.Join([]string{"yanngo-envelope-v1", topic, e.KeyId, e.EncKeyId, hex.EncodeToString(e.Nonce), strconv.FormatInt(e.Time, 10)}, "\n"))
+}
+
+func (e *Envelope) signed(topic string) []byte {
+	return append(append(e.header(topic), '\n'), e.Payload...)
+}
+
+// Default of SecurePubSub.MaxAge
+var DefaultEnvelopeMaxAge = time.Minute
+
+// Wraps a PubSub, so all payloads are signed, and optionally encrypted. Messages that are not signed by a trusted key,
+// are older than MaxAge, or seen before, are dropped. Use it under NewReplyablePubSub and FeedClient like any PubSub.
+type SecurePubSub struct {
+	ps    PubSub
+	local *EnvelopeKey
+
+	sync.RWMutex
+	keys   map[string]*EnvelopeKey
+	topics map[string]string // Topic prefix to the key id to encrypt with
+	maxAge time.Duration
+}
+
+// Messages are signed with local, and encrypted with its Cipher if it has one. It is also trusted.
+func NewSecurePubSub(ps PubSub, local *EnvelopeKey) *SecurePubSub {
+	sps := &SecurePubSub{ps: ps, local: local, keys: make(map[string]*EnvelopeKey), topics: make(map[string]string), maxAge: DefaultEnvelopeMaxAge}
+	return sps.Trust(local)
+}
+
+// Accept messages signed with key, and decrypt with it
+func (sps *SecurePubSub) Trust(key *EnvelopeKey) *SecurePubSub {
+	sps.Lock()
+	defer sps.Unlock()
+	sps.keys[key.Id] = key
+	return sps
+}
+
+// Encrypt messages on topics starting with prefix with the Cipher of a trusted key, like a client inbox with the key of
+// that client. The longest prefix wins.
+func (sps *SecurePubSub) EncryptFor(prefix, keyId string) *SecurePubSub {
+	sps.Lock()
+	defer sps.Unlock()
+	sps.topics[prefix] = keyId
+	return sps
+}
+
+// How old, or how far in the future, a message may be. Nonces are remembered this long.
+func (sps *SecurePubSub) MaxAge(d time.Duration) *SecurePubSub {
+	sps.Lock()
+	defer sps.Unlock()
+	sps.maxAge = d
+	return sps
+}
+
+func (sps *SecurePubSub) key(id string) *EnvelopeKey {
+	sps.RLock()
+	defer sps.RUnlock()
+	return sps.keys[id]
+}
+
+func (sps *SecurePubSub) encKeyFor(topic string) (*EnvelopeKey, error) {
+	sps.RLock()
+	defer sps.RUnlock()
+	prefixes := make([]string, 0, len(sps.topics))
+	for p := range sps.topics {
+		if strings.HasPrefix(topic, p) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if len(prefixes) > 0 {
+		sort.Strings(prefixes)
+		id := sps.topics[prefixes[len(prefixes)-1]]
+		if k, ok := sps.keys[id]; ok && k.Cipher != nil {
+			return k, nil
+		}
+		return nil, fmt.Errorf("No cipher for key '%s' of topic %s", id, topic)
+	}
+	if sps.local.Cipher != nil {
+		return sps.local, nil
+	}
+	return nil, nil
+}
+
+// Seal the payload for topic
+func (sps *SecurePubSub) Seal(topic string, data []byte) ([]byte, error) {
+	env := &Envelope{KeyId: sps.local.Id, Nonce: make([]byte, 12), Time: time.Now().UnixNano(), Payload: data}
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return nil, err
+	}
+	encKey, err := sps.encKeyFor(topic)
+	if err != nil {
+		return nil, err
+	}
+	if encKey != nil {
+		env.EncKeyId = encKey.Id
+		aead, err := encKey.aead()
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = aead.Seal(nil, env.Nonce, data, env.header(topic))
+	}
+	if env.Sig, err = sps.local.Signer.Sign(env.signed(topic)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// Verify and open a sealed message. Replays are not checked here, but in the subscriptions.
+func (sps *SecurePubSub) Open(topic string, data []byte) (payload []byte, err error) {
+	_, payload, _, err = sps.open(topic, data)
+	return
+}
+
+// The reason is set if it is rejected
+func (sps *SecurePubSub) open(topic string, data []byte) (env *Envelope, payload []byte, reason string, err error) {
+	env = &Envelope{}
+	if err = json.Unmarshal(data, env); err != nil {
+		return nil, nil, "malformed", err
+	} else if len(env.Nonce) != 12 {
+		return nil, nil, "malformed", fmt.Errorf("Nonce of %d bytes", len(env.Nonce))
+	}
+	key := sps.key(env.KeyId)
+	if key == nil {
+		return nil, nil, "unknown_key", fmt.Errorf("Unknown key '%s'", env.KeyId)
+	}
+	if !key.Signer.Verify(env.signed(topic), env.Sig) {
+		return nil, nil, "bad_signature", fmt.Errorf("Bad signature of key '%s'", env.KeyId)
+	}
+	sps.RLock()
+	maxAge := sps.maxAge
+	sps.RUnlock()
+	if age := time.Since(time.Unix(0, env.Time)); age > maxAge || age < -maxAge {
+		return nil, nil, "stale", fmt.Errorf("Message from '%s' is %s old", env.KeyId, age)
+	}
+	if env.EncKeyId == "" {
+		return env, env.Payload, "", nil
+	}
+	encKey := sps.key(env.EncKeyId)
+	if encKey == nil || encKey.Cipher == nil {
+		return nil, nil, "unknown_key", fmt.Errorf("Unknown cipher key '%s'", env.EncKeyId)
+	}
+	aead, err := encKey.aead()
+	if err == nil {
+		payload, err = aead.Open(nil, env.Nonce, env.Payload, env.header(topic))
+	}
+	if err != nil {
+		return nil, nil, "decrypt", err
+	}
+	return env, payload, "", nil
+}
+
+func (sps *SecurePubSub) Pub(topic string, data []byte) error {
+	sealed, err := sps.Seal(topic, data)
+	if err != nil {
+		return err
+	}
+	return sps.ps.Pub(topic, sealed)
+}
+
+// Remembers the nonces of one subscription, for as long as the messages are fresh
+type nonceCache struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// False if the nonce is already seen
+func (nc *nonceCache) add(nonce []byte, maxAge time.Duration) bool {
+	nc.Lock()
+	defer nc.Unlock()
+	now := time.Now()
+	if now.Sub(nc.lastSweep) > maxAge {
+		for n, t := range nc.seen {
+			if now.Sub(t) > 2*maxAge {
+				delete(nc.seen, n)
+			}
+		}
+		nc.lastSweep = now
+	}
+	if _, ok := nc.seen[string(nonce)]; ok {
+		return false
+	}
+	nc.seen[string(nonce)] = now
+	return true
+}
+
+// Rejected messages are logged and dropped, and not returned as errors, so they are not requeued
+func (sps *SecurePubSub) Sub(topic string, handler SubHandler) error {
+	nonces := &nonceCache{seen: make(map[string]time.Time), lastSweep: time.Now()}
+	return sps.ps.Sub(topic, SubHandlerFn(func(topic string, data []byte) error {
+		env, payload, reason, err := sps.open(topic, data)
+		if err == nil {
+			sps.RLock()
+			maxAge := sps.maxAge
+			sps.RUnlock()
+			if !nonces.add(env.Nonce, maxAge) {
+				reason, err = "replay", fmt.Errorf("Replayed message")
+			}
+		}
+		if err != nil {
+			rejectedEnvelopes.With(reason).Inc()
+			logger.Warn("Dropped message", "topic", topic, "reason", reason, "err", err)
+			return nil
+		}
+		return handler.Handle(topic, payload)
+	}))
+}
+
+func (sps *SecurePubSub) Close() error {
+	return sps.ps.Close()
+}
+
+// A key in an EnvelopeConfig. Binary values are base64, as encoding/json does it.
+type EnvelopeKeyConfig struct {
+	Id             string `json:"id"`
+	HMAC           []byte `json:"hmac,omitempty"`
+	Ed25519Private []byte `json:"ed25519_private,omitempty"` // Seed of 32 bytes, or the full 64 bytes
+	Ed25519Public  []byte `json:"ed25519_public,omitempty"`
+	AES            []byte `json:"aes,omitempty"`
+}
+
+func (kc *EnvelopeKeyConfig) Key() (*EnvelopeKey, error) {
+	key := &EnvelopeKey{Id: kc.Id, Cipher: kc.AES}
+	if kc.AES != nil {
+		if _, err := aes.NewCipher(kc.AES); err != nil {
+			return nil, fmt.Errorf("Key '%s': %v", kc.Id, err)
+		}
+	}
+	switch {
+	case kc.HMAC != nil:
+		key.Signer = NewHMACSigner(kc.HMAC)
+	case kc.Ed25519Private != nil:
+		private := ed25519.PrivateKey(kc.Ed25519Private)
+		if len(kc.Ed25519Private) == ed25519.SeedSize {
+			private = ed25519.NewKeyFromSeed(kc.Ed25519Private)
+		} else if len(kc.Ed25519Private) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("Key '%s': Ed25519 private key of %d bytes", kc.Id, len(kc.Ed25519Private))
+		}
+		key.Signer = NewEd25519Signer(private, nil)
+	case kc.Ed25519Public != nil:
+		if len(kc.Ed25519Public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Key '%s': Ed25519 public key of %d bytes", kc.Id, len(kc.Ed25519Public))
+		}
+		key.Signer = NewEd25519Signer(nil, ed25519.PublicKey(kc.Ed25519Public))
+	default:
+		return nil, fmt.Errorf("Key '%s' has no hmac or ed25519 key", kc.Id)
+	}
+	return key, nil
+}
+
+// Keys of a SecurePubSub, as stored in a json file
+type EnvelopeConfig struct {
+	Local     EnvelopeKeyConfig   `json:"local"`
+	Trusted   []EnvelopeKeyConfig `json:"trusted,omitempty"`
+	EncryptTo map[string]string   `json:"encrypt_to,omitempty"` // Topic prefix to key id, see EncryptFor
+	MaxAge    string              `json:"max_age,omitempty"`    // Like 1m. Default DefaultEnvelopeMaxAge
+}
+
+func LoadEnvelopeConfig(path string) (*EnvelopeConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf EnvelopeConfig
+	if err = json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", path, err)
+	}
+	return &conf, nil
+}
+
+// A SecurePubSub on ps, with the keys of the config
+func (ec *EnvelopeConfig) Wrap(ps PubSub) (*SecurePubSub, error) {
+	local, err := ec.Local.Key()
+	if err != nil {
+		return nil, err
+	}
+	sps := NewSecurePubSub(ps, local)
+	for idx := range ec.Trusted {
+		key, err := ec.Trusted[idx].Key()
+		if err != nil {
+			return nil, err
+		}
+		sps.Trust(key)
+	}
+	for prefix, id := range ec.EncryptTo {
+		if sps.key(id) == nil {
+			return nil, fmt.Errorf("Topic %s is encrypted to unknown key '%s'", prefix, id)
+		}
+		sps.EncryptFor(prefix, id)
+	}
+	if ec.MaxAge != "" {
+		d, err := time.ParseDuration(ec.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		sps.MaxAge(d)
+	}
+	return sps, nil
+}
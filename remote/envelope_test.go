@@ -0,0 +1,200 @@
+package remote_test
+
+import (
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/remote/tinypubsub"
+	"github.com/Forau/yanngo/trace"
+
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records what is sent on the wire, and delivers it right away
+type wire struct {
+	sync.Mutex
+	sent [][]byte
+	subs map[string][]remote.SubHandler
+}
+
+func newWire() *wire {
+	return &wire{subs: make(map[string][]remote.SubHandler)}
+}
+
+func (w *wire) Pub(topic string, data []byte) error {
+	w.Lock()
+	w.sent = append(w.sent, data)
+	handlers := w.subs[topic]
+	w.Unlock()
+	for _, h := range handlers {
+		h.Handle(topic, data)
+	}
+	return nil
+}
+
+func (w *wire) Sub(topic string, handler remote.SubHandler) error {
+	w.Lock()
+	defer w.Unlock()
+	w.subs[topic] = append(w.subs[topic], handler)
+	return nil
+}
+
+func (w *wire) Close() error {
+	return nil
+}
+
+func (w *wire) last() []byte {
+	w.Lock()
+	defer w.Unlock()
+	return w.sent[len(w.sent)-1]
+}
+
+// Records the bytes on the way to another pubsub
+type tap struct {
+	remote.PubSub
+	sync.Mutex
+	sent [][]byte
+}
+
+func (t *tap) Pub(topic string, data []byte) error {
+	t.Lock()
+	t.sent = append(t.sent, data)
+	t.Unlock()
+	return t.PubSub.Pub(topic, data)
+}
+
+func TestSecureRequestReply(t *testing.T) {
+	daemonPub, daemonPriv, _ := ed25519.GenerateKey(nil)
+	alicePub, alicePriv, _ := ed25519.GenerateKey(nil)
+	aliceAES := bytes.Repeat([]byte{7}, 32)
+
+	bus := &tap{PubSub: tinypubsub.NewTinyPubSub()}
+	daemon := remote.NewSecurePubSub(bus, &remote.EnvelopeKey{Id: "daemon", Signer: remote.NewEd25519Signer(daemonPriv, nil)}).
+		Trust(&remote.EnvelopeKey{Id: "alice", Signer: remote.NewEd25519Signer(nil, alicePub), Cipher: aliceAES}).
+		EncryptFor("INBOX.alice", "alice")
+	alice := remote.NewSecurePubSub(bus, &remote.EnvelopeKey{Id: "alice", Signer: remote.NewEd25519Signer(alicePriv, nil), Cipher: aliceAES}).
+		Trust(&remote.EnvelopeKey{Id: "daemon", Signer: remote.NewEd25519Signer(nil, daemonPub)})
+
+	daemon.Sub("api", remote.MakeSubReplyHandler(daemon, func(topic string, msg []byte, sc trace.SpanContext) ([]byte, error) {
+		return []byte(`{"session_key":"s3cr3t-` + string(msg) + `"}`), nil
+	}))
+	rps, err := remote.NewReplyablePubSubWithInbox(alice, "INBOX.alice.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := rps.Request("api", []byte("order-instruction"))
+	if err != nil || string(reply.Payload) != `{"session_key":"s3cr3t-order-instruction"}` {
+		t.Fatalf("Unexpected reply %+v: %+v", reply, err)
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+	if len(bus.sent) != 2 {
+		t.Fatalf("Expected a request and a reply on the wire, got %d", len(bus.sent))
+	}
+	for _, raw := range bus.sent {
+		if bytes.Contains(raw, []byte("s3cr3t")) || bytes.Contains(raw, []byte("order-instruction")) {
+			t.Errorf("Expected the payloads to be encrypted: %s", raw)
+		}
+		var env remote.Envelope
+		if err := json.Unmarshal(raw, &env); err != nil || env.EncKeyId != "alice" || len(env.Sig) != ed25519.SignatureSize {
+			t.Errorf("Unexpected envelope %+v: %+v", env, err)
+		}
+	}
+}
+
+func TestSecureRejects(t *testing.T) {
+	w := newWire()
+	shared := []byte("shared hmac key")
+	sender := remote.NewSecurePubSub(w, &remote.EnvelopeKey{Id: "a", Signer: remote.NewHMACSigner(shared)})
+	receiver := remote.NewSecurePubSub(w, &remote.EnvelopeKey{Id: "b", Signer: remote.NewHMACSigner([]byte("b key"))}).
+		Trust(&remote.EnvelopeKey{Id: "a", Signer: remote.NewHMACSigner(shared)})
+	forger := remote.NewSecurePubSub(w, &remote.EnvelopeKey{Id: "a", Signer: remote.NewHMACSigner([]byte("guessed"))})
+
+	var got []string
+	receiver.Sub("orders", remote.SubHandlerFn(func(topic string, data []byte) error {
+		got = append(got, string(data))
+		return nil
+	}))
+	receiver.Sub("other", remote.SubHandlerFn(func(topic string, data []byte) error {
+		got = append(got, "other:"+string(data))
+		return nil
+	}))
+
+	sender.Pub("orders", []byte("buy 1"))
+	w.Pub("orders", w.last()) // Replay
+	w.Pub("other", w.last())  // On another topic
+
+	forger.Pub("orders", []byte("buy 1000"))
+	w.Pub("orders", []byte("buy 1000")) // Not in an envelope
+
+	var env remote.Envelope
+	sealed, _ := sender.Seal("orders", []byte("buy 2"))
+	json.Unmarshal(sealed, &env)
+	env.Payload = []byte("buy 2000")
+	tampered, _ := json.Marshal(env)
+	w.Pub("orders", tampered)
+
+	receiver.MaxAge(10 * time.Millisecond)
+	old, _ := sender.Seal("orders", []byte("buy 3"))
+	time.Sleep(20 * time.Millisecond)
+	w.Pub("orders", old)
+	receiver.MaxAge(time.Minute)
+
+	sender.Pub("orders", []byte("buy 4"))
+	if strings.Join(got, ",") != "buy 1,buy 4" {
+		t.Errorf("Expected only the valid messages, got %v", got)
+	}
+	if _, err := receiver.Open("orders", sealed); err != nil {
+		t.Errorf("Expected the untampered message to open: %+v", err)
+	}
+}
+
+func TestSecureFeedAndConfig(t *testing.T) {
+	dir := t.TempDir()
+	conf := `{"local":{"id":"daemon","hmac":"c2hhcmVk","aes":"` + strings.Repeat("A", 43) + `="},` +
+		`"trusted":[{"id":"ro","hmac":"b3RoZXI="}],"max_age":"30s"}`
+	ioutil.WriteFile(filepath.Join(dir, "envelope.json"), []byte(conf), 0600)
+	ec, err := remote.LoadEnvelopeConfig(filepath.Join(dir, "envelope.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWire()
+	daemon, err := ec.Wrap(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ec.Wrap(w) // Same keys, like a client that shares them
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prices []string
+	feed.FeedClient(func(msg *feedmodel.FeedMsg) {
+		prices = append(prices, msg.Type)
+	}).Bind(client, "nordnet.feed")
+	remote.MakeStreamTopicChannel(daemon, "nordnet.feed")([]byte(`{"type":"price","data":{"i":"101","m":11}}`))
+	if len(prices) != 1 || prices[0] != "price" {
+		t.Errorf("Expected the price on the feed client: %v", prices)
+	}
+	if bytes.Contains(w.last(), []byte("price")) {
+		t.Errorf("Expected the feed to be encrypted: %s", w.last())
+	}
+
+	for _, bad := range []string{`{"local":{"id":"x"}}`, `{"local":{"id":"x","hmac":"AA==","aes":"AA=="}}`,
+		`{"local":{"id":"x","hmac":"AA=="},"encrypt_to":{"INBOX":"nobody"}}`, `{"local":{"id":"x","ed25519_private":"AA=="}}`} {
+		var ec remote.EnvelopeConfig
+		json.Unmarshal([]byte(bad), &ec)
+		if _, err := ec.Wrap(w); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
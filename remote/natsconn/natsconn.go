@@ -0,0 +1,248 @@
+package natsconn
+
+import (
+	nats "github.com/nats-io/nats.go"
+
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/trace"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var logger = nnlog.For("remote/natsconn")
+
+// How long a request waits for all parts of its reply
+var DefaultRequestTimeout = 30 * time.Second
+
+type NatsConnBuilder struct {
+	urls    []string
+	opts    []nats.Option
+	queue   string
+	timeout time.Duration
+	errors  []error
+}
+
+func NewNatsBuilder() *NatsConnBuilder {
+	return &NatsConnBuilder{timeout: DefaultRequestTimeout, opts: []nats.Option{nats.Name("yanngo")}}
+}
+
+// Servers to connect to, like nats://127.0.0.1:4222. More than one is used for failover.
+func (ncb *NatsConnBuilder) AddUrls(urls ...string) *NatsConnBuilder {
+	ncb.urls = append(ncb.urls, urls...)
+	return ncb
+}
+
+// Any option of nats.Connect, like nats.UserInfo or nats.RootCAs
+func (ncb *NatsConnBuilder) Option(opt nats.Option) *NatsConnBuilder {
+	ncb.opts = append(ncb.opts, opt)
+	return ncb
+}
+
+// Subscribe in a queue group, so connections with the same queue share the messages, like an nsq channel.
+// Empty, the default, gives every connection all messages.
+func (ncb *NatsConnBuilder) Queue(q string) *NatsConnBuilder {
+	ncb.queue = q
+	return ncb
+}
+
+func (ncb *NatsConnBuilder) Timeout(d time.Duration) *NatsConnBuilder {
+	if d <= 0 {
+		ncb.errors = append(ncb.errors, fmt.Errorf("Timeout must be positive, was %v", d))
+	}
+	ncb.timeout = d
+	return ncb
+}
+
+func (ncb *NatsConnBuilder) Build() (*NatsConn, error) {
+	if len(ncb.errors) > 0 {
+		return nil, fmt.Errorf("Errors during building natsConn: %+v", ncb.errors)
+	}
+	if len(ncb.urls) == 0 {
+		return nil, fmt.Errorf("Need to add nats urls so we can connect")
+	}
+	opts := append([]nats.Option{
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			if err != nil { // nil when we close
+				logger.Warn("Disconnected", "err", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			logger.Info("Reconnected", "url", c.ConnectedUrl())
+		}),
+	}, ncb.opts...)
+	conn, err := nats.Connect(strings.Join(ncb.urls, ","), opts...)
+	if err != nil {
+		return nil, err
+	}
+	nc := NewNatsConn(conn)
+	nc.queue, nc.timeout = ncb.queue, ncb.timeout
+	return nc, nil
+}
+
+// Implements remote.PubSub and remote.ReplyablePubSub on a NATS connection. Requests use the reply subject
+// of NATS, so no shared inbox is needed, and the servers can be any remote.MakeSubReplyHandler.
+// Requests and replies are plain. Under a remote.SecurePubSub, use NewSecureNatsConn for requests.
+type NatsConn struct {
+	conn    *nats.Conn
+	queue   string
+	timeout time.Duration
+}
+
+// Use a connection that is already made. It is closed by Close.
+func NewNatsConn(conn *nats.Conn) *NatsConn {
+	return &NatsConn{conn: conn, timeout: DefaultRequestTimeout}
+}
+
+func (nc *NatsConn) Conn() *nats.Conn {
+	return nc.conn
+}
+
+func (nc *NatsConn) Pub(topic string, data []byte) error {
+	return nc.conn.Publish(topic, data)
+}
+
+func (nc *NatsConn) Sub(topic string, handler remote.SubHandler) error {
+	cb := func(m *nats.Msg) {
+		if err := handler.Handle(m.Subject, m.Data); err != nil {
+			logger.Warn("Handler failed", "topic", m.Subject, "err", err)
+		}
+	}
+	var err error
+	if nc.queue != "" {
+		_, err = nc.conn.QueueSubscribe(topic, nc.queue, cb)
+	} else {
+		_, err = nc.conn.Subscribe(topic, cb)
+	}
+	if err != nil {
+		return err
+	}
+	// So a Pub right after Sub, from another connection, is not lost
+	return nc.conn.Flush()
+}
+
+// Drains the subscriptions, so messages being handled get their replies out, then closes
+func (nc *NatsConn) Close() error {
+	if nc.conn.IsClosed() {
+		return nil
+	}
+	return nc.conn.Drain()
+}
+
+func (nc *NatsConn) Request(topic string, data []byte) (*remote.MessageReply, error) {
+	return nc.RequestTrace(topic, data, trace.SpanContext{})
+}
+
+// Sends a remote.ReplyableMessage with an inbox of its own as reply subject. The server sends its reply to
+// the inbox, in as many parts as it needs, and the parts are put together here.
+func (nc *NatsConn) RequestTrace(topic string, data []byte, sc trace.SpanContext) (res *remote.MessageReply, err error) {
+	return nc.request(topic, data, sc, nil)
+}
+
+// Seals the request, and opens the replies, with sps if it is not nil
+func (nc *NatsConn) request(topic string, data []byte, sc trace.SpanContext, sps *remote.SecurePubSub) (res *remote.MessageReply, err error) {
+	span := trace.Start("remote.request", sc, trace.KindClient).SetAttr("topic", topic).SetAttr("transport", "nats")
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	inbox := nc.conn.NewInbox()
+	sub, err := nc.conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	sctx := span.Context()
+	msg := &remote.ReplyableMessage{MsgId: rand.Int63(), ReplyTo: inbox, Payload: data, TraceId: sctx.TraceId, SpanId: sctx.SpanId}
+	b, err := msg.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if sps != nil {
+		if b, err = sps.Seal(topic, b); err != nil {
+			return nil, err
+		}
+	}
+	if err = nc.conn.PublishRequest(topic, inbox, b); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *remote.MessageReply, 1)
+	rsc := &remote.ReplySegmentChannel{Channel: ch}
+	deadline := time.Now().Add(nc.timeout)
+	for {
+		m, err := sub.NextMsg(time.Until(deadline))
+		if err == nats.ErrTimeout {
+			logger.Warn("Request timed out", "topic", topic, "msg_id", msg.MsgId, "trace_id", span.TraceId, "parts", len(rsc.Parts))
+			return nil, fmt.Errorf("Timeout: No reply in %v", nc.timeout)
+		} else if err != nil {
+			return nil, err
+		}
+		payload := m.Data
+		if sps != nil {
+			if payload, err = sps.Open(inbox, m.Data); err != nil {
+				logger.Warn("Dropped reply", "topic", topic, "err", err)
+				continue
+			}
+		}
+		var reply remote.MessageReply
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+		if err = dec.Decode(&reply); err != nil {
+			logger.Warn("Unable to handle reply", "topic", topic, "data", string(payload), "err", err)
+			continue
+		}
+		if reply.MsgId != msg.MsgId {
+			logger.Warn("Reply to another request", "msg_id", reply.MsgId, "expected", msg.MsgId)
+			continue
+		}
+		if reply.Error != "" {
+			span.SetAttr("reply_error", reply.Error)
+			return &reply, nil
+		} else if reply.NumSeq <= 1 {
+			return &reply, nil
+		} else if rsc.SendIfComplete(&reply) {
+			return <-ch, nil
+		}
+	}
+}
+
+// A remote.ReplyablePubSub with envelopes. Pub and Sub go through the SecurePubSub, and requests use the reply subject
+// of NATS, sealed and opened with the keys of the SecurePubSub. Its servers must use the same SecurePubSub keys.
+type SecureNatsConn struct {
+	*remote.SecurePubSub
+	nc *NatsConn
+}
+
+// The SecurePubSub should be on nc
+func NewSecureNatsConn(nc *NatsConn, sps *remote.SecurePubSub) *SecureNatsConn {
+	return &SecureNatsConn{SecurePubSub: sps, nc: nc}
+}
+
+func (snc *SecureNatsConn) Request(topic string, data []byte) (*remote.MessageReply, error) {
+	return snc.RequestTrace(topic, data, trace.SpanContext{})
+}
+
+func (snc *SecureNatsConn) RequestTrace(topic string, data []byte, sc trace.SpanContext) (*remote.MessageReply, error) {
+	return snc.nc.request(topic, data, sc, snc.SecurePubSub)
+}
+
+// Like remote.MakeRequestReplyChannel, that also fails on the error of the reply. For NatsConn and SecureNatsConn.
+func MakeRequestReplyChannel(rps remote.ReplyablePubSub, topic string) remote.RequestReplyChannel {
+	return func(data []byte, sc trace.SpanContext) ([]byte, error) {
+		res, err := rps.RequestTrace(topic, data, sc)
+		if err != nil {
+			return []byte{}, err
+		} else if res.Error != "" {
+			return []byte{}, fmt.Errorf("%s", res.Error)
+		}
+		return res.Payload, nil
+	}
+}
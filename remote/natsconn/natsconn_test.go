@@ -0,0 +1,217 @@
+package natsconn_test
+
+import (
+	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/remote/natsconn"
+	"github.com/Forau/yanngo/trace"
+	"github.com/nats-io/nats-server/v2/server"
+
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests run an embedded NATS server, from github.com/nats-io/nats-server/v2 (v2.10 or later).
+// Starts one in the test, on a random port
+func runServer(t *testing.T) *server.Server {
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func connect(t *testing.T, srv *server.Server, b *natsconn.NatsConnBuilder) *natsconn.NatsConn {
+	nc, err := b.AddUrls(srv.ClientURL()).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return nc
+}
+
+type received struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (r *received) Handle(topic string, data []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = append(r.msgs, topic+":"+string(data))
+	return nil
+}
+
+func (r *received) wait(t *testing.T, n int) []string {
+	for i := 0; i < 200; i++ {
+		r.Lock()
+		if len(r.msgs) >= n {
+			defer r.Unlock()
+			return r.msgs
+		}
+		r.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d messages, got %v", n, r.msgs)
+	return nil
+}
+
+func TestPubSub(t *testing.T) {
+	srv := runServer(t)
+	pub := connect(t, srv, natsconn.NewNatsBuilder())
+
+	// Every plain subscriber gets the feed, and a queue shares it
+	var feed1, feed2, queued1, queued2 received
+	connect(t, srv, natsconn.NewNatsBuilder()).Sub("nordnet.feed", &feed1)
+	connect(t, srv, natsconn.NewNatsBuilder()).Sub("nordnet.feed", &feed2)
+	connect(t, srv, natsconn.NewNatsBuilder().Queue("daemons")).Sub("nordnet.feed", &queued1)
+	connect(t, srv, natsconn.NewNatsBuilder().Queue("daemons")).Sub("nordnet.feed", &queued2)
+
+	stream := remote.MakeStreamTopicChannel(pub, "nordnet.feed")
+	for i := 0; i < 10; i++ {
+		if err := stream([]byte(fmt.Sprintf(`{"i":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs := feed1.wait(t, 10); msgs[0] != `nordnet.feed:{"i":0}` || msgs[9] != `nordnet.feed:{"i":9}` {
+		t.Errorf("Unexpected messages: %v", msgs)
+	}
+	feed2.wait(t, 10)
+	time.Sleep(50 * time.Millisecond)
+	queued1.Lock()
+	queued2.Lock()
+	if len(queued1.msgs)+len(queued2.msgs) != 10 {
+		t.Errorf("Expected the queue to share 10 messages, got %d and %d", len(queued1.msgs), len(queued2.msgs))
+	}
+	queued1.Unlock()
+	queued2.Unlock()
+
+	if _, err := natsconn.NewNatsBuilder().Build(); err == nil {
+		t.Error("Expected an error without urls")
+	}
+	if _, err := natsconn.NewNatsBuilder().AddUrls(srv.ClientURL()).Timeout(0).Build(); err == nil {
+		t.Error("Expected an error without a timeout")
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	srv := runServer(t)
+	daemon := connect(t, srv, natsconn.NewNatsBuilder().Queue("nsqnnd"))
+	client := connect(t, srv, natsconn.NewNatsBuilder().Timeout(200*time.Millisecond))
+
+	big := bytes.Repeat([]byte("0123456789"), 120000) // Sent in three parts
+	var lock sync.Mutex
+	var seen []trace.SpanContext
+	err := daemon.Sub("nordnet.api", remote.MakeSubReplyHandler(daemon, func(topic string, msg []byte, sc trace.SpanContext) ([]byte, error) {
+		lock.Lock()
+		seen = append(seen, sc)
+		lock.Unlock()
+		switch string(msg) {
+		case "big":
+			return big, nil
+		case "fail":
+			return nil, fmt.Errorf("No such command")
+		}
+		return append([]byte("re:"), msg...), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rps remote.ReplyablePubSub = client
+	reply, err := rps.Request("nordnet.api", []byte("accounts"))
+	if err != nil || string(reply.Payload) != "re:accounts" || reply.NumSeq != 1 {
+		t.Fatalf("Unexpected reply %s: %+v", reply.Info(), err)
+	}
+
+	sc := trace.Start("test", trace.SpanContext{}, trace.KindInternal).Context()
+	reply, err = client.RequestTrace("nordnet.api", []byte("big"), sc)
+	if err != nil || !bytes.Equal(reply.Payload, big) {
+		t.Fatalf("Expected the big reply assembled: %s, %+v", reply.Info(), err)
+	}
+	lock.Lock()
+	if reply.TraceId != sc.TraceId || seen[1].TraceId != sc.TraceId {
+		t.Errorf("Expected the trace %s on both sides: %s, %+v", sc.TraceId, reply.TraceId, seen[1])
+	}
+	lock.Unlock()
+
+	rrchan := natsconn.MakeRequestReplyChannel(client, "nordnet.api")
+	if b, err := rrchan([]byte("positions"), trace.SpanContext{}); err != nil || string(b) != "re:positions" {
+		t.Errorf("Unexpected reply from channel %s: %+v", b, err)
+	}
+	if _, err := rrchan([]byte("fail"), trace.SpanContext{}); err == nil || err.Error() != "No such command" {
+		t.Errorf("Expected the error of the handler: %+v", err)
+	}
+	if b, err := remote.MakeRequestReplyChannel(client, "nordnet.api")([]byte("orders"), trace.SpanContext{}); err != nil || string(b) != "re:orders" {
+		t.Errorf("Unexpected reply from remote channel %s: %+v", b, err)
+	}
+
+	// Concurrent requests on one connection each get their own reply
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := fmt.Sprintf("q%d", i)
+			if b, err := rrchan([]byte(q), trace.SpanContext{}); err != nil || string(b) != "re:"+q {
+				t.Errorf("Unexpected concurrent reply %s: %+v", b, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	start := time.Now()
+	if _, err := client.Request("nobody.listens", []byte("hello")); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected a timeout: %+v after %v", err, time.Since(start))
+	}
+
+	// The same handler works with the emulated inbox on top of NATS, as with NSQ
+	emulated, err := remote.NewReplyablePubSubWithInbox(connect(t, srv, natsconn.NewNatsBuilder()), "INBOX.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err = emulated.Request("nordnet.api", []byte("markets")); err != nil || string(reply.Payload) != "re:markets" {
+		t.Errorf("Unexpected emulated reply %s: %+v", reply.Info(), err)
+	}
+}
+
+func TestSecureRequestReply(t *testing.T) {
+	srv := runServer(t)
+	shared := &remote.EnvelopeKey{Id: "shared", Signer: remote.NewHMACSigner([]byte("secret")), Cipher: bytes.Repeat([]byte("k"), 32)}
+	secure := func(b *natsconn.NatsConnBuilder) *natsconn.SecureNatsConn {
+		nc := connect(t, srv, b)
+		return natsconn.NewSecureNatsConn(nc, remote.NewSecurePubSub(nc, shared).EncryptFor("", "shared"))
+	}
+	daemon := secure(natsconn.NewNatsBuilder().Queue("nsqnnd"))
+	client := secure(natsconn.NewNatsBuilder().Timeout(200 * time.Millisecond))
+	err := daemon.Sub("nordnet.api", remote.MakeSubReplyHandler(daemon, func(topic string, msg []byte, sc trace.SpanContext) ([]byte, error) {
+		return append([]byte("re:"), msg...), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wire received
+	connect(t, srv, natsconn.NewNatsBuilder()).Sub(">", &wire)
+	if b, err := natsconn.MakeRequestReplyChannel(client, "nordnet.api")([]byte("accounts"), trace.SpanContext{}); err != nil || string(b) != "re:accounts" {
+		t.Fatalf("Unexpected secure reply %s: %+v", b, err)
+	}
+	for _, m := range wire.wait(t, 2) {
+		if bytes.Contains([]byte(m), []byte("accounts")) {
+			t.Errorf("Expected the request and reply sealed on the wire: %s", m)
+		}
+	}
+
+	// A plain client gets no answer, since the daemon drops what is not sealed
+	plain := connect(t, srv, natsconn.NewNatsBuilder().Timeout(200*time.Millisecond))
+	if _, err := plain.Request("nordnet.api", []byte("accounts")); err == nil {
+		t.Error("Expected a plain request to time out")
+	}
+}
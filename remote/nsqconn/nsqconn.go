@@ -3,14 +3,35 @@ package nsqconn
 import (
 	nsq "github.com/nsqio/go-nsq"
 
+	"github.com/Forau/yanngo/nnlog"
 	"github.com/Forau/yanngo/remote"
 
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"strings"
 	"time"
 )
 
+var logger = nnlog.For("remote/nsqconn")
+
+// Sends the log lines of go-nsq to our logger. Lines start with the level, like 'INF    1 (127.0.0.1:4150) connecting'
+type nsqLogger struct{}
+
+func (nsqLogger) Output(calldepth int, s string) error {
+	level := slog.LevelInfo
+	switch {
+	case strings.HasPrefix(s, "DBG"):
+		level = slog.LevelDebug
+	case strings.HasPrefix(s, "WRN"):
+		level = slog.LevelWarn
+	case strings.HasPrefix(s, "ERR"):
+		level = slog.LevelError
+	}
+	nnlog.Log(logger, level, "nsq", "text", s)
+	return nil
+}
+
 var rnd *rand.Rand
 
 func init() {
@@ -71,6 +92,7 @@ func (ncb *NsqConnBuilder) Build() (remote.PubSub, error) {
 		if err != nil {
 			return nil, err
 		} else {
+			p.SetLogger(nsqLogger{}, nsq.LogLevelInfo)
 			prod = append(prod, p)
 		}
 	}
@@ -96,7 +118,7 @@ func (nc *NsqConn) Pub(topic string, data []byte) error {
 				return // All well
 			}
 		}
-		log.Printf("Trying to send data to '%s', but all %d produces failed", topic, len(nc.producers))
+		logger.Error("All producers failed", "topic", topic, "producers", len(nc.producers))
 	}(rnd.Perm(len(nc.producers)))
 	return nil // No errors for now....
 }
@@ -106,6 +128,7 @@ func (nc *NsqConn) Sub(topic string, handler remote.SubHandler) error {
 	if err != nil {
 		return err
 	}
+	consumer.SetLogger(nsqLogger{}, nsq.LogLevelInfo)
 	consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
 		return handler.Handle(topic, m.Body)
 	}))
@@ -0,0 +1,355 @@
+package strategy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/backtest"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/nnutils"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/transports/paper"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("strategy")
+
+// Runs one strategy. Create it with NewRunner, NewPaperRunner or NewBacktestRunner.
+type Runner struct {
+	sync.Mutex
+	strategy Strategy
+	api      *api.ApiClient
+	accno    int64
+	clock    func() int64
+	started  bool
+	now      int64
+	phase    string
+	nextPh   int64 // When the phase changes next
+	timers   map[string]*timer
+	feedHook feed.FeedClient // The paper broker gets market data before the strategy
+	stop     chan bool
+
+	queueLock sync.Mutex
+	queue     []func()
+	draining  bool
+
+	state     map[string]interface{}
+	stateFile string
+
+	bt *backtest.Backtest
+}
+
+// Live trading with the transport, like a router with the nordnet transport, or a remote transport client
+func NewRunner(strategy Strategy, th api.TransportHandler) *Runner {
+	return &Runner{
+		strategy: strategy,
+		api:      api.NewApiClient(th),
+		clock:    func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+		timers:   make(map[string]*timer),
+		state:    make(map[string]interface{}),
+	}
+}
+
+// Paper trading. Orders and account commands go to the broker, everything else to the real transport.
+// Market data reaching the runner is also given to the broker.
+func NewPaperRunner(strategy Strategy, real api.TransportHandler, broker *paper.PaperBroker) *Runner {
+	r := NewRunner(strategy, paper.NewPaperTransport(broker, real)).SetAccno(broker.Accno())
+	r.feedHook = broker.OnMessage
+	broker.SetPublisher(r.OnMessage)
+	return r
+}
+
+// Backtesting. Set latency, slippage and commission on Backtest(), and run with RunBacktest.
+func NewBacktestRunner(strategy Strategy, cash float64) *Runner {
+	r := NewRunner(strategy, nil)
+	r.bt = backtest.NewBacktest(backtestAdapter{r}, cash)
+	r.api = api.NewApiClient(paper.NewPaperTransport(r.bt.Broker(), nil))
+	r.accno = backtest.Accno
+	r.clock = r.bt.Now
+	return r
+}
+
+// The account to trade on, for the strategy. Set from the broker when paper trading or backtesting.
+func (r *Runner) SetAccno(accno int64) *Runner {
+	r.accno = accno
+	return r
+}
+
+func (r *Runner) SetClock(clock func() int64) *Runner {
+	r.clock = clock
+	return r
+}
+
+// Persist the state between runs. Loaded before Init, and saved after Shutdown.
+func (r *Runner) SetStateFile(file string) *Runner {
+	r.stateFile = file
+	return r
+}
+
+func (r *Runner) Api() *api.ApiClient {
+	return r.api
+}
+
+func (r *Runner) Accno() int64 {
+	return r.accno
+}
+
+// Current time in millis. In a backtest, the time of the replayed message.
+func (r *Runner) Now() int64 {
+	r.Lock()
+	defer r.Unlock()
+	if r.now > 0 {
+		return r.now
+	}
+	return r.clock()
+}
+
+// Current market phase. Empty before the runner is started.
+func (r *Runner) Phase() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.phase
+}
+
+// State owned by the strategy. Only use it from the hooks. Must encode to json, if persisted.
+func (r *Runner) State() map[string]interface{} {
+	return r.state
+}
+
+// Nil unless created with NewBacktestRunner
+func (r *Runner) Backtest() *backtest.Backtest {
+	return r.bt
+}
+
+// Receive the feed from a topic, like the one nsqnnd publishes on
+func (r *Runner) Bind(ps remote.PubSub, feedTopic string) error {
+	return feed.FeedClient(r.OnMessage).Bind(ps, feedTopic)
+}
+
+// Receive the feed from a FeedState in the same process
+func (r *Runner) BindFeedState(fs *feed.FeedState) *Runner {
+	fs.AddListener(r.OnMessage)
+	return r
+}
+
+// Implements feed.FeedClient. Messages are ignored until the runner is started.
+func (r *Runner) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	isOrder := msg.Type == "order" || msg.Type == "privtrade"
+	if !isOrder && r.feedHook != nil {
+		r.feedHook(msg)
+	}
+	r.post(func() {
+		if !r.isStarted() {
+			return
+		}
+		r.advance(r.clock())
+		if isOrder {
+			r.strategy.OnOrder(r, msg)
+		} else {
+			r.strategy.OnFeed(r, msg)
+		}
+	})
+}
+
+// Run fn serialized with all other hooks. If another call is running, fn is queued and we return at once.
+// That way hooks can place orders, that call back with events, without deadlocks.
+func (r *Runner) post(fn func()) {
+	r.queueLock.Lock()
+	r.queue = append(r.queue, fn)
+	if r.draining {
+		r.queueLock.Unlock()
+		return
+	}
+	r.draining = true
+	for len(r.queue) > 0 {
+		next := r.queue[0]
+		r.queue = r.queue[1:]
+		r.queueLock.Unlock()
+		next()
+		r.queueLock.Lock()
+	}
+	r.draining = false
+	r.queueLock.Unlock()
+}
+
+func (r *Runner) isStarted() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.started
+}
+
+// Move the clock to millis. Phase changes and timers up to then are fired in time order.
+func (r *Runner) advance(millis int64) {
+	r.Lock()
+	if millis <= r.now {
+		r.Unlock()
+		return
+	}
+	first := r.now == 0
+	if first {
+		r.now = millis
+		r.phase, r.nextPh = phaseAt(millis)
+	}
+	phase := r.phase
+	r.Unlock()
+	if first {
+		r.strategy.OnMarketPhase(r, phase, omxtime.NewOmxTimeMillis(millis))
+	}
+
+	for {
+		r.Lock()
+		nextPh := r.nextPh
+		r.Unlock()
+		if t := r.dueTimer(millis); t != nil && t.next < nextPh {
+			r.setNow(t.next)
+			r.reschedule(t)
+			r.strategy.OnTimer(r, t.name)
+			continue
+		}
+		if nextPh > millis {
+			break
+		}
+		// The phase changes before timers at the same time
+		r.Lock()
+		r.now = nextPh
+		r.phase, r.nextPh = phaseAt(nextPh)
+		phase = r.phase
+		r.Unlock()
+		r.strategy.OnMarketPhase(r, phase, omxtime.NewOmxTimeMillis(nextPh))
+	}
+	r.setNow(millis)
+}
+
+func (r *Runner) setNow(millis int64) {
+	r.Lock()
+	r.now = millis
+	r.Unlock()
+}
+
+func (r *Runner) init() error {
+	if err := r.loadState(); err != nil {
+		return err
+	}
+	if err := r.strategy.Init(r); err != nil {
+		return err
+	}
+	r.Lock()
+	r.started = true
+	r.Unlock()
+	return nil
+}
+
+// Init the strategy, and start driving timers every tick. Not used for backtests.
+func (r *Runner) Start(tick time.Duration) error {
+	if r.bt != nil {
+		return fmt.Errorf("Use RunBacktest for backtests")
+	}
+	if err := r.init(); err != nil {
+		return err
+	}
+	r.stop = make(chan bool)
+	go func(stop chan bool) {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.post(func() { r.advance(r.clock()) })
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop)
+	r.post(func() { r.advance(r.clock()) })
+	return nil
+}
+
+// Stop the timers, and shutdown the strategy. Waits for the shutdown, so do not call it from a hook.
+func (r *Runner) Stop() error {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	done := make(chan error, 1)
+	r.post(func() { done <- r.shutdown() })
+	return <-done
+}
+
+func (r *Runner) shutdown() error {
+	if !r.isStarted() {
+		return nil
+	}
+	r.strategy.Shutdown(r)
+	r.Lock()
+	r.started = false
+	r.Unlock()
+	return r.SaveState()
+}
+
+// Init the strategy, replay the recorded feed, and shutdown.
+func (r *Runner) RunBacktest(in io.Reader) (*backtest.Report, error) {
+	if r.bt == nil {
+		return nil, fmt.Errorf("Not a backtest runner")
+	}
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+	report, err := r.bt.Run(in)
+	if serr := r.shutdown(); err == nil {
+		err = serr
+	}
+	return report, err
+}
+
+// The backtest calls us from one go routine, and queues the order events itself
+type backtestAdapter struct {
+	r *Runner
+}
+
+func (ba backtestAdapter) OnFeed(bt *backtest.Backtest, msg *feedmodel.FeedMsg) {
+	ba.r.OnMessage(msg)
+}
+
+func (ba backtestAdapter) OnOrderEvent(bt *backtest.Backtest, msg *feedmodel.FeedMsg) {
+	ba.r.OnMessage(msg)
+}
+
+// ---------- State
+
+func (r *Runner) loadState() error {
+	if r.stateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &r.state)
+}
+
+// Save the state now, from a hook. It is also saved after Shutdown.
+func (r *Runner) SaveState() error {
+	if r.stateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = nnutils.WriteFileAtomic(r.stateFile, data, 0600); err != nil {
+		logger.Error("Unable to save state", "file", r.stateFile, "err", err)
+	}
+	return err
+}
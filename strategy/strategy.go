@@ -0,0 +1,46 @@
+// Package strategy is the skeleton of a trading bot. Implement Strategy, and let a Runner wire it to a transport
+// and the feed, keep its state and drive its timers. The same strategy runs live, paper traded or in a backtest.
+package strategy
+
+import (
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+)
+
+// Market phases, from the opening hours in omxtime
+const (
+	PhaseOpen   = "OPEN"
+	PhaseClosed = "CLOSED"
+)
+
+// All hooks are called from one go routine at a time, so a strategy needs no locking of its own.
+// Calls to the runner, like placing orders or adding timers, are fine from within the hooks.
+type Strategy interface {
+	Init(r *Runner) error                                        // Before any other hook. An error stops the runner
+	OnFeed(r *Runner, msg *feedmodel.FeedMsg)                    // Market data
+	OnOrder(r *Runner, msg *feedmodel.FeedMsg)                   // 'order' and 'privtrade' messages
+	OnTimer(r *Runner, name string)                              // A timer added with the runner is due
+	OnMarketPhase(r *Runner, phase string, day *omxtime.OmxTime) // First phase when started, then on each change
+	Shutdown(r *Runner)                                          // Last hook. State is saved after
+}
+
+// Embed to only implement the hooks you need
+type BaseStrategy struct{}
+
+func (BaseStrategy) Init(r *Runner) error                                        { return nil }
+func (BaseStrategy) OnFeed(r *Runner, msg *feedmodel.FeedMsg)                    {}
+func (BaseStrategy) OnOrder(r *Runner, msg *feedmodel.FeedMsg)                   {}
+func (BaseStrategy) OnTimer(r *Runner, name string)                              {}
+func (BaseStrategy) OnMarketPhase(r *Runner, phase string, day *omxtime.OmxTime) {}
+func (BaseStrategy) Shutdown(r *Runner)                                          {}
+
+// The phase at millis, and when it changes next
+func phaseAt(millis int64) (phase string, next int64) {
+	ot := omxtime.NewOmxTimeMillis(millis)
+	if ot.IsTrading(millis) {
+		return PhaseOpen, ot.OmxClose
+	} else if ot.OmxOpen > millis {
+		return PhaseClosed, ot.OmxOpen
+	}
+	return PhaseClosed, ot.NextTradingDay().OmxOpen
+}
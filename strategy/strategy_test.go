@@ -0,0 +1,158 @@
+package strategy_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/strategy"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Buys once the market is open, and logs all hooks
+type logStrategy struct {
+	strategy.BaseStrategy
+	open   int64
+	log    []string
+	bought bool
+}
+
+func (ls *logStrategy) add(r *strategy.Runner, format string, args ...interface{}) {
+	ls.log = append(ls.log, fmt.Sprintf("%d ", (r.Now()-ls.open)/1000)+fmt.Sprintf(format, args...))
+}
+
+func (ls *logStrategy) Init(r *strategy.Runner) error {
+	r.Every("minute", omxtime.MinuteX1).AtMarketOpen("open", 0)
+	runs, _ := r.State()["runs"].(float64)
+	r.State()["runs"] = runs + 1
+	return nil
+}
+
+func (ls *logStrategy) OnFeed(r *strategy.Runner, msg *feedmodel.FeedMsg) {
+	var price feedmodel.FeedPriceData
+	if msg.DecodeData(&price) != nil {
+		return
+	}
+	ls.add(r, "feed %v", price.Ask)
+	if r.Phase() == strategy.PhaseOpen && !ls.bought {
+		ls.bought = true
+		_, err := r.Api().CreateOrder(&api.AccountOrder{Accno: r.Accno(), Identifier: price.Identifier,
+			MarketId: price.Market, Price: price.Ask, Volume: 10, Side: "BUY"})
+		if err != nil {
+			ls.add(r, "error %v", err)
+		}
+	}
+}
+
+func (ls *logStrategy) OnOrder(r *strategy.Runner, msg *feedmodel.FeedMsg) {
+	ls.add(r, msg.Type)
+}
+
+func (ls *logStrategy) OnTimer(r *strategy.Runner, name string) {
+	ls.add(r, "timer %s", name)
+	if name == "minute" && r.Now() >= ls.open+2*omxtime.MinuteX1 {
+		r.CancelTimer("minute")
+	}
+}
+
+func (ls *logStrategy) OnMarketPhase(r *strategy.Runner, phase string, day *omxtime.OmxTime) {
+	ls.add(r, "phase %s %s", phase, day.Date)
+}
+
+func (ls *logStrategy) Shutdown(r *strategy.Runner) {
+	ls.add(r, "shutdown")
+}
+
+func priceLine(millis int64, ask float64) string {
+	return fmt.Sprintf(`{"type":"price","data":{"i":"101","m":11,"tick_timestamp":%d,"bid":%v,"ask":%v}}`, millis, ask-1, ask)
+}
+
+func TestBacktestRunner(t *testing.T) {
+	day, _ := omxtime.NewOmxTimeDate("2026-10-19")
+	open := day.OmxOpen
+	recorded := strings.Join([]string{
+		priceLine(open-90*1000, 100),
+		priceLine(open+30*1000, 101),
+		priceLine(open+5*omxtime.MinuteX1, 102),
+		priceLine(day.NextTradingDay().OmxOpen+1000, 103),
+	}, "\n")
+
+	dir, _ := ioutil.TempDir("", "strategy")
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	ls := &logStrategy{open: open}
+	r := strategy.NewBacktestRunner(ls, 10000).SetStateFile(stateFile)
+	report, err := r.RunBacktest(strings.NewReader(recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"-90 phase CLOSED 2026-10-19",
+		"-90 feed 100",
+		"-60 timer minute",
+		"0 phase OPEN 2026-10-19",
+		"0 timer minute",
+		"0 timer open",
+		"30 feed 101",
+		"30 order",
+		"30 privtrade",
+		"30 order",
+		"60 timer minute",
+		"120 timer minute",
+		"300 feed 102",
+		"30600 phase CLOSED 2026-10-19",
+		"86400 phase OPEN 2026-10-20",
+		"86400 timer open",
+		"86401 feed 103",
+		"86401 shutdown",
+	}
+	if strings.Join(ls.log, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\nbut got:\n%s", strings.Join(expected, "\n"), strings.Join(ls.log, "\n"))
+	}
+	if len(report.Trades) != 1 || report.Trades[0].Price.Value != 101 {
+		t.Errorf("Expected a buy at 101: %+v", report.Trades)
+	}
+
+	// The state survives, and is given to the next run
+	r = strategy.NewBacktestRunner(&logStrategy{open: open}, 10000).SetStateFile(stateFile)
+	r.RunBacktest(strings.NewReader(recorded))
+	if runs := r.State()["runs"]; runs != 2.0 {
+		t.Errorf("Expected 2 runs from state, but got %v", runs)
+	}
+}
+
+func TestPaperRunner(t *testing.T) {
+	day, _ := omxtime.NewOmxTimeDate("2026-10-19")
+	now := day.OmxOpen + 1000
+	broker := paper.NewPaperBroker(5, "SEK", 10000).SetClock(func() int64 { return now })
+	ls := &logStrategy{open: day.OmxOpen}
+	r := strategy.NewPaperRunner(ls, nil, broker).SetClock(func() int64 { return now })
+
+	msg, _ := feedmodel.NewFeedMsgFromObject("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11, Bid: 99, Ask: 100})
+	r.OnMessage(msg) // Not started, so ignored
+	if err := r.Start(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	now += 1000
+	r.OnMessage(msg)
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "1 phase OPEN 2026-10-19,2 feed 100,2 order,2 privtrade,2 order,2 shutdown"
+	if strings.Join(ls.log, ",") != expected {
+		t.Errorf("Expected %s, but got %s", expected, strings.Join(ls.log, ","))
+	}
+	if positions := broker.Positions(); len(positions) != 1 || positions[0].Accno != 5 || positions[0].Qty != 10 {
+		t.Errorf("Expected paper position: %+v", positions)
+	}
+}
@@ -0,0 +1,130 @@
+package strategy
+
+import (
+	"github.com/Forau/yanngo/omxtime"
+	"sort"
+)
+
+type timer struct {
+	name     string
+	next     int64                   // 0 until scheduled with the clock of the runner
+	schedule func(after int64) int64 // Next time after the given. Zero to stop
+}
+
+type byNext []*timer
+
+func (a byNext) Len() int      { return len(a) }
+func (a byNext) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byNext) Less(i, j int) bool {
+	return a[i].next < a[j].next || (a[i].next == a[j].next && a[i].name < a[j].name)
+}
+
+// Add or replace a timer
+func (r *Runner) addTimer(name string, schedule func(after int64) int64) *Runner {
+	r.Lock()
+	defer r.Unlock()
+	t := &timer{name: name, schedule: schedule}
+	if r.now > 0 {
+		t.next = schedule(r.now)
+	}
+	r.timers[name] = t
+	return r
+}
+
+// Fire every interval millis, aligned to the interval. Like each minute, on the minute.
+func (r *Runner) Every(name string, interval int64) *Runner {
+	if interval <= 0 {
+		logger.Warn("Timer needs a positive interval", "timer", name, "interval", interval)
+		return r
+	}
+	return r.addTimer(name, func(after int64) int64 {
+		return after - after%interval + interval
+	})
+}
+
+// Like Every, but only while the market is open
+func (r *Runner) EveryInMarket(name string, interval int64) *Runner {
+	if interval <= 0 {
+		logger.Warn("Timer needs a positive interval", "timer", name, "interval", interval)
+		return r
+	}
+	return r.addTimer(name, func(after int64) int64 {
+		next := after - after%interval + interval
+		if phase, change := phaseAt(next); phase == PhaseClosed {
+			return change // Next open
+		}
+		return next
+	})
+}
+
+// Fire once, at millis. If already passed, on the next advance of the clock.
+func (r *Runner) At(name string, millis int64) *Runner {
+	fired := false
+	return r.addTimer(name, func(after int64) int64 {
+		if fired {
+			return 0
+		}
+		fired = true
+		return millis
+	})
+}
+
+// Fire each trading day, offset millis from open. Negative offsets is before open.
+func (r *Runner) AtMarketOpen(name string, offset int64) *Runner {
+	return r.addTimer(name, daily(func(ot *omxtime.OmxTime) int64 { return ot.OmxOpen + offset }))
+}
+
+// Fire each trading day, offset millis from close. Like -omxtime.MinuteX5 to close positions before the end.
+func (r *Runner) AtMarketClose(name string, offset int64) *Runner {
+	return r.addTimer(name, daily(func(ot *omxtime.OmxTime) int64 { return ot.OmxClose + offset }))
+}
+
+func daily(at func(ot *omxtime.OmxTime) int64) func(after int64) int64 {
+	return func(after int64) int64 {
+		ot := omxtime.NewOmxTimeMillis(after)
+		if ot.OmxOpen < 0 || at(ot) <= after {
+			ot = ot.NextTradingDay()
+		}
+		return at(ot)
+	}
+}
+
+func (r *Runner) CancelTimer(name string) *Runner {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.timers, name)
+	return r
+}
+
+// The timer due first, up to and including millis
+func (r *Runner) dueTimer(millis int64) *timer {
+	r.Lock()
+	defer r.Unlock()
+	due := []*timer{}
+	for _, t := range r.timers {
+		if t.next == 0 && r.now > 0 {
+			t.next = t.schedule(r.now)
+		}
+		if t.next > 0 && t.next <= millis {
+			due = append(due, t)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	sort.Sort(byNext(due))
+	return due[0]
+}
+
+// Schedule the next time, before firing, so the strategy can replace or cancel the timer from OnTimer
+func (r *Runner) reschedule(t *timer) {
+	r.Lock()
+	defer r.Unlock()
+	if r.timers[t.name] != t {
+		return
+	}
+	fired := t.next
+	if t.next = t.schedule(fired); t.next <= 0 {
+		delete(r.timers, t.name)
+	}
+}
@@ -0,0 +1,157 @@
+package tax
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/omxtime"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type datedRate struct {
+	date string
+	rate float64
+}
+
+// Daily rates to SEK, like the ones from Riksbanken. Looks up the rate of the day, or the closest day before.
+type DailyRates struct {
+	rates map[string][]datedRate
+}
+
+func NewDailyRates() *DailyRates {
+	return &DailyRates{rates: make(map[string][]datedRate)}
+}
+
+// Date as 2006-01-02
+func (dr *DailyRates) Add(date, currency string, rate float64) *DailyRates {
+	list := append(dr.rates[currency], datedRate{date, rate})
+	sort.Sort(byDate(list))
+	dr.rates[currency] = list
+	return dr
+}
+
+// Read rates as csv with date, currency and rate. A header, and empty lines, are skipped.
+func LoadRates(in io.Reader) (*DailyRates, error) {
+	dr := NewDailyRates()
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return dr, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rate, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			if line == 1 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("Line %d: Bad rate '%s'", line, rec[2])
+		}
+		dr.Add(rec[0], strings.ToUpper(rec[1]), rate)
+	}
+}
+
+// Implements RateSource
+func (dr *DailyRates) Rate(currency string, millis int64) (float64, error) {
+	day := omxtime.MillisToDayString(millis)
+	list := dr.rates[currency]
+	idx := sort.Search(len(list), func(i int) bool { return list[i].date > day })
+	if idx == 0 {
+		return 0, fmt.Errorf("No exchange rate for %s on or before %s", currency, day)
+	}
+	return list[idx-1].rate, nil
+}
+
+type byDate []datedRate
+
+func (a byDate) Len() int           { return len(a) }
+func (a byDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDate) Less(i, j int) bool { return a[i].date < a[j].date }
+
+var tradeColumns = []string{"date", "security", "name", "side", "volume", "price", "currency", "commission", "exchange_rate"}
+
+// Read archived trades, as a json array of Trade, or csv with the columns
+// date, security, name, side, volume, price, currency, commission and exchange_rate. Date is 2006-01-02 or millis.
+func LoadTrades(in io.Reader) ([]Trade, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		var trades []Trade
+		err = json.Unmarshal(data, &trades)
+		return trades, err
+	}
+
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.FieldsPerRecord = len(tradeColumns)
+	r.TrimLeadingSpace = true
+	trades := []Trade{}
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return trades, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if line == 1 && rec[0] == tradeColumns[0] {
+			continue
+		}
+		t, err := parseTrade(rec)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+		trades = append(trades, t)
+	}
+}
+
+func parseTrade(rec []string) (t Trade, err error) {
+	if t.Time, err = strconv.ParseInt(rec[0], 10, 64); err != nil {
+		day, derr := omxtime.NewOmxTimeDate(rec[0])
+		if derr != nil {
+			return t, fmt.Errorf("Bad date '%s'", rec[0])
+		}
+		t.Time, err = day.Millis+12*int64(time.Hour/time.Millisecond), nil // Midday in Stockholm
+	}
+	t.Security, t.Name, t.Side, t.Currency = rec[1], rec[2], strings.ToUpper(rec[3]), strings.ToUpper(rec[6])
+	floats := []*float64{&t.Volume, &t.Price, nil, &t.Commission, &t.ExchangeRate}
+	for idx, ptr := range floats {
+		if ptr == nil || rec[4+idx] == "" {
+			continue
+		}
+		if *ptr, err = strconv.ParseFloat(rec[4+idx], 64); err != nil {
+			return t, fmt.Errorf("Bad %s '%s'", tradeColumns[4+idx], rec[4+idx])
+		}
+	}
+	return
+}
+
+// Write the K4 as csv. One line per row, and the sums of each section.
+func (k *K4) WriteCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"section", "volume", "name", "sales_price", "cost", "gain", "loss"})
+	i64 := func(v int64) string { return strconv.FormatInt(v, 10) }
+	for _, section := range []string{SectionA, SectionC, SectionD} {
+		rows := k.Section(section)
+		for _, r := range rows {
+			w.Write([]string{section, i64(r.Volume), r.Name, i64(r.SalesPrice), i64(r.Cost), i64(r.Gain), i64(r.Loss)})
+		}
+		if len(rows) > 0 {
+			s := sum(rows)
+			w.Write([]string{section, "", "SUM", i64(s.SalesPrice), i64(s.Cost), i64(s.Gain), i64(s.Loss)})
+		}
+	}
+	for _, d := range k.Deferrals {
+		w.Write([]string{SectionB, "", d.Name, "", "", i64(d.Amount), ""})
+	}
+	w.Flush()
+	return w.Error()
+}
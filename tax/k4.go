@@ -0,0 +1,268 @@
+// Package tax builds the Swedish K4 declaration from trades. Gains and losses are computed with the average cost
+// method (genomsnittsmetoden), in SEK, and can be written as CSV or as SRU files for upload to Skatteverket.
+package tax
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/omxtime"
+	"github.com/Forau/yanngo/swagger"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// K4 sections
+const (
+	SectionA = "A" // Listed shares, equity funds, share options etc
+	SectionB = "B" // Reversal of deferral amounts
+	SectionC = "C" // Listed bonds, interest funds, currency etc
+	SectionD = "D" // Other securities, unlisted shares, commodities etc
+)
+
+// Converts an amount in currency, at the time in millis, to SEK
+type RateSource func(currency string, millis int64) (float64, error)
+
+// One trade. Price and commission in the currency of the trade.
+type Trade struct {
+	Time         int64   `json:"time"`                    // Millis
+	Security     string  `json:"security"`                // What makes it the same security for the average. Like the ISIN
+	Name         string  `json:"name,omitempty"`          // As written on the K4. Security if empty
+	Side         string  `json:"side"`                    // BUY or SELL
+	Volume       float64 `json:"volume"`                  //
+	Price        float64 `json:"price"`                   //
+	Currency     string  `json:"currency,omitempty"`      // SEK if empty
+	Commission   float64 `json:"commission,omitempty"`    //
+	ExchangeRate float64 `json:"exchange_rate,omitempty"` // To SEK. Looked up in the RateSource if zero
+	NoCommission bool    `json:"no_commission,omitempty"` // The commission is not known. The K4 warns about it
+}
+
+// Trade from AccountTrades, or the private feed. They carry no commission, so the K4 warns of the securities they are in.
+func TradeFromSwagger(t swagger.Trade) Trade {
+	return Trade{
+		Time:         t.Tradetime,
+		Security:     fmt.Sprintf("%d:%s", t.Tradable.MarketId, t.Tradable.Identifier),
+		Side:         t.Side,
+		Volume:       t.Volume,
+		Price:        t.Price.Value,
+		Currency:     t.Price.Currency,
+		NoCommission: true,
+	}
+}
+
+// A row in section A, C or D. All sales of one security during the year, in whole SEK.
+type Row struct {
+	Section     string `json:"section"`
+	Volume      int64  `json:"volume"`      // Antal
+	Name        string `json:"name"`        // Beteckning
+	SalesPrice  int64  `json:"sales_price"` // Försäljningspris, after commission
+	Cost        int64  `json:"cost"`        // Omkostnadsbelopp, including commission
+	Gain        int64  `json:"gain"`        // Vinst
+	Loss        int64  `json:"loss"`        // Förlust
+	volumeExact float64
+	salesExact  float64
+	costExact   float64
+}
+
+// A row in section B
+type Deferral struct {
+	Name   string `json:"name"`
+	Amount int64  `json:"amount"` // Uppskovsbelopp att återföra
+}
+
+type Sums struct {
+	SalesPrice int64 `json:"sales_price"`
+	Cost       int64 `json:"cost"`
+	Gain       int64 `json:"gain"`
+	Loss       int64 `json:"loss"`
+}
+
+type K4 struct {
+	Year      int        `json:"year"`
+	Rows      []Row      `json:"rows"` // Sorted on section and name
+	Deferrals []Deferral `json:"deferrals,omitempty"`
+	Warnings  []string   `json:"warnings,omitempty"`
+}
+
+// Rows of one section
+func (k *K4) Section(section string) (rows []Row) {
+	for _, r := range k.Rows {
+		if r.Section == section {
+			rows = append(rows, r)
+		}
+	}
+	return
+}
+
+func sum(rows []Row) (s Sums) {
+	for _, r := range rows {
+		s.SalesPrice += r.SalesPrice
+		s.Cost += r.Cost
+		s.Gain += r.Gain
+		s.Loss += r.Loss
+	}
+	return
+}
+
+func (k *K4) Sums(section string) Sums {
+	return sum(k.Section(section))
+}
+
+type Calculator struct {
+	rates     RateSource
+	sections  map[string]string
+	trades    []Trade
+	deferrals []Deferral
+}
+
+// Rates can be nil, if all trades are in SEK or have an exchange rate
+func NewCalculator(rates RateSource) *Calculator {
+	if rates == nil {
+		rates = func(currency string, millis int64) (float64, error) {
+			return 0, fmt.Errorf("No exchange rate for %s at %s", currency, omxtime.MillisToString(millis))
+		}
+	}
+	return &Calculator{rates: rates, sections: make(map[string]string)}
+}
+
+// Section of a security. Default is SectionA.
+func (c *Calculator) SetSection(security, section string) *Calculator {
+	c.sections[security] = section
+	return c
+}
+
+// Add trades from all years. Older trades are needed for the average cost.
+func (c *Calculator) AddTrades(trades ...Trade) *Calculator {
+	c.trades = append(c.trades, trades...)
+	return c
+}
+
+func (c *Calculator) AddDeferral(name string, amount int64) *Calculator {
+	c.deferrals = append(c.deferrals, Deferral{Name: name, Amount: amount})
+	return c
+}
+
+type holding struct {
+	volume float64
+	cost   float64 // SEK, including commissions
+}
+
+// Build the K4 for the year. Sales are aggregated per security.
+func (c *Calculator) Report(year int) (*K4, error) {
+	trades := append([]Trade{}, c.trades...)
+	sort.Stable(byTime(trades))
+
+	k4 := &K4{Year: year, Rows: []Row{}, Deferrals: append([]Deferral{}, c.deferrals...)}
+	holdings := make(map[string]*holding)
+	rows := make(map[string]*Row)
+	noCommission := make(map[string]int)
+	for _, t := range trades {
+		if y, _ := strconv.Atoi(omxtime.MillisToDayString(t.Time)[:4]); y > year {
+			continue
+		}
+		if t.NoCommission {
+			noCommission[t.Security]++
+		}
+		rate, err := c.rate(t)
+		if err != nil {
+			return nil, err
+		}
+		h, ok := holdings[t.Security]
+		if !ok {
+			h = &holding{}
+			holdings[t.Security] = h
+		}
+		value, commission := t.Volume*t.Price*rate, t.Commission*rate
+
+		switch t.Side {
+		case "BUY":
+			h.volume += t.Volume
+			h.cost += value + commission
+		case "SELL":
+			volume := t.Volume
+			if volume > h.volume+1e-9 {
+				k4.Warnings = append(k4.Warnings, fmt.Sprintf("%s: Sold %v at %s, but only held %v. The rest has no cost",
+					t.Security, t.Volume, omxtime.MillisToDayString(t.Time), h.volume))
+				volume = h.volume
+			}
+			cost := 0.0
+			if h.volume > 0 {
+				cost = h.cost * volume / h.volume
+			}
+			h.volume -= volume
+			h.cost -= cost
+			if h.volume < 1e-9 {
+				h.volume, h.cost = 0, 0
+			}
+			if omxtime.MillisToDayString(t.Time)[:4] != strconv.Itoa(year) {
+				continue
+			}
+			row, ok := rows[t.Security]
+			if !ok {
+				section := c.sections[t.Security]
+				if section == "" {
+					section = SectionA
+				}
+				name := t.Name
+				if name == "" {
+					name = t.Security
+				}
+				row = &Row{Section: section, Name: name}
+				rows[t.Security] = row
+			}
+			row.volumeExact += t.Volume
+			row.salesExact += value - commission
+			row.costExact += cost
+		default:
+			return nil, fmt.Errorf("%s: Unknown side '%s'", t.Security, t.Side)
+		}
+	}
+
+	var securities []string
+	for security := range rows {
+		securities = append(securities, security)
+	}
+	sort.Strings(securities)
+	for _, security := range securities {
+		if n := noCommission[security]; n > 0 {
+			k4.Warnings = append(k4.Warnings, fmt.Sprintf("%s: %d trades without commission, like those from AccountTrades. "+
+				"The gain is overstated by their commission. Use archived trade files for them", security, n))
+		}
+	}
+
+	for _, row := range rows {
+		row.Volume = int64(math.Floor(row.volumeExact + 0.5))
+		row.SalesPrice = int64(math.Floor(row.salesExact + 0.5))
+		row.Cost = int64(math.Floor(row.costExact + 0.5))
+		if result := row.SalesPrice - row.Cost; result > 0 {
+			row.Gain = result
+		} else {
+			row.Loss = -result
+		}
+		k4.Rows = append(k4.Rows, *row)
+	}
+	sort.Sort(bySection(k4.Rows))
+	return k4, nil
+}
+
+func (c *Calculator) rate(t Trade) (float64, error) {
+	if t.ExchangeRate > 0 {
+		return t.ExchangeRate, nil
+	} else if t.Currency == "" || t.Currency == "SEK" {
+		return 1, nil
+	}
+	return c.rates(t.Currency, t.Time)
+}
+
+type byTime []Trade
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Time < a[j].Time }
+
+type bySection []Row
+
+func (a bySection) Len() int      { return len(a) }
+func (a bySection) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySection) Less(i, j int) bool {
+	return a[i].Section < a[j].Section || (a[i].Section == a[j].Section && a[i].Name < a[j].Name)
+}
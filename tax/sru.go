@@ -0,0 +1,159 @@
+package tax
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Who declares. Written to INFO.SRU, and as identity of each form.
+type SRUInfo struct {
+	Pnr        string // Personnummer, 12 digits
+	Name       string
+	Address    string
+	PostalCode string
+	City       string
+	Email      string
+	Form       string    // Default K4-<year>P4
+	Created    time.Time // Default now
+}
+
+// Field codes of one section, from the SRU specification of K4
+type sectionCodes struct {
+	rows  int   // Rows on one form
+	first int   // Code of the volume on the first row. Then name, sales price, cost, gain and loss
+	step  int   // Between rows
+	sums  []int // Sales price, cost, gain and loss
+}
+
+var sruCodes = map[string]sectionCodes{
+	SectionA: {rows: 9, first: 3100, step: 10, sums: []int{3300, 3301, 3304, 3305}},
+	SectionC: {rows: 7, first: 3310, step: 10, sums: []int{3400, 3401, 3403, 3404}},
+	SectionD: {rows: 7, first: 3410, step: 10, sums: []int{3500, 3501, 3503, 3504}},
+}
+
+// Field codes of section B. Each form has one row, with the name and the amount to return.
+const (
+	sruDeferralRows   = 1
+	sruDeferralName   = 3200
+	sruDeferralAmount = 3201
+)
+
+// Field with the number of the form, when there are more than one
+const sruSerialCode = 7014
+
+// SRU files are ISO 8859-1
+type latin1Writer struct {
+	w *bufio.Writer
+}
+
+func (lw latin1Writer) line(format string, args ...interface{}) {
+	for _, r := range fmt.Sprintf(format, args...) {
+		if r > 0xff {
+			r = '?'
+		}
+		lw.w.WriteByte(byte(r))
+	}
+	lw.w.WriteByte('\n')
+}
+
+// Write INFO.SRU and BLANKETTER.SRU. Rows that do not fit on one form continue on the next.
+func (k *K4) WriteSRU(info SRUInfo, infoOut, formsOut io.Writer) error {
+	if len(info.Pnr) != 12 {
+		return fmt.Errorf("Pnr must be 12 digits, not '%s'", info.Pnr)
+	}
+	if info.Form == "" {
+		info.Form = fmt.Sprintf("K4-%dP4", k.Year)
+	}
+	if info.Created.IsZero() {
+		info.Created = time.Now()
+	}
+	iw := latin1Writer{bufio.NewWriter(infoOut)}
+	iw.line("#DATABESKRIVNING_START")
+	iw.line("#PRODUKT SRU")
+	iw.line("#FILNAMN BLANKETTER.SRU")
+	iw.line("#DATABESKRIVNING_SLUT")
+	iw.line("#MEDIELEV_START")
+	iw.line("#ORGNR %s", info.Pnr)
+	iw.line("#NAMN %s", info.Name)
+	if info.Address != "" {
+		iw.line("#ADRESS %s", info.Address)
+	}
+	iw.line("#POSTNR %s", info.PostalCode)
+	iw.line("#POSTORT %s", info.City)
+	if info.Email != "" {
+		iw.line("#EMAIL %s", info.Email)
+	}
+	iw.line("#MEDIELEV_SLUT")
+	if err := iw.w.Flush(); err != nil {
+		return err
+	}
+
+	// Rows per form, for each section
+	sections := []string{SectionA, SectionC, SectionD}
+	forms := (len(k.Deferrals) + sruDeferralRows - 1) / sruDeferralRows
+	if forms < 1 {
+		forms = 1
+	}
+	rows := make(map[string][]Row)
+	for _, s := range sections {
+		rows[s] = k.Section(s)
+		if n := (len(rows[s]) + sruCodes[s].rows - 1) / sruCodes[s].rows; n > forms {
+			forms = n
+		}
+	}
+
+	fw := latin1Writer{bufio.NewWriter(formsOut)}
+	for form := 0; form < forms; form++ {
+		fw.line("#BLANKETT %s", info.Form)
+		fw.line("#IDENTITET %s %s", info.Pnr, info.Created.Format("20060102 150405"))
+		fw.line("#NAMN %s", info.Name)
+		if forms > 1 {
+			fw.line("#UPPGIFT %d %d", sruSerialCode, form+1)
+		}
+		if start := form * sruDeferralRows; start < len(k.Deferrals) {
+			end := start + sruDeferralRows
+			if end > len(k.Deferrals) {
+				end = len(k.Deferrals)
+			}
+			for _, d := range k.Deferrals[start:end] {
+				fw.line("#UPPGIFT %d %s", sruDeferralName, d.Name)
+				fw.line("#UPPGIFT %d %d", sruDeferralAmount, d.Amount)
+			}
+		}
+		for _, s := range sections {
+			codes := sruCodes[s]
+			start := form * codes.rows
+			if start >= len(rows[s]) {
+				continue
+			}
+			end := start + codes.rows
+			if end > len(rows[s]) {
+				end = len(rows[s])
+			}
+			for idx, r := range rows[s][start:end] {
+				code := codes.first + idx*codes.step
+				fw.line("#UPPGIFT %d %d", code, r.Volume)
+				fw.line("#UPPGIFT %d %s", code+1, r.Name)
+				fw.line("#UPPGIFT %d %d", code+2, r.SalesPrice)
+				fw.line("#UPPGIFT %d %d", code+3, r.Cost)
+				if r.Gain > 0 {
+					fw.line("#UPPGIFT %d %d", code+4, r.Gain)
+				}
+				if r.Loss > 0 {
+					fw.line("#UPPGIFT %d %d", code+5, r.Loss)
+				}
+			}
+			s := sum(rows[s][start:end])
+			for idx, v := range []int64{s.SalesPrice, s.Cost, s.Gain, s.Loss} {
+				if v > 0 {
+					fw.line("#UPPGIFT %d %d", codes.sums[idx], v)
+				}
+			}
+		}
+		fw.line("#BLANKETTSLUT")
+	}
+	fw.line("#FIL_SLUT")
+	return fw.w.Flush()
+}
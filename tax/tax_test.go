@@ -0,0 +1,129 @@
+package tax_test
+
+import (
+	"github.com/Forau/yanngo/swagger"
+	"github.com/Forau/yanngo/tax"
+
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const archived = `date,security,name,side,volume,price,currency,commission,exchange_rate
+2025-05-02,SE0000108656,Ericsson B,BUY,100,50,SEK,39,
+2026-03-02,SE0000108656,Ericsson B,buy,100,70,,39,
+2026-06-01,SE0000108656,Ericsson B,SELL,150,80,SEK,39,
+2027-01-04,SE0000108656,Ericsson B,SELL,50,90,SEK,39,
+2026-01-05,US0378331005,Äpple Inc,BUY,10,100,usd,,
+2026-04-01,BOND,Obligation,BUY,1000,1,SEK,,
+2026-05-04,BOND,Obligation,SELL,1000,0.9,SEK,,
+2026-07-01,SHORT,Blankad,SELL,10,10,SEK,,
+`
+
+const rates = `date,currency,rate
+2026-01-05,USD,10
+2026-01-30,USD,11
+`
+
+func report(t *testing.T) *tax.K4 {
+	trades, err := tax.LoadTrades(strings.NewReader(archived))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr, err := tax.LoadRates(strings.NewReader(rates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// And one from AccountTrades, on a monday where the rate of the friday before is used
+	sold := tax.TradeFromSwagger(swagger.Trade{Tradable: swagger.TradableId{Identifier: "AAPL", MarketId: 19},
+		Price: swagger.Amount{Value: 120, Currency: "USD"}, Volume: 10, Side: "SELL",
+		Tradetime: time.Date(2026, 2, 2, 15, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)})
+	sold.Security, sold.Name = "US0378331005", "Äpple Inc"
+
+	k4, err := tax.NewCalculator(dr.Rate).SetSection("BOND", tax.SectionC).AddTrades(trades...).AddTrades(sold).
+		AddDeferral("Andelsbyte", 1000).Report(2026)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k4
+}
+
+func TestK4(t *testing.T) {
+	k4 := report(t)
+	expected := []tax.Row{
+		{Section: "A", Volume: 10, Name: "Blankad", SalesPrice: 100, Cost: 0, Gain: 100},
+		{Section: "A", Volume: 150, Name: "Ericsson B", SalesPrice: 11961, Cost: 9059, Gain: 2902},
+		{Section: "A", Volume: 10, Name: "Äpple Inc", SalesPrice: 13200, Cost: 10000, Gain: 3200},
+		{Section: "C", Volume: 1000, Name: "Obligation", SalesPrice: 900, Cost: 1000, Loss: 100},
+	}
+	if len(k4.Rows) != len(expected) {
+		t.Fatalf("Expected %d rows, but got %+v", len(expected), k4.Rows)
+	}
+	fields := func(r tax.Row) string {
+		return fmt.Sprint(r.Section, r.Volume, r.Name, r.SalesPrice, r.Cost, r.Gain, r.Loss)
+	}
+	for idx, row := range k4.Rows {
+		if fields(row) != fields(expected[idx]) {
+			t.Errorf("Expected %+v, but got %+v", expected[idx], row)
+		}
+	}
+	if len(k4.Warnings) != 2 || !strings.HasPrefix(k4.Warnings[0], "SHORT: Sold 10") ||
+		!strings.HasPrefix(k4.Warnings[1], "US0378331005: 1 trades without commission") {
+		t.Errorf("Expected warnings on short sale, and the trade without commission: %v", k4.Warnings)
+	}
+	if s := k4.Sums(tax.SectionA); s.SalesPrice != 25261 || s.Gain != 6202 || s.Loss != 0 {
+		t.Errorf("Unexpected sums: %+v", s)
+	}
+
+	if _, err := tax.NewCalculator(nil).AddTrades(tax.Trade{Security: "X", Side: "BUY", Volume: 1, Price: 1, Currency: "EUR"}).
+		Report(2026); err == nil {
+		t.Error("Expected error without exchange rate")
+	}
+}
+
+func TestK4Files(t *testing.T) {
+	k4 := report(t)
+	var csv bytes.Buffer
+	if err := k4.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 8 || lines[4] != "A,,SUM,25261,19059,6202,0" || lines[7] != "B,,Andelsbyte,,,1000," {
+		t.Errorf("Unexpected csv:\n%s", csv.String())
+	}
+
+	var info, forms bytes.Buffer
+	created := time.Date(2027, 3, 1, 10, 0, 0, 0, time.UTC)
+	err := k4.WriteSRU(tax.SRUInfo{Pnr: "191212121212", Name: "Tolvan Tolvansson", PostalCode: "12345", City: "Sthlm", Created: created},
+		&info, &forms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(info.String(), "#ORGNR 191212121212\n#NAMN Tolvan Tolvansson\n#POSTNR 12345\n") {
+		t.Errorf("Unexpected INFO.SRU:\n%s", info.String())
+	}
+	expected := []string{
+		"#BLANKETT K4-2026P4",
+		"#IDENTITET 191212121212 20270301 100000",
+		"#UPPGIFT 3200 Andelsbyte",
+		"#UPPGIFT 3201 1000",
+		"#UPPGIFT 3110 150",
+		"#UPPGIFT 3111 Ericsson B",
+		"#UPPGIFT 3121 \xc4pple Inc", // Latin 1
+		"#UPPGIFT 3304 6202",
+		"#UPPGIFT 3310 1000",
+		"#UPPGIFT 3315 100",
+		"#UPPGIFT 3404 100",
+		"#BLANKETTSLUT\n#FIL_SLUT\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(forms.String(), e+"\n") && !strings.HasSuffix(forms.String(), e) {
+			t.Errorf("Expected '%s' in BLANKETTER.SRU:\n%s", e, forms.String())
+		}
+	}
+	if strings.Contains(forms.String(), "3305") || strings.Contains(forms.String(), "7014") {
+		t.Errorf("Expected no zero sums, and no serial with one form:\n%s", forms.String())
+	}
+}
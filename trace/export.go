@@ -0,0 +1,247 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/nnlog"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = nnlog.For("trace")
+
+// Receives the ended spans, in batches
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// How often queued spans are exported, and how many are queued before an export is forced
+var (
+	FlushInterval = 5 * time.Second
+	MaxQueued     = 512
+)
+
+type processor struct {
+	sync.Mutex
+	exporter Exporter
+	service  string
+	queue    []*Span
+	stop     chan bool
+}
+
+var proc = &processor{}
+
+// Export ended spans to exp, as service. A nil exporter stops the recording, after flushing what is queued.
+func SetExporter(exp Exporter, service string) {
+	Flush()
+	proc.Lock()
+	defer proc.Unlock()
+	if proc.stop != nil {
+		close(proc.stop)
+		proc.stop = nil
+	}
+	proc.exporter, proc.service = exp, service
+	if exp != nil {
+		stop := make(chan bool)
+		proc.stop = stop
+		go func() {
+			ticker := time.NewTicker(FlushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					Flush()
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// True if spans are recorded
+func Enabled() bool {
+	proc.Lock()
+	defer proc.Unlock()
+	return proc.exporter != nil
+}
+
+func record(s *Span) {
+	proc.Lock()
+	if proc.exporter == nil {
+		proc.Unlock()
+		return
+	}
+	proc.queue = append(proc.queue, s)
+	full := len(proc.queue) >= MaxQueued
+	proc.Unlock()
+	if full {
+		go Flush()
+	}
+}
+
+// Export the queued spans now
+func Flush() {
+	proc.Lock()
+	exp, service, spans := proc.exporter, proc.service, proc.queue
+	proc.queue = nil
+	proc.Unlock()
+	if exp == nil || len(spans) == 0 {
+		return
+	}
+	if err := exp.Export(service, spans); err != nil {
+		logger.Warn("Unable to export spans", "spans", len(spans), "err", err)
+	}
+}
+
+// OTLP/JSON, as in opentelemetry-proto. Times are strings, since they do not fit in a json number.
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toAttrs(m map[string]string) []otlpAttr {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]otlpAttr, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, otlpAttr{k, otlpValue{m[k]}})
+	}
+	return res
+}
+
+// Encode spans as an OTLP/JSON ExportTraceServiceRequest
+func EncodeOTLP(service string, spans []*Span) ([]byte, error) {
+	ss := otlpScopeSpans{Scope: otlpScope{"github.com/Forau/yanngo/trace"}, Spans: make([]otlpSpan, 0, len(spans))}
+	for _, s := range spans {
+		s.Lock()
+		sp := otlpSpan{TraceId: s.TraceId, SpanId: s.SpanId, ParentSpanId: s.ParentId, Name: s.Name, Kind: s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        toAttrs(s.Attributes)}
+		if s.Err != "" {
+			sp.Status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		s.Unlock()
+		ss.Spans = append(ss.Spans, sp)
+	}
+	res := otlpResourceSpans{Resource: otlpResource{toAttrs(map[string]string{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{ss}}
+	return json.Marshal(otlpTraces{[]otlpResourceSpans{res}})
+}
+
+// Appends each batch as one line of OTLP/JSON, like the file exporter of the OpenTelemetry collector
+type FileExporter struct {
+	sync.Mutex
+	path string
+}
+
+func NewFileExporter(path string) *FileExporter {
+	return &FileExporter{path: path}
+}
+
+func (fe *FileExporter) Export(service string, spans []*Span) error {
+	data, err := EncodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+	fe.Lock()
+	defer fe.Unlock()
+	f, err := os.OpenFile(fe.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Posts each batch to an OTLP/HTTP collector, like http://localhost:4318/v1/traces
+type HTTPExporter struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPExporter(url string) *HTTPExporter {
+	return &HTTPExporter{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (he *HTTPExporter) Export(service string, spans []*Span) error {
+	data, err := EncodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+	resp, err := he.client.Post(he.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// An http exporter if target is an url, otherwise a file exporter
+func NewExporter(target string) Exporter {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return NewHTTPExporter(target)
+	}
+	return NewFileExporter(target)
+}
@@ -0,0 +1,155 @@
+// Package trace carries a trace id through the hops of a request, and records the time of each hop as a span.
+// Ids are W3C trace context compatible, and spans are exported in the OpenTelemetry OTLP/JSON format.
+//
+// Spans are only recorded when an exporter is set with SetExporter. The ids are always made, so log lines of a
+// request can be correlated even without an exporter.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, with the values of OTLP
+type Kind int
+
+const (
+	KindInternal Kind = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+// The ids that are propagated between hops. TraceId is the correlation id.
+type SpanContext struct {
+	TraceId string `json:"trace_id,omitempty"` // 32 hex chars
+	SpanId  string `json:"span_id,omitempty"`  // 16 hex chars
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func NewTraceId() string {
+	return randomHex(16)
+}
+
+func NewSpanId() string {
+	return randomHex(8)
+}
+
+func validHex(s string, l int) bool {
+	if len(s) != l || strings.Trim(s, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+func (sc SpanContext) Valid() bool {
+	return validHex(sc.TraceId, 32) && validHex(sc.SpanId, 16)
+}
+
+// The W3C traceparent header, or empty if not valid
+func (sc SpanContext) Traceparent() string {
+	if !sc.Valid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceId, sc.SpanId)
+}
+
+// Parse a W3C traceparent header, like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(header string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	sc = SpanContext{TraceId: parts[1], SpanId: parts[2]}
+	return sc, sc.Valid()
+}
+
+// Name of the http header with the traceparent
+const TraceparentHeader = "traceparent"
+
+// One hop of a request. Start it with Start, and Finish it when the hop is done.
+type Span struct {
+	sync.Mutex
+	TraceId    string
+	SpanId     string
+	ParentId   string
+	Name       string
+	Kind       Kind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        string
+	ended      bool
+}
+
+// Start a span, as a child of parent. A new trace is started if the parent is not valid.
+func Start(name string, parent SpanContext, kind Kind) *Span {
+	s := &Span{SpanId: NewSpanId(), Name: name, Kind: kind, Start: now()}
+	if parent.Valid() {
+		s.TraceId, s.ParentId = parent.TraceId, parent.SpanId
+	} else if validHex(parent.TraceId, 32) {
+		s.TraceId = parent.TraceId // Keep the correlation id, even if we do not know the span
+	} else {
+		s.TraceId = NewTraceId()
+	}
+	return s
+}
+
+// The ids to give to the next hop
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceId: s.TraceId, SpanId: s.SpanId}
+}
+
+func (s *Span) SetAttr(key, value string) *Span {
+	s.Lock()
+	defer s.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+	return s
+}
+
+// Mark the span as failed. Nil errors are ignored.
+func (s *Span) SetError(err error) *Span {
+	if err != nil {
+		s.Lock()
+		s.Err = err.Error()
+		s.Unlock()
+	}
+	return s
+}
+
+// End the span, and queue it for export. Only the first call counts.
+func (s *Span) Finish() {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = now()
+	s.Unlock()
+	record(s)
+}
+
+func (s *Span) Duration() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.End.Sub(s.Start)
+}
+
+var now = time.Now
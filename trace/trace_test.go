@@ -0,0 +1,242 @@
+package trace_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/trace"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSpanContext(t *testing.T) {
+	sc, ok := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || sc.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanId != "00f067aa0ba902b7" {
+		t.Errorf("Unable to parse traceparent: %+v, %v", sc, ok)
+	}
+	if sc.Traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Unexpected traceparent: %s", sc.Traceparent())
+	}
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		if _, ok := trace.ParseTraceparent(bad); ok {
+			t.Errorf("Expected '%s' to be invalid", bad)
+		}
+	}
+	if (trace.SpanContext{}).Traceparent() != "" {
+		t.Error("Expected no traceparent for an empty context")
+	}
+
+	root := trace.Start("root", trace.SpanContext{}, trace.KindServer)
+	if !root.Context().Valid() || root.ParentId != "" {
+		t.Errorf("Expected a new trace: %+v", root)
+	}
+	child := trace.Start("child", root.Context(), trace.KindClient)
+	if child.TraceId != root.TraceId || child.ParentId != root.SpanId || child.SpanId == root.SpanId {
+		t.Errorf("Expected a child of %+v, got %+v", root.Context(), child)
+	}
+	orphan := trace.Start("orphan", trace.SpanContext{TraceId: root.TraceId}, trace.KindInternal)
+	if orphan.TraceId != root.TraceId || orphan.ParentId != "" {
+		t.Errorf("Expected the correlation id to be kept: %+v", orphan)
+	}
+}
+
+type otlp struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string
+				Value struct{ StringValue string }
+			}
+		}
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceId, SpanId, ParentSpanId, Name string
+				Kind                                int
+				StartTimeUnixNano, EndTimeUnixNano  string
+				Attributes                          []struct {
+					Key   string
+					Value struct{ StringValue string }
+				}
+				Status struct {
+					Code    int
+					Message string
+				}
+			}
+		}
+	}
+}
+
+func TestExporters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	trace.SetExporter(trace.NewExporter(path), "test")
+	defer trace.SetExporter(nil, "")
+
+	span := trace.Start("work", trace.SpanContext{}, trace.KindInternal).SetAttr("cmd", "Echo")
+	span.SetError(fmt.Errorf("Failed"))
+	span.Finish()
+	span.Finish() // Only once
+	trace.Flush()
+	trace.Flush() // Nothing queued, so nothing written
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("Expected one line: %+v, %s", err, data)
+	}
+	var res otlp
+	if err := json.Unmarshal(data, &res); err != nil || len(res.ResourceSpans) != 1 || len(res.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Unexpected export %+v: %s", err, data)
+	}
+	rs := res.ResourceSpans[0]
+	s := rs.ScopeSpans[0].Spans[0]
+	if rs.Resource.Attributes[0].Key != "service.name" || rs.Resource.Attributes[0].Value.StringValue != "test" ||
+		s.TraceId != span.TraceId || s.SpanId != span.SpanId || s.Name != "work" || s.Kind != 1 ||
+		s.StartTimeUnixNano == "" || s.EndTimeUnixNano < s.StartTimeUnixNano ||
+		s.Attributes[0].Key != "cmd" || s.Attributes[0].Value.StringValue != "Echo" ||
+		s.Status.Code != 2 || s.Status.Message != "Failed" {
+		t.Errorf("Unexpected span: %s", data)
+	}
+
+	var mu sync.Mutex
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, r.URL.Path+" "+r.Header.Get("Content-Type")+" "+string(b))
+		mu.Unlock()
+		if strings.Contains(string(b), "reject") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	exp := trace.NewExporter(srv.URL + "/v1/traces")
+	if err := exp.Export("test", []*trace.Span{span}); err != nil {
+		t.Error(err)
+	}
+	reject := trace.Start("reject", trace.SpanContext{}, trace.KindInternal)
+	reject.Finish()
+	if err := exp.Export("test", []*trace.Span{reject}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected the collector error: %+v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 2 || !strings.HasPrefix(posted[0], "/v1/traces application/json {\"resourceSpans\"") ||
+		!strings.Contains(posted[0], span.SpanId) {
+		t.Errorf("Unexpected posts: %+v", posted)
+	}
+}
+
+// Delivers in the background, like the real pubsubs
+type memPubSub struct {
+	sync.Mutex
+	subs map[string][]remote.SubHandler
+}
+
+func (mps *memPubSub) Pub(topic string, data []byte) error {
+	mps.Lock()
+	defer mps.Unlock()
+	for _, h := range mps.subs[topic] {
+		go h.Handle(topic, data)
+	}
+	return nil
+}
+
+func (mps *memPubSub) Sub(topic string, handler remote.SubHandler) error {
+	mps.Lock()
+	defer mps.Unlock()
+	mps.subs[topic] = append(mps.subs[topic], handler)
+	return nil
+}
+
+func (mps *memPubSub) Close() error {
+	return nil
+}
+
+type spanCollector struct {
+	sync.Mutex
+	spans []*trace.Span
+}
+
+func (sc *spanCollector) Export(service string, spans []*trace.Span) error {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.spans = append(sc.spans, spans...)
+	return nil
+}
+
+func TestPropagation(t *testing.T) {
+	collector := &spanCollector{}
+	trace.SetExporter(collector, "test")
+	defer trace.SetExporter(nil, "")
+
+	// The daemon: a router with a command that sees the trace of the request
+	var seen trace.SpanContext
+	backend := make(api.RequestCommandTransport)
+	backend.AddCommand(string(api.CountriesCmd)).AddOptArgument("countries").RequestHandler(func(req *api.Request) (json.RawMessage, error) {
+		seen = req.TraceContext()
+		return json.Marshal([]map[string]string{{"country": req.Args["countries"]}})
+	})
+	router, _ := api.NewTransportRouter(backend)
+
+	ps := &memPubSub{subs: make(map[string][]remote.SubHandler)}
+	var serverSpan trace.SpanContext
+	ps.Sub("api", remote.MakeSubReplyHandler(ps, func(topic string, msg []byte, sc trace.SpanContext) ([]byte, error) {
+		serverSpan = sc
+		var req api.Request
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return nil, err
+		}
+		req.TraceId, req.SpanId = sc.TraceId, sc.SpanId
+		res := router.Preform(&req)
+		return json.Marshal(&res)
+	}))
+
+	// The client, with a trace from an incoming http request
+	rps, err := remote.NewReplyablePubSub(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrchan := remote.MakeRequestReplyChannel(rps, "api")
+	incoming, _ := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	cli := api.NewApiClient(api.Transport(func(req *api.Request) (res api.Response) {
+		data, _ := req.Encode()
+		b, err := rrchan(data, req.TraceContext())
+		if err != nil {
+			res.Fail(-1, err.Error())
+		} else {
+			json.Unmarshal(b, &res)
+		}
+		return
+	})).Trace(incoming)
+
+	if countries, err := cli.Countries("SE"); err != nil || len(countries) != 1 || countries[0].Country != "SE" {
+		t.Fatalf("Unexpected reply %+v: %+v", countries, err)
+	}
+	trace.Flush()
+
+	byName := map[string]*trace.Span{}
+	collector.Lock()
+	for _, s := range collector.spans {
+		byName[s.Name] = s
+		if s.TraceId != incoming.TraceId {
+			t.Errorf("Expected all spans in trace %s: %+v", incoming.TraceId, s)
+		}
+	}
+	collector.Unlock()
+	client, server, route := byName["remote.request"], byName["remote.server"], byName["route Countries"]
+	if client == nil || server == nil || route == nil {
+		t.Fatalf("Missing spans: %+v", byName)
+	}
+	if client.ParentId != incoming.SpanId || server.ParentId != client.SpanId || route.ParentId != server.SpanId ||
+		serverSpan != server.Context() || seen != route.Context() || client.Attributes["topic"] != "api" {
+		t.Errorf("Unexpected chain: client %+v, server %+v, route %+v, seen %+v", client, server, route, seen)
+	}
+}
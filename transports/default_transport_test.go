@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 var pemData []byte
@@ -91,3 +93,176 @@ func TestCommands(t *testing.T) {
 		t.Log(res.String())
 	}
 }
+
+// Stand-in for the REST API, that echoes the path and query of each request in the response
+func newEchoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		echo := r.URL.Path
+		if q := r.URL.Query().Encode(); q != "" {
+			echo += "?" + q
+		}
+		t.Logf("HTTP-SRV: %s -> %s", r.Method, echo)
+
+		switch path := r.URL.Path; {
+		case r.Method == "POST" && path == "/login":
+			fmt.Fprint(w, `{"session_key": "abc", "expires_in": 300}`)
+		case path == "/news":
+			fmt.Fprintf(w, `[{"news_id": 1, "headline": "%s"}]`, echo)
+		case strings.HasPrefix(path, "/news/"):
+			fmt.Fprintf(w, `[{"news_id": 1, "body": "%s"}, {"news_id": 2}]`, echo)
+		case strings.HasPrefix(path, "/instruments/sectors"), strings.HasPrefix(path, "/instruments/types/"):
+			fmt.Fprintf(w, `[{"name": "%s"}]`, echo)
+		case strings.HasSuffix(path, "/option_pairs"):
+			fmt.Fprintf(w, `[{"strike_price": 100, "call": {"name": "%s"}, "put": {"instrument_id": 2}}]`, echo)
+		case strings.HasSuffix(path, "/filters"):
+			fmt.Fprintf(w, `{"expiration_dates": ["%s"], "no_of_instruments": 3}`, echo)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"code": "NOT_FOUND", "message": "Not found"}`)
+		}
+	}))
+}
+
+func TestNewsSectorsAndDerivatives(t *testing.T) {
+	ts := newEchoServer(t)
+	defer ts.Close()
+
+	tr, err := transports.NewDefaultTransport(ts.URL, []byte("kalle"), []byte("hemlig"), pemData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := api.NewApiClient(tr)
+
+	previews, err := cli.SearchNews("ericsson", []int64{1, 2}, 7, 10, 20)
+	if err != nil || len(previews) != 1 || previews[0].Headline != "/news?days=7&limit=10&offset=20&query=ericsson&source_id=1%2C2" {
+		t.Errorf("Unexpected SearchNews: %+v, %+v", previews, err)
+	}
+	if previews, err = cli.SearchNews("", nil, 0, 0, 0); err != nil || previews[0].Headline != "/news" {
+		t.Errorf("Expected no filters: %+v, %+v", previews, err)
+	}
+	if news, err := cli.News(1, 2); err != nil || len(news) != 2 || news[0].Body != "/news/1,2" {
+		t.Errorf("Unexpected News: %+v, %+v", news, err)
+	}
+
+	if sectors, err := cli.InstrumentSectors("2"); err != nil || len(sectors) != 1 || sectors[0].Name != "/instruments/sectors?group=2" {
+		t.Errorf("Unexpected InstrumentSectors: %+v, %+v", sectors, err)
+	}
+	if sectors, err := cli.InstrumentSector("10", "11"); err != nil || sectors[0].Name != "/instruments/sectors/10,11" {
+		t.Errorf("Unexpected InstrumentSector: %+v, %+v", sectors, err)
+	}
+	if types, err := cli.InstrumentType("ESH"); err != nil || len(types) != 1 || types[0].Name != "/instruments/types/ESH" {
+		t.Errorf("Unexpected InstrumentType: %+v, %+v", types, err)
+	}
+
+	pairs, err := cli.InstrumentOptionPairs(101, "2026-12-18", "SEK")
+	if err != nil || len(pairs) != 1 || pairs[0].StrikePrice != 100 || pairs[0].Put.InstrumentId != 2 ||
+		pairs[0].Call.Name != "/instruments/101/option_pairs?currency=SEK&expiration_date=2026-12-18" {
+		t.Errorf("Unexpected InstrumentOptionPairs: %+v, %+v", pairs, err)
+	}
+	opf, err := cli.InstrumentOptionPairFilters(101, "", "")
+	if err != nil || len(opf.ExpirationDates) != 1 || opf.ExpirationDates[0] != "/instruments/101/option_pairs/filters" {
+		t.Errorf("Unexpected InstrumentOptionPairFilters: %+v, %+v", opf, err)
+	}
+	lf, err := cli.InstrumentLeverageFilters(101, "2026-12-18", 5, "U", "BULL", "LEV", "SEK")
+	if err != nil || lf.NoOfInstruments != 3 || len(lf.ExpirationDates) != 1 || lf.ExpirationDates[0] != "/instruments/101/leverages/filters?"+
+		"currency=SEK&expiration_date=2026-12-18&instrument_group_type=LEV&instrument_type=BULL&issuer_id=5&market_view=U" {
+		t.Errorf("Unexpected InstrumentLeverageFilters: %+v, %+v", lf, err)
+	}
+}
+
+// Stand-in for the REST API of one login, with its own accounts
+func newLoginServer(t *testing.T, name string, accnos ...int64) (*httptest.Server, *int) {
+	calls := new(int)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		t.Logf("HTTP-SRV[%s]: %s -> %s", name, r.Method, r.URL)
+		switch path := r.URL.Path; {
+		case r.Method == "POST" && path == "/login":
+			fmt.Fprintf(w, `{"session_key": "%s", "expires_in": 300}`, name)
+		case path == "/accounts":
+			*calls++
+			accs := []string{}
+			for _, accno := range accnos {
+				accs = append(accs, fmt.Sprintf(`{"accno": %d, "type": "%s"}`, accno, name))
+			}
+			fmt.Fprintf(w, "[%s]", strings.Join(accs, ","))
+		case strings.HasSuffix(path, "/orders"):
+			fmt.Fprintf(w, `[{"accno": %s, "reference": "%s"}]`, strings.Split(path, "/")[2], name)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"code": "NOT_FOUND", "message": "Not found"}`)
+		}
+	})), calls
+}
+
+func TestMultiLogin(t *testing.T) {
+	personal, personalCalls := newLoginServer(t, "personal", 1, 2)
+	defer personal.Close()
+	company, _ := newLoginServer(t, "company", 3)
+	defer company.Close()
+
+	multi := transports.NewMultiLoginTransport()
+	for _, ts := range []*httptest.Server{personal, company} {
+		tr, err := transports.NewDefaultTransport(ts.URL, []byte("kalle"), []byte("hemlig"), pemData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "personal"
+		if ts == company {
+			name = "company"
+		}
+		multi.AddLogin(name, tr)
+	}
+	multi.MapAccount(4, "company")
+	router, err := api.NewCachedTransportRouter(transports.NewSimpleMemoryCacheHandler(), multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := api.NewApiClient(router)
+
+	accounts, err := cli.Accounts()
+	if err != nil || len(accounts) != 3 || accounts[2].Accno != 3 || accounts[2].Typ != "company" {
+		t.Errorf("Expected the accounts of both logins: %+v, %+v", accounts, err)
+	}
+	if accounts, err = cli.Login("company").Accounts(); err != nil || len(accounts) != 1 || accounts[0].Accno != 3 {
+		t.Errorf("Expected the company account: %+v, %+v", accounts, err)
+	}
+	if accounts, err = cli.Login("personal").Accounts(); err != nil || len(accounts) != 2 {
+		t.Errorf("Expected the personal accounts: %+v, %+v", accounts, err)
+	}
+	if *personalCalls != 2 {
+		t.Errorf("Expected the cache to keep the logins apart, got %d calls", *personalCalls)
+	}
+
+	for accno, login := range map[int64]string{1: "personal", 3: "company", 4: "company"} {
+		orders, err := cli.AccountOrders(accno)
+		if err != nil || len(orders) != 1 || orders[0].Reference != login {
+			t.Errorf("Expected the orders of %d from %s: %+v, %+v", accno, login, orders, err)
+		}
+	}
+	if got := multi.Accounts(); len(got) != 4 || got[2] != "personal" || got[4] != "company" {
+		t.Errorf("Unexpected account map: %v", got)
+	}
+
+	for _, req := range []*api.Request{
+		genCmd(api.AccountOrdersCmd, map[string]string{"accno": "99"}),
+		genCmd(api.AccountOrdersCmd, map[string]string{"accno": "1", "login": "isk"}),
+		genCmd(api.AccountOrdersCmd, map[string]string{"accno": "1,3"}),
+	} {
+		if res := router.Preform(req); !res.IsError() || res.Error.Status != transports.UnknownLoginStatus {
+			t.Errorf("Expected an unknown login for %+v: %s", req.Args, res.String())
+		}
+	}
+
+	var cmds []api.RequestCommandInfo
+	res := router.Preform(genCmd(api.TransportRespondsToCmd, nil))
+	if err = res.Unmarshal(&cmds); err != nil || len(cmds) == 0 {
+		t.Fatalf("Unexpected commands %s: %+v", res.String(), err)
+	}
+	for _, cmd := range cmds {
+		if args := cmd.GetArgumentNames(); args[len(args)-1] != "login" {
+			t.Errorf("Expected a login argument on %s: %v", cmd.Command, args)
+		}
+	}
+}
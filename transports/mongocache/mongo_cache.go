@@ -6,11 +6,17 @@ import (
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/Forau/yanngo/api"
-	"log"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
 
+	"fmt"
 	"time"
 )
 
+var logger = nnlog.For("transports/mongocache")
+
+var stats = metrics.Default.CacheStats("mongo")
+
 type MongoCacheHandler struct {
 	mgocol *mgo.Collection
 }
@@ -37,13 +43,15 @@ func (mch *MongoCacheHandler) Handle(info api.RequestCommandInfo, th api.Transpo
 
 		tmpres := make(map[string]interface{})
 		if err := mch.mgocol.Find(query).One(&tmpres); err == nil {
-			log.Printf("got result: %v: %v -> %v", tmpres["_id"], tmpres["cmd"], tmpres["timestamp"])
+			stats.Hit()
+			logger.Debug("Cache hit", "id", tmpres["_id"], "cmd", tmpres["cmd"], "timestamp", tmpres["timestamp"])
 			if err := res.Marshal(tmpres["payload"]); err != nil {
-				log.Printf("ERROR converting payload[%+v]: %T %+v", err, tmpres["payload"], tmpres["payload"])
+				logger.Error("Unable to convert cached payload", "cmd", tmpres["cmd"], "type", fmt.Sprintf("%T", tmpres["payload"]), "err", err)
 				res = th.Preform(req)
 			}
 		} else {
-			log.Printf("got error: %+v", err)
+			stats.Miss()
+			logger.Debug("Cache miss", "cmd", info.Command, "err", err)
 			res = th.Preform(req)
 			if !res.IsError() {
 				query["timestamp"] = time.Now()
@@ -55,7 +63,7 @@ func (mch *MongoCacheHandler) Handle(info api.RequestCommandInfo, th api.Transpo
 
 				err := mch.mgocol.Insert(query)
 				if err != nil {
-					log.Printf("Error insering cached entry: %+v", err)
+					logger.Error("Unable to insert cached entry", "cmd", info.Command, "err", err)
 				}
 			}
 		}
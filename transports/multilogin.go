@@ -0,0 +1,228 @@
+package transports
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/swagger"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when a request names a login, or account, that the daemon does not have
+const UnknownLoginStatus api.ErrorStatus = -19
+
+// How often unknown accounts make us reload the accounts of all logins
+var AccountRefreshInterval = time.Minute
+
+// Hosts several Nordnet logins, each with its own transport, and so its own session and rate limit.
+// Requests go to the login in the 'login' argument, else to the login of the 'accno' argument, else to the default login.
+// Accounts without a login returns the accounts of all logins.
+type MultiLoginTransport struct {
+	sync.Mutex
+	logins       map[string]api.TransportHandler
+	names        []string
+	defaultLogin string
+
+	accounts    map[int64]string // accno -> login
+	lastRefresh time.Time
+}
+
+func NewMultiLoginTransport() *MultiLoginTransport {
+	return &MultiLoginTransport{logins: make(map[string]api.TransportHandler), accounts: make(map[int64]string)}
+}
+
+// For builder pattern. The first login is the default.
+func (mt *MultiLoginTransport) AddLogin(name string, th api.TransportHandler) *MultiLoginTransport {
+	mt.Lock()
+	defer mt.Unlock()
+	if _, ok := mt.logins[name]; !ok {
+		mt.names = append(mt.names, name)
+	}
+	mt.logins[name] = th
+	if mt.defaultLogin == "" {
+		mt.defaultLogin = name
+	}
+	return mt
+}
+
+// For builder pattern. Use login for requests without a login, or accno.
+func (mt *MultiLoginTransport) Default(login string) *MultiLoginTransport {
+	mt.Lock()
+	defer mt.Unlock()
+	mt.defaultLogin = login
+	return mt
+}
+
+// For builder pattern. Route accno to login, without asking Nordnet.
+func (mt *MultiLoginTransport) MapAccount(accno int64, login string) *MultiLoginTransport {
+	mt.Lock()
+	defer mt.Unlock()
+	mt.accounts[accno] = login
+	return mt
+}
+
+// The names of the logins, in the order they were added
+func (mt *MultiLoginTransport) Logins() []string {
+	mt.Lock()
+	defer mt.Unlock()
+	return append([]string{}, mt.names...)
+}
+
+// The transport of a login, or nil
+func (mt *MultiLoginTransport) Login(name string) api.TransportHandler {
+	mt.Lock()
+	defer mt.Unlock()
+	return mt.logins[name]
+}
+
+// The known accounts, and their login
+func (mt *MultiLoginTransport) Accounts() map[int64]string {
+	mt.Lock()
+	defer mt.Unlock()
+	res := make(map[int64]string)
+	for accno, login := range mt.accounts {
+		res[accno] = login
+	}
+	return res
+}
+
+// The login the request should go to
+func (mt *MultiLoginTransport) LoginFor(req *api.Request) (string, error) {
+	if login := req.Args["login"]; login != "" {
+		if mt.Login(login) == nil {
+			return "", fmt.Errorf("Unknown login '%s'. Have %v", login, mt.Logins())
+		}
+		return login, nil
+	}
+	if req.Args["accno"] == "" {
+		mt.Lock()
+		defer mt.Unlock()
+		return mt.defaultLogin, nil
+	}
+
+	login := ""
+	for _, s := range strings.Split(req.Args["accno"], ",") {
+		accno, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Unable to parse accno '%s': %v", s, err)
+		}
+		l, err := mt.loginOf(accno)
+		if err != nil {
+			return "", err
+		}
+		if login != "" && login != l {
+			return "", fmt.Errorf("The accounts %s belong to different logins", req.Args["accno"])
+		}
+		login = l
+	}
+	return login, nil
+}
+
+func (mt *MultiLoginTransport) loginOf(accno int64) (string, error) {
+	mt.Lock()
+	login, ok := mt.accounts[accno]
+	refresh := !ok && time.Since(mt.lastRefresh) > AccountRefreshInterval
+	mt.Unlock()
+	if ok {
+		return login, nil
+	}
+	if refresh {
+		mt.allAccounts(nil)
+		mt.Lock()
+		login, ok = mt.accounts[accno]
+		mt.Unlock()
+		if ok {
+			return login, nil
+		}
+	}
+	return "", fmt.Errorf("No login has account %d", accno)
+}
+
+// The accounts of all logins. Also remembers which login each account belongs to.
+func (mt *MultiLoginTransport) allAccounts(req *api.Request) (res api.Response) {
+	if req == nil {
+		req = &api.Request{Command: api.AccountsCmd, Args: api.Params{}}
+	}
+	mt.Lock()
+	mt.lastRefresh = time.Now()
+	mt.Unlock()
+
+	all := []json.RawMessage{}
+	for _, login := range mt.Logins() {
+		r := mt.Login(login).Preform(req)
+		var accounts []json.RawMessage
+		if r.IsError() {
+			logger.Warn("Unable to get accounts", "login", login, "err", r.Error)
+			continue
+		} else if err := r.Unmarshal(&accounts); err != nil {
+			logger.Warn("Unable to parse accounts", "login", login, "err", err)
+			continue
+		}
+		for _, raw := range accounts {
+			var acc swagger.Account
+			if json.Unmarshal(raw, &acc) == nil && acc.Accno != 0 {
+				mt.Lock()
+				if _, mapped := mt.accounts[acc.Accno]; !mapped {
+					mt.accounts[acc.Accno] = login
+				}
+				mt.Unlock()
+			}
+		}
+		all = append(all, accounts...)
+	}
+	res.Success(all)
+	return
+}
+
+// Implements api.TransportHandler
+func (mt *MultiLoginTransport) Preform(req *api.Request) (res api.Response) {
+	if req.Command == api.TransportRespondsToCmd {
+		return mt.respondsTo(req)
+	}
+	if req.Command == api.AccountsCmd && req.Args["login"] == "" {
+		return mt.allAccounts(req)
+	}
+	login, err := mt.LoginFor(req)
+	if err != nil {
+		res.Fail(UnknownLoginStatus, err.Error())
+		return
+	}
+	// The login is ours, so the transport of the login does not see it
+	fwd := *req
+	fwd.Args = make(api.Params)
+	for k, v := range req.Args {
+		if k != "login" {
+			fwd.Args[k] = v
+		}
+	}
+	return mt.Login(login).Preform(&fwd)
+}
+
+// The commands of the logins, with a login argument added. The argument is also what keeps the cache of each login apart.
+func (mt *MultiLoginTransport) respondsTo(req *api.Request) (res api.Response) {
+	names := mt.Logins()
+	sort.Strings(names)
+	cmds := map[api.RequestCommand]*api.RequestCommandInfo{}
+	for _, login := range names {
+		var loginCmds []*api.RequestCommandInfo
+		if r := mt.Login(login).Preform(req); r.IsError() || r.Unmarshal(&loginCmds) != nil {
+			logger.Warn("Unable to get commands", "login", login, "err", r.Error)
+			continue
+		}
+		for _, cmd := range loginCmds {
+			if _, ok := cmds[cmd.Command]; !ok {
+				cmds[cmd.Command] = cmd.AddFullArgument("login", "The login to use. Default is the login of accno", names, true)
+			}
+		}
+	}
+	arr := []*api.RequestCommandInfo{}
+	for _, cmd := range cmds {
+		arr = append(arr, cmd)
+	}
+	res.Success(arr)
+	return
+}
@@ -0,0 +1,673 @@
+// Package paper simulates a broker account. Orders are matched against the feed, instead of being sent to the market.
+// The PaperTransport handles the order and account commands, and forwards everything else to a real transport.
+package paper
+
+import (
+	"fmt"
+	"github.com/Forau/yanngo/feed"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/nnutils"
+	"github.com/Forau/yanngo/swagger"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Order states, as used by Nordnet
+const (
+	OrderOnMarket = "ON_MARKET"
+	OrderDone     = "DONE"
+	OrderDeleted  = "DELETED"
+)
+
+type tradableKey struct {
+	identifier string
+	market     int64
+}
+
+type quote struct {
+	bid, ask, last       float64
+	bidVolume, askVolume float64
+	levels               []feedmodel.FeedDepthLevel // From depth, if subscribed
+	hasDepth             bool
+
+	// Volume our orders have taken from each level of the book, so the same volume is not filled twice
+	askTaken, bidTaken map[float64]float64
+
+	// Traded volume, from the last price update, that orders can still be filled against when there is no book
+	tradeVolume    float64
+	turnoverVolume int64
+	tradeTimestamp int64
+}
+
+func newQuote() *quote {
+	return &quote{askTaken: make(map[float64]float64), bidTaken: make(map[float64]float64)}
+}
+
+func (q *quote) taken(buy bool) map[float64]float64 {
+	if buy {
+		return q.askTaken
+	}
+	return q.bidTaken
+}
+
+// Forget what we took from levels that are gone from the book, and never count more than the level shows
+func (q *quote) prune() {
+	for _, buy := range []bool{true, false} {
+		prices, volumes := q.book(buy)
+		shown := make(map[float64]float64)
+		for idx, price := range prices {
+			shown[price] = volumes[idx]
+		}
+		taken := q.taken(buy)
+		for price, vol := range taken {
+			if s, ok := shown[price]; !ok {
+				delete(taken, price)
+			} else if vol > s {
+				taken[price] = s
+			}
+		}
+	}
+}
+
+// Register the trade of a price update. The volume is what traded since the last update, if we know the turnover.
+func (q *quote) onTrade(price *feedmodel.FeedPriceData) {
+	switch {
+	case price.Turnover_volume > q.turnoverVolume && q.turnoverVolume > 0:
+		q.tradeVolume = float64(price.Turnover_volume - q.turnoverVolume)
+	case price.Trade_timestamp != q.tradeTimestamp && price.Last_volume > 0:
+		q.tradeVolume = float64(price.Last_volume)
+	}
+	if price.Turnover_volume > 0 {
+		q.turnoverVolume = price.Turnover_volume
+	}
+	q.tradeTimestamp = price.Trade_timestamp
+}
+
+// Levels to match against, best first. Depth if we have it, else best bid and ask.
+func (q *quote) book(buy bool) (prices, volumes []float64) {
+	if q.hasDepth {
+		for _, l := range q.levels {
+			if buy && l.Ask > 0 {
+				prices, volumes = append(prices, l.Ask), append(volumes, float64(l.AskVolume))
+			} else if !buy && l.Bid > 0 {
+				prices, volumes = append(prices, l.Bid), append(volumes, float64(l.BidVolume))
+			}
+		}
+		return
+	}
+	if buy && q.ask > 0 {
+		return []float64{q.ask}, []float64{q.askVolume}
+	} else if !buy && q.bid > 0 {
+		return []float64{q.bid}, []float64{q.bidVolume}
+	}
+	return
+}
+
+type position struct {
+	qty      float64
+	acqPrice float64 // Average cost
+	currency string
+}
+
+type paperOrder struct {
+	swagger.Order
+	activeAt int64 // Simulated latency. Not matched before this time
+}
+
+// Commission for a trade, given the traded value
+type CommissionFn func(value float64) float64
+
+// A commission of percent of the value, but at least minimum
+func PercentCommission(percent, minimum float64) CommissionFn {
+	return func(value float64) float64 {
+		if c := value * percent / 100; c > minimum {
+			return c
+		}
+		return minimum
+	}
+}
+
+// The simulated account. Feed it messages with OnMessage, or Bind it to a FeedState.
+//
+// Order and privtrade messages are published synchronously, outside the lock, and in order. That includes the
+// fills of a marketable order, which are published from CreateOrder, before the caller gets the OrderReply.
+// Nordnet usually sends the reply first, but the feed is a separate connection, so listeners must handle both.
+// Keeping it synchronous makes backtests deterministic.
+type PaperBroker struct {
+	sync.Mutex
+	accno     int64
+	currency  string
+	cash      float64
+	orders    map[int64]*paperOrder
+	positions map[tradableKey]*position
+	trades    []swagger.Trade
+	quotes    map[tradableKey]*quote
+	nextId    int64
+
+	clock      func() int64
+	publish    feed.FeedClient
+	commission CommissionFn
+	slippage   int64 // Ticks worse than the book
+	latency    int64 // Millis before an order reaches the market
+	ticks      nnutils.TickTableUtil
+	partial    bool // If false, only fill orders in full
+}
+
+func NewPaperBroker(accno int64, currency string, cash float64) *PaperBroker {
+	return &PaperBroker{
+		accno:      accno,
+		currency:   currency,
+		cash:       cash,
+		orders:     make(map[int64]*paperOrder),
+		positions:  make(map[tradableKey]*position),
+		quotes:     make(map[tradableKey]*quote),
+		nextId:     1,
+		clock:      func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+		publish:    func(*feedmodel.FeedMsg) {},
+		commission: func(float64) float64 { return 0 },
+		ticks:      nnutils.NewDefaultTickTableUtil(),
+		partial:    true,
+	}
+}
+
+// Listen to the messages of the FeedState, and publish order and privtrade messages on its topic
+func (pb *PaperBroker) Bind(fs *feed.FeedState) *PaperBroker {
+	pb.SetPublisher(fs.Publish)
+	fs.AddListener(pb.OnMessage)
+	return pb
+}
+
+func (pb *PaperBroker) SetPublisher(publish feed.FeedClient) *PaperBroker {
+	pb.Lock()
+	defer pb.Unlock()
+	pb.publish = publish
+	return pb
+}
+
+// Override the clock. Used by backtests.
+func (pb *PaperBroker) SetClock(clock func() int64) *PaperBroker {
+	pb.Lock()
+	defer pb.Unlock()
+	pb.clock = clock
+	return pb
+}
+
+func (pb *PaperBroker) SetCommission(fn CommissionFn) *PaperBroker {
+	pb.Lock()
+	defer pb.Unlock()
+	pb.commission = fn
+	return pb
+}
+
+// Fill this many ticks worse than the book
+func (pb *PaperBroker) SetSlippage(ticks int64) *PaperBroker {
+	pb.Lock()
+	defer pb.Unlock()
+	pb.slippage = ticks
+	return pb
+}
+
+// Orders are not matched until latency millis after they are placed
+func (pb *PaperBroker) SetLatency(millis int64) *PaperBroker {
+	pb.Lock()
+	defer pb.Unlock()
+	pb.latency = millis
+	return pb
+}
+
+// If false, orders are only filled when the book has the full volume
+func (pb *PaperBroker) SetPartialFills(partial bool) *PaperBroker {
+	pb.Lock()
+	defer pb.Unlock()
+	pb.partial = partial
+	return pb
+}
+
+func (pb *PaperBroker) Accno() int64 {
+	return pb.accno
+}
+
+func (pb *PaperBroker) Cash() float64 {
+	pb.Lock()
+	defer pb.Unlock()
+	return pb.cash
+}
+
+// Handle price and depth messages. Implements feed.FeedClient.
+func (pb *PaperBroker) OnMessage(msg *feedmodel.FeedMsg) {
+	if msg == nil {
+		return
+	}
+	var key tradableKey
+	var update func(q *quote)
+	switch msg.Type {
+	case "price":
+		var price feedmodel.FeedPriceData
+		if msg.DecodeData(&price) != nil {
+			return
+		}
+		key = tradableKey{price.Identifier, price.Market}
+		update = func(q *quote) {
+			if price.Bid > 0 || price.Ask > 0 {
+				q.bid, q.ask, q.bidVolume, q.askVolume = price.Bid, price.Ask, price.Bid_volume, price.Ask_volume
+			}
+			if price.Last > 0 {
+				q.last = price.Last
+				q.onTrade(&price)
+			}
+		}
+	case "depth":
+		var depth feedmodel.FeedDepthData
+		if msg.DecodeData(&depth) != nil {
+			return
+		}
+		key = tradableKey{depth.Identifier, depth.Market}
+		update = func(q *quote) {
+			q.levels, q.hasDepth = depth.Levels(), true
+		}
+	default:
+		return
+	}
+
+	pb.Lock()
+	q, ok := pb.quotes[key]
+	if !ok {
+		q = newQuote()
+		pb.quotes[key] = q
+	}
+	update(q)
+	q.prune()
+	events := pb.matchLocked(key)
+	publish := pb.publish
+	pb.Unlock()
+	for _, e := range events {
+		publish(e)
+	}
+}
+
+// Try to match all active orders. Call periodically if latency is used, and the feed is slow.
+func (pb *PaperBroker) Match() {
+	pb.Lock()
+	var events []*feedmodel.FeedMsg
+	for key := range pb.quotes {
+		events = append(events, pb.matchLocked(key)...)
+	}
+	publish := pb.publish
+	pb.Unlock()
+	for _, e := range events {
+		publish(e)
+	}
+}
+
+// Caller must hold the lock
+func (pb *PaperBroker) matchLocked(key tradableKey) (events []*feedmodel.FeedMsg) {
+	q, ok := pb.quotes[key]
+	if !ok {
+		return
+	}
+	now := pb.clock()
+	ids := []int64{}
+	for id, o := range pb.orders {
+		if o.OrderState == OrderOnMarket && o.Tradable.Identifier == key.identifier && o.Tradable.MarketId == key.market && o.activeAt <= now {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(int64s(ids)) // Time priority
+	for _, id := range ids {
+		events = append(events, pb.matchOrderLocked(pb.orders[id], q, now)...)
+	}
+	return
+}
+
+// Caller must hold the lock
+func (pb *PaperBroker) matchOrderLocked(o *paperOrder, q *quote, now int64) (events []*feedmodel.FeedMsg) {
+	buy := o.Side == "BUY"
+	prices, volumes := q.book(buy)
+	taken := q.taken(buy)
+	noBook := false
+	if len(prices) == 0 && q.last > 0 && q.tradeVolume > 0 {
+		// No book. Fill if the last trade went through our limit, up to its volume
+		if (buy && q.last < o.Price.Value) || (!buy && q.last > o.Price.Value) {
+			prices, volumes, noBook = []float64{o.Price.Value}, []float64{q.tradeVolume}, true
+		}
+	}
+
+	type fill struct {
+		price, volume float64
+		known         bool // The book showed the volume, so we take from it
+	}
+	fills := []fill{}
+	open := o.Volume - o.TradedVolume
+	for idx, price := range prices {
+		if (buy && price > o.Price.Value) || (!buy && price < o.Price.Value) || open <= 0 {
+			break
+		}
+		vol := volumes[idx]
+		if vol > 0 && !noBook {
+			vol -= taken[price] // What earlier orders took
+			if vol <= 0 {
+				continue
+			}
+		}
+		if vol <= 0 || vol > open {
+			vol = open // Unknown book volume, like prices without volume, is assumed to be enough
+		}
+		fills = append(fills, fill{price, vol, volumes[idx] > 0})
+		open -= vol
+	}
+	if len(fills) == 0 || (!pb.partial && open > 0) {
+		if o.OrderType == "FAK" || o.OrderType == "FOK" {
+			events = append(events, pb.deleteLocked(o, now))
+		}
+		return
+	}
+	if o.OrderType == "FOK" && open > 0 {
+		return append(events, pb.deleteLocked(o, now))
+	}
+
+	for _, f := range fills {
+		if noBook {
+			q.tradeVolume -= f.volume
+		} else if f.known {
+			taken[f.price] += f.volume
+		}
+		price := f.price
+		if pb.slippage > 0 {
+			if buy {
+				price = pb.ticks.AddTicks(price, pb.slippage)
+			} else {
+				price = pb.ticks.AddTicks(price, -pb.slippage)
+			}
+		}
+		events = append(events, pb.fillLocked(o, price, f.volume, now))
+	}
+	if o.TradedVolume >= o.Volume {
+		o.OrderState = OrderDone
+		o.OpenVolume = 0
+	} else if o.OrderType == "FAK" {
+		return append(events, pb.deleteLocked(o, now))
+	}
+	o.Modified = now
+	return append(events, orderMsg(o))
+}
+
+// Caller must hold the lock
+func (pb *PaperBroker) fillLocked(o *paperOrder, price, volume float64, now int64) *feedmodel.FeedMsg {
+	key := tradableKey{o.Tradable.Identifier, o.Tradable.MarketId}
+	value := price * volume
+	commission := pb.commission(value)
+	sign := 1.0
+	if o.Side == "SELL" {
+		sign = -1
+	}
+
+	pos, ok := pb.positions[key]
+	if !ok {
+		pos = &position{currency: pb.currency}
+		pb.positions[key] = pos
+	}
+	newQty := pos.qty + sign*volume
+	switch {
+	case newQty == 0:
+		pos.acqPrice = 0
+	case pos.qty == 0 || (pos.qty > 0) != (newQty > 0):
+		pos.acqPrice = price // New position, or flipped side
+	case (pos.qty > 0) == (sign > 0):
+		pos.acqPrice = (pos.acqPrice*pos.qty + price*sign*volume) / newQty // Added to the position
+	}
+	pos.qty = newQty
+	pb.cash -= sign*value + commission
+
+	o.TradedVolume += volume
+	o.OpenVolume = o.Volume - o.TradedVolume
+	trade := swagger.Trade{
+		Accno:     pb.accno,
+		OrderId:   o.OrderId,
+		TradeId:   fmt.Sprintf("P%d-%d", o.OrderId, len(pb.trades)+1),
+		Tradable:  o.Tradable,
+		Price:     swagger.Amount{Value: price, Currency: pb.currency},
+		Volume:    volume,
+		Side:      o.Side,
+		Tradetime: now,
+	}
+	pb.trades = append(pb.trades, trade)
+	msg, _ := feedmodel.NewFeedMsgFromObject("privtrade", &trade)
+	return msg
+}
+
+// Caller must hold the lock
+func (pb *PaperBroker) deleteLocked(o *paperOrder, now int64) *feedmodel.FeedMsg {
+	o.OrderState, o.OpenVolume, o.Modified = OrderDeleted, 0, now
+	return orderMsg(o)
+}
+
+func orderMsg(o *paperOrder) *feedmodel.FeedMsg {
+	msg, _ := feedmodel.NewFeedMsgFromObject("order", &o.Order)
+	return msg
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// ---------- Order entry
+
+func (pb *PaperBroker) checkAccno(accno int64) error {
+	if accno != pb.accno {
+		return fmt.Errorf("Unknown account %d", accno)
+	}
+	return nil
+}
+
+// Place an order. It is matched right away, if we have a quote, and its events are published before returning.
+func (pb *PaperBroker) CreateOrder(accno int64, identifier string, market int64, side string, price, volume float64,
+	orderType, reference string) (reply swagger.OrderReply, err error) {
+	if err = pb.checkAccno(accno); err != nil {
+		return
+	}
+	if side != "BUY" && side != "SELL" {
+		return reply, fmt.Errorf("Side must be BUY or SELL, not '%s'", side)
+	}
+	if volume <= 0 || price <= 0 {
+		return reply, fmt.Errorf("Price and volume must be positive")
+	}
+	if orderType == "" {
+		orderType = "LIMIT"
+	}
+	switch orderType {
+	case "LIMIT", "FAK", "FOK":
+	default:
+		return reply, fmt.Errorf("Order type %s is not supported when paper trading", orderType)
+	}
+
+	pb.Lock()
+	now := pb.clock()
+	o := &paperOrder{Order: swagger.Order{
+		Accno:      accno,
+		OrderId:    pb.nextId,
+		Price:      swagger.Amount{Value: price, Currency: pb.currency},
+		Volume:     volume,
+		Tradable:   swagger.TradableId{Identifier: identifier, MarketId: market},
+		OpenVolume: volume,
+		Side:       side,
+		Modified:   now,
+		Reference:  reference,
+		OrderType:  orderType,
+		OrderState: OrderOnMarket,
+		Validity:   swagger.Validity{Typ: "DAY"},
+	}, activeAt: now + pb.latency}
+	pb.nextId++
+	pb.orders[o.OrderId] = o
+	events := []*feedmodel.FeedMsg{orderMsg(o)}
+	if pb.latency == 0 {
+		if q, ok := pb.quotes[tradableKey{identifier, market}]; ok {
+			events = append(events, pb.matchOrderLocked(o, q, now)...)
+		}
+	}
+	reply = swagger.OrderReply{OrderId: o.OrderId, ResultCode: "OK", OrderState: o.OrderState, ActionState: "INS_CONF"}
+	publish := pb.publish
+	pb.Unlock()
+
+	for _, e := range events {
+		publish(e)
+	}
+	return
+}
+
+// Change price and volume. Volume is the new total volume.
+func (pb *PaperBroker) UpdateOrder(accno, orderId int64, price, volume float64) (reply swagger.OrderReply, err error) {
+	if err = pb.checkAccno(accno); err != nil {
+		return
+	}
+	pb.Lock()
+	o, ok := pb.orders[orderId]
+	if !ok || o.OrderState != OrderOnMarket {
+		pb.Unlock()
+		return reply, fmt.Errorf("Order %d not found, or not on market", orderId)
+	}
+	if volume < o.TradedVolume {
+		pb.Unlock()
+		return reply, fmt.Errorf("Volume %v is less then traded volume %v", volume, o.TradedVolume)
+	}
+	now := pb.clock()
+	if price > 0 {
+		o.Price.Value = price
+	}
+	if volume > 0 {
+		o.Volume, o.OpenVolume = volume, volume-o.TradedVolume
+	}
+	o.Modified = now
+	if o.OpenVolume == 0 {
+		o.OrderState = OrderDone
+	}
+	events := []*feedmodel.FeedMsg{orderMsg(o)}
+	if q, ok := pb.quotes[tradableKey{o.Tradable.Identifier, o.Tradable.MarketId}]; ok && o.OrderState == OrderOnMarket && o.activeAt <= now {
+		events = append(events, pb.matchOrderLocked(o, q, now)...)
+	}
+	reply = swagger.OrderReply{OrderId: orderId, ResultCode: "OK", OrderState: o.OrderState, ActionState: "MOD_CONF"}
+	publish := pb.publish
+	pb.Unlock()
+
+	for _, e := range events {
+		publish(e)
+	}
+	return
+}
+
+func (pb *PaperBroker) DeleteOrder(accno, orderId int64) (reply swagger.OrderReply, err error) {
+	if err = pb.checkAccno(accno); err != nil {
+		return
+	}
+	pb.Lock()
+	o, ok := pb.orders[orderId]
+	if !ok || o.OrderState != OrderOnMarket {
+		pb.Unlock()
+		return reply, fmt.Errorf("Order %d not found, or not on market", orderId)
+	}
+	event := pb.deleteLocked(o, pb.clock())
+	reply = swagger.OrderReply{OrderId: orderId, ResultCode: "OK", OrderState: o.OrderState, ActionState: "DEL_CONF"}
+	publish := pb.publish
+	pb.Unlock()
+
+	publish(event)
+	return
+}
+
+// ---------- Account state
+
+func (pb *PaperBroker) Orders() (res []swagger.Order) {
+	pb.Lock()
+	defer pb.Unlock()
+	ids := []int64{}
+	for id := range pb.orders {
+		ids = append(ids, id)
+	}
+	sort.Sort(int64s(ids))
+	res = []swagger.Order{}
+	for _, id := range ids {
+		res = append(res, pb.orders[id].Order)
+	}
+	return
+}
+
+func (pb *PaperBroker) Trades() (res []swagger.Trade) {
+	pb.Lock()
+	defer pb.Unlock()
+	return append([]swagger.Trade{}, pb.trades...)
+}
+
+// Last price we know, or the mid of bid and ask
+func (q *quote) mark() float64 {
+	if q.last > 0 {
+		return q.last
+	}
+	if q.bid > 0 && q.ask > 0 {
+		return (q.bid + q.ask) / 2
+	}
+	return 0
+}
+
+// Positions, valued at the last price we know. Closed positions are not included.
+func (pb *PaperBroker) Positions() (res []swagger.Position) {
+	pb.Lock()
+	defer pb.Unlock()
+	res = []swagger.Position{}
+	for key, pos := range pb.positions {
+		if pos.qty == 0 {
+			continue
+		}
+		price := pos.acqPrice
+		if q, ok := pb.quotes[key]; ok && q.mark() > 0 {
+			price = q.mark()
+		}
+		value := swagger.Amount{Value: price * pos.qty, Currency: pos.currency}
+		acq := swagger.Amount{Value: pos.acqPrice, Currency: pos.currency}
+		res = append(res, swagger.Position{
+			Accno: pb.accno,
+			Instrument: swagger.Instrument{
+				Currency:  pos.currency,
+				Tradables: []swagger.Tradable{{Identifier: key.identifier, MarketId: key.market}},
+			},
+			Qty:            float32(pos.qty),
+			MarketValue:    value,
+			MarketValueAcc: value,
+			AcqPrice:       acq,
+			AcqPriceAcc:    acq,
+		})
+	}
+	return
+}
+
+// Cash plus the market value of the positions
+func (pb *PaperBroker) Equity() (equity float64) {
+	equity = pb.Cash()
+	for _, pos := range pb.Positions() {
+		equity += pos.MarketValue.Value
+	}
+	return
+}
+
+func (pb *PaperBroker) Ledgers() swagger.LedgerInformation {
+	cash := swagger.Amount{Value: pb.Cash(), Currency: pb.currency}
+	return swagger.LedgerInformation{
+		Total: cash,
+		Ledgers: []swagger.Ledger{{Currency: pb.currency, AccountSum: cash, AccountSumAcc: cash,
+			ExchangeRate: swagger.Amount{Value: 1, Currency: pb.currency}}},
+	}
+}
+
+func (pb *PaperBroker) AccountInfo() swagger.AccountInfo {
+	cash := pb.Cash()
+	equity := pb.Equity()
+	amount := func(v float64) swagger.Amount { return swagger.Amount{Value: v, Currency: pb.currency} }
+	return swagger.AccountInfo{
+		AccountCurrency: pb.currency,
+		AccountSum:      amount(cash),
+		FullMarketvalue: amount(equity - cash),
+		OwnCapital:      amount(equity),
+		TradingPower:    amount(cash),
+	}
+}
@@ -0,0 +1,178 @@
+package paper_test
+
+import (
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/feed/feedmodel"
+	"github.com/Forau/yanngo/swagger"
+	"github.com/Forau/yanngo/transports/paper"
+
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.001
+}
+
+func msg(typ string, data interface{}) *feedmodel.FeedMsg {
+	m, _ := feedmodel.NewFeedMsgFromObject(typ, data)
+	return m
+}
+
+func TestPaperTrading(t *testing.T) {
+	real := make(api.RequestCommandTransport)
+	real.AddCommand(string(api.TradableInfoCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		return json.Marshal([]swagger.TradableInfo{{Identifier: p["ids"]}})
+	})
+	real.AddCommand(string(api.CreateOrderCmd)).Handler(func(p api.Params) (json.RawMessage, error) {
+		t.Error("Real order placed when paper trading")
+		return nil, nil
+	})
+
+	broker := paper.NewPaperBroker(1, "SEK", 100000).SetCommission(paper.PercentCommission(0.1, 1))
+	var fills []feedmodel.FeedPrivateTradeData
+	broker.SetPublisher(func(m *feedmodel.FeedMsg) {
+		var trade feedmodel.FeedPrivateTradeData
+		if m.Type == "privtrade" && m.DecodeData(&trade) == nil {
+			fills = append(fills, trade)
+		}
+	})
+	pt := paper.NewPaperTransport(broker, real)
+	cli := api.NewApiClient(pt)
+
+	// Market data is forwarded
+	if info, err := cli.TradableInfo("11:101"); err != nil || len(info) != 1 || info[0].Identifier != "11:101" {
+		t.Errorf("Expected TradableInfo from real transport: %+v, %+v", info, err)
+	}
+	var cmds []api.RequestCommandInfo
+	res := pt.Preform(&api.Request{Command: api.TransportRespondsToCmd})
+	res.Unmarshal(&cmds)
+	if len(cmds) != 10 {
+		t.Errorf("Expected 9 paper commands and 1 forwarded, but got %d", len(cmds))
+	}
+
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11, Bid: 99, Bid_volume: 50, Ask: 100, Ask_volume: 50}))
+	if reply, err := cli.CreateOrder(&api.AccountOrder{Accno: 1, Identifier: "101", MarketId: 11, Price: 100, Volume: 30, Side: "BUY"}); err != nil || reply.OrderId != 1 {
+		t.Fatalf("Unable to place order: %+v, %+v", reply, err)
+	}
+	resting, _ := cli.CreateOrder(&api.AccountOrder{Accno: 1, Identifier: "101", MarketId: 11, Price: 99.5, Volume: 100, Side: "BUY"})
+	if len(fills) != 1 {
+		t.Fatalf("Expected only the first order to fill: %+v", fills)
+	}
+	broker.OnMessage(msg("depth", &feedmodel.FeedDepthData{Identifier: "101", Market: 11,
+		Bid1: 99, Bid_volume1: 50, Ask1: 99.25, Ask_volume1: 40, Ask2: 99.5, Ask_volume2: 100}))
+	if len(fills) != 3 || fills[1].Price.Value != 99.25 || fills[2].Volume != 60 || fills[2].OrderId != resting.OrderId {
+		t.Fatalf("Expected resting order to fill on two levels: %+v", fills)
+	}
+
+	fak, _ := cli.CreateOrder(&api.AccountOrder{Accno: 1, Identifier: "101", MarketId: 11, Price: 98, Volume: 200, Side: "SELL", OrderType: "FAK"})
+	if _, err := cli.DeleteOrder(1, fak.OrderId); err == nil {
+		t.Error("Expected FAK to be deleted after partial fill")
+	}
+	if _, err := cli.AccountOrders(2); err == nil {
+		t.Error("Expected error on unknown account")
+	}
+
+	positions, err := cli.AccountPositions(1)
+	if err != nil || len(positions) != 1 || positions[0].Qty != 80 || !near(positions[0].AcqPrice.Value, (3000+3970+5970)/130.0) {
+		t.Errorf("Unexpected positions: %+v: %+v", positions, err)
+	}
+	ledgers, _ := cli.AccountLedgers(1)
+	if !near(ledgers.Total.Value, 100000-3003-3973.97-5975.97+4945.05) {
+		t.Errorf("Unexpected cash: %+v", ledgers)
+	}
+	orders, _ := cli.AccountOrders(1)
+	trades, _ := cli.AccountTrades(1)
+	if len(orders) != 3 || orders[2].OrderState != paper.OrderDeleted || orders[2].TradedVolume != 50 || len(trades) != 4 {
+		t.Errorf("Unexpected orders %+v, or trades %+v", orders, trades)
+	}
+}
+
+func TestPaperLatencyAndUpdate(t *testing.T) {
+	now := int64(1000)
+	broker := paper.NewPaperBroker(1, "SEK", 1000).SetLatency(100).SetClock(func() int64 { return now })
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11, Bid: 9, Ask: 10}))
+
+	reply, _ := broker.CreateOrder(1, "101", 11, "BUY", 9.5, 10, "", "")
+	broker.Match()
+	now = 1200
+	broker.Match()
+	if len(broker.Trades()) != 0 {
+		t.Fatalf("Expected no fill below ask: %+v", broker.Trades())
+	}
+	broker.UpdateOrder(1, reply.OrderId, 10, 20)
+	if trades := broker.Trades(); len(trades) != 1 || trades[0].Volume != 20 || !near(broker.Cash(), 800) {
+		t.Errorf("Expected fill of 20 after update: %+v, cash %v", trades, broker.Cash())
+	}
+	// Without a last price, positions are marked at mid
+	if !near(broker.Equity(), 990) {
+		t.Errorf("Expected equity marked at 9.5, but got %v", broker.Equity())
+	}
+}
+
+func TestPaperBookVolume(t *testing.T) {
+	broker := paper.NewPaperBroker(1, "SEK", 100000)
+	var orders []feedmodel.FeedOrderData
+	var events []string
+	broker.SetPublisher(func(m *feedmodel.FeedMsg) {
+		events = append(events, m.Type)
+		var order feedmodel.FeedOrderData
+		if m.Type == "order" && m.DecodeData(&order) == nil {
+			orders = append(orders, order)
+		}
+	})
+	filled := func(orderId int64) (res float64) {
+		for _, trade := range broker.Trades() {
+			if trade.OrderId == orderId {
+				res += trade.Volume
+			}
+		}
+		return
+	}
+
+	// The ask volume is shared by the orders, and is not filled again on the next tick
+	ask := msg("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11, Bid: 99, Bid_volume: 50, Ask: 100, Ask_volume: 50})
+	broker.OnMessage(ask)
+	first, _ := broker.CreateOrder(1, "101", 11, "BUY", 100, 40, "", "")
+	second, _ := broker.CreateOrder(1, "101", 11, "BUY", 100, 40, "", "")
+	broker.OnMessage(ask)
+	if filled(first.OrderId) != 40 || filled(second.OrderId) != 10 {
+		t.Fatalf("Expected the 50 on the ask to be shared: %+v", broker.Trades())
+	}
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "101", Market: 11, Bid: 99, Bid_volume: 50, Ask: 100, Ask_volume: 70}))
+	if filled(second.OrderId) != 30 {
+		t.Errorf("Expected 20 more when the ask grew to 70: %+v", broker.Trades())
+	}
+
+	// Without a book, orders fill up to the traded volume
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "102", Market: 11, Last: 10, Last_volume: 5,
+		Turnover_volume: 100, Trade_timestamp: 1}))
+	third, _ := broker.CreateOrder(1, "102", 11, "BUY", 11, 20, "", "")
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "102", Market: 11, Last: 10, Last_volume: 5,
+		Turnover_volume: 100, Trade_timestamp: 1}))
+	if filled(third.OrderId) != 5 {
+		t.Fatalf("Expected a fill of the last volume only: %+v", broker.Trades())
+	}
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "102", Market: 11, Last: 10, Last_volume: 4,
+		Turnover_volume: 112, Trade_timestamp: 2}))
+	if filled(third.OrderId) != 17 {
+		t.Errorf("Expected a fill of the 12 traded since the last update: %+v", broker.Trades())
+	}
+
+	// Events of a marketable order are published before CreateOrder returns, the order first
+	events = nil
+	broker.OnMessage(msg("price", &feedmodel.FeedPriceData{Identifier: "103", Market: 11, Bid: 99, Bid_volume: 50, Ask: 100, Ask_volume: 50}))
+	if _, err := broker.CreateOrder(1, "103", 11, "BUY", 100, 10, "", ""); err != nil || len(events) != 3 ||
+		events[0] != "order" || events[1] != "privtrade" || events[2] != "order" {
+		t.Errorf("Expected the order, the trade and the done order, before the reply: %+v, %+v", events, err)
+	}
+
+	// Reducing the volume to what is traded makes the order done, and the event says so
+	if reply, err := broker.UpdateOrder(1, third.OrderId, 0, 17); err != nil || reply.OrderState != paper.OrderDone {
+		t.Fatalf("Unable to update: %+v, %+v", reply, err)
+	}
+	if last := orders[len(orders)-1]; last.OrderId != third.OrderId || last.OrderState != paper.OrderDone {
+		t.Errorf("Expected the update event to be DONE: %+v", last)
+	}
+}
@@ -0,0 +1,170 @@
+package paper
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Forau/yanngo/api"
+	"github.com/Forau/yanngo/swagger"
+)
+
+// Transport with the order and account commands against a PaperBroker. Other commands, like market data,
+// are forwarded to the real transport, so it can be used alone, or mixed with real handlers in a TransportRouter.
+type PaperTransport struct {
+	api.RequestCommandTransport
+	broker *PaperBroker
+	real   api.TransportHandler // Optional
+}
+
+func NewPaperTransport(broker *PaperBroker, real api.TransportHandler) *PaperTransport {
+	pt := &PaperTransport{RequestCommandTransport: make(api.RequestCommandTransport), broker: broker, real: real}
+	pt.init()
+	return pt
+}
+
+func (pt *PaperTransport) Broker() *PaperBroker {
+	return pt.broker
+}
+
+// Implements api.TransportHandler
+func (pt *PaperTransport) Preform(req *api.Request) (res api.Response) {
+	if req.Command == api.TransportRespondsToCmd {
+		cmds := []*api.RequestCommandInfo{}
+		if pt.real != nil {
+			var realCmds []*api.RequestCommandInfo
+			if r := pt.real.Preform(req); !r.IsError() && r.Unmarshal(&realCmds) == nil {
+				for _, cmd := range realCmds {
+					if _, ok := pt.RequestCommandTransport[cmd.Command]; !ok {
+						cmds = append(cmds, cmd)
+					}
+				}
+			}
+		}
+		for _, cmd := range pt.RequestCommandTransport {
+			cmds = append(cmds, cmd)
+		}
+		res.Success(cmds)
+		return
+	}
+	if _, ok := pt.RequestCommandTransport[req.Command]; ok || pt.real == nil {
+		return pt.RequestCommandTransport.Preform(req)
+	}
+	return pt.real.Preform(req)
+}
+
+func parseArgs(params api.Params, dst map[string]interface{}) error {
+	for key, ptr := range dst {
+		if v := params[key]; v != "" {
+			if _, err := fmt.Sscan(v, ptr); err != nil {
+				return fmt.Errorf("Bad %s '%s': %v", key, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (pt *PaperTransport) accno(params api.Params) (accno int64, err error) {
+	if err = parseArgs(params, map[string]interface{}{"accno": &accno}); err == nil {
+		err = pt.broker.checkAccno(accno)
+	}
+	return
+}
+
+func (pt *PaperTransport) init() {
+	pb := pt.broker
+
+	pt.AddCommand(string(api.AccountsCmd)).Description("Paper account").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			return json.Marshal([]swagger.Account{{Accno: pb.Accno(), Typ: "PAPER", IsDefault: true, Alias: "Paper"}})
+		})
+
+	pt.AddCommand(string(api.AccountCmd)).Description("Paper account info").AddArgument("accno").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if _, err := pt.accno(params); err != nil {
+				return nil, err
+			}
+			return json.Marshal(pb.AccountInfo())
+		})
+
+	pt.AddCommand(string(api.AccountLedgersCmd)).Description("Paper account ledgers").AddArgument("accno").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if _, err := pt.accno(params); err != nil {
+				return nil, err
+			}
+			return json.Marshal(pb.Ledgers())
+		})
+
+	pt.AddCommand(string(api.AccountOrdersCmd)).Description("Paper account orders").AddArgument("accno").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if _, err := pt.accno(params); err != nil {
+				return nil, err
+			}
+			return json.Marshal(pb.Orders())
+		})
+
+	pt.AddCommand(string(api.AccountPositionsCmd)).Description("Paper account positions").AddArgument("accno").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if _, err := pt.accno(params); err != nil {
+				return nil, err
+			}
+			return json.Marshal(pb.Positions())
+		})
+
+	pt.AddCommand(string(api.AccountTradesCmd)).Description("Paper account trades").AddArgument("accno").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			if _, err := pt.accno(params); err != nil {
+				return nil, err
+			}
+			return json.Marshal(pb.Trades())
+		})
+
+	pt.AddCommand(string(api.CreateOrderCmd)).Description("Place a paper order").
+		AddArgument("accno").AddArgument("identifier").AddArgument("market_id").AddArgument("price").
+		AddArgument("currency").AddArgument("volume").
+		AddFullArgument("side", "Buy or Sell", []string{"BUY", "SELL"}, false).
+		AddFullArgument("order_type", "The order type", []string{"FAK", "FOK", "LIMIT"}, true).
+		AddOptArgument("reference").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			var accno, market int64
+			var price, volume float64
+			err := parseArgs(params, map[string]interface{}{"accno": &accno, "market_id": &market, "price": &price, "volume": &volume})
+			if err != nil {
+				return nil, err
+			}
+			reply, err := pb.CreateOrder(accno, params["identifier"], market, params["side"], price, volume,
+				params["order_type"], params["reference"])
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(reply)
+		})
+
+	pt.AddCommand(string(api.UpdateOrderCmd)).Description("Modify a paper order").
+		AddArgument("accno").AddArgument("order_id").AddArgument("price").AddArgument("currency").AddArgument("volume").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			var accno, orderId int64
+			var price, volume float64
+			err := parseArgs(params, map[string]interface{}{"accno": &accno, "order_id": &orderId, "price": &price, "volume": &volume})
+			if err != nil {
+				return nil, err
+			}
+			reply, err := pb.UpdateOrder(accno, orderId, price, volume)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(reply)
+		})
+
+	pt.AddCommand(string(api.DeleteOrderCmd)).Description("Delete a paper order").
+		AddArgument("accno").AddArgument("order_id").
+		Handler(func(params api.Params) (json.RawMessage, error) {
+			var accno, orderId int64
+			if err := parseArgs(params, map[string]interface{}{"accno": &accno, "order_id": &orderId}); err != nil {
+				return nil, err
+			}
+			reply, err := pb.DeleteOrder(accno, orderId)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(reply)
+		})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/Forau/yanngo/api"
 	"github.com/Forau/yanngo/remote"
+	"github.com/Forau/yanngo/trace"
 
 	"bytes"
 	//	"log"
@@ -15,7 +16,7 @@ func NewRemoteTransportClient(rrchan remote.RequestReplyChannel) (transp api.Tra
 		if err != nil {
 			res.Fail(-42, err.Error())
 		} else {
-			resData, err := rrchan(data)
+			resData, err := rrchan(data, req.TraceContext())
 			if err != nil {
 				res.Fail(-43, err.Error())
 			}
@@ -36,7 +37,7 @@ func NewRemoteTransportClient(rrchan remote.RequestReplyChannel) (transp api.Tra
 }
 
 func BindRemoteTransportServer(topic string, pubsub remote.PubSub, transp api.TransportHandler) error {
-	srh := remote.MakeSubReplyHandler(pubsub, remote.SubReplyHandlerHelperFn(func(topic string, msg []byte) (rb []byte, err error) {
+	srh := remote.MakeSubReplyHandler(pubsub, remote.SubReplyHandlerHelperFn(func(topic string, msg []byte, sc trace.SpanContext) (rb []byte, err error) {
 		var req api.Request
 		dec := json.NewDecoder(bytes.NewReader(msg))
 		dec.UseNumber()
@@ -44,6 +45,7 @@ func BindRemoteTransportServer(topic string, pubsub remote.PubSub, transp api.Tr
 
 		//		err = json.Unmarshal(msg, &req)
 		if err == nil {
+			req.TraceId, req.SpanId = sc.TraceId, sc.SpanId
 			res := transp.Preform(&req)
 			rb, err = json.Marshal(&res)
 		}
@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/Forau/yanngo/api"
-	"log"
+	"github.com/Forau/yanngo/metrics"
+	"github.com/Forau/yanngo/nnlog"
+	"github.com/Forau/yanngo/trace"
 	"sync"
 	"time"
 )
 
+var logger = nnlog.For("transports")
+
 //type TransportCacheHandler func(RequestCommandInfo, TransportHandler, *Request) (Response)
 
 type cachedEntry struct {
@@ -19,15 +23,18 @@ type cachedEntry struct {
 type SimpleMemoryCacheHandler struct {
 	sync.RWMutex
 	memMap map[string]cachedEntry
+	stats  *metrics.CacheStats
 }
 
 func NewSimpleMemoryCacheHandler() *SimpleMemoryCacheHandler {
-	return &SimpleMemoryCacheHandler{memMap: make(map[string]cachedEntry)}
+	return &SimpleMemoryCacheHandler{memMap: make(map[string]cachedEntry), stats: metrics.Default.CacheStats("memory")}
 }
 
 // Implements TransportCacheHandler func(RequestCommandInfo, TransportHandler, *Request) (Response)
 func (smch *SimpleMemoryCacheHandler) Handle(info api.RequestCommandInfo, th api.TransportHandler, req *api.Request) (res api.Response) {
 	if info.TimeToLive > 0 {
+		span, done := req.Span("cache "+string(info.Command), trace.KindInternal)
+		defer done()
 		params := req.Args.SubParams(info.GetArgumentNames()...)
 		params["cmd"] = string(info.Command)
 		if b, err := json.Marshal(params); err != nil {
@@ -38,15 +45,21 @@ func (smch *SimpleMemoryCacheHandler) Handle(info api.RequestCommandInfo, th api
 			smch.RUnlock() // Unlock now.  Dont care if we get a newer result in paralell
 			if ok {
 				eol := entry.timestamp.Add(time.Duration(info.TimeToLive) * time.Millisecond)
-				log.Printf("Found entry with end of life at [%s] for '%s'", eol.String(), string(b))
+				logger.Debug("Found cached entry", "eol", eol, "key", string(b))
 				if eol.After(time.Now()) {
+					span.SetAttr("result", "hit")
+					smch.stats.Hit()
 					res.Payload = entry.data
 					return // Return cached entry
 				} else {
-					log.Printf("Entry too old, will refresh cache")
+					span.SetAttr("result", "stale")
+					logger.Debug("Cached entry too old, will refresh cache", "key", string(b))
 				}
+			} else {
+				span.SetAttr("result", "miss")
 			}
 
+			smch.stats.Miss()
 			res = th.Preform(req)
 			if !res.IsError() {
 				smch.Lock()